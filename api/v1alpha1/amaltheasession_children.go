@@ -10,6 +10,7 @@ import (
 	"maps"
 	"net/url"
 	"os"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -49,6 +50,15 @@ const AuthProxyMetaPort int32 = 65534
 const secondProxyPort int32 = 65533
 const RemoteSessionControllerPort int32 = 65532
 const TunnelPort int32 = 65531
+const idTokenHeader string = "X-Amalthea-Id-Token"
+
+// The headers where oauth2-proxy passes the identity of the logged in user to the authproxy
+const forwardedUserHeader string = "X-Forwarded-User"
+const forwardedEmailHeader string = "X-Forwarded-Email"
+
+// The key of the internal secret with the random secret used by the builtin OIDC login to encrypt
+// the session cookies. It is not regenerated when the secret is updated, so users stay logged in.
+const OidcCookieSecretKey string = "OIDC_COOKIE_SECRET"
 
 var sidecarsImage string = getSidecarsImage()
 var rcloneStorageClass string = getStorageClass()
@@ -98,6 +108,10 @@ func (cr *AmaltheaSession) SessionVolumes() ([]v1.Volume, []v1.VolumeMount) {
 		)
 	}
 
+	caVolumes, caVolumeMounts := cr.gitProxyCAVolumes()
+	volumes = append(volumes, caVolumes...)
+	volumeMounts = append(volumeMounts, caVolumeMounts...)
+
 	return volumes, volumeMounts
 }
 
@@ -105,6 +119,7 @@ func (cr *AmaltheaSession) Pod(cfg config.AmaltheaSessionConfiguration) (*v1.Pod
 	_, dsVols, dsVolMounts := cr.DataSources()
 	cloneInit := cr.cloneInit()
 	sessionVols, sessionMounts := cr.SessionVolumes()
+	sshAgent, sshAgentMounts := cr.sshAgent()
 
 	var auth = manifests{}
 	// auth containers are only for interactive sessions
@@ -122,11 +137,13 @@ func (cr *AmaltheaSession) Pod(cfg config.AmaltheaSessionConfiguration) (*v1.Pod
 	volumes = append(volumes, cr.Spec.ExtraVolumes...)
 	volumes = append(volumes, dsVols...)
 	volumes = append(volumes, auth.Volumes...)
+	volumes = append(volumes, sshAgent.Volumes...)
 
 	volumeMounts := []v1.VolumeMount{} //nolint:prealloc
 	volumeMounts = append(volumeMounts, sessionMounts...)
 	volumeMounts = append(volumeMounts, cr.Spec.Session.ExtraVolumeMounts...)
 	volumeMounts = append(volumeMounts, dsVolMounts...)
+	volumeMounts = append(volumeMounts, sshAgentMounts...)
 
 	initContainers := []v1.Container{} //nolint:prealloc
 	initContainers = append(initContainers, cloneInit.Containers...)
@@ -134,10 +151,18 @@ func (cr *AmaltheaSession) Pod(cfg config.AmaltheaSessionConfiguration) (*v1.Pod
 
 	// Create the main session container
 	sessionContainer := cr.sessionContainer(volumeMounts, cfg)
+	if len(sshAgent.Containers) > 0 {
+		// NOTE: The environment of the session container is shared with the spec, it is clipped so that it is copied
+		sessionContainer.Env = append(slices.Clip(sessionContainer.Env), v1.EnvVar{Name: SSHAuthSockEnv, Value: sshAgentSocket})
+	}
+	if caEnv := cr.gitProxyCAEnv(); len(caEnv) > 0 {
+		sessionContainer.Env = append(slices.Clip(sessionContainer.Env), caEnv...)
+	}
 
 	containers := []v1.Container{}
 	containers = append(containers, sessionContainer)
 	containers = append(containers, auth.Containers...)
+	containers = append(containers, sshAgent.Containers...)
 	if cr.Spec.SessionLocation == Remote {
 		containers = append(containers, cr.tunnelContainer())
 	}
@@ -248,6 +273,14 @@ func (cr *AmaltheaSession) StatefulSet(cfg config.AmaltheaSessionConfiguration)
 	if uid != "" {
 		annotations["renku.io/session_uid"] = uid
 	}
+	podAnnotations := maps.Clone(annotations)
+	cloneConfigHash, err := cr.cloneConfigHash()
+	if err != nil {
+		return appsv1.StatefulSet{}, err
+	}
+	if cloneConfigHash != "" {
+		podAnnotations[gitCloneConfigHashAnnotation] = cloneConfigHash
+	}
 
 	sts := appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{
@@ -267,7 +300,7 @@ func (cr *AmaltheaSession) StatefulSet(cfg config.AmaltheaSessionConfiguration)
 			Template: v1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels:      stsLabels,
-					Annotations: annotations,
+					Annotations: podAnnotations,
 				},
 				Spec: *pod,
 			},
@@ -652,6 +685,23 @@ func (cr *AmaltheaSession) AdoptedSecrets() v1.SecretList {
 		}
 	}
 
+	if sshAgent := cr.Spec.SSHAgent; sshAgent != nil {
+		secretRefs := slices.Clone(sshAgent.KeySecretRefs)
+		if sshAgent.Certificate != nil && sshAgent.Certificate.TokenSecretRef != nil {
+			secretRefs = append(secretRefs, *sshAgent.Certificate.TokenSecretRef)
+		}
+		for _, secretRef := range secretRefs {
+			if secretRef.isAdopted() {
+				secrets.Items = append(secrets.Items, v1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      secretRef.Name,
+						Namespace: cr.Namespace,
+					},
+				})
+			}
+		}
+	}
+
 	for _, imagePull := range cr.Spec.ImagePullSecrets {
 		if imagePull.isAdopted() {
 			secrets.Items = append(secrets.Items, v1.Secret{
@@ -666,8 +716,120 @@ func (cr *AmaltheaSession) AdoptedSecrets() v1.SecretList {
 	return secrets
 }
 
-// Assuming that the csi-rclone driver from https://github.com/SwissDataScienceCenter/csi-rclone
-// is installed, this will generate PVCs for the data sources that have the rclone type.
+// DataSourceVolumeName returns the name of the volume of a data source, which is also the name of the PVC
+// created for the rclone data sources.
+func (as *AmaltheaSession) DataSourceVolumeName(ids int) string {
+	return fmt.Sprintf("%s%s-ds-%d", prefix, as.Name, ids)
+}
+
+// DataSourceClaimName returns the name of the claim mounted for a data source, it is empty
+// for the data sources which are mounted without a claim.
+func (as *AmaltheaSession) DataSourceClaimName(ids int) string {
+	ds := as.Spec.DataSources[ids]
+	switch {
+	case ds.Type == Rclone:
+		return as.DataSourceVolumeName(ids)
+	case ds.Type == PVCStorage && ds.PVC != nil:
+		return ds.PVC.ClaimName
+	default:
+		return ""
+	}
+}
+
+// DataSourceSkipped tells whether an optional data source is left out of the session because it
+// could not be mounted, the data source is mounted again once the session is resumed.
+func (as *AmaltheaSession) DataSourceSkipped(ids int) bool {
+	if as.Spec.Hibernated || ids >= len(as.Spec.DataSources) || ids >= len(as.Status.DataSources) {
+		return false
+	}
+	ds := as.Spec.DataSources[ids]
+	status := as.Status.DataSources[ids]
+	return ds.Optional && status.Type == ds.Type && status.MountPath == ds.MountPath && status.Phase == DataSourceFailed
+}
+
+// rclonePVC returns the PVC of an rclone data source, assuming that the csi-rclone driver from
+// https://github.com/SwissDataScienceCenter/csi-rclone is installed.
+func (as *AmaltheaSession) rclonePVC(name string, ds DataSource) v1.PersistentVolumeClaim {
+	storageClass := rcloneStorageClass
+	annotations := map[string]string{}
+	maps.Copy(annotations, as.Spec.Template.Metadata.Annotations)
+	annotations[rcloneStorageSecretNameAnnotation] = ds.SecretRef.Name
+	return v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   as.Namespace,
+			Annotations: annotations,
+			Labels:      as.childLabels(),
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{ds.AccessMode},
+			Resources: v1.VolumeResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: rcloneDefaultStorage,
+				},
+			},
+			StorageClassName: &storageClass,
+		},
+	}
+}
+
+// dataSourceVolumeSource returns the volume source of a data source, it is nil for the data sources
+// which are not complete, e.g. when they were not validated by the API server.
+func dataSourceVolumeSource(name string, ds DataSource, readOnly bool) *v1.VolumeSource {
+	switch ds.Type {
+	case Rclone:
+		if ds.SecretRef == nil {
+			return nil
+		}
+		return &v1.VolumeSource{
+			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: name, ReadOnly: readOnly},
+		}
+	case PVCStorage:
+		if ds.PVC == nil {
+			return nil
+		}
+		return &v1.VolumeSource{
+			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: ds.PVC.ClaimName, ReadOnly: readOnly},
+		}
+	case NFSStorage:
+		if ds.NFS == nil {
+			return nil
+		}
+		return &v1.VolumeSource{
+			NFS: &v1.NFSVolumeSource{Server: ds.NFS.Server, Path: ds.NFS.Path, ReadOnly: readOnly},
+		}
+	case CSIStorage:
+		if ds.CSI == nil {
+			return nil
+		}
+		csi := &v1.CSIVolumeSource{
+			Driver:           ds.CSI.Driver,
+			ReadOnly:         &readOnly,
+			VolumeAttributes: ds.CSI.VolumeAttributes,
+		}
+		if ds.CSI.FSType != "" {
+			csi.FSType = &ds.CSI.FSType
+		}
+		if ds.SecretRef != nil {
+			csi.NodePublishSecretRef = &v1.LocalObjectReference{Name: ds.SecretRef.Name}
+		}
+		return &v1.VolumeSource{CSI: csi}
+	case EmptyDirStorage:
+		emptyDir := &v1.EmptyDirVolumeSource{}
+		if ds.EmptyDir != nil {
+			emptyDir.SizeLimit = ds.EmptyDir.SizeLimit
+			emptyDir.Medium = ds.EmptyDir.Medium
+		}
+		return &v1.VolumeSource{EmptyDir: emptyDir}
+	default:
+		return nil
+	}
+}
+
+// DataSources returns the PVCs created for the rclone data sources and the volumes and mounts of all
+// the data sources. The data sources are mounted read-only with the ReadOnlyMany access mode, except
+// the emptyDir data sources which would be useless. The optional data sources which failed to mount
+// are left out, but their PVCs are kept.
 func (as *AmaltheaSession) DataSources() ([]v1.PersistentVolumeClaim, []v1.Volume, []v1.VolumeMount) {
 	// TODO: Configure this for remote sessions
 	if as.Spec.SessionLocation == Remote {
@@ -678,57 +840,28 @@ func (as *AmaltheaSession) DataSources() ([]v1.PersistentVolumeClaim, []v1.Volum
 	vols := []v1.Volume{}
 	volMounts := []v1.VolumeMount{}
 	for ids, ds := range as.Spec.DataSources {
-		pvcName := fmt.Sprintf("%s%s-ds-%d", prefix, as.Name, ids)
-		switch ds.Type {
-		case Rclone:
-			storageClass := rcloneStorageClass
-			readOnly := ds.AccessMode == v1.ReadOnlyMany
-			annotations := map[string]string{}
-			maps.Copy(annotations, as.Spec.Template.Metadata.Annotations)
-			annotations[rcloneStorageSecretNameAnnotation] = ds.SecretRef.Name
-			pvcs = append(
-				pvcs,
-				v1.PersistentVolumeClaim{
-					ObjectMeta: metav1.ObjectMeta{
-						Name:        pvcName,
-						Namespace:   as.Namespace,
-						Annotations: annotations,
-						Labels:      as.childLabels(),
-					},
-					Spec: v1.PersistentVolumeClaimSpec{
-						AccessModes: []v1.PersistentVolumeAccessMode{ds.AccessMode},
-						Resources: v1.VolumeResourceRequirements{
-							Requests: v1.ResourceList{
-								v1.ResourceStorage: rcloneDefaultStorage,
-							},
-						},
-						StorageClassName: &storageClass,
-					},
-				},
-			)
-			vols = append(
-				vols,
-				v1.Volume{
-					Name: pvcName,
-					VolumeSource: v1.VolumeSource{
-						PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
-							ClaimName: pvcName,
-							ReadOnly:  readOnly,
-						},
-					},
-				},
-			)
-			volMounts = append(
-				volMounts,
-				v1.VolumeMount{
-					Name:      pvcName,
-					ReadOnly:  readOnly,
-					MountPath: ds.MountPath,
-				},
-			)
-		default:
+		name := as.DataSourceVolumeName(ids)
+		readOnly := ds.AccessMode == v1.ReadOnlyMany && ds.Type != EmptyDirStorage
+		source := dataSourceVolumeSource(name, ds, readOnly)
+		if source == nil {
 			continue
 		}
+		if ds.Type == Rclone {
+			pvcs = append(pvcs, as.rclonePVC(name, ds))
+		}
+		if as.DataSourceSkipped(ids) {
+			continue
+		}
+		vols = append(vols, v1.Volume{Name: name, VolumeSource: *source})
+		volMount := v1.VolumeMount{
+			Name:      name,
+			ReadOnly:  readOnly,
+			MountPath: ds.MountPath,
+		}
+		if ds.Type == PVCStorage {
+			volMount.SubPath = ds.PVC.SubPath
+		}
+		volMounts = append(volMounts, volMount)
 	}
 	return pvcs, vols, volMounts
 }
@@ -765,7 +898,7 @@ func (as *AmaltheaSession) InternalSecretName() string {
 	return fmt.Sprintf("%s---internal", as.Name)
 }
 
-// The secret created by this method may contain secrets for two purposes:
+// The secret created by this method may contain secrets for three purposes:
 //  1. If the type of authentication is 'oidc' then the secret with OAuth
 //     configuration created by the creator of the AmaltheaSession CR will be in
 //     a format acceptable to oauth2proxy. With the 'oidc' method we do not have to expose
@@ -773,10 +906,28 @@ func (as *AmaltheaSession) InternalSecretName() string {
 //     We define our own API - specific only to OIDC and limited strictly to fields we need.
 //  2. If the session location is 'remote' then the secret is populated with a value used
 //     to authenticate remote tunnel connections
+//  3. If the session has a git proxy CA then the secret contains its certificate and private key,
+//     they are not part of the desired secret but added when the secret is reconciled, see GitProxyCAData
+//  4. If the session has code repositories then the secret contains the configuration read by the cloner
 //
-// The secret will contain either, both or none of these configurations depending
+// The secret will contain any combination of these configurations depending
 // on the configuration of the Amalthea session.
 func (as *AmaltheaSession) Secret() v1.Secret {
+	secret := as.secret()
+	if len(as.Spec.CodeRepositories) > 0 {
+		cloneConfig, err := as.cloneConfig()
+		if err != nil {
+			panic(err)
+		}
+		if secret.StringData == nil {
+			secret.StringData = map[string]string{}
+		}
+		secret.StringData[GitCloneConfigKey] = cloneConfig
+	}
+	return secret
+}
+
+func (as *AmaltheaSession) secret() v1.Secret {
 	secret := v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        as.InternalSecretName(),
@@ -807,8 +958,6 @@ func (as *AmaltheaSession) Secret() v1.Secret {
 	}
 
 	pathPrefix := as.ingressPathPrefix()
-	sessionURL := as.GetURL()
-	pathPrefixURL := url.URL{Host: sessionURL.Host, Path: pathPrefix, Scheme: sessionURL.Scheme}
 	cookieSecret := make([]byte, 32)
 	_, err := rand.Read(cookieSecret)
 	if err != nil {
@@ -816,15 +965,36 @@ func (as *AmaltheaSession) Secret() v1.Secret {
 		// See: https://pkg.go.dev/crypto/rand#Read
 		panic(err)
 	}
+	if as.Spec.Authentication.Proxy == OidcProxyBuiltin {
+		// NOTE: The builtin OIDC login is configured with environment variables, only the cookie secret is generated here
+		secret.StringData = map[string]string{
+			OidcCookieSecretKey: base64.URLEncoding.EncodeToString(cookieSecret),
+		}
+		if tunnelSecret != "" {
+			secret.StringData["WSTUNNEL_SECRET"] = tunnelSecret
+		}
+		return secret
+	}
+	authz := as.Spec.Authentication.Authorization
 	oldConfigLines := []string{
-		"session_cookie_minimal = true",
 		"skip_provider_button = true",
-		fmt.Sprintf("redirect_url = \"%s\"", pathPrefixURL.JoinPath("oauth2/callback").String()),
+		fmt.Sprintf("redirect_url = \"%s\"", as.oidcRedirectURL()),
 		fmt.Sprintf("cookie_path = \"%s\"", pathPrefix),
 		fmt.Sprintf("proxy_prefix = \"%soauth2\"", pathPrefix),
-		"authenticated_emails_file = \"/authorized_emails\"",
 		fmt.Sprintf("cookie_secret = \"%s\"", base64.URLEncoding.EncodeToString(cookieSecret)),
 	}
+	if authz.HasRules() {
+		// NOTE: The authorization rules replace the list of authorized emails, any user
+		// that can log in with the identity provider passes the email check.
+		oldConfigLines = append(oldConfigLines, "email_domains = [ \"*\" ]")
+	} else {
+		oldConfigLines = append(oldConfigLines, "authenticated_emails_file = \"/authorized_emails\"")
+	}
+	if authz == nil || len(authz.RequiredClaims) == 0 {
+		// NOTE: The required claims are checked against the ID token by the authproxy,
+		// a minimal session cookie does not contain the ID token.
+		oldConfigLines = append(oldConfigLines, "session_cookie_minimal = true")
+	}
 	upstreamPort := secondProxyPort
 	upstreamConfig := map[string]any{
 		"upstreams": []map[string]any{
@@ -838,27 +1008,61 @@ func (as *AmaltheaSession) Secret() v1.Secret {
 			},
 		},
 	}
+	oidcConfig := map[string]any{
+		"insecureSkipNonce":            false,
+		"issuerURL":                    "${OIDC_ISSUER_URL}",
+		"insecureAllowUnverifiedEmail": "${ALLOW_UNVERIFIED_EMAILS}",
+		"emailClaim":                   "email",
+		"audienceClaims":               []string{"aud"},
+	}
+	provider := map[string]any{
+		"clientID":     "${OIDC_CLIENT_ID}",
+		"clientSecret": "${OIDC_CLIENT_SECRET}",
+		"id":           "amalthea-oidc",
+		"provider":     "oidc",
+		"oidcConfig":   oidcConfig,
+	}
+	if authz != nil && len(authz.AllowedGroups) > 0 {
+		groupsClaim := authz.GroupsClaim
+		if groupsClaim == "" {
+			groupsClaim = "groups"
+		}
+		oidcConfig["groupsClaim"] = groupsClaim
+		provider["allowedGroups"] = authz.AllowedGroups
+	}
 	newConfig := map[string]any{
-		"providers": []map[string]any{
-			{
-				"clientID":     "${OIDC_CLIENT_ID}",
-				"clientSecret": "${OIDC_CLIENT_SECRET}",
-				"id":           "amalthea-oidc",
-				"provider":     "oidc",
-				"oidcConfig": map[string]any{
-					"insecureSkipNonce":            false,
-					"issuerURL":                    "${OIDC_ISSUER_URL}",
-					"insecureAllowUnverifiedEmail": "${ALLOW_UNVERIFIED_EMAILS}",
-					"emailClaim":                   "email",
-					"audienceClaims":               []string{"aud"},
-				},
-			},
-		},
+		"providers": []map[string]any{provider},
 		"server": map[string]string{
 			"bindAddress": fmt.Sprintf("0.0.0.0:%d", authenticatedPort),
 		},
 		"upstreamConfig": upstreamConfig,
 	}
+	// Pass the identity of the user to the authproxy so that it can be written to the audit log,
+	// oauth2-proxy removes any value of these headers sent by the client.
+	injectRequestHeaders := []map[string]any{
+		{
+			"name": forwardedUserHeader,
+			"values": []map[string]string{
+				{"claim": "user"},
+			},
+		},
+		{
+			"name": forwardedEmailHeader,
+			"values": []map[string]string{
+				{"claim": "email"},
+			},
+		},
+	}
+	if authz != nil && len(authz.RequiredClaims) > 0 {
+		// Pass the ID token to the authproxy which checks the required claims
+		injectRequestHeaders = append(injectRequestHeaders, map[string]any{
+			"name": idTokenHeader,
+			"values": []map[string]string{
+				{"claim": "id_token"},
+			},
+		})
+	}
+	newConfig["injectRequestHeaders"] = injectRequestHeaders
 	newConfigStr, err := yaml.Marshal(newConfig)
 	if err != nil {
 		panic(err)
@@ -874,6 +1078,13 @@ func (as *AmaltheaSession) Secret() v1.Secret {
 	return secret
 }
 
+// oidcRedirectURL is the URL where the identity provider sends the users back after they log in
+func (as *AmaltheaSession) oidcRedirectURL() string {
+	sessionURL := as.GetURL()
+	pathPrefixURL := url.URL{Host: sessionURL.Host, Path: as.ingressPathPrefix(), Scheme: sessionURL.Scheme}
+	return pathPrefixURL.JoinPath("oauth2/callback").String()
+}
+
 func makeTunnelSecret(length int) (string, error) {
 	b := make([]byte, length)
 	if _, err := io.ReadFull(rand.Reader, b); err != nil {
@@ -2,13 +2,21 @@ package v1alpha1
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/SwissDataScienceCenter/amalthea/internal/controller/config"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -148,3 +156,505 @@ func TestSessionContainerRemoteResources(t *testing.T) {
 		})
 	}
 }
+
+func TestSecretOidcAuthorization(t *testing.T) {
+	newSession := func(authz *OidcAuthorization) AmaltheaSession {
+		return AmaltheaSession{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+			Spec: AmaltheaSessionSpec{
+				Session: Session{URLPath: "/"},
+				Ingress: &Ingress{Host: "example.org", PathPrefix: "/"},
+				Authentication: &Authentication{
+					Enabled:       true,
+					Type:          Oidc,
+					SecretRef:     SessionSecretRef{Name: "oidc-secret"},
+					Authorization: authz,
+				},
+			},
+		}
+	}
+	parseAlphaConfig := func(t *testing.T, secret v1.Secret) map[string]any {
+		alphaConfig := map[string]any{}
+		err := yaml.Unmarshal([]byte(secret.StringData["oauth2-proxy-alpha-config.yaml"]), &alphaConfig)
+		assert.NoError(t, err)
+		return alphaConfig
+	}
+
+	t.Run("emails only", func(t *testing.T) {
+		session := newSession(nil)
+		secret := session.Secret()
+		config := secret.StringData["oauth2-proxy-config.yaml"]
+		assert.Contains(t, config, "authenticated_emails_file = \"/authorized_emails\"")
+		assert.Contains(t, config, "session_cookie_minimal = true")
+		assert.NotContains(t, config, "email_domains")
+		alphaConfig := parseAlphaConfig(t, secret)
+		provider := alphaConfig["providers"].([]any)[0].(map[string]any)
+		assert.NotContains(t, provider, "allowedGroups")
+		// Only the identity of the user is passed on, without the ID token
+		headers := alphaConfig["injectRequestHeaders"].([]any)
+		assert.Len(t, headers, 2)
+		assert.Equal(t, forwardedEmailHeader, headers[1].(map[string]any)["name"])
+	})
+
+	t.Run("allowed groups", func(t *testing.T) {
+		session := newSession(&OidcAuthorization{AllowedGroups: []string{"course-101", "staff"}})
+		secret := session.Secret()
+		config := secret.StringData["oauth2-proxy-config.yaml"]
+		assert.NotContains(t, config, "authenticated_emails_file")
+		assert.Contains(t, config, "email_domains = [ \"*\" ]")
+		assert.Contains(t, config, "session_cookie_minimal = true")
+		alphaConfig := parseAlphaConfig(t, secret)
+		provider := alphaConfig["providers"].([]any)[0].(map[string]any)
+		assert.Equal(t, []any{"course-101", "staff"}, provider["allowedGroups"])
+		assert.Equal(t, "groups", provider["oidcConfig"].(map[string]any)["groupsClaim"])
+	})
+
+	t.Run("required claims", func(t *testing.T) {
+		session := newSession(&OidcAuthorization{
+			RequiredClaims: []OidcClaimRequirement{{Claim: "realm_access.roles", Values: []string{"teacher"}}},
+		})
+		secret := session.Secret()
+		config := secret.StringData["oauth2-proxy-config.yaml"]
+		assert.Contains(t, config, "email_domains = [ \"*\" ]")
+		assert.NotContains(t, config, "session_cookie_minimal")
+		alphaConfig := parseAlphaConfig(t, secret)
+		headers := []any{}
+		for _, header := range alphaConfig["injectRequestHeaders"].([]any) {
+			headers = append(headers, header.(map[string]any)["name"])
+		}
+		assert.Equal(t, []any{forwardedUserHeader, forwardedEmailHeader, idTokenHeader}, headers)
+
+		manifests, err := session.auth()
+		assert.NoError(t, err)
+		authproxy := manifests.Containers[len(manifests.Containers)-1]
+		assert.Contains(t, authproxy.Env, v1.EnvVar{
+			Name:  "AUTHPROXY_REQUIRED_CLAIMS",
+			Value: `[{"claim":"realm_access.roles","values":["teacher"]}]`,
+		})
+		for _, vol := range manifests.Volumes {
+			assert.NotEqual(t, "oidc-secret", vol.Secret.SecretName)
+		}
+	})
+}
+
+func TestBuiltinOidcProxy(t *testing.T) {
+	session := AmaltheaSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: AmaltheaSessionSpec{
+			Session: Session{URLPath: "/", Port: 8888},
+			Ingress: &Ingress{Host: "example.org", PathPrefix: "/"},
+			Authentication: &Authentication{
+				Enabled:       true,
+				Type:          Oidc,
+				Proxy:         OidcProxyBuiltin,
+				SecretRef:     SessionSecretRef{Name: "oidc-secret"},
+				Authorization: &OidcAuthorization{GroupsClaim: "groups", AllowedGroups: []string{"staff", "course,101"}},
+			},
+		},
+	}
+	secret := session.Secret()
+	assert.NotContains(t, secret.StringData, "oauth2-proxy-config.yaml")
+	assert.NotEmpty(t, secret.StringData[OidcCookieSecretKey])
+
+	manifests, err := session.auth()
+	assert.NoError(t, err)
+	// Only the authproxy is used, without oauth2-proxy in front of it
+	assert.Len(t, manifests.Containers, 1)
+	assert.Empty(t, manifests.Volumes)
+	authproxy := manifests.Containers[0]
+	assert.Equal(t, "authproxy", authproxy.Name)
+	assert.Contains(t, authproxy.Env, v1.EnvVar{Name: "AUTHPROXY_PORT", Value: fmt.Sprintf("%d", authenticatedPort)})
+	assert.Contains(t, authproxy.Env, v1.EnvVar{Name: "AUTHPROXY_OIDC_REDIRECT_URL", Value: "http://example.org/oauth2/callback"})
+	assert.Contains(t, authproxy.Env, v1.EnvVar{Name: "AUTHPROXY_OIDC_ALLOWED_GROUPS", Value: `staff,"course,101"`})
+	envFromSecret := map[string]string{}
+	for _, env := range authproxy.Env {
+		if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+			envFromSecret[env.Name] = env.ValueFrom.SecretKeyRef.Name + "/" + env.ValueFrom.SecretKeyRef.Key
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"AUTHPROXY_OIDC_ISSUER_URL":              "oidc-secret/OIDC_ISSUER_URL",
+		"AUTHPROXY_OIDC_CLIENT_ID":               "oidc-secret/OIDC_CLIENT_ID",
+		"AUTHPROXY_OIDC_CLIENT_SECRET":           "oidc-secret/OIDC_CLIENT_SECRET",
+		"AUTHPROXY_OIDC_ALLOW_UNVERIFIED_EMAILS": "oidc-secret/ALLOW_UNVERIFIED_EMAILS",
+		"AUTHPROXY_OIDC_COOKIE_SECRET":           session.InternalSecretName() + "/" + OidcCookieSecretKey,
+	}, envFromSecret)
+}
+
+func TestAuditLog(t *testing.T) {
+	cases := []struct {
+		name            string
+		auth            Authentication
+		principalHeader bool
+	}{
+		{name: "token", auth: Authentication{Type: Token, SecretRef: SessionSecretRef{Name: "token-secret", Key: "config.yaml"}}},
+		{name: "oidc with oauth2-proxy", auth: Authentication{Type: Oidc, SecretRef: SessionSecretRef{Name: "oidc-secret"}}, principalHeader: true},
+		{name: "oauth2proxy", auth: Authentication{Type: OauthProxy, SecretRef: SessionSecretRef{Name: "oauth2-secret", Key: "config.cfg"}}},
+		{name: "builtin oidc", auth: Authentication{Type: Oidc, Proxy: OidcProxyBuiltin, SecretRef: SessionSecretRef{Name: "oidc-secret"}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.auth.Enabled = true
+			tc.auth.AuditLog = true
+			session := AmaltheaSession{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+				Spec: AmaltheaSessionSpec{
+					Session:        Session{URLPath: "/", Port: 8888},
+					Ingress:        &Ingress{Host: "example.org", PathPrefix: "/"},
+					Authentication: &tc.auth,
+				},
+			}
+			manifests, err := session.auth()
+			assert.NoError(t, err)
+			authproxy := manifests.Containers[len(manifests.Containers)-1]
+			assert.Equal(t, "authproxy", authproxy.Name)
+			assert.Contains(t, authproxy.Env, v1.EnvVar{Name: "AUTHPROXY_AUDIT_LOG", Value: "stdout"})
+			principalHeader := v1.EnvVar{Name: "AUTHPROXY_AUDIT_PRINCIPAL_HEADER", Value: forwardedEmailHeader}
+			if tc.principalHeader {
+				assert.Contains(t, authproxy.Env, principalHeader)
+			} else {
+				assert.NotContains(t, authproxy.Env, principalHeader)
+			}
+		})
+	}
+}
+
+func TestGitProxyCA(t *testing.T) {
+	session := AmaltheaSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: AmaltheaSessionSpec{
+			Session: Session{URLPath: "/", Port: 8888, Storage: Storage{MountPath: "/workspace"}},
+		},
+	}
+	caData, err := session.GitProxyCAData(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, caData)
+	volumes, _ := session.SessionVolumes()
+	assert.Len(t, volumes, 1)
+
+	session.Spec.GitProxyCA = &GitProxyCA{MountPath: "/etc/git-proxy"}
+	// The CA is not generated with the desired secret but when the secret is reconciled
+	assert.NotContains(t, session.Secret().StringData, GitProxyCACertKey)
+	caData, err = session.GitProxyCAData(nil)
+	assert.NoError(t, err)
+	block, _ := pem.Decode([]byte(caData[GitProxyCACertKey]))
+	assert.NotNil(t, block)
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	assert.NoError(t, err)
+	assert.True(t, certificate.IsCA)
+	_, err = tls.X509KeyPair([]byte(caData[GitProxyCACertKey]), []byte(caData[GitProxyCAKeyKey]))
+	assert.NoError(t, err)
+
+	// The CA of the existing secret is kept, it is only generated again when a key is missing
+	existing := map[string][]byte{GitProxyCACertKey: []byte("cert"), GitProxyCAKeyKey: []byte("key")}
+	caData, err = session.GitProxyCAData(existing)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{GitProxyCACertKey: "cert", GitProxyCAKeyKey: "key"}, caData)
+	caData, err = session.GitProxyCAData(map[string][]byte{GitProxyCACertKey: []byte("cert")})
+	assert.NoError(t, err)
+	assert.NotEqual(t, "cert", caData[GitProxyCACertKey])
+
+	// Only the certificate is mounted in the session container
+	volumes, volumeMounts := session.SessionVolumes()
+	assert.Contains(t, volumes, v1.Volume{
+		Name: gitProxyCAVolumeName,
+		VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{
+			SecretName: session.InternalSecretName(),
+			Items:      []v1.KeyToPath{{Key: GitProxyCACertKey, Path: "ca.crt"}},
+		}},
+	})
+	assert.Contains(t, volumeMounts, v1.VolumeMount{Name: gitProxyCAVolumeName, MountPath: "/etc/git-proxy", ReadOnly: true})
+
+	// Git trusts the CA in the session for the intercepted hosts only
+	assert.Empty(t, session.gitProxyCAEnv(), "no host is intercepted")
+	session.Spec.GitProxyCA.Hosts = []string{"gitlab.example.org"}
+	session.Spec.CodeRepositories = []CodeRepository{
+		{Remote: "https://github.com/org/repo.git"},
+		{Remote: "https://gitlab.example.org/group/repo.git"},
+		{Remote: "git@gitlab.com:group/repo.git"},
+		{Type: Archive, Remote: "https://example.org/data.tar.gz"},
+	}
+	pod, err := session.Pod(config.AmaltheaSessionConfiguration{})
+	assert.NoError(t, err)
+	env := pod.Containers[0].Env
+	assert.Contains(t, env, v1.EnvVar{Name: "GIT_CONFIG_COUNT", Value: "2"})
+	assert.Contains(t, env, v1.EnvVar{Name: "GIT_CONFIG_KEY_0", Value: "http.https://gitlab.example.org/.sslCAInfo"})
+	assert.Contains(t, env, v1.EnvVar{Name: "GIT_CONFIG_VALUE_0", Value: "/etc/git-proxy/ca.crt"})
+	assert.Contains(t, env, v1.EnvVar{Name: "GIT_CONFIG_KEY_1", Value: "http.https://github.com/.sslCAInfo"})
+	assert.Contains(t, env, v1.EnvVar{Name: "GIT_CONFIG_VALUE_1", Value: "/etc/git-proxy/ca.crt"})
+	for _, variable := range env {
+		assert.NotContains(t, []string{"GIT_SSL_CAINFO", "SSL_CERT_FILE"}, variable.Name)
+	}
+
+	// The git configuration of the session is not overridden
+	session.Spec.Session.Env = []v1.EnvVar{{Name: "GIT_CONFIG_COUNT", Value: "1"}}
+	assert.Empty(t, session.gitProxyCAEnv())
+}
+
+func TestCloneInitOptions(t *testing.T) {
+	session := AmaltheaSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: AmaltheaSessionSpec{
+			Session: Session{URLPath: "/", Port: 8888, Storage: Storage{MountPath: "/workspace"}},
+			CodeRepositories: []CodeRepository{
+				{Remote: "https://example.org/small.git", ClonePath: "small"},
+				{
+					Remote:         "https://example.org/monorepo.git",
+					ClonePath:      "monorepo",
+					Depth:          1,
+					SparseCheckout: []string{"services/api", "docs"},
+					Submodules:     NoSubmodules,
+					LFS: &CodeRepositoryLFS{
+						Fetch:   EagerLFSFetch,
+						Include: []string{"data/*.csv"},
+						MaxSize: ptr.To(resource.MustParse("1Gi")),
+					},
+					ResumeStrategy: UpdateOnResume,
+				},
+			},
+		},
+	}
+	cloneInit := session.cloneInit()
+	assert.Len(t, cloneInit.Containers, 1)
+	container := cloneInit.Containers[0]
+	assert.Equal(t, GitCloneContainerName, container.Name)
+	assert.Subset(t, container.Args, []string{"clone-all", "--parallelism", "4", "--results-dir", "/workspace/.git-clone-results"})
+
+	var config gitCloneConfig
+	err := json.Unmarshal([]byte(session.Secret().StringData[GitCloneConfigKey]), &config)
+	assert.Nil(t, err)
+	assert.Len(t, config.Repositories, 2)
+	assert.Equal(t, gitCloneRepository{Remote: "https://example.org/small.git", Path: "/workspace/small", Strategy: "notifexist"}, config.Repositories[0])
+	assert.Equal(t, gitCloneRepository{
+		Remote:         "https://example.org/monorepo.git",
+		Path:           "/workspace/monorepo",
+		Strategy:       "update",
+		Depth:          1,
+		SparseCheckout: []string{"services/api", "docs"},
+		Submodules:     "none",
+		LFS:            &gitCloneLFS{Fetch: "eager", Include: []string{"data/*.csv"}, MaxSize: 1 << 30},
+	}, config.Repositories[1])
+}
+
+func TestCloneInitSecrets(t *testing.T) {
+	session := AmaltheaSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: AmaltheaSessionSpec{
+			Session:          Session{URLPath: "/", Port: 8888, Storage: Storage{MountPath: "/workspace"}},
+			CloneParallelism: 2,
+			CodeRepositories: []CodeRepository{
+				{Remote: "https://example.org/first.git", CloningConfigSecretRef: &SessionSecretKeyRef{Name: "first", Key: "config"}},
+				{Remote: "https://example.org/public.git"},
+				{Remote: "https://example.org/second.git", CloningConfigSecretRef: &SessionSecretKeyRef{Name: "second", Key: "config"}},
+			},
+		},
+	}
+	cloneInit := session.cloneInit()
+	assert.Len(t, cloneInit.Containers, 1)
+	assert.Subset(t, cloneInit.Containers[0].Args, []string{"--parallelism", "2"})
+	// The secrets use the same key so they are mounted in different directories
+	assert.Contains(t, cloneInit.Containers[0].VolumeMounts, v1.VolumeMount{Name: "amalthea-git-clone-cred-volume-0", MountPath: "/git-clone-secrets/0"})
+	assert.Contains(t, cloneInit.Containers[0].VolumeMounts, v1.VolumeMount{Name: "amalthea-git-clone-cred-volume-2", MountPath: "/git-clone-secrets/2"})
+	assert.Len(t, cloneInit.Volumes, 3)
+
+	var config gitCloneConfig
+	err := json.Unmarshal([]byte(session.Secret().StringData[GitCloneConfigKey]), &config)
+	assert.Nil(t, err)
+	assert.Equal(t, "/git-clone-secrets/0/config", config.Repositories[0].ConfigPath)
+	assert.Empty(t, config.Repositories[1].ConfigPath)
+	assert.Equal(t, "/git-clone-secrets/2/config", config.Repositories[2].ConfigPath)
+
+	// No init container is needed without code repositories
+	session.Spec.CodeRepositories = nil
+	assert.Empty(t, session.cloneInit().Containers)
+	assert.NotContains(t, session.Secret().StringData, GitCloneConfigKey)
+}
+
+func TestCloneConfigHash(t *testing.T) {
+	session := AmaltheaSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: AmaltheaSessionSpec{
+			Session:          Session{URLPath: "/", Port: 8888, Storage: Storage{MountPath: "/workspace"}},
+			CodeRepositories: []CodeRepository{{Remote: "https://example.org/first.git", ClonePath: "first"}},
+		},
+	}
+	sts, err := session.StatefulSet(config.AmaltheaSessionConfiguration{})
+	assert.Nil(t, err)
+	hash := sts.Spec.Template.Annotations[gitCloneConfigHashAnnotation]
+	assert.Len(t, hash, 64)
+	assert.NotContains(t, sts.Annotations, gitCloneConfigHashAnnotation, "only the pod template is annotated")
+
+	// The pod template changes with the code repositories so that the session is restarted
+	session.Spec.CodeRepositories = append(session.Spec.CodeRepositories, CodeRepository{Remote: "https://example.org/second.git", ClonePath: "second"})
+	sts, err = session.StatefulSet(config.AmaltheaSessionConfiguration{})
+	assert.Nil(t, err)
+	assert.NotEqual(t, hash, sts.Spec.Template.Annotations[gitCloneConfigHashAnnotation])
+
+	session.Spec.CodeRepositories = nil
+	sts, err = session.StatefulSet(config.AmaltheaSessionConfiguration{})
+	assert.Nil(t, err)
+	assert.NotContains(t, sts.Spec.Template.Annotations, gitCloneConfigHashAnnotation)
+}
+
+func TestCloneInitSources(t *testing.T) {
+	checksum := "sha256:" + strings.Repeat("ab", 32)
+	session := AmaltheaSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: AmaltheaSessionSpec{
+			Session: Session{URLPath: "/", Port: 8888, Storage: Storage{MountPath: "/workspace"}},
+			CodeRepositories: []CodeRepository{
+				{Type: Archive, Remote: "https://example.org/course.tar.gz", ClonePath: "material", Checksum: checksum},
+				{
+					Type:                   OCI,
+					Remote:                 "ghcr.io/org/course:2026",
+					CloningConfigSecretRef: &SessionSecretKeyRef{Name: "registry", Key: "config"},
+				},
+			},
+		},
+	}
+	var config gitCloneConfig
+	err := json.Unmarshal([]byte(session.Secret().StringData[GitCloneConfigKey]), &config)
+	assert.Nil(t, err)
+	assert.Equal(t, gitCloneRepository{
+		Type:     "archive",
+		Remote:   "https://example.org/course.tar.gz",
+		Path:     "/workspace/material",
+		Strategy: "notifexist",
+		Checksum: checksum,
+	}, config.Repositories[0])
+	// The archives and artifacts use the same secrets as the git repositories
+	assert.Equal(t, "oci", config.Repositories[1].Type)
+	assert.Equal(t, "/git-clone-secrets/1/config", config.Repositories[1].ConfigPath)
+}
+
+func TestDataSources(t *testing.T) {
+	session := AmaltheaSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: AmaltheaSessionSpec{
+			Session: Session{URLPath: "/", Port: 8888, Storage: Storage{MountPath: "/workspace"}},
+			DataSources: []DataSource{
+				{Type: Rclone, MountPath: "/data/s3", AccessMode: v1.ReadOnlyMany, SecretRef: &SessionSecretRef{Name: "rclone"}},
+				{Type: PVCStorage, MountPath: "/data/shared", AccessMode: v1.ReadWriteMany, PVC: &PVCDataSource{ClaimName: "shared", SubPath: "team"}},
+				{Type: NFSStorage, MountPath: "/data/nfs", AccessMode: v1.ReadOnlyMany, NFS: &NFSDataSource{Server: "nfs.example.org", Path: "/exports"}},
+				{
+					Type:       CSIStorage,
+					MountPath:  "/data/csi",
+					AccessMode: v1.ReadOnlyMany,
+					SecretRef:  &SessionSecretRef{Name: "csi"},
+					CSI:        &CSIDataSource{Driver: "example.csi.k8s.io", VolumeAttributes: map[string]string{"bucket": "b"}},
+				},
+				{Type: EmptyDirStorage, MountPath: "/scratch", AccessMode: v1.ReadOnlyMany, EmptyDir: &EmptyDirDataSource{SizeLimit: ptr.To(resource.MustParse("1Gi"))}},
+				// An incomplete data source is skipped
+				{Type: PVCStorage, MountPath: "/data/missing"},
+			},
+		},
+	}
+	pvcs, volumes, mounts := session.DataSources()
+	// Only the rclone data sources need a PVC
+	assert.Len(t, pvcs, 1)
+	assert.Equal(t, "amalthea-test-ds-0", pvcs[0].Name)
+	assert.Len(t, volumes, 5)
+	assert.Len(t, mounts, 5)
+
+	assert.Equal(t, &v1.PersistentVolumeClaimVolumeSource{ClaimName: "amalthea-test-ds-0", ReadOnly: true}, volumes[0].PersistentVolumeClaim)
+	assert.Equal(t, &v1.PersistentVolumeClaimVolumeSource{ClaimName: "shared"}, volumes[1].PersistentVolumeClaim)
+	assert.Equal(t, v1.VolumeMount{Name: "amalthea-test-ds-1", MountPath: "/data/shared", SubPath: "team"}, mounts[1])
+	assert.Equal(t, &v1.NFSVolumeSource{Server: "nfs.example.org", Path: "/exports", ReadOnly: true}, volumes[2].NFS)
+	assert.True(t, mounts[2].ReadOnly)
+	assert.Equal(t, &v1.CSIVolumeSource{
+		Driver:               "example.csi.k8s.io",
+		ReadOnly:             ptr.To(true),
+		VolumeAttributes:     map[string]string{"bucket": "b"},
+		NodePublishSecretRef: &v1.LocalObjectReference{Name: "csi"},
+	}, volumes[3].CSI)
+	// The emptyDir data sources are always writable
+	assert.Equal(t, &v1.EmptyDirVolumeSource{SizeLimit: ptr.To(resource.MustParse("1Gi"))}, volumes[4].EmptyDir)
+	assert.Equal(t, v1.VolumeMount{Name: "amalthea-test-ds-4", MountPath: "/scratch"}, mounts[4])
+
+	// An optional data source which failed to mount is left out, its PVC is kept
+	session.Spec.DataSources[0].Optional = true
+	session.Status.DataSources = []DataSourceStatus{{Type: Rclone, MountPath: "/data/s3", Phase: DataSourceFailed}}
+	pvcs, volumes, mounts = session.DataSources()
+	assert.Len(t, pvcs, 1)
+	assert.Len(t, volumes, 4)
+	assert.Len(t, mounts, 4)
+	assert.Equal(t, "amalthea-test-ds-1", volumes[0].Name)
+	session.Spec.Hibernated = true
+	_, volumes, _ = session.DataSources()
+	assert.Len(t, volumes, 5)
+}
+
+func TestSSHAgent(t *testing.T) {
+	session := AmaltheaSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: AmaltheaSessionSpec{
+			Session: Session{
+				URLPath: "/",
+				Port:    8888,
+				Storage: Storage{MountPath: "/workspace"},
+				Env:     []v1.EnvVar{{Name: "FOO", Value: "bar"}},
+			},
+		},
+	}
+	pod, err := session.Pod(config.AmaltheaSessionConfiguration{})
+	assert.NoError(t, err)
+	assert.Len(t, pod.Containers, 1)
+	assert.NotContains(t, pod.Containers[0].Env, v1.EnvVar{Name: SSHAuthSockEnv, Value: "/ssh-agent/agent.sock"})
+
+	session.Spec.SSHAgent = &SSHAgent{
+		KeySecretRefs: []SessionSecretKeyRef{
+			{Name: "github-key", Key: "id_ed25519"},
+			{Name: "gitlab-key", Key: "id_ed25519", Adopt: true},
+		},
+		Certificate: &SSHAgentCertificate{
+			URL:            "https://signer.example.org/sign",
+			TokenSecretRef: &SessionSecretKeyRef{Name: "signer-token", Key: "token"},
+			Principals:     []string{"alice", "git"},
+		},
+	}
+	pod, err = session.Pod(config.AmaltheaSessionConfiguration{})
+	assert.NoError(t, err)
+	assert.Len(t, pod.Containers, 2)
+	sessionContainer, agentContainer := pod.Containers[0], pod.Containers[1]
+	assert.Equal(t, SSHAgentContainerName, agentContainer.Name)
+	assert.Equal(t, []string{"ssh-agent", "serve"}, agentContainer.Args)
+	assert.ElementsMatch(t, []v1.EnvVar{
+		{Name: "SSH_AGENT_SOCKET", Value: "/ssh-agent/agent.sock"},
+		{Name: "SSH_AGENT_KEY_FILES", Value: "/ssh-agent-keys/0/id_ed25519,/ssh-agent-keys/1/id_ed25519"},
+		{Name: "SSH_AGENT_CERTIFICATE_URL", Value: "https://signer.example.org/sign"},
+		{Name: "SSH_AGENT_CERTIFICATE_PRINCIPALS", Value: "alice,git"},
+		{Name: "SSH_AGENT_CERTIFICATE_TOKEN_FILE", Value: "/ssh-agent-token/token"},
+	}, agentContainer.Env)
+
+	// The session only gets the socket, the secrets are mounted in the agent container
+	assert.Equal(t, []v1.EnvVar{{Name: "FOO", Value: "bar"}, {Name: SSHAuthSockEnv, Value: "/ssh-agent/agent.sock"}}, sessionContainer.Env)
+	assert.Len(t, session.Spec.Session.Env, 1)
+	socketMount := v1.VolumeMount{Name: sshAgentSocketVolumeName, MountPath: "/ssh-agent"}
+	assert.Contains(t, sessionContainer.VolumeMounts, socketMount)
+	assert.Contains(t, agentContainer.VolumeMounts, socketMount)
+	for _, mount := range sessionContainer.VolumeMounts {
+		assert.NotContains(t, mount.Name, "ssh-agent-key")
+		assert.NotContains(t, mount.Name, "ssh-agent-token")
+	}
+	assert.Contains(t, pod.Volumes, v1.Volume{
+		Name: prefix + "ssh-agent-key-1",
+		VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{
+			SecretName:  "gitlab-key",
+			Items:       []v1.KeyToPath{{Key: "id_ed25519", Path: "id_ed25519"}},
+			DefaultMode: ptr.To(int32(0o440)),
+		}},
+	})
+	assert.Contains(t, agentContainer.VolumeMounts, v1.VolumeMount{Name: prefix + "ssh-agent-key-1", MountPath: "/ssh-agent-keys/1", ReadOnly: true})
+
+	adopted := session.AdoptedSecrets()
+	assert.Len(t, adopted.Items, 1)
+	assert.Equal(t, "gitlab-key", adopted.Items[0].Name)
+
+	// The agent socket cannot be shared with a remote session
+	session.Spec.SessionLocation = Remote
+	pod, err = session.Pod(config.AmaltheaSessionConfiguration{})
+	assert.NoError(t, err)
+	for _, container := range pod.Containers {
+		assert.NotEqual(t, SSHAgentContainerName, container.Name)
+	}
+}
@@ -47,6 +47,24 @@ type AmaltheaSessionSpec struct {
 	// A list of code repositories and associated configuration that will be cloned in the session
 	CodeRepositories []CodeRepository `json:"codeRepositories,omitempty"`
 
+	// +optional
+	// +kubebuilder:default:=4
+	// +kubebuilder:validation:Minimum:=1
+	// The number of code repositories that are cloned at the same time by the init container
+	CloneParallelism int32 `json:"cloneParallelism,omitempty"`
+
+	// +optional
+	// Generate a certificate authority for the git proxy of the session. The git proxy signs the certificates
+	// of the git hosts it intercepts with it and the session container trusts it, so that TLS verification
+	// does not have to be disabled in the repositories that use the proxy.
+	GitProxyCA *GitProxyCA `json:"gitProxyCA,omitempty"`
+
+	// +optional
+	// Run an SSH agent next to the session container, the session can authenticate with git remotes over SSH
+	// through SSH_AUTH_SOCK but the private keys are never mounted in the session container or written to
+	// the session volume. The agent is only added to local sessions.
+	SSHAgent *SSHAgent `json:"sshAgent,omitempty"`
+
 	// +optional
 	// A list of data sources that should be added to the session
 	DataSources []DataSource `json:"dataSources,omitempty"`
@@ -205,6 +223,47 @@ type Session struct {
 	RemoteSecretRef *SessionSecretRef `json:"remoteSecretRef,omitempty"`
 }
 
+type GitProxyCA struct {
+	// +optional
+	// +kubebuilder:default:="/etc/amalthea/git-proxy"
+	// The directory where the certificate of the CA is mounted in the session container as "ca.crt".
+	// The certificate and the private key are also in the internal secret of the session, under the
+	// GIT_PROXY_CA_CERT and GIT_PROXY_CA_KEY keys, so that they can be passed to the git proxy.
+	// The git proxy and the cloner are not added by Amalthea, the environment variables and the volume
+	// they need are listed in the git proxy CA section of the README.
+	MountPath string `json:"mountPath,omitempty"`
+	// +optional
+	// +kubebuilder:example:={"gitlab.com"}
+	// The hosts intercepted by the git proxy, e.g. gitlab.com. Git in the session container trusts the CA
+	// for these hosts and for the hosts of the git code repositories with an https remote, with
+	// http.https://<host>/.sslCAInfo set through the GIT_CONFIG_COUNT environment variables.
+	// The other hosts are still verified with the system CAs.
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// +kubebuilder:validation:XValidation:rule="(has(self.keySecretRefs) && size(self.keySecretRefs) > 0) || has(self.certificate)",message="the SSH agent needs keySecretRefs or a certificate"
+type SSHAgent struct {
+	// +optional
+	// Secrets with unencrypted private keys in the OpenSSH or PEM format that are loaded in the agent.
+	// The secrets are only mounted in the agent container.
+	KeySecretRefs []SessionSecretKeyRef `json:"keySecretRefs,omitempty"`
+	// +optional
+	// Get short-lived SSH certificates for a key generated in memory by the agent
+	Certificate *SSHAgentCertificate `json:"certificate,omitempty"`
+}
+
+type SSHAgentCertificate struct {
+	// The URL of the endpoint that signs the public key of the agent
+	URL string `json:"url"`
+	// +optional
+	// A secret with the bearer token sent to the signing endpoint, it is mounted in the agent container only
+	// and it is read again for every request so that it can be rotated.
+	TokenSecretRef *SessionSecretKeyRef `json:"tokenSecretRef,omitempty"`
+	// +optional
+	// The principals requested for the certificates
+	Principals []string `json:"principals,omitempty"`
+}
+
 type Ingress struct {
 	Annotations map[string]string `json:"annotations,omitempty"`
 	// +optional
@@ -257,26 +316,39 @@ type Storage struct {
 	MountPath string `json:"mountPath,omitempty"`
 }
 
-// +kubebuilder:validation:Enum={git}
+// +kubebuilder:validation:Enum={git,archive,oci}
 type CodeRepositoryType string
 
-const Git CodeRepositoryType = "git"
+const (
+	Git CodeRepositoryType = "git"
+	// A tar or zip archive downloaded over https and extracted
+	Archive CodeRepositoryType = "archive"
+	// An OCI artifact pulled from a registry whose layers are unpacked
+	OCI CodeRepositoryType = "oci"
+)
 
+// +kubebuilder:validation:XValidation:rule="!has(self.checksum) || self.type == 'archive'",message="the checksum only applies to archives"
+// +kubebuilder:validation:XValidation:rule="!has(self.resumeStrategy) || self.resumeStrategy == 'keep' || !has(self.type) || self.type == 'git'",message="the update resume strategy only applies to git repositories"
 type CodeRepository struct {
 	// +kubebuilder:default:=git
-	// The type of the code repository - currently the only supported kind is git.
+	// The type of the code repository: a git repository, an archive (tar, tar.gz, tar.bz2 or zip) or an OCI artifact.
+	// The git options (revision, depth, sparse checkout, submodules and LFS) only apply to git repositories.
+	// When all the files of an archive or an artifact are in a single directory, the content of the directory is
+	// extracted in the clone path.
 	Type CodeRepositoryType `json:"type,omitempty"`
 	// +kubebuilder:example:=repositories/project1
 	// +kubebuilder:default:="."
 	// Path relative to the session working directory where the repository should be cloned into.
 	ClonePath string `json:"clonePath,omitempty"`
 	// +kubebuilder:example:="https://github.com/SwissDataScienceCenter/renku"
-	// The HTTP url to the code repository
+	// The HTTP url to the code repository, the https url of the archive or the reference of the OCI
+	// artifact, e.g. ghcr.io/org/course-material:2026
 	Remote string `json:"remote"`
 	// +kubebuilder:example:=main
 	// The tag, branch or commit SHA to checkout, if omitted then will be the tip of the default branch of the repo
 	Revision string `json:"revision,omitempty"`
 	// The Kubernetes secret that contains the code repository configuration to be used during cloning.
+	// For 'archive' and 'oci' only the username and password are supported.
 	// For 'git' this should contain either:
 	// The username and password
 	// The private key and its corresponding password
@@ -287,13 +359,101 @@ type CodeRepository struct {
 	// For 'git' this is the git configuration which can be used to inject credentials in addition to any other repo-specific Git configuration.
 	// NOTE: you have to specify the whole config in a single key in the secret.
 	ConfigSecretRef *SessionSecretKeyRef `json:"configSecretRef,omitempty"`
+	// +kubebuilder:validation:Minimum:=0
+	// The number of commits to fetch from the tip of the revision, the whole history is fetched when omitted.
+	Depth int32 `json:"depth,omitempty"`
+	// +kubebuilder:example:={"src","docs"}
+	// The directories to check out, relative to the root of the repository. The whole repository is
+	// checked out when omitted.
+	SparseCheckout []string `json:"sparseCheckout,omitempty"`
+	// +kubebuilder:default:=recursive
+	// Whether the submodules are cloned: none skips them, shallow clones them with a depth of 1
+	// and recursive clones them with their whole history.
+	Submodules SubmodulePolicy `json:"submodules,omitempty"`
+	// How the Git LFS objects of the repository are fetched. When omitted the cloner decides, the
+	// go-git cloner leaves the LFS pointers and the shell cloner follows its LFS auto fetch setting.
+	// +optional
+	LFS *CodeRepositoryLFS `json:"lfs,omitempty"`
+	// +kubebuilder:default:=keep
+	// What to do with the repository when it already exists, e.g. when the session is resumed: keep leaves
+	// it as it is and update fetches the remote and fast-forwards the checked out branch when the worktree
+	// is clean. A repository which cannot be fast-forwarded is left as it is and its divergence is reported
+	// in the status.
+	ResumeStrategy ResumeStrategy `json:"resumeStrategy,omitempty"`
+	// +kubebuilder:validation:Pattern:=`^sha256:[a-f0-9]{64}$`
+	// The sha256 digest of the archive, e.g. sha256:<hex>. The archive is not extracted when its digest differs.
+	// +optional
+	Checksum string `json:"checksum,omitempty"`
 }
 
-// +kubebuilder:validation:Enum={rclone}
+// +kubebuilder:validation:Enum={keep,update}
+type ResumeStrategy string
+
+const (
+	KeepOnResume   ResumeStrategy = "keep"
+	UpdateOnResume ResumeStrategy = "update"
+)
+
+// +kubebuilder:validation:Enum={eager,lazy,none}
+type LFSFetchPolicy string
+
+const (
+	// The LFS objects are fetched when the repository is cloned
+	EagerLFSFetch LFSFetchPolicy = "eager"
+	// The LFS objects are not fetched when the repository is cloned, git-lfs fetches them in the session
+	// when the files are checked out or pulled
+	LazyLFSFetch LFSFetchPolicy = "lazy"
+	// The LFS objects are never fetched automatically, the files are left as LFS pointers
+	NoLFSFetch LFSFetchPolicy = "none"
+)
+
+type CodeRepositoryLFS struct {
+	// +kubebuilder:default:=eager
+	// When the LFS objects are fetched
+	Fetch LFSFetchPolicy `json:"fetch,omitempty"`
+	// +kubebuilder:example:={"data/*.csv","models"}
+	// The paths of the LFS objects to fetch, with the syntax of lfs.fetchinclude. All the objects are fetched when omitted.
+	// +optional
+	Include []string `json:"include,omitempty"`
+	// The paths of the LFS objects not to fetch, with the syntax of lfs.fetchexclude.
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+	// The maximum total size of the LFS objects fetched when the repository is cloned. When the objects
+	// are larger none of them is fetched, the repository is cloned with the LFS pointers and its LFS
+	// status is TooLarge.
+	// +optional
+	MaxSize *resource.Quantity `json:"maxSize,omitempty"`
+}
+
+// +kubebuilder:validation:Enum={none,shallow,recursive}
+type SubmodulePolicy string
+
+const (
+	NoSubmodules        SubmodulePolicy = "none"
+	ShallowSubmodules   SubmodulePolicy = "shallow"
+	RecursiveSubmodules SubmodulePolicy = "recursive"
+)
+
+// +kubebuilder:validation:Enum={rclone,pvc,nfs,csi,emptyDir}
 type StorageType string
 
-const Rclone StorageType = "rclone"
+const (
+	Rclone StorageType = "rclone"
+	// An existing persistent volume claim
+	PVCStorage StorageType = "pvc"
+	// A directory exported by an NFS server
+	NFSStorage StorageType = "nfs"
+	// An inline ephemeral volume of a CSI driver
+	CSIStorage StorageType = "csi"
+	// An empty directory which lives as long as the session pod
+	EmptyDirStorage StorageType = "emptyDir"
+)
 
+// +kubebuilder:validation:XValidation:rule="self.type != 'rclone' || has(self.secretRef)",message="the rclone data sources require a secretRef"
+// +kubebuilder:validation:XValidation:rule="has(self.pvc) == (self.type == 'pvc')",message="the pvc field is required for and only applies to the pvc data sources"
+// +kubebuilder:validation:XValidation:rule="has(self.nfs) == (self.type == 'nfs')",message="the nfs field is required for and only applies to the nfs data sources"
+// +kubebuilder:validation:XValidation:rule="has(self.csi) == (self.type == 'csi')",message="the csi field is required for and only applies to the csi data sources"
+// +kubebuilder:validation:XValidation:rule="!has(self.emptyDir) || self.type == 'emptyDir'",message="the emptyDir field only applies to the emptyDir data sources"
 type DataSource struct {
 	// +kubebuilder:default:=rclone
 	// The data source type
@@ -303,13 +463,77 @@ type DataSource struct {
 	// Path relative to the session working directory where the data should be mounted
 	MountPath string `json:"mountPath,omitempty"`
 	// +kubebuilder:default:=ReadOnlyMany
-	// The access mode for the data source
+	// The access mode for the data source, the data source is mounted read-only with ReadOnlyMany.
+	// The emptyDir data sources are always writable.
 	AccessMode v1.PersistentVolumeAccessMode `json:"accessMode,omitempty"`
 	// The secret containing the configuration or credentials needed for access to the data.
 	// The format of the configuration that is expected depends on the storage type.
 	// NOTE: define all values in a single key of the Kubernetes secret.
 	// rclone: any valid rclone configuration for a single remote, see the output of `rclone config providers` for validation and format.
+	// csi: the secret passed to the driver when the volume is published, the key is not used.
 	SecretRef *SessionSecretRef `json:"secretRef,omitempty"`
+	// The existing claim of a pvc data source. The S3 buckets mounted with the Mountpoint for Amazon S3
+	// CSI driver are statically provisioned and used through a claim.
+	// +optional
+	PVC *PVCDataSource `json:"pvc,omitempty"`
+	// The export of an nfs data source
+	// +optional
+	NFS *NFSDataSource `json:"nfs,omitempty"`
+	// The driver and attributes of a csi data source
+	// +optional
+	CSI *CSIDataSource `json:"csi,omitempty"`
+	// The options of an emptyDir data source
+	// +optional
+	EmptyDir *EmptyDirDataSource `json:"emptyDir,omitempty"`
+	// When an optional data source cannot be mounted, the session is restarted without it and runs
+	// in the RunningDegraded state, otherwise the session waits for the data source to be mounted.
+	// The data source is mounted again when the session is resumed. The data source is left out and
+	// mounted again whatever the reconcile strategy of the session.
+	// +optional
+	Optional bool `json:"optional,omitempty"`
+}
+
+type PVCDataSource struct {
+	// +kubebuilder:validation:MinLength:=1
+	// The name of the claim, in the namespace of the session
+	ClaimName string `json:"claimName"`
+	// +kubebuilder:validation:XValidation:rule="!self.startsWith('/') && !self.split('/').exists(p, p == '..')",message="the subPath must be a relative path inside of the volume"
+	// The directory of the volume to mount, the whole volume is mounted when omitted
+	// +optional
+	SubPath string `json:"subPath,omitempty"`
+}
+
+type NFSDataSource struct {
+	// +kubebuilder:validation:MinLength:=1
+	// +kubebuilder:example:=nfs.example.org
+	// The hostname or IP address of the NFS server
+	Server string `json:"server"`
+	// +kubebuilder:validation:Pattern:=`^/`
+	// +kubebuilder:example:=/exports/data
+	// The path exported by the NFS server
+	Path string `json:"path"`
+}
+
+type CSIDataSource struct {
+	// +kubebuilder:validation:MinLength:=1
+	// The name of the CSI driver, it has to support inline ephemeral volumes
+	Driver string `json:"driver"`
+	// The attributes of the volume passed to the driver, they are specific to the driver
+	// +optional
+	VolumeAttributes map[string]string `json:"volumeAttributes,omitempty"`
+	// The filesystem type of the volume, the driver decides when omitted
+	// +optional
+	FSType string `json:"fsType,omitempty"`
+}
+
+type EmptyDirDataSource struct {
+	// The maximum size of the directory, the pod is evicted when it is exceeded
+	// +optional
+	SizeLimit *resource.Quantity `json:"sizeLimit,omitempty"`
+	// +kubebuilder:validation:Enum={"",Memory}
+	// The storage medium of the directory, Memory uses a tmpfs counted in the memory of the session
+	// +optional
+	Medium v1.StorageMedium `json:"medium,omitempty"`
 }
 
 type Culling struct {
@@ -376,6 +600,12 @@ const Token AuthenticationType = "token"
 const OauthProxy AuthenticationType = "oauth2proxy"
 const Oidc AuthenticationType = "oidc"
 
+// +kubebuilder:validation:Enum={oauth2-proxy,builtin}
+type OidcProxy string
+
+const OidcProxyOauth2Proxy OidcProxy = "oauth2-proxy"
+const OidcProxyBuiltin OidcProxy = "builtin"
+
 type Authentication struct {
 	// +optional
 	// +kubebuilder:validation:Optional
@@ -384,8 +614,16 @@ type Authentication struct {
 	Type    AuthenticationType `json:"type"`
 	// Kubernetes secret that contains the authentication configuration.
 	// For `token` a single key in the secret should have a yaml file with the following format:
-	//   - token: the token value used to authenticate the user
+	//   - token: the token value used to authenticate the user, in plain text or as a bcrypt or argon2 hash (argon2 with at most m=4096,t=10,p=4)
+	//   - tokens: optional list of additional tokens for the user, each with a `value` in the same format as `token`
+	//     and an optional `expires_at` timestamp, this allows rotating tokens without downtime
 	//   - cookie_key: the name of the cookie where the token will be saved and searched for
+	//   - principals: optional list of additional users that can access the session, each with an `id`,
+	//     a `token` or a list of `tokens` and a `role` which is one of `owner`, `editor` or `viewer`
+	//   - changes to the tokens and the principals are picked up without restarting the session
+	//   - viewer_allowed_paths: optional list of path prefixes where viewers can also use unsafe HTTP methods and
+	//     websockets, everywhere else viewers can only use GET, HEAD and OPTIONS requests without websockets.
+	//     The prefixes match whole path segments, without the path prefix of the session, e.g. `/api/kernels`
 	//   - the `key` field in `secretRef` should point to the the `key` of the Kubernetes secret that has this format.
 	// For `oauth2proxy` a single key in the secret should have the configuration:
 	//   - see https://oauth2-proxy.github.io/oauth2-proxy/configuration/overview#config-file
@@ -395,13 +633,62 @@ type Authentication struct {
 	//   - OIDC_CLIENT_ID - the OIDC client ID
 	//   - OIDC_CLIENT_SECRET - the OIDC client secret
 	//   - OIDC_ISSUER_URL - the OIDC issuer url
-	//   - AUTHORIZED_EMAILS - newline delimited list of user emails that should have access the session
+	//   - AUTHORIZED_EMAILS - newline delimited list of user emails that should have access the session,
+	//     this is ignored if any rules are defined in the `authorization` field
 	//   - ALLOW_UNVERIFIED_EMAILS - allow users with unverified emails to authenticate, set to "true" or "false"
 	//   - the `key` field in `secretRef` should be left unset or it will be ignored
 	SecretRef SessionSecretRef `json:"secretRef"`
 	// +optional
 	// Additional volume mounts for the authentication container.
 	ExtraVolumeMounts []v1.VolumeMount `json:"extraVolumeMounts,omitempty"`
+	// +optional
+	// Authorization rules based on the claims of the user, only used with the `oidc` authentication type.
+	// When any rule is defined, access to the session is decided by the rules and the AUTHORIZED_EMAILS
+	// list from the secret is not used anymore.
+	Authorization *OidcAuthorization `json:"authorization,omitempty"`
+	// +optional
+	// +kubebuilder:default:=oauth2-proxy
+	// The proxy that logs in the users, only used with the `oidc` authentication type.
+	// With `builtin` the login is handled by the authproxy sidecar directly and the
+	// oauth2-proxy container is not added to the session.
+	Proxy OidcProxy `json:"proxy,omitempty"`
+	// +optional
+	// Write a JSON audit record for every request that reaches the session to the logs of the authproxy
+	// container. A record holds the authenticated user, the source IP, the method, the path, the status
+	// and the duration of the request. The user logged in with the `oauth2proxy` type is not recorded,
+	// the headers set by a configuration of oauth2-proxy which comes from the user cannot be trusted.
+	AuditLog bool `json:"auditLog,omitempty"`
+}
+
+type OidcAuthorization struct {
+	// +optional
+	// +kubebuilder:default:="groups"
+	// The claim of the ID token that contains the groups of the user. Nested claims are separated by dots,
+	// for example `realm_access.roles` will authorize users based on their Keycloak realm roles.
+	GroupsClaim string `json:"groupsClaim,omitempty"`
+	// +optional
+	// Users that are members of at least one of these groups are allowed to access the session.
+	AllowedGroups []string `json:"allowedGroups,omitempty"`
+	// +optional
+	// Claims that have to be present in the ID token of the user, all of them have to match
+	// for the user to be allowed to access the session. This can be used to require specific
+	// roles by referring to the claim where the identity provider lists the roles.
+	RequiredClaims []OidcClaimRequirement `json:"requiredClaims,omitempty"`
+}
+
+// A claim that has to match one of the listed values
+type OidcClaimRequirement struct {
+	// +kubebuilder:example:=realm_access.roles
+	// The name of the claim, nested claims are separated by dots.
+	Claim string `json:"claim"`
+	// +kubebuilder:validation:MinItems:=1
+	// The accepted values, if the claim is a list then it matches when any of its elements is accepted.
+	Values []string `json:"values"`
+}
+
+// HasRules returns true when at least one authorization rule is defined.
+func (a *OidcAuthorization) HasRules() bool {
+	return a != nil && (len(a.AllowedGroups) > 0 || len(a.RequiredClaims) > 0)
 }
 
 // A reference to a Kubernetes secret and a specific field in the secret to be used in a session
@@ -492,6 +779,141 @@ type AmaltheaSessionStatus struct {
 	// If the state is failed then the message will contain information about what went wrong, otherwise it is empty
 	// +optional
 	Error string `json:"error,omitempty"`
+
+	// The result of cloning the code repositories, as reported by the init containers which clone them
+	// +optional
+	CodeRepositories []CodeRepositoryStatus `json:"codeRepositories,omitempty"`
+
+	// The state of the data sources, in the order of the data sources of the spec
+	// +optional
+	DataSources []DataSourceStatus `json:"dataSources,omitempty"`
+}
+
+// +kubebuilder:validation:Enum={Pending,Bound,Mounted,Failed}
+type DataSourcePhase string
+
+const (
+	// The data source is not mounted yet
+	DataSourcePending DataSourcePhase = "Pending"
+	// The claim of the data source is bound to a volume, the data source is not mounted yet
+	DataSourceBound DataSourcePhase = "Bound"
+	// The data source is mounted in the session
+	DataSourceMounted DataSourcePhase = "Mounted"
+	// The data source cannot be mounted
+	DataSourceFailed DataSourcePhase = "Failed"
+)
+
+type DataSourceStatus struct {
+	Type StorageType `json:"type"`
+	// The path where the data source is mounted
+	MountPath string          `json:"mountPath"`
+	Phase     DataSourcePhase `json:"phase"`
+	// The claim of the data source, it is empty for the data sources mounted without a claim
+	// +optional
+	PVCName string `json:"pvcName,omitempty"`
+	// The last reason why the data source could not be mounted, it is kept until the session is hibernated
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+	// When the data source started failing to be mounted, the data source is only failed once the
+	// failures persisted for a grace period since the warnings and mount events are often transient
+	// +optional
+	FailingSince metav1.Time `json:"failingSince,omitempty"`
+}
+
+// +kubebuilder:validation:Enum={Cloned,Skipped,Updated,Failed}
+type CodeRepositoryState string
+
+const (
+	// The repository was cloned
+	CodeRepositoryCloned CodeRepositoryState = "Cloned"
+	// The repository was not cloned because it already exists, e.g. when the session is resumed
+	CodeRepositorySkipped CodeRepositoryState = "Skipped"
+	// The repository already exists and was updated to the commit of its remote, or was already at it
+	CodeRepositoryUpdated CodeRepositoryState = "Updated"
+	// The repository could not be cloned
+	CodeRepositoryFailed CodeRepositoryState = "Failed"
+)
+
+// The result of cloning a code repository as reported by the cloner init container
+type CodeRepositoryStatus struct {
+	// The remote of the repository
+	Remote string `json:"remote"`
+	// The path where the repository is cloned
+	ClonePath string              `json:"clonePath,omitempty"`
+	State     CodeRepositoryState `json:"state"`
+	// The commit SHA checked out in the repository, or the digest of the archive or of the manifest of the OCI artifact
+	// +optional
+	Commit string `json:"commit,omitempty"`
+	// The reason why the repository could not be cloned
+	// +optional
+	Error string `json:"error,omitempty"`
+	// How long it took to clone the repository
+	// +optional
+	Duration metav1.Duration `json:"duration,omitempty"`
+	// Whether the LFS objects of the repository were fetched, it is omitted when the cloner does not fetch them
+	// +optional
+	LFS *CodeRepositoryLFSStatus `json:"lfs,omitempty"`
+	// How the existing repository was updated, it is only set when the resume strategy is update
+	// +optional
+	Update *CodeRepositoryUpdateStatus `json:"update,omitempty"`
+}
+
+// +kubebuilder:validation:Enum={UpToDate,FastForwarded,Ahead,Diverged,Dirty,Detached,Failed}
+type UpdateState string
+
+const (
+	// The checked out branch is already at the commit of the remote
+	UpdateUpToDate UpdateState = "UpToDate"
+	// The checked out branch was fast-forwarded to the commit of the remote
+	UpdateFastForwarded UpdateState = "FastForwarded"
+	// The checked out branch has commits which are not on the remote
+	UpdateAhead UpdateState = "Ahead"
+	// The checked out branch and the remote both have commits which the other does not have
+	UpdateDiverged UpdateState = "Diverged"
+	// The worktree has uncommitted changes, the branch is left as it is
+	UpdateDirty UpdateState = "Dirty"
+	// No branch is checked out, there is nothing to fast-forward
+	UpdateDetached UpdateState = "Detached"
+	// The remote could not be fetched or the branch could not be fast-forwarded
+	UpdateFailed UpdateState = "Failed"
+)
+
+type CodeRepositoryUpdateStatus struct {
+	State UpdateState `json:"state"`
+	// The number of commits of the checked out branch which are not on the remote
+	// +optional
+	Ahead int32 `json:"ahead,omitempty"`
+	// The number of commits of the remote which are not on the checked out branch
+	// +optional
+	Behind int32 `json:"behind,omitempty"`
+	// The tracked files with uncommitted changes, or the untracked files which the update would overwrite,
+	// at most the first 10 are listed
+	// +optional
+	DirtyFiles []string `json:"dirtyFiles,omitempty"`
+	// The reason why the repository could not be updated
+	// +optional
+	Error string `json:"error,omitempty"`
+}
+
+// +kubebuilder:validation:Enum={Fetched,Skipped,TooLarge,Failed}
+type LFSState string
+
+const (
+	// The LFS objects were fetched
+	LFSFetched LFSState = "Fetched"
+	// The LFS objects were not fetched, they can be pulled from the session
+	LFSSkipped LFSState = "Skipped"
+	// The LFS objects were not fetched because they exceed the maximum size or the free space of the volume
+	LFSTooLarge LFSState = "TooLarge"
+	// The LFS objects could not be fetched, the repository is cloned without them
+	LFSFailed LFSState = "Failed"
+)
+
+type CodeRepositoryLFSStatus struct {
+	State LFSState `json:"state"`
+	// The reason why the LFS objects could not be fetched
+	// +optional
+	Error string `json:"error,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -1,7 +1,10 @@
 package v1alpha1
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -127,6 +130,15 @@ func (as *AmaltheaSession) auth() (manifests, error) {
 			volumeMounts...,
 		)
 	case Oidc:
+		if auth.Proxy == OidcProxyBuiltin {
+			var err error
+			authContainer, err = as.builtinOidcAuthProxy()
+			if err != nil {
+				return output, err
+			}
+			authContainer.VolumeMounts = append(authContainer.VolumeMounts, volumeMounts...)
+			break
+		}
 		volNameFixedConfig := fmt.Sprintf("%s-fixed-proxy-configuration-secret", prefix)
 		volNameAuthorizedEmails := fmt.Sprintf("%s-authorized-emails-secret", prefix)
 		fixedConfigVol := v1.Volume{
@@ -147,7 +159,22 @@ func (as *AmaltheaSession) auth() (manifests, error) {
 				},
 			},
 		}
-		output.Volumes = append(output.Volumes, fixedConfigVol, authorizedEmailsVol)
+		oauth2ProxyVolumeMounts := []v1.VolumeMount{
+			{
+				Name:      volNameFixedConfig,
+				MountPath: "/etc/oauth2-proxy",
+			},
+		}
+		output.Volumes = append(output.Volumes, fixedConfigVol)
+		if !auth.Authorization.HasRules() {
+			// NOTE: The list of authorized emails is only used when there are no authorization rules
+			output.Volumes = append(output.Volumes, authorizedEmailsVol)
+			oauth2ProxyVolumeMounts = append(oauth2ProxyVolumeMounts, v1.VolumeMount{
+				Name:      volNameAuthorizedEmails,
+				MountPath: "/authorized_emails",
+				SubPath:   "AUTHORIZED_EMAILS",
+			})
+		}
 		probeHandler := v1.ProbeHandler{
 			HTTPGet: &v1.HTTPGetAction{
 				Path: "/ping",
@@ -182,20 +209,7 @@ func (as *AmaltheaSession) auth() (manifests, error) {
 					},
 				},
 			},
-			VolumeMounts: append(
-				[]v1.VolumeMount{
-					{
-						Name:      volNameFixedConfig,
-						MountPath: "/etc/oauth2-proxy",
-					},
-					{
-						Name:      volNameAuthorizedEmails,
-						MountPath: "/authorized_emails",
-						SubPath:   "AUTHORIZED_EMAILS",
-					},
-				},
-				volumeMounts...,
-			),
+			VolumeMounts:   append(oauth2ProxyVolumeMounts, volumeMounts...),
 			ReadinessProbe: &v1.Probe{ProbeHandler: probeHandler},
 			LivenessProbe:  &v1.Probe{ProbeHandler: probeHandler},
 			Resources: v1.ResourceRequirements{
@@ -213,6 +227,15 @@ func (as *AmaltheaSession) auth() (manifests, error) {
 			},
 		}
 		authContainer = as.get_rewrite_authn_proxy(secondProxyPort, AuthProxyMetaPort, as.Spec.Session.Port)
+		if auth.Authorization != nil && len(auth.Authorization.RequiredClaims) > 0 {
+			requiredClaims, err := json.Marshal(auth.Authorization.RequiredClaims)
+			if err != nil {
+				return output, err
+			}
+			authContainer.Env = append(authContainer.Env, v1.EnvVar{
+				Name: "AUTHPROXY_REQUIRED_CLAIMS", Value: string(requiredClaims),
+			})
+		}
 		output.Containers = append(output.Containers, oauth2ProxyContainer)
 	default:
 		return output, fmt.Errorf("unexpected authentication type %v when trying to template authentication containers", auth.Type)
@@ -221,6 +244,68 @@ func (as *AmaltheaSession) auth() (manifests, error) {
 	return output, nil
 }
 
+// builtinOidcAuthProxy returns the authproxy container that handles the OIDC login by itself,
+// the configuration is read from the secret of the user and the internal secret of the session.
+func (as *AmaltheaSession) builtinOidcAuthProxy() (v1.Container, error) {
+	auth := as.Spec.Authentication
+	secretEnv := func(name string, secretName string, key string, optional bool) v1.EnvVar {
+		return v1.EnvVar{
+			Name: name,
+			ValueFrom: &v1.EnvVarSource{
+				SecretKeyRef: &v1.SecretKeySelector{
+					LocalObjectReference: v1.LocalObjectReference{Name: secretName},
+					Key:                  key,
+					Optional:             ptr.To(optional),
+				},
+			},
+		}
+	}
+	sameSiteCookieFlag := "strict"
+	if useNoneSameSiteSessionCookie {
+		sameSiteCookieFlag = "none"
+	}
+	authContainer := as.get_rewrite_authn_proxy(authenticatedPort, AuthProxyMetaPort, as.Spec.Session.Port)
+	authContainer.Env = append(authContainer.Env,
+		secretEnv("AUTHPROXY_OIDC_ISSUER_URL", auth.SecretRef.Name, "OIDC_ISSUER_URL", false),
+		secretEnv("AUTHPROXY_OIDC_CLIENT_ID", auth.SecretRef.Name, "OIDC_CLIENT_ID", false),
+		secretEnv("AUTHPROXY_OIDC_CLIENT_SECRET", auth.SecretRef.Name, "OIDC_CLIENT_SECRET", false),
+		secretEnv("AUTHPROXY_OIDC_ALLOW_UNVERIFIED_EMAILS", auth.SecretRef.Name, "ALLOW_UNVERIFIED_EMAILS", true),
+		secretEnv("AUTHPROXY_OIDC_COOKIE_SECRET", as.InternalSecretName(), OidcCookieSecretKey, false),
+		v1.EnvVar{Name: "AUTHPROXY_OIDC_REDIRECT_URL", Value: as.oidcRedirectURL()},
+		v1.EnvVar{Name: "AUTHPROXY_OIDC_COOKIE_SAMESITE", Value: sameSiteCookieFlag},
+	)
+	authz := auth.Authorization
+	if !authz.HasRules() {
+		authContainer.Env = append(authContainer.Env,
+			secretEnv("AUTHPROXY_OIDC_AUTHORIZED_EMAILS", auth.SecretRef.Name, "AUTHORIZED_EMAILS", true),
+		)
+		return authContainer, nil
+	}
+	if len(authz.AllowedGroups) > 0 {
+		// NOTE: The groups are parsed as CSV by the authproxy, so groups with commas or quotes are quoted
+		groups := &strings.Builder{}
+		writer := csv.NewWriter(groups)
+		if err := writer.Write(authz.AllowedGroups); err != nil {
+			return authContainer, err
+		}
+		writer.Flush()
+		authContainer.Env = append(authContainer.Env,
+			v1.EnvVar{Name: "AUTHPROXY_OIDC_GROUPS_CLAIM", Value: authz.GroupsClaim},
+			v1.EnvVar{Name: "AUTHPROXY_OIDC_ALLOWED_GROUPS", Value: strings.TrimSuffix(groups.String(), "\n")},
+		)
+	}
+	if len(authz.RequiredClaims) > 0 {
+		requiredClaims, err := json.Marshal(authz.RequiredClaims)
+		if err != nil {
+			return authContainer, err
+		}
+		authContainer.Env = append(authContainer.Env, v1.EnvVar{
+			Name: "AUTHPROXY_REQUIRED_CLAIMS", Value: string(requiredClaims),
+		})
+	}
+	return authContainer, nil
+}
+
 func (as *AmaltheaSession) get_rewrite_authn_proxy(listenPort int32, metaListenPort int32, remotePort int32) v1.Container {
 	probeHandler := v1.ProbeHandler{
 		HTTPGet: &v1.HTTPGetAction{
@@ -273,5 +358,16 @@ func (as *AmaltheaSession) get_rewrite_authn_proxy(listenPort int32, metaListenP
 			Name: "AUTHPROXY_STRIP_PATH_PREFIX", Value: as.urlPath(),
 		})
 	}
+	if auth := as.Spec.Authentication; auth != nil && auth.AuditLog {
+		authContainer.Env = append(authContainer.Env, v1.EnvVar{Name: "AUTHPROXY_AUDIT_LOG", Value: "stdout"})
+		if auth.Type == Oidc && auth.Proxy != OidcProxyBuiltin {
+			// NOTE: The authproxy is behind the oauth2-proxy configured by Amalthea which sets the header on every
+			// request. The configuration of the oauth2proxy sessions comes from the user, the header may be passed
+			// through from the client, so it is not trusted.
+			authContainer.Env = append(authContainer.Env, v1.EnvVar{
+				Name: "AUTHPROXY_AUDIT_PRINCIPAL_HEADER", Value: forwardedEmailHeader,
+			})
+		}
+	}
 	return authContainer
 }
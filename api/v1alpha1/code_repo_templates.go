@@ -1,63 +1,196 @@
 package v1alpha1
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 
 	v1 "k8s.io/api/core/v1"
 )
 
+// The name of the init container that clones all the code repositories
+const GitCloneContainerName string = "git-clone"
+
+// The key of the internal secret with the configuration of the repositories cloned by the init container
+const GitCloneConfigKey string = "GIT_CLONE_CONFIG"
+
+// The directory of the session volume where the cloner writes the result of each repository
+const GitCloneResultsDir string = ".git-clone-results"
+
+const gitCloneConfigVolumeName string = prefix + "git-clone-config"
+const gitCloneConfigMountPath string = "/etc/amalthea/git-clone"
+const gitCloneConfigFile string = "repositories.json"
+const gitCloneSecretsMountPath string = "/git-clone-secrets"
+
+// The annotation of the pod template with the hash of the configuration of the cloner, the configuration
+// is read from the internal secret so the annotation restarts the session when the code repositories change
+const gitCloneConfigHashAnnotation string = "amalthea.dev/git-clone-config-hash"
+
+// The number of repositories cloned at the same time when the session does not specify it
+const defaultCloneParallelism int32 = 4
+
 type manifests struct {
 	Containers []v1.Container
 	Volumes    []v1.Volume
 }
 
-func (as *AmaltheaSession) cloneInit() manifests {
-	envVars := []v1.EnvVar{}
-	volMounts := []v1.VolumeMount{{Name: sessionVolumeName, MountPath: as.Spec.Session.Storage.MountPath}}
-	vols := []v1.Volume{}
-	containers := []v1.Container{} //nolint:prealloc
+// gitCloneRepository is the configuration of a repository read by the clone-all command of the cloner
+type gitCloneRepository struct {
+	Type           string       `json:"type,omitempty"`
+	Remote         string       `json:"remote"`
+	Revision       string       `json:"revision,omitempty"`
+	Path           string       `json:"path"`
+	ConfigPath     string       `json:"configPath,omitempty"`
+	Strategy       string       `json:"strategy,omitempty"`
+	Depth          int32        `json:"depth,omitempty"`
+	SparseCheckout []string     `json:"sparseCheckout,omitempty"`
+	Submodules     string       `json:"submodules,omitempty"`
+	LFS            *gitCloneLFS `json:"lfs,omitempty"`
+	Checksum       string       `json:"checksum,omitempty"`
+}
+
+// gitCloneLFS is the LFS configuration of a repository read by the cloner, the maximum size is in bytes
+type gitCloneLFS struct {
+	Fetch   string   `json:"fetch,omitempty"`
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	MaxSize int64    `json:"maxSize,omitempty"`
+}
 
+type gitCloneConfig struct {
+	Repositories []gitCloneRepository `json:"repositories"`
+}
+
+// cloningConfigSecretMountPath is where the cloning configuration secret of a repository is mounted,
+// each repository has its own directory since the secrets can use the same key.
+func cloningConfigSecretMountPath(irepo int) string {
+	return fmt.Sprintf("%s/%d", gitCloneSecretsMountPath, irepo)
+}
+
+// cloneStrategy returns the pre-cloning strategy of the cloner which applies the resume strategy
+func cloneStrategy(strategy ResumeStrategy) string {
+	if strategy == UpdateOnResume {
+		return "update"
+	}
+	return "notifexist"
+}
+
+// cloneConfig returns the serialized configuration of all the code repositories of the session
+func (as *AmaltheaSession) cloneConfig() (string, error) {
+	config := gitCloneConfig{Repositories: []gitCloneRepository{}}
 	for irepo, repo := range as.Spec.CodeRepositories {
-		args := []string{
-			"cloner",
-			"clone",
-			"--strategy",
-			"notifexist",
-			"--remote",
-			repo.Remote,
-			"--path",
-			fmt.Sprintf("%s/%s", as.Spec.Session.Storage.MountPath, repo.ClonePath),
+		repository := gitCloneRepository{
+			Type:           string(repo.Type),
+			Remote:         repo.Remote,
+			Revision:       repo.Revision,
+			Path:           fmt.Sprintf("%s/%s", as.Spec.Session.Storage.MountPath, repo.ClonePath),
+			Strategy:       cloneStrategy(repo.ResumeStrategy),
+			Depth:          repo.Depth,
+			SparseCheckout: repo.SparseCheckout,
+			Submodules:     string(repo.Submodules),
+			Checksum:       repo.Checksum,
+		}
+		if repo.LFS != nil {
+			repository.LFS = &gitCloneLFS{
+				Fetch:   string(repo.LFS.Fetch),
+				Include: repo.LFS.Include,
+				Exclude: repo.LFS.Exclude,
+			}
+			if repo.LFS.MaxSize != nil {
+				repository.LFS.MaxSize = repo.LFS.MaxSize.Value()
+			}
 		}
-
 		if repo.CloningConfigSecretRef != nil {
-			secretVolName := fmt.Sprintf("%sgit-clone-cred-volume-%d", prefix, irepo)
-			secretMountPath := "/git-clone-secrets"
-			secretFilePath := fmt.Sprintf("%s/%s", secretMountPath, repo.CloningConfigSecretRef.Key)
-			vols = append(
-				vols,
-				v1.Volume{
-					Name: secretVolName,
-					VolumeSource: v1.VolumeSource{
-						Secret: &v1.SecretVolumeSource{SecretName: repo.CloningConfigSecretRef.Name},
-					},
+			repository.ConfigPath = fmt.Sprintf("%s/%s", cloningConfigSecretMountPath(irepo), repo.CloningConfigSecretRef.Key)
+		}
+		config.Repositories = append(config.Repositories, repository)
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// cloneConfigHash returns the sha256 digest of the configuration of the cloner, it is empty when
+// the session has no code repositories
+func (as *AmaltheaSession) cloneConfigHash() (string, error) {
+	if len(as.Spec.CodeRepositories) == 0 {
+		return "", nil
+	}
+	cloneConfig, err := as.cloneConfig()
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256([]byte(cloneConfig))
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// cloneInit returns a single init container that clones all the code repositories concurrently
+func (as *AmaltheaSession) cloneInit() manifests {
+	if len(as.Spec.CodeRepositories) == 0 {
+		return manifests{}
+	}
+
+	envVars := []v1.EnvVar{}
+	volMounts := []v1.VolumeMount{
+		{Name: sessionVolumeName, MountPath: as.Spec.Session.Storage.MountPath},
+		{Name: gitCloneConfigVolumeName, MountPath: gitCloneConfigMountPath, ReadOnly: true},
+	}
+	vols := []v1.Volume{
+		{
+			Name: gitCloneConfigVolumeName,
+			VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{
+					SecretName: as.InternalSecretName(),
+					Items:      []v1.KeyToPath{{Key: GitCloneConfigKey, Path: gitCloneConfigFile}},
 				},
-			)
-			volMounts = append(volMounts, v1.VolumeMount{Name: secretVolName, MountPath: secretMountPath})
+			},
+		},
+	}
 
-			args = append(args, []string{"--config", secretFilePath}...)
+	for irepo, repo := range as.Spec.CodeRepositories {
+		if repo.CloningConfigSecretRef == nil {
+			continue
 		}
+		secretVolName := fmt.Sprintf("%sgit-clone-cred-volume-%d", prefix, irepo)
+		vols = append(
+			vols,
+			v1.Volume{
+				Name: secretVolName,
+				VolumeSource: v1.VolumeSource{
+					Secret: &v1.SecretVolumeSource{SecretName: repo.CloningConfigSecretRef.Name},
+				},
+			},
+		)
+		volMounts = append(volMounts, v1.VolumeMount{Name: secretVolName, MountPath: cloningConfigSecretMountPath(irepo)})
+	}
 
-		if repo.Revision != "" {
-			args = append(args, []string{"--revision", repo.Revision}...)
-		}
+	parallelism := as.Spec.CloneParallelism
+	if parallelism < 1 {
+		parallelism = defaultCloneParallelism
+	}
+	args := []string{
+		"cloner",
+		"clone-all",
+		"--config",
+		fmt.Sprintf("%s/%s", gitCloneConfigMountPath, gitCloneConfigFile),
+		"--parallelism",
+		fmt.Sprintf("%d", parallelism),
+		"--results-dir",
+		fmt.Sprintf("%s/%s", as.Spec.Session.Storage.MountPath, GitCloneResultsDir),
+	}
 
-		gitCloneContainerName := fmt.Sprintf("git-clone-%d", irepo)
-		containers = append(containers, v1.Container{
-			Name:         gitCloneContainerName,
-			Image:        sidecarsImage,
-			VolumeMounts: volMounts,
-			WorkingDir:   as.Spec.Session.Storage.MountPath,
-			Env:          envVars,
+	containers := []v1.Container{
+		{
+			Name:                     GitCloneContainerName,
+			Image:                    sidecarsImage,
+			VolumeMounts:             volMounts,
+			WorkingDir:               as.Spec.Session.Storage.MountPath,
+			Env:                      envVars,
+			TerminationMessagePath:   "/dev/termination-log",
+			TerminationMessagePolicy: v1.TerminationMessageReadFile,
 			SecurityContext: &v1.SecurityContext{
 				RunAsUser:  &as.Spec.Session.RunAsUser,
 				RunAsGroup: &as.Spec.Session.RunAsGroup,
@@ -66,7 +199,7 @@ func (as *AmaltheaSession) cloneInit() manifests {
 				},
 			},
 			Args: args,
-		})
+		},
 	}
 	return manifests{containers, vols}
 }
@@ -0,0 +1,175 @@
+package v1alpha1
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// The keys of the internal secret with the certificate authority used by the git proxy to intercept HTTPS connections
+const GitProxyCACertKey string = "GIT_PROXY_CA_CERT"
+const GitProxyCAKeyKey string = "GIT_PROXY_CA_KEY"
+
+const gitProxyCAVolumeName string = prefix + "git-proxy-ca"
+const gitProxyCADefaultMountPath string = "/etc/amalthea/git-proxy"
+const gitProxyCACertFile string = "ca.crt"
+
+// NOTE: The CA is kept for the whole life of the session, including when it is hibernated and resumed,
+// sessions rarely live that long but an expired CA would break all git operations through the proxy.
+const gitProxyCAValidity = 10 * 365 * 24 * time.Hour
+
+// makeGitProxyCA generates a certificate authority that is used only by the git proxy of a single session,
+// the certificate and the private key are returned PEM encoded.
+func makeGitProxyCA(sessionName string) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"Amalthea"},
+			CommonName:   "Amalthea git proxy CA for " + sessionName,
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(gitProxyCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		// The proxy signs only leaf certificates
+		MaxPathLenZero: true,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	privateKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKey})
+	return string(certPEM), string(keyPEM), nil
+}
+
+// GitProxyCAData returns the certificate and the private key of the git proxy CA for the internal secret,
+// the CA of the existing secret is kept and a new one is only generated when the secret has none. The
+// session and the git proxy would stop trusting each other if the CA was regenerated.
+func (as *AmaltheaSession) GitProxyCAData(existing map[string][]byte) (map[string]string, error) {
+	if as.Spec.GitProxyCA == nil {
+		return nil, nil
+	}
+	cert, certExists := existing[GitProxyCACertKey]
+	key, keyExists := existing[GitProxyCAKeyKey]
+	if certExists && keyExists {
+		return map[string]string{GitProxyCACertKey: string(cert), GitProxyCAKeyKey: string(key)}, nil
+	}
+	caCert, caKey, err := makeGitProxyCA(as.Name)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{GitProxyCACertKey: caCert, GitProxyCAKeyKey: caKey}, nil
+}
+
+// gitProxyCAMountPath returns the directory where the certificate of the CA is mounted
+func (as *AmaltheaSession) gitProxyCAMountPath() string {
+	// NOTE: The default is set by the CRD, it is only missing when the session is not created through the API server
+	if as.Spec.GitProxyCA.MountPath == "" {
+		return gitProxyCADefaultMountPath
+	}
+	return as.Spec.GitProxyCA.MountPath
+}
+
+// gitProxyCAHosts returns the hosts for which the session trusts the git proxy CA, the hosts of the
+// gitProxyCA spec followed by the hosts of the git repositories with an https remote
+func (as *AmaltheaSession) gitProxyCAHosts() []string {
+	hosts := []string{}
+	for _, host := range as.Spec.GitProxyCA.Hosts {
+		if !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	for _, repo := range as.Spec.CodeRepositories {
+		if repo.Type != "" && repo.Type != Git {
+			continue
+		}
+		remote, err := url.Parse(repo.Remote)
+		if err != nil || remote.Scheme != "https" || remote.Host == "" {
+			continue
+		}
+		if !slices.Contains(hosts, remote.Host) {
+			hosts = append(hosts, remote.Host)
+		}
+	}
+	return hosts
+}
+
+// gitProxyCAEnv configures git in the session container to trust the git proxy CA for the intercepted hosts
+// with http.<url>.sslCAInfo. The CA is not added with GIT_SSL_CAINFO, SSL_CERT_FILE or a global http.sslCAInfo
+// since they replace the system CAs, and the hosts that are not intercepted present their own certificates.
+// The settings are passed with GIT_CONFIG_COUNT, which requires git 2.31, and they are left out when the session
+// already sets GIT_CONFIG_COUNT.
+func (as *AmaltheaSession) gitProxyCAEnv() []v1.EnvVar {
+	if as.Spec.GitProxyCA == nil || slices.ContainsFunc(as.Spec.Session.Env, func(env v1.EnvVar) bool {
+		return env.Name == "GIT_CONFIG_COUNT"
+	}) {
+		return nil
+	}
+	hosts := as.gitProxyCAHosts()
+	if len(hosts) == 0 {
+		return nil
+	}
+	caFile := fmt.Sprintf("%s/%s", as.gitProxyCAMountPath(), gitProxyCACertFile)
+	env := []v1.EnvVar{{Name: "GIT_CONFIG_COUNT", Value: strconv.Itoa(len(hosts))}}
+	for ihost, host := range hosts {
+		env = append(env,
+			v1.EnvVar{Name: fmt.Sprintf("GIT_CONFIG_KEY_%d", ihost), Value: fmt.Sprintf("http.https://%s/.sslCAInfo", host)},
+			v1.EnvVar{Name: fmt.Sprintf("GIT_CONFIG_VALUE_%d", ihost), Value: caFile},
+		)
+	}
+	return env
+}
+
+// gitProxyCAVolumes mounts only the certificate of the git proxy CA in the session container,
+// the private key stays in the secret.
+func (as *AmaltheaSession) gitProxyCAVolumes() ([]v1.Volume, []v1.VolumeMount) {
+	if as.Spec.GitProxyCA == nil {
+		return nil, nil
+	}
+	mountPath := as.gitProxyCAMountPath()
+	volumes := []v1.Volume{
+		{
+			Name: gitProxyCAVolumeName,
+			VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{
+					SecretName: as.InternalSecretName(),
+					Items:      []v1.KeyToPath{{Key: GitProxyCACertKey, Path: gitProxyCACertFile}},
+				},
+			},
+		},
+	}
+	volumeMounts := []v1.VolumeMount{
+		{
+			Name:      gitProxyCAVolumeName,
+			MountPath: mountPath,
+			ReadOnly:  true,
+		},
+	}
+	return volumes, volumeMounts
+}
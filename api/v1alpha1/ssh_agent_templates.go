@@ -0,0 +1,128 @@
+package v1alpha1
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/utils/ptr"
+)
+
+// The name of the sidecar that runs the SSH agent
+const SSHAgentContainerName string = "ssh-agent"
+
+// The environment variable with the socket of the agent in the session container
+const SSHAuthSockEnv string = "SSH_AUTH_SOCK"
+
+const sshAgentSocketVolumeName string = prefix + "ssh-agent-socket"
+const sshAgentSocketMountPath string = "/ssh-agent"
+const sshAgentSocket string = sshAgentSocketMountPath + "/agent.sock"
+const sshAgentKeysMountPath string = "/ssh-agent-keys"
+const sshAgentTokenMountPath string = "/ssh-agent-token"
+
+// sshAgentKeyMountPath is where the secret with a key of the agent is mounted, each key has its own
+// directory since the secrets can use the same key.
+func sshAgentKeyMountPath(ikey int) string {
+	return fmt.Sprintf("%s/%d", sshAgentKeysMountPath, ikey)
+}
+
+// sshAgent returns the sidecar with the SSH agent and its volumes, along with the mount of the socket
+// for the session container. The secrets with the keys and the token are only mounted in the sidecar.
+func (as *AmaltheaSession) sshAgent() (manifests, []v1.VolumeMount) {
+	if as.Spec.SSHAgent == nil || as.Spec.SessionLocation == Remote {
+		return manifests{}, nil
+	}
+	sshAgent := as.Spec.SSHAgent
+
+	vols := []v1.Volume{
+		{
+			Name: sshAgentSocketVolumeName,
+			VolumeSource: v1.VolumeSource{
+				EmptyDir: &v1.EmptyDirVolumeSource{Medium: v1.StorageMediumMemory},
+			},
+		},
+	}
+	socketMount := v1.VolumeMount{Name: sshAgentSocketVolumeName, MountPath: sshAgentSocketMountPath}
+	volMounts := []v1.VolumeMount{socketMount}
+	env := []v1.EnvVar{
+		{Name: "SSH_AGENT_SOCKET", Value: sshAgentSocket},
+	}
+
+	keyFiles := make([]string, 0, len(sshAgent.KeySecretRefs))
+	for ikey, keyRef := range sshAgent.KeySecretRefs {
+		volName := fmt.Sprintf("%sssh-agent-key-%d", prefix, ikey)
+		vols = append(vols, v1.Volume{
+			Name: volName,
+			VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{
+					SecretName:  keyRef.Name,
+					Items:       []v1.KeyToPath{{Key: keyRef.Key, Path: keyRef.Key}},
+					DefaultMode: ptr.To(int32(0o440)),
+				},
+			},
+		})
+		volMounts = append(volMounts, v1.VolumeMount{Name: volName, MountPath: sshAgentKeyMountPath(ikey), ReadOnly: true})
+		keyFiles = append(keyFiles, fmt.Sprintf("%s/%s", sshAgentKeyMountPath(ikey), keyRef.Key))
+	}
+	if len(keyFiles) > 0 {
+		env = append(env, v1.EnvVar{Name: "SSH_AGENT_KEY_FILES", Value: strings.Join(keyFiles, ",")})
+	}
+
+	if certificate := sshAgent.Certificate; certificate != nil {
+		env = append(env, v1.EnvVar{Name: "SSH_AGENT_CERTIFICATE_URL", Value: certificate.URL})
+		if len(certificate.Principals) > 0 {
+			env = append(env, v1.EnvVar{Name: "SSH_AGENT_CERTIFICATE_PRINCIPALS", Value: strings.Join(certificate.Principals, ",")})
+		}
+		if tokenRef := certificate.TokenSecretRef; tokenRef != nil {
+			volName := prefix + "ssh-agent-token"
+			// NOTE: The token is not projected as a single item so that the rotations of the secret are picked up
+			vols = append(vols, v1.Volume{
+				Name: volName,
+				VolumeSource: v1.VolumeSource{
+					Secret: &v1.SecretVolumeSource{
+						SecretName:  tokenRef.Name,
+						DefaultMode: ptr.To(int32(0o440)),
+					},
+				},
+			})
+			volMounts = append(volMounts, v1.VolumeMount{Name: volName, MountPath: sshAgentTokenMountPath, ReadOnly: true})
+			env = append(env, v1.EnvVar{
+				Name:  "SSH_AGENT_CERTIFICATE_TOKEN_FILE",
+				Value: fmt.Sprintf("%s/%s", sshAgentTokenMountPath, tokenRef.Key),
+			})
+		}
+	}
+
+	container := v1.Container{
+		Image: sidecarsImage,
+		Name:  SSHAgentContainerName,
+		SecurityContext: &v1.SecurityContext{
+			AllowPrivilegeEscalation: ptr.To(false),
+			RunAsNonRoot:             ptr.To(true),
+			RunAsUser:                ptr.To(int64(1000)),
+			RunAsGroup:               ptr.To(int64(1000)),
+			Capabilities: &v1.Capabilities{
+				Drop: []v1.Capability{"ALL"},
+			},
+		},
+		Args: []string{
+			"ssh-agent",
+			"serve",
+		},
+		Env:          env,
+		VolumeMounts: volMounts,
+		Resources: v1.ResourceRequirements{
+			Requests: v1.ResourceList{
+				"memory": resource.MustParse("16Mi"),
+				"cpu":    resource.MustParse("10m"),
+			},
+			Limits: v1.ResourceList{
+				"memory": resource.MustParse("32Mi"),
+				// NOTE: Cpu limit not set on purpose
+			},
+		},
+	}
+
+	return manifests{Containers: []v1.Container{container}, Volumes: vols}, []v1.VolumeMount{socketMount}
+}
@@ -111,6 +111,16 @@ func (in *AmaltheaSessionSpec) DeepCopyInto(out *AmaltheaSessionSpec) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.GitProxyCA != nil {
+		in, out := &in.GitProxyCA, &out.GitProxyCA
+		*out = new(GitProxyCA)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SSHAgent != nil {
+		in, out := &in.SSHAgent, &out.SSHAgent
+		*out = new(SSHAgent)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.DataSources != nil {
 		in, out := &in.DataSources, &out.DataSources
 		*out = make([]DataSource, len(*in))
@@ -204,6 +214,20 @@ func (in *AmaltheaSessionStatus) DeepCopyInto(out *AmaltheaSessionStatus) {
 	in.FailedSchedulingSince.DeepCopyInto(&out.FailedSchedulingSince)
 	in.HibernatedSince.DeepCopyInto(&out.HibernatedSince)
 	in.WillHibernateAt.DeepCopyInto(&out.WillHibernateAt)
+	if in.CodeRepositories != nil {
+		in, out := &in.CodeRepositories, &out.CodeRepositories
+		*out = make([]CodeRepositoryStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.DataSources != nil {
+		in, out := &in.DataSources, &out.DataSources
+		*out = make([]DataSourceStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AmaltheaSessionStatus.
@@ -227,6 +251,11 @@ func (in *Authentication) DeepCopyInto(out *Authentication) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Authorization != nil {
+		in, out := &in.Authorization, &out.Authorization
+		*out = new(OidcAuthorization)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Authentication.
@@ -239,6 +268,28 @@ func (in *Authentication) DeepCopy() *Authentication {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CSIDataSource) DeepCopyInto(out *CSIDataSource) {
+	*out = *in
+	if in.VolumeAttributes != nil {
+		in, out := &in.VolumeAttributes, &out.VolumeAttributes
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CSIDataSource.
+func (in *CSIDataSource) DeepCopy() *CSIDataSource {
+	if in == nil {
+		return nil
+	}
+	out := new(CSIDataSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CodeRepository) DeepCopyInto(out *CodeRepository) {
 	*out = *in
@@ -252,6 +303,16 @@ func (in *CodeRepository) DeepCopyInto(out *CodeRepository) {
 		*out = new(SessionSecretKeyRef)
 		**out = **in
 	}
+	if in.SparseCheckout != nil {
+		in, out := &in.SparseCheckout, &out.SparseCheckout
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.LFS != nil {
+		in, out := &in.LFS, &out.LFS
+		*out = new(CodeRepositoryLFS)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CodeRepository.
@@ -264,6 +325,97 @@ func (in *CodeRepository) DeepCopy() *CodeRepository {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CodeRepositoryLFS) DeepCopyInto(out *CodeRepositoryLFS) {
+	*out = *in
+	if in.Include != nil {
+		in, out := &in.Include, &out.Include
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Exclude != nil {
+		in, out := &in.Exclude, &out.Exclude
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.MaxSize != nil {
+		in, out := &in.MaxSize, &out.MaxSize
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CodeRepositoryLFS.
+func (in *CodeRepositoryLFS) DeepCopy() *CodeRepositoryLFS {
+	if in == nil {
+		return nil
+	}
+	out := new(CodeRepositoryLFS)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CodeRepositoryLFSStatus) DeepCopyInto(out *CodeRepositoryLFSStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CodeRepositoryLFSStatus.
+func (in *CodeRepositoryLFSStatus) DeepCopy() *CodeRepositoryLFSStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CodeRepositoryLFSStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CodeRepositoryStatus) DeepCopyInto(out *CodeRepositoryStatus) {
+	*out = *in
+	out.Duration = in.Duration
+	if in.LFS != nil {
+		in, out := &in.LFS, &out.LFS
+		*out = new(CodeRepositoryLFSStatus)
+		**out = **in
+	}
+	if in.Update != nil {
+		in, out := &in.Update, &out.Update
+		*out = new(CodeRepositoryUpdateStatus)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CodeRepositoryStatus.
+func (in *CodeRepositoryStatus) DeepCopy() *CodeRepositoryStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CodeRepositoryStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CodeRepositoryUpdateStatus) DeepCopyInto(out *CodeRepositoryUpdateStatus) {
+	*out = *in
+	if in.DirtyFiles != nil {
+		in, out := &in.DirtyFiles, &out.DirtyFiles
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CodeRepositoryUpdateStatus.
+func (in *CodeRepositoryUpdateStatus) DeepCopy() *CodeRepositoryUpdateStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CodeRepositoryUpdateStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ContainerCounts) DeepCopyInto(out *ContainerCounts) {
 	*out = *in
@@ -309,6 +461,26 @@ func (in *DataSource) DeepCopyInto(out *DataSource) {
 		*out = new(SessionSecretRef)
 		**out = **in
 	}
+	if in.PVC != nil {
+		in, out := &in.PVC, &out.PVC
+		*out = new(PVCDataSource)
+		**out = **in
+	}
+	if in.NFS != nil {
+		in, out := &in.NFS, &out.NFS
+		*out = new(NFSDataSource)
+		**out = **in
+	}
+	if in.CSI != nil {
+		in, out := &in.CSI, &out.CSI
+		*out = new(CSIDataSource)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.EmptyDir != nil {
+		in, out := &in.EmptyDir, &out.EmptyDir
+		*out = new(EmptyDirDataSource)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DataSource.
@@ -321,6 +493,62 @@ func (in *DataSource) DeepCopy() *DataSource {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DataSourceStatus) DeepCopyInto(out *DataSourceStatus) {
+	*out = *in
+	in.FailingSince.DeepCopyInto(&out.FailingSince)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DataSourceStatus.
+func (in *DataSourceStatus) DeepCopy() *DataSourceStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DataSourceStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EmptyDirDataSource) DeepCopyInto(out *EmptyDirDataSource) {
+	*out = *in
+	if in.SizeLimit != nil {
+		in, out := &in.SizeLimit, &out.SizeLimit
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EmptyDirDataSource.
+func (in *EmptyDirDataSource) DeepCopy() *EmptyDirDataSource {
+	if in == nil {
+		return nil
+	}
+	out := new(EmptyDirDataSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitProxyCA) DeepCopyInto(out *GitProxyCA) {
+	*out = *in
+	if in.Hosts != nil {
+		in, out := &in.Hosts, &out.Hosts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitProxyCA.
+func (in *GitProxyCA) DeepCopy() *GitProxyCA {
+	if in == nil {
+		return nil
+	}
+	out := new(GitProxyCA)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Ingress) DeepCopyInto(out *Ingress) {
 	*out = *in
@@ -353,6 +581,83 @@ func (in *Ingress) DeepCopy() *Ingress {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NFSDataSource) DeepCopyInto(out *NFSDataSource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NFSDataSource.
+func (in *NFSDataSource) DeepCopy() *NFSDataSource {
+	if in == nil {
+		return nil
+	}
+	out := new(NFSDataSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OidcAuthorization) DeepCopyInto(out *OidcAuthorization) {
+	*out = *in
+	if in.AllowedGroups != nil {
+		in, out := &in.AllowedGroups, &out.AllowedGroups
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RequiredClaims != nil {
+		in, out := &in.RequiredClaims, &out.RequiredClaims
+		*out = make([]OidcClaimRequirement, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OidcAuthorization.
+func (in *OidcAuthorization) DeepCopy() *OidcAuthorization {
+	if in == nil {
+		return nil
+	}
+	out := new(OidcAuthorization)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OidcClaimRequirement) DeepCopyInto(out *OidcClaimRequirement) {
+	*out = *in
+	if in.Values != nil {
+		in, out := &in.Values, &out.Values
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OidcClaimRequirement.
+func (in *OidcClaimRequirement) DeepCopy() *OidcClaimRequirement {
+	if in == nil {
+		return nil
+	}
+	out := new(OidcClaimRequirement)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PVCDataSource) DeepCopyInto(out *PVCDataSource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PVCDataSource.
+func (in *PVCDataSource) DeepCopy() *PVCDataSource {
+	if in == nil {
+		return nil
+	}
+	out := new(PVCDataSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ReadinessProbe) DeepCopyInto(out *ReadinessProbe) {
 	*out = *in
@@ -368,6 +673,56 @@ func (in *ReadinessProbe) DeepCopy() *ReadinessProbe {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SSHAgent) DeepCopyInto(out *SSHAgent) {
+	*out = *in
+	if in.KeySecretRefs != nil {
+		in, out := &in.KeySecretRefs, &out.KeySecretRefs
+		*out = make([]SessionSecretKeyRef, len(*in))
+		copy(*out, *in)
+	}
+	if in.Certificate != nil {
+		in, out := &in.Certificate, &out.Certificate
+		*out = new(SSHAgentCertificate)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SSHAgent.
+func (in *SSHAgent) DeepCopy() *SSHAgent {
+	if in == nil {
+		return nil
+	}
+	out := new(SSHAgent)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SSHAgentCertificate) DeepCopyInto(out *SSHAgentCertificate) {
+	*out = *in
+	if in.TokenSecretRef != nil {
+		in, out := &in.TokenSecretRef, &out.TokenSecretRef
+		*out = new(SessionSecretKeyRef)
+		**out = **in
+	}
+	if in.Principals != nil {
+		in, out := &in.Principals, &out.Principals
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SSHAgentCertificate.
+func (in *SSHAgentCertificate) DeepCopy() *SSHAgentCertificate {
+	if in == nil {
+		return nil
+	}
+	out := new(SSHAgentCertificate)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Session) DeepCopyInto(out *Session) {
 	*out = *in
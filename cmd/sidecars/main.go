@@ -22,6 +22,7 @@ import (
 	"github.com/SwissDataScienceCenter/amalthea/internal/cloner"
 	gitproxy "github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy"
 	"github.com/SwissDataScienceCenter/amalthea/internal/remote"
+	"github.com/SwissDataScienceCenter/amalthea/internal/sshagent"
 	"github.com/SwissDataScienceCenter/amalthea/internal/tunnel"
 	"github.com/spf13/cobra"
 )
@@ -60,6 +61,10 @@ func buildCommands() *cobra.Command {
 		Use:   "gitproxy proxy",
 		Short: "Proxy https git call",
 	}
+	sshAgentRoot := &cobra.Command{
+		Use:   "ssh-agent serve",
+		Short: "SSH agent for git remotes",
+	}
 	rootCmd.AddCommand(versionCmd)
 	authCmd, err := authproxy.Command()
 	cobra.CheckErr(err)
@@ -71,15 +76,19 @@ func buildCommands() *cobra.Command {
 	cobra.CheckErr(err)
 	gitProxyCmd, err := gitproxy.Command()
 	cobra.CheckErr(err)
+	sshAgentCmd, err := sshagent.Command()
+	cobra.CheckErr(err)
 	proxyRoot.AddCommand(authCmd)
 	remoteSessionControllerRoot.AddCommand(remoteSessionControllerCmd)
 	tunnelRoot.AddCommand(tunnelCmd)
 	gitProxyRoot.AddCommand(gitProxyCmd)
+	sshAgentRoot.AddCommand(sshAgentCmd)
 	rootCmd.AddCommand(proxyRoot)
 	rootCmd.AddCommand(clonerRoot)
 	rootCmd.AddCommand(remoteSessionControllerRoot)
 	rootCmd.AddCommand(tunnelRoot)
 	rootCmd.AddCommand(gitProxyRoot)
+	rootCmd.AddCommand(sshAgentRoot)
 	return rootCmd
 }
 
@@ -0,0 +1,177 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The value of the audit log option that writes the records to stdout
+const auditLogStdout = "stdout"
+
+// The ways in which the principal of an audit record was authenticated
+const (
+	principalTypeToken = "token"
+	principalTypeOidc  = "oidc"
+	// The principal was passed by an authenticating proxy in front of the authproxy, e.g. oauth2-proxy
+	principalTypeHeader = "header"
+)
+
+// AuditRecord describes who accessed the session, it is written as a single line of JSON
+type AuditRecord struct {
+	Time          time.Time    `json:"time"`
+	Principal     string       `json:"principal,omitempty"`
+	PrincipalType string       `json:"principal_type,omitempty"`
+	SourceIP      string       `json:"source_ip"`
+	Method        string       `json:"method"`
+	Path          string       `json:"path"`
+	Status        int          `json:"status"`
+	Class         RequestClass `json:"class"`
+	// The duration of the request in seconds, for websockets it is how long the connection was open
+	Duration float64 `json:"duration"`
+}
+
+type AuditConfig struct {
+	// The fraction of the requests that are recorded, between 0 and 1
+	SampleRate float64
+	// The fraction of the background requests that are recorded, between 0 and 1
+	BackgroundSampleRate float64
+	// The header with the email of the user set by an authenticating proxy in front of the authproxy.
+	// It must only be set when that proxy overwrites the header on every request.
+	PrincipalHeader string
+}
+
+// AuditLog writes an audit record for the requests that reach the session. The requests that are
+// rejected by the authentication or the authorization are always recorded, the other requests
+// are sampled.
+type AuditLog struct {
+	config AuditConfig
+	writer io.Writer
+	random func() float64
+	now    func() time.Time
+	mutex  sync.Mutex
+}
+
+func NewAuditLog(writer io.Writer, config AuditConfig) (*AuditLog, error) {
+	if config.SampleRate < 0 || config.SampleRate > 1 {
+		return nil, fmt.Errorf("the audit sample rate has to be between 0 and 1, got %v", config.SampleRate)
+	}
+	if config.BackgroundSampleRate < 0 || config.BackgroundSampleRate > 1 {
+		return nil, fmt.Errorf("the audit sample rate of the background requests has to be between 0 and 1, got %v", config.BackgroundSampleRate)
+	}
+	return &AuditLog{
+		config: config,
+		writer: writer,
+		random: rand.Float64,
+		now:    time.Now,
+	}, nil
+}
+
+// openAuditLog opens the destination of the audit records, either stdout or a file where the records are appended
+func openAuditLog(destination string) (io.Writer, error) {
+	if destination == auditLogStdout || destination == "-" {
+		return os.Stdout, nil
+	}
+	file, err := os.OpenFile(destination, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the audit log: %w", err)
+	}
+	return file, nil
+}
+
+func (a *AuditLog) sampled(class RequestClass) bool {
+	rate := a.config.SampleRate
+	switch class {
+	case RequestRejected:
+		return true
+	case RequestBackground:
+		rate = a.config.BackgroundSampleRate
+	}
+	return rate >= 1 || a.random() < rate
+}
+
+// principal returns the identity that was authenticated by one of the middlewares further down the chain
+func (a *AuditLog) principal(c echo.Context) (string, string) {
+	if principal, ok := c.Get(principalContextKey).(Principal); ok {
+		return principal.ID, principalTypeToken
+	}
+	if session, ok := c.Get(oidcSessionContextKey).(OidcSession); ok {
+		if session.Email != "" {
+			return session.Email, principalTypeOidc
+		}
+		return session.Subject, principalTypeOidc
+	}
+	if a.config.PrincipalHeader != "" {
+		if value := c.Request().Header.Get(a.config.PrincipalHeader); value != "" {
+			return value, principalTypeHeader
+		}
+	}
+	return "", ""
+}
+
+// Process is a middleware that records the requests, it has to run before the request
+// statistics so that the response status and the class of the request are known.
+func (a *AuditLog) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := a.now()
+		// NOTE: The path may be rewritten further down the chain, the original path is recorded
+		path := c.Request().URL.Path
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
+		class, _ := c.Get(requestClassContextKey).(RequestClass)
+		if !a.sampled(class) {
+			return nil
+		}
+		principal, principalType := a.principal(c)
+		a.write(AuditRecord{
+			Time:          start.UTC(),
+			Principal:     principal,
+			PrincipalType: principalType,
+			SourceIP:      c.RealIP(),
+			Method:        c.Request().Method,
+			Path:          path,
+			Status:        c.Response().Status,
+			Class:         class,
+			Duration:      a.now().Sub(start).Seconds(),
+		}, c)
+		return nil
+	}
+}
+
+func (a *AuditLog) write(record AuditRecord, c echo.Context) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		c.Logger().Errorf("cannot encode the audit record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, err := a.writer.Write(line); err != nil {
+		c.Logger().Errorf("cannot write the audit record: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package authproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAuditRecords(t *testing.T, output *bytes.Buffer) []AuditRecord {
+	records := []AuditRecord{}
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := AuditRecord{}
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	output.Reset()
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	output := &bytes.Buffer{}
+	audit, err := NewAuditLog(output, AuditConfig{SampleRate: 1, BackgroundSampleRate: 1, PrincipalHeader: "X-Forwarded-Email"})
+	require.NoError(t, err)
+	audit.now = func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }
+	rs, err := NewStats(DefaultBackgroundPaths)
+	require.NoError(t, err)
+	principals := &Principals{}
+	require.NoError(t, principals.Update([]Principal{
+		{ID: "alice", Token: "alice-token", Role: RoleOwner},
+		{ID: "bob", Token: "bob-token", Role: RoleViewer},
+	}, nil))
+
+	e := echo.New()
+	e.IPExtractor = echo.ExtractIPFromXFFHeader()
+	e.Group("/*").Use(
+		audit.Process,
+		rs.Process,
+		middleware.KeyAuth(principals.Validator),
+		principals.Authorize,
+		func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				return c.String(http.StatusOK, "hello")
+			}
+		},
+	)
+
+	req := httptest.NewRequest(http.MethodGet, "/lab/tree", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer alice-token")
+	// The request comes through the ingress which is a trusted internal proxy
+	req.RemoteAddr = "10.0.0.1:43210"
+	req.Header.Set(echo.HeaderXForwardedFor, "192.0.2.10")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest(http.MethodPost, "/api/contents", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer bob-token")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest(http.MethodGet, "/lab", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer wrong-token")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	records := readAuditRecords(t, output)
+	require.Len(t, records, 3)
+	assert.Equal(t, AuditRecord{
+		Time:          time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Principal:     "alice",
+		PrincipalType: principalTypeToken,
+		SourceIP:      "192.0.2.10",
+		Method:        http.MethodGet,
+		Path:          "/lab/tree",
+		Status:        http.StatusOK,
+		Class:         RequestInteractive,
+	}, records[0])
+	assert.Equal(t, "bob", records[1].Principal)
+	assert.Equal(t, http.StatusForbidden, records[1].Status)
+	assert.Equal(t, RequestRejected, records[1].Class)
+	assert.Empty(t, records[2].Principal)
+	assert.Equal(t, http.StatusUnauthorized, records[2].Status)
+}
+
+func TestAuditLogPrincipalHeader(t *testing.T) {
+	output := &bytes.Buffer{}
+	audit, err := NewAuditLog(output, AuditConfig{SampleRate: 1, BackgroundSampleRate: 1, PrincipalHeader: "X-Forwarded-Email"})
+	require.NoError(t, err)
+	rs, err := NewStats(DefaultBackgroundPaths)
+	require.NoError(t, err)
+	e := echo.New()
+	e.Group("/*").Use(audit.Process, rs.Process, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		}
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/lab", nil)
+	req.Header.Set("X-Forwarded-Email", "alice@example.com")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	records := readAuditRecords(t, output)
+	require.Len(t, records, 1)
+	assert.Equal(t, "alice@example.com", records[0].Principal)
+	assert.Equal(t, principalTypeHeader, records[0].PrincipalType)
+}
+
+func TestAuditLogSampling(t *testing.T) {
+	output := &bytes.Buffer{}
+	audit, err := NewAuditLog(output, AuditConfig{SampleRate: 0.5, BackgroundSampleRate: 0})
+	require.NoError(t, err)
+	random := 0.0
+	audit.random = func() float64 { return random }
+	rs, err := NewStats(DefaultBackgroundPaths)
+	require.NoError(t, err)
+	e := echo.New()
+	e.Group("/*").Use(audit.Process, rs.Process, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Request().URL.Path == "/forbidden" {
+				return echo.ErrForbidden
+			}
+			return c.NoContent(http.StatusOK)
+		}
+	})
+
+	for _, path := range []string{"/lab", "/api/kernels", "/forbidden"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	random = 0.9
+	for _, path := range []string{"/lab", "/forbidden"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	paths := []string{}
+	for _, record := range readAuditRecords(t, output) {
+		paths = append(paths, record.Path)
+	}
+	// The background requests are skipped and the rejected requests are always recorded
+	assert.Equal(t, []string{"/lab", "/forbidden", "/forbidden"}, paths)
+
+	_, err = NewAuditLog(output, AuditConfig{SampleRate: 2})
+	assert.Error(t, err)
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// The header where oauth2-proxy passes the ID token of the logged in user.
+// It is set by oauth2-proxy on every request, so any value sent by the client is overwritten.
+const idTokenHeader = "X-Amalthea-Id-Token"
+
+// ClaimRequirement is a claim that has to match one of the listed values
+type ClaimRequirement struct {
+	// The name of the claim, nested claims are separated by dots
+	Claim string `json:"claim"`
+	// The accepted values for the claim
+	Values []string `json:"values"`
+}
+
+func parseClaimRequirements(raw string) ([]ClaimRequirement, error) {
+	requirements := []ClaimRequirement{}
+	if err := json.Unmarshal([]byte(raw), &requirements); err != nil {
+		return nil, fmt.Errorf("cannot parse the required claims: %w", err)
+	}
+	for _, req := range requirements {
+		if req.Claim == "" || len(req.Values) == 0 {
+			return nil, fmt.Errorf("a required claim needs a name and at least one value, got %+v", req)
+		}
+	}
+	return requirements, nil
+}
+
+// Matches returns true if the claim is present and at least one of its values is accepted.
+func (r ClaimRequirement) Matches(claims jwt.MapClaims) bool {
+	var value any = map[string]any(claims)
+	for _, part := range strings.Split(r.Claim, ".") {
+		nested, ok := value.(map[string]any)
+		if !ok {
+			return false
+		}
+		value, ok = nested[part]
+		if !ok {
+			return false
+		}
+	}
+	switch v := value.(type) {
+	case []any:
+		for _, item := range v {
+			if slices.Contains(r.Values, fmt.Sprint(item)) {
+				return true
+			}
+		}
+		return false
+	case map[string]any, nil:
+		return false
+	default:
+		return slices.Contains(r.Values, fmt.Sprint(v))
+	}
+}
+
+// requireClaims returns a middleware that rejects requests where the ID token does not satisfy all requirements.
+// The token is not verified here, oauth2-proxy is in front of the authproxy and has already validated it.
+func requireClaims(requirements []ClaimRequirement) echo.MiddlewareFunc {
+	parser := jwt.NewParser()
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			rawToken := c.Request().Header.Get(idTokenHeader)
+			// The session does not need to see the token
+			c.Request().Header.Del(idTokenHeader)
+			if rawToken == "" {
+				return echo.NewHTTPError(http.StatusForbidden, "missing ID token")
+			}
+			claims := jwt.MapClaims{}
+			if _, _, err := parser.ParseUnverified(rawToken, claims); err != nil {
+				c.Logger().Warnf("cannot parse the ID token: %v", err)
+				return echo.NewHTTPError(http.StatusForbidden, "invalid ID token")
+			}
+			for _, req := range requirements {
+				if !req.Matches(claims) {
+					return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("the claim %s does not have an accepted value", req.Claim))
+				}
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package authproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimRequirementMatches(t *testing.T) {
+	claims := jwt.MapClaims{
+		"email":          "user@example.org",
+		"email_verified": true,
+		"groups":         []any{"course-101", "staff"},
+		"realm_access":   map[string]any{"roles": []any{"admin", "user"}},
+	}
+	cases := []struct {
+		name    string
+		req     ClaimRequirement
+		matches bool
+	}{
+		{"string claim", ClaimRequirement{"email", []string{"user@example.org"}}, true},
+		{"string claim mismatch", ClaimRequirement{"email", []string{"other@example.org"}}, false},
+		{"bool claim", ClaimRequirement{"email_verified", []string{"true"}}, true},
+		{"list claim", ClaimRequirement{"groups", []string{"course-102", "staff"}}, true},
+		{"list claim mismatch", ClaimRequirement{"groups", []string{"course-102"}}, false},
+		{"nested claim", ClaimRequirement{"realm_access.roles", []string{"admin"}}, true},
+		{"nested object", ClaimRequirement{"realm_access", []string{"admin"}}, false},
+		{"missing claim", ClaimRequirement{"department", []string{"physics"}}, false},
+		{"missing nested claim", ClaimRequirement{"email.domain", []string{"example.org"}}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.matches, tc.req.Matches(claims))
+		})
+	}
+}
+
+func TestParseClaimRequirements(t *testing.T) {
+	reqs, err := parseClaimRequirements(`[{"claim": "realm_access.roles", "values": ["admin"]}]`)
+	require.NoError(t, err)
+	assert.Equal(t, []ClaimRequirement{{Claim: "realm_access.roles", Values: []string{"admin"}}}, reqs)
+
+	_, err = parseClaimRequirements(`[{"claim": "roles", "values": []}]`)
+	assert.Error(t, err)
+	_, err = parseClaimRequirements(`not json`)
+	assert.Error(t, err)
+}
+
+func TestRequireClaims(t *testing.T) {
+	signedToken := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		require.NoError(t, err)
+		return token
+	}
+	mw := requireClaims([]ClaimRequirement{{Claim: "roles", Values: []string{"admin"}}})
+	handler := mw(func(c echo.Context) error {
+		assert.Empty(t, c.Request().Header.Get(idTokenHeader))
+		return c.NoContent(http.StatusOK)
+	})
+	cases := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"no token", "", http.StatusForbidden},
+		{"invalid token", "not-a-jwt", http.StatusForbidden},
+		{"wrong role", signedToken(jwt.MapClaims{"roles": []any{"user"}}), http.StatusForbidden},
+		{"accepted role", signedToken(jwt.MapClaims{"roles": []any{"user", "admin"}}), http.StatusOK},
+	}
+	e := echo.New()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.token != "" {
+				req.Header.Set(idTokenHeader, tc.token)
+			}
+			rec := httptest.NewRecorder()
+			err := handler(e.NewContext(req, rec))
+			if tc.status == http.StatusOK {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.status, rec.Code)
+				return
+			}
+			var httpErr *echo.HTTPError
+			require.ErrorAs(t, err, &httpErr)
+			assert.Equal(t, tc.status, httpErr.Code)
+		})
+	}
+}
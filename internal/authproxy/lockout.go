@@ -0,0 +1,189 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authproxy
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
+)
+
+// Above this number of tracked clients the expired entries are removed when a new failure is recorded
+const maxTrackedClientsBeforeCleanup = 1000
+
+type clientFailures struct {
+	count       int
+	firstFailed time.Time
+	lockedUntil time.Time
+}
+
+// AuthFailureLimiter locks out clients that fail to authenticate too many times.
+// Clients are identified by their IP address. A client is locked out for the lockout duration
+// once it has failed maxFailures times within the window.
+type AuthFailureLimiter struct {
+	maxFailures int
+	window      time.Duration
+	lockout     time.Duration
+	logFailures bool
+	// The total number of failed authentication attempts
+	failedTotal uint64
+	// The total number of requests rejected because the client was locked out
+	rejectedTotal uint64
+	clients       map[string]*clientFailures
+	now           func() time.Time
+	mutex         sync.Mutex
+}
+
+func NewAuthFailureLimiter(maxFailures int, window time.Duration, lockout time.Duration, logFailures bool) *AuthFailureLimiter {
+	return &AuthFailureLimiter{
+		maxFailures: maxFailures,
+		window:      window,
+		lockout:     lockout,
+		logFailures: logFailures,
+		clients:     map[string]*clientFailures{},
+		now:         time.Now,
+	}
+}
+
+// isLockedOut returns true if the client is currently locked out
+func (l *AuthFailureLimiter) isLockedOut(clientIP string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	failures, found := l.clients[clientIP]
+	if !found || !l.now().Before(failures.lockedUntil) {
+		return false
+	}
+	l.rejectedTotal++
+	lockedOutRequests.Inc()
+	return true
+}
+
+// recordFailure counts a failed authentication and starts the lockout when the limit is reached
+func (l *AuthFailureLimiter) recordFailure(clientIP string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.failedTotal++
+	authFailures.Inc()
+	if len(l.clients) > maxTrackedClientsBeforeCleanup {
+		l.removeExpired(now)
+	}
+	failures, found := l.clients[clientIP]
+	if !found || now.Sub(failures.firstFailed) > l.window {
+		failures = &clientFailures{firstFailed: now}
+		l.clients[clientIP] = failures
+	}
+	failures.count++
+	if l.maxFailures > 0 && failures.count >= l.maxFailures {
+		failures.lockedUntil = now.Add(l.lockout)
+		failures.count = 0
+		failures.firstFailed = now
+	}
+}
+
+// recordSuccess forgets the previous failures of the client
+func (l *AuthFailureLimiter) recordSuccess(clientIP string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.clients, clientIP)
+}
+
+func (l *AuthFailureLimiter) removeExpired(now time.Time) {
+	for clientIP, failures := range l.clients {
+		if now.Sub(failures.firstFailed) > l.window && !now.Before(failures.lockedUntil) {
+			delete(l.clients, clientIP)
+		}
+	}
+}
+
+// Reject is a middleware that rejects requests from clients that are locked out,
+// it should run before the authentication middleware.
+func (l *AuthFailureLimiter) Reject(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if l.isLockedOut(c.RealIP()) {
+			return echo.NewHTTPError(http.StatusTooManyRequests, "too many failed authentication attempts")
+		}
+		return next(c)
+	}
+}
+
+// Validator wraps a key authentication validator to forget the previous failures of a client
+// once it authenticates successfully.
+func (l *AuthFailureLimiter) Validator(validator middleware.KeyAuthValidator) middleware.KeyAuthValidator {
+	return func(key string, c echo.Context) (bool, error) {
+		valid, err := validator(key, c)
+		if err == nil && valid {
+			l.recordSuccess(c.RealIP())
+		}
+		return valid, err
+	}
+}
+
+// ErrorHandler can be used as the error handler for the key authentication middleware,
+// it is called once for every request that does not pass the authentication.
+func (l *AuthFailureLimiter) ErrorHandler(err error, c echo.Context) error {
+	var missingErr *middleware.ErrKeyAuthMissing
+	if errors.As(err, &missingErr) {
+		// A request without any token does not count as a failed attempt
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	clientIP := c.RealIP()
+	l.recordFailure(clientIP)
+	if l.logFailures {
+		c.Logger().Warnj(log.JSON{
+			"event":     "authentication_failed",
+			"client_ip": clientIP,
+			"method":    c.Request().Method,
+			"path":      c.Request().URL.Path,
+			"reason":    err.Error(),
+		})
+	}
+	return &echo.HTTPError{
+		Code:     http.StatusUnauthorized,
+		Message:  "Unauthorized",
+		Internal: err,
+	}
+}
+
+type AuthStatsResponse struct {
+	FailedAuthentications uint64 `json:"failed_authentications"`
+	LockedOutRequests     uint64 `json:"locked_out_requests"`
+	LockedOutClients      int    `json:"locked_out_clients"`
+}
+
+// Handle serves the authentication failure counters
+func (l *AuthFailureLimiter) Handle(c echo.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	lockedOut := 0
+	for _, failures := range l.clients {
+		if now.Before(failures.lockedUntil) {
+			lockedOut++
+		}
+	}
+	return c.JSON(http.StatusOK, AuthStatsResponse{
+		FailedAuthentications: l.failedTotal,
+		LockedOutRequests:     l.rejectedTotal,
+		LockedOutClients:      lockedOut,
+	})
+}
@@ -0,0 +1,86 @@
+package authproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newLockoutTestServer(t *testing.T, limiter *AuthFailureLimiter) *echo.Echo {
+	principals := &Principals{}
+	require.NoError(t, principals.Update([]Principal{{ID: "owner", Token: "secret-token", Role: RoleOwner}}, nil))
+	e := echo.New()
+	e.IPExtractor = echo.ExtractIPDirect()
+	e.GET("/", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, limiter.Reject, middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		KeyLookup:    "header:Authorization",
+		Validator:    limiter.Validator(principals.Validator),
+		ErrorHandler: limiter.ErrorHandler,
+	}))
+	e.GET("/auth_stats", limiter.Handle)
+	return e
+}
+
+func doRequest(e *echo.Echo, clientIP string, token string) int {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = clientIP + ":12345"
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestAuthFailureLimiterLockout(t *testing.T) {
+	now := time.Now()
+	limiter := NewAuthFailureLimiter(3, time.Minute, 5*time.Minute, true)
+	limiter.now = func() time.Time { return now }
+	e := newLockoutTestServer(t, limiter)
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(e, "10.0.0.1", ""))
+	assert.Equal(t, http.StatusUnauthorized, doRequest(e, "10.0.0.1", "wrong-1"))
+	assert.Equal(t, http.StatusUnauthorized, doRequest(e, "10.0.0.1", "wrong-2"))
+	assert.Equal(t, http.StatusUnauthorized, doRequest(e, "10.0.0.1", "wrong-3"))
+	// The client is locked out, even with the right token
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(e, "10.0.0.1", "secret-token"))
+	// Other clients are not affected
+	assert.Equal(t, http.StatusOK, doRequest(e, "10.0.0.2", "secret-token"))
+
+	req := httptest.NewRequest(http.MethodGet, "/auth_stats", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	stats := AuthStatsResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(t, AuthStatsResponse{FailedAuthentications: 3, LockedOutRequests: 1, LockedOutClients: 1}, stats)
+
+	now = now.Add(5 * time.Minute)
+	assert.Equal(t, http.StatusOK, doRequest(e, "10.0.0.1", "secret-token"))
+}
+
+func TestAuthFailureLimiterWindow(t *testing.T) {
+	now := time.Now()
+	limiter := NewAuthFailureLimiter(3, time.Minute, 5*time.Minute, false)
+	limiter.now = func() time.Time { return now }
+	e := newLockoutTestServer(t, limiter)
+
+	assert.Equal(t, http.StatusUnauthorized, doRequest(e, "10.0.0.1", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, doRequest(e, "10.0.0.1", "wrong"))
+	// The failures expire after the window
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(e, "10.0.0.1", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, doRequest(e, "10.0.0.1", "wrong"))
+	// A successful authentication resets the failures
+	assert.Equal(t, http.StatusOK, doRequest(e, "10.0.0.1", "secret-token"))
+	assert.Equal(t, http.StatusUnauthorized, doRequest(e, "10.0.0.1", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, doRequest(e, "10.0.0.1", "wrong"))
+	assert.Equal(t, http.StatusOK, doRequest(e, "10.0.0.1", "secret-token"))
+}
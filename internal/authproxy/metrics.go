@@ -0,0 +1,165 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authproxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// requestsTotal counts the proxied requests by status code and path class
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amalthea_authproxy_requests_total",
+			Help: "Number of requests handled by the authproxy by status code and path class",
+		},
+		[]string{"code", "class"},
+	)
+
+	// requestDuration tracks the latency of the proxied requests, websocket connections are not included
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "amalthea_authproxy_request_duration_seconds",
+			Help:    "Duration in seconds of the requests handled by the authproxy by status code and path class",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"code", "class"},
+	)
+
+	// receivedBytes counts the bytes received from the clients
+	receivedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amalthea_authproxy_received_bytes_total",
+			Help: "Number of bytes received from the clients by path class",
+		},
+		[]string{"class"},
+	)
+
+	// sentBytes counts the bytes sent to the clients
+	sentBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amalthea_authproxy_sent_bytes_total",
+			Help: "Number of bytes sent to the clients by path class",
+		},
+		[]string{"class"},
+	)
+
+	// upstreamErrors counts the requests that could not be passed on to the session
+	upstreamErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amalthea_authproxy_upstream_errors_total",
+			Help: "Number of requests that could not be proxied to the session by protocol",
+		},
+		[]string{"protocol"},
+	)
+
+	// authFailures counts the failed authentication attempts
+	authFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "amalthea_authproxy_auth_failures_total",
+			Help: "Number of failed authentication attempts",
+		},
+	)
+
+	// lockedOutRequests counts the requests rejected because the client is locked out
+	lockedOutRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "amalthea_authproxy_locked_out_requests_total",
+			Help: "Number of requests rejected because the client is locked out after too many failed authentication attempts",
+		},
+	)
+
+	// openConnections tracks the client connections, hijacked websocket connections are tracked separately
+	openConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "amalthea_authproxy_open_connections",
+			Help: "Number of open HTTP connections from clients",
+		},
+	)
+
+	// openWebsockets tracks the proxied websocket connections
+	openWebsockets = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "amalthea_authproxy_open_websockets",
+			Help: "Number of open websocket connections",
+		},
+	)
+)
+
+// The metrics of the authproxy have their own registry, they are served on the meta port
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		requestsTotal,
+		requestDuration,
+		receivedBytes,
+		sentBytes,
+		upstreamErrors,
+		authFailures,
+		lockedOutRequests,
+		openConnections,
+		openWebsockets,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// MetricsHandler serves the metrics in the Prometheus format
+func MetricsHandler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// trackConnections can be used as the ConnState hook of the HTTP server to count the open connections
+func trackConnections(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		openConnections.Inc()
+	case http.StateHijacked, http.StateClosed:
+		openConnections.Dec()
+	}
+}
+
+// observeRequest records the metrics of a request once it has been handled
+func observeRequest(c echo.Context, class RequestClass, duration time.Duration) {
+	code := strconv.Itoa(c.Response().Status)
+	requestsTotal.WithLabelValues(code, string(class)).Inc()
+	if class == RequestWebsocket {
+		// The duration of a websocket request is the lifetime of the connection and its bytes
+		// are counted by the websocket proxy
+		return
+	}
+	requestDuration.WithLabelValues(code, string(class)).Observe(duration.Seconds())
+	if length := c.Request().ContentLength; length > 0 {
+		receivedBytes.WithLabelValues(string(class)).Add(float64(length))
+	}
+	sentBytes.WithLabelValues(string(class)).Add(float64(c.Response().Size))
+}
+
+// countUpstreamErrors is the error handler of the HTTP proxy, it counts the requests that failed
+func countUpstreamErrors(c echo.Context, err error) error {
+	upstreamErrors.WithLabelValues("http").Inc()
+	return err
+}
@@ -0,0 +1,55 @@
+package authproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	metric := &dto.Metric{}
+	require.NoError(t, counter.Write(metric))
+	return metric.GetCounter().GetValue()
+}
+
+func TestMetrics(t *testing.T) {
+	rs, err := NewStats(DefaultBackgroundPaths)
+	require.NoError(t, err)
+	e := echo.New()
+	e.Group("/*").Use(rs.Process, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Request().URL.Path == "/forbidden" {
+				return echo.ErrForbidden
+			}
+			return c.String(http.StatusOK, "hello")
+		}
+	})
+
+	interactive := requestsTotal.WithLabelValues("200", string(RequestInteractive))
+	rejected := requestsTotal.WithLabelValues("403", string(RequestRejected))
+	sent := sentBytes.WithLabelValues(string(RequestInteractive))
+	received := receivedBytes.WithLabelValues(string(RequestInteractive))
+	interactiveBefore, rejectedBefore := counterValue(t, interactive), counterValue(t, rejected)
+	sentBefore, receivedBefore := counterValue(t, sent), counterValue(t, received)
+
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/lab", strings.NewReader("some data")))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/forbidden", nil))
+
+	assert.Equal(t, interactiveBefore+1, counterValue(t, interactive))
+	assert.Equal(t, rejectedBefore+1, counterValue(t, rejected))
+	assert.Equal(t, sentBefore+float64(len("hello")), counterValue(t, sent))
+	assert.Equal(t, receivedBefore+float64(len("some data")), counterValue(t, received))
+
+	rec := httptest.NewRecorder()
+	require.NoError(t, MetricsHandler()(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/metrics", nil), rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `amalthea_authproxy_request_duration_seconds_count{class="interactive",code="200"}`)
+	assert.Contains(t, rec.Body.String(), "go_goroutines")
+}
@@ -0,0 +1,625 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authproxy
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+)
+
+// The key in the echo context where the session of the user logged in with OIDC is stored
+const oidcSessionContextKey = "authproxy.oidc_session"
+
+// How long a user has to complete the login with the identity provider
+const oidcLoginTimeout = 10 * time.Minute
+
+// The signing keys of the identity provider are fetched again at most this often
+// when a token is signed with an unknown key
+const oidcKeysRefreshInterval = time.Minute
+
+// OidcConfig is the configuration of the built-in OpenID Connect login
+type OidcConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	// The callback URL registered with the identity provider, the login and logout endpoints
+	// are served next to it and the cookies are limited to the parent path of the callback.
+	RedirectURL string
+	Scopes      []string
+	CookieName  string
+	// The secret used to encrypt the cookies, it has to be at least 16 bytes long
+	CookieSecret    string
+	CookieSameSite  http.SameSite
+	SessionLifetime time.Duration
+	// How often the email, group and claim rules are checked again with a refreshed ID token, so that
+	// the users who lost their access are logged out. Without a refresh token the user logs in again.
+	RecheckInterval time.Duration
+	// The users allowed to access the session when there are no group or claim rules
+	AuthorizedEmails      []string
+	AllowUnverifiedEmails bool
+	GroupsClaim           string
+	AllowedGroups         []string
+	RequiredClaims        []ClaimRequirement
+}
+
+// HasRules returns true if the access is decided by the groups or claims instead of the emails
+func (c OidcConfig) HasRules() bool {
+	return len(c.AllowedGroups) > 0 || len(c.RequiredClaims) > 0
+}
+
+// OidcSession is the identity of a user logged in with OIDC, it is stored in an encrypted cookie
+type OidcSession struct {
+	Subject   string `json:"sub"`
+	Email     string `json:"email,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+	// When the rules have to be checked again with the refresh token
+	RecheckAt    int64  `json:"recheck"`
+	RefreshToken string `json:"rt,omitempty"`
+}
+
+// oidcLogin holds the values of a login that is in progress, it is stored in an encrypted cookie
+type oidcLogin struct {
+	State     string `json:"state"`
+	Verifier  string `json:"verifier"`
+	Nonce     string `json:"nonce"`
+	Redirect  string `json:"redirect"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// OidcAuthenticator logs users in with the OpenID Connect authorization code flow with PKCE.
+// The identity provider is discovered on the first login so that the proxy can start while
+// the provider is unreachable.
+type OidcAuthenticator struct {
+	config       OidcConfig
+	aead         cipher.AEAD
+	secure       bool
+	cookiePath   string
+	callbackPath string
+	signInPath   string
+	signOutPath  string
+	client       *http.Client
+	now          func() time.Time
+	mutex        sync.Mutex
+	provider     *oidcProvider
+	keys         map[string]any
+	keysFetched  time.Time
+	// The concurrent requests of a user share the refresh of the session
+	refreshes singleflight.Group
+}
+
+func NewOidcAuthenticator(config OidcConfig) (*OidcAuthenticator, error) {
+	if config.IssuerURL == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, fmt.Errorf("the OIDC issuer URL, client ID and redirect URL are required")
+	}
+	if len(config.CookieSecret) < 16 {
+		return nil, fmt.Errorf("the OIDC cookie secret has to be at least 16 bytes long")
+	}
+	redirectURL, err := url.Parse(config.RedirectURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OIDC redirect URL: %w", err)
+	}
+	if redirectURL.Path == "" {
+		return nil, fmt.Errorf("the OIDC redirect URL %s must have a path", config.RedirectURL)
+	}
+	if config.CookieName == "" {
+		config.CookieName = "_amalthea_oidc"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	if config.SessionLifetime <= 0 {
+		config.SessionLifetime = 7 * 24 * time.Hour
+	}
+	if config.RecheckInterval <= 0 {
+		config.RecheckInterval = 15 * time.Minute
+	}
+	// The secret is hashed so that a secret of any length gives a 256 bit AES key
+	key := sha256.Sum256([]byte(config.CookieSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// e.g. the redirect URL https://example.com/session/oauth2/callback gives the
+	// endpoints under /session/oauth2/ and the cookie path /session/
+	endpoints := path.Dir(redirectURL.Path)
+	cookiePath := path.Dir(endpoints)
+	if !strings.HasSuffix(cookiePath, "/") {
+		cookiePath += "/"
+	}
+	return &OidcAuthenticator{
+		config:       config,
+		aead:         aead,
+		secure:       redirectURL.Scheme == "https",
+		cookiePath:   cookiePath,
+		callbackPath: redirectURL.Path,
+		signInPath:   path.Join(endpoints, "sign_in"),
+		signOutPath:  path.Join(endpoints, "sign_out"),
+		client:       &http.Client{Timeout: 10 * time.Second},
+		now:          time.Now,
+	}, nil
+}
+
+// Authenticate is a middleware that serves the login endpoints and only lets requests
+// with a valid session through. Browsers are redirected to the identity provider to log in.
+func (a *OidcAuthenticator) Authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r := c.Request()
+		switch r.URL.Path {
+		case a.callbackPath:
+			return a.callback(c)
+		case a.signInPath:
+			return a.signIn(c, c.QueryParam("rd"))
+		case a.signOutPath:
+			return a.signOut(c)
+		}
+		session, err := a.session(r)
+		if err == nil && a.now().Unix() >= session.RecheckAt {
+			session, err = a.recheck(c, session)
+		}
+		if err == nil {
+			c.Set(oidcSessionContextKey, session)
+			return next(c)
+		}
+		c.Logger().Debugf("no valid OIDC session: %v", err)
+		if r.Method == http.MethodGet && strings.Contains(r.Header.Get(echo.HeaderAccept), echo.MIMETextHTML) && !c.IsWebSocket() {
+			return a.signIn(c, r.URL.RequestURI())
+		}
+		return echo.NewHTTPError(http.StatusUnauthorized)
+	}
+}
+
+func (a *OidcAuthenticator) oauth2Config(provider *oidcProvider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     a.config.ClientID,
+		ClientSecret: a.config.ClientSecret,
+		RedirectURL:  a.config.RedirectURL,
+		Scopes:       a.config.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  provider.AuthorizationEndpoint,
+			TokenURL: provider.TokenEndpoint,
+		},
+	}
+}
+
+func (a *OidcAuthenticator) signIn(c echo.Context, redirect string) error {
+	provider, err := a.discover(c.Request().Context())
+	if err != nil {
+		c.Logger().Errorf("cannot discover the OIDC provider: %v", err)
+		return echo.NewHTTPError(http.StatusBadGateway, "the identity provider is not available")
+	}
+	login := oidcLogin{
+		State:     rand.Text(),
+		Verifier:  oauth2.GenerateVerifier(),
+		Nonce:     rand.Text(),
+		Redirect:  a.safeRedirect(redirect),
+		ExpiresAt: a.now().Add(oidcLoginTimeout).Unix(),
+	}
+	value, err := a.seal(a.loginCookieName(), login)
+	if err != nil {
+		return err
+	}
+	// NOTE: The identity provider redirects back to the callback from another site,
+	// the login cookie would not be sent with a strict same site policy.
+	c.SetCookie(a.cookie(a.loginCookieName(), value, int(oidcLoginTimeout.Seconds()), http.SameSiteLaxMode))
+	authURL := a.oauth2Config(provider).AuthCodeURL(
+		login.State,
+		oauth2.S256ChallengeOption(login.Verifier),
+		oauth2.SetAuthURLParam("nonce", login.Nonce),
+	)
+	return c.Redirect(http.StatusFound, authURL)
+}
+
+func (a *OidcAuthenticator) callback(c echo.Context) error {
+	r := c.Request()
+	loginCookie, err := r.Cookie(a.loginCookieName())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "there is no login in progress")
+	}
+	login := oidcLogin{}
+	if err := a.open(a.loginCookieName(), loginCookie.Value, &login); err != nil || a.now().Unix() > login.ExpiresAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "the login has expired")
+	}
+	c.SetCookie(a.cookie(a.loginCookieName(), "", -1, http.SameSiteLaxMode))
+	if subtle.ConstantTimeCompare([]byte(login.State), []byte(c.QueryParam("state"))) != 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid login state")
+	}
+	if errorCode := c.QueryParam("error"); errorCode != "" {
+		c.Logger().Warnf("the identity provider returned an error: %s %s", errorCode, c.QueryParam("error_description"))
+		return echo.NewHTTPError(http.StatusForbidden, "the login failed")
+	}
+	provider, err := a.discover(r.Context())
+	if err != nil {
+		c.Logger().Errorf("cannot discover the OIDC provider: %v", err)
+		return echo.NewHTTPError(http.StatusBadGateway, "the identity provider is not available")
+	}
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, a.client)
+	token, err := a.oauth2Config(provider).Exchange(ctx, c.QueryParam("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		c.Logger().Warnf("cannot exchange the authorization code: %v", err)
+		return echo.NewHTTPError(http.StatusForbidden, "the login failed")
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return echo.NewHTTPError(http.StatusForbidden, "the identity provider did not return an ID token")
+	}
+	claims, err := a.verify(r.Context(), provider, rawIDToken, login.Nonce)
+	if err != nil {
+		c.Logger().Warnf("invalid ID token: %v", err)
+		return echo.NewHTTPError(http.StatusForbidden, "invalid ID token")
+	}
+	if err := a.authorize(claims); err != nil {
+		c.Logger().Infof("denied access to the session: %v", err)
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+	subject, _ := claims.GetSubject()
+	email, _ := claims["email"].(string)
+	session := OidcSession{
+		Subject:      subject,
+		Email:        email,
+		ExpiresAt:    a.now().Add(a.config.SessionLifetime).Unix(),
+		RecheckAt:    a.now().Add(a.config.RecheckInterval).Unix(),
+		RefreshToken: token.RefreshToken,
+	}
+	if session.RefreshToken == "" {
+		// NOTE: The rules cannot be checked again without a refresh token, the user has to log in again
+		session.ExpiresAt = session.RecheckAt
+	}
+	if err := a.setSessionCookie(c, session); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusFound, login.Redirect)
+}
+
+func (a *OidcAuthenticator) setSessionCookie(c echo.Context, session OidcSession) error {
+	value, err := a.seal(a.config.CookieName, session)
+	if err != nil {
+		return err
+	}
+	maxAge := int(time.Until(time.Unix(session.ExpiresAt, 0)).Seconds())
+	c.SetCookie(a.cookie(a.config.CookieName, value, max(maxAge, 1), a.config.CookieSameSite))
+	return nil
+}
+
+// recheck refreshes the ID token of the user and checks the rules again, the session is extended until
+// the next check when the user is still allowed. When the identity provider cannot be reached the current
+// session is kept and the check is retried later, when it rejects the refresh token the session ends.
+func (a *OidcAuthenticator) recheck(c echo.Context, session OidcSession) (OidcSession, error) {
+	if session.RefreshToken == "" {
+		return OidcSession{}, fmt.Errorf("the session cannot be refreshed")
+	}
+	result, err, _ := a.refreshes.Do(session.RefreshToken, func() (any, error) {
+		// NOTE: The refresh is shared with the other requests, it does not stop when this request is canceled
+		return a.refresh(context.WithoutCancel(c.Request().Context()), session)
+	})
+	var retrieveErr *oauth2.RetrieveError
+	rejected := errors.As(err, &retrieveErr) && retrieveErr.Response != nil && retrieveErr.Response.StatusCode < http.StatusInternalServerError
+	switch {
+	case rejected:
+		c.Logger().Infof("the identity provider rejected the refresh of the session: %v", err)
+	case err != nil && !errors.Is(err, errOidcAccessRevoked):
+		c.Logger().Warnf("cannot refresh the OIDC session, retrying later: %v", err)
+		session.RecheckAt = a.now().Add(oidcKeysRefreshInterval).Unix()
+		if err := a.setSessionCookie(c, session); err != nil {
+			return OidcSession{}, err
+		}
+		return session, nil
+	}
+	if err != nil {
+		c.Logger().Infof("ending the OIDC session: %v", err)
+		c.SetCookie(a.cookie(a.config.CookieName, "", -1, a.config.CookieSameSite))
+		return OidcSession{}, err
+	}
+	refreshed := result.(OidcSession)
+	if err := a.setSessionCookie(c, refreshed); err != nil {
+		return OidcSession{}, err
+	}
+	return refreshed, nil
+}
+
+// errOidcAccessRevoked is returned when the refreshed ID token does not satisfy the rules anymore
+var errOidcAccessRevoked = errors.New("the access to the session was revoked")
+
+func (a *OidcAuthenticator) refresh(ctx context.Context, session OidcSession) (OidcSession, error) {
+	provider, err := a.discover(ctx)
+	if err != nil {
+		return OidcSession{}, err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, a.client)
+	token, err := a.oauth2Config(provider).TokenSource(ctx, &oauth2.Token{RefreshToken: session.RefreshToken}).Token()
+	if err != nil {
+		return OidcSession{}, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return OidcSession{}, fmt.Errorf("%w: the identity provider did not return an ID token", errOidcAccessRevoked)
+	}
+	// NOTE: The ID tokens issued on a refresh do not have to contain the nonce of the login
+	claims, err := a.verify(ctx, provider, rawIDToken, "")
+	if err != nil {
+		return OidcSession{}, fmt.Errorf("%w: invalid ID token: %w", errOidcAccessRevoked, err)
+	}
+	if subject, _ := claims.GetSubject(); subject != session.Subject {
+		return OidcSession{}, fmt.Errorf("%w: the subject of the ID token changed", errOidcAccessRevoked)
+	}
+	if err := a.authorize(claims); err != nil {
+		return OidcSession{}, fmt.Errorf("%w: %w", errOidcAccessRevoked, err)
+	}
+	email, _ := claims["email"].(string)
+	return OidcSession{
+		Subject:      session.Subject,
+		Email:        email,
+		ExpiresAt:    session.ExpiresAt,
+		RecheckAt:    a.now().Add(a.config.RecheckInterval).Unix(),
+		RefreshToken: token.RefreshToken,
+	}, nil
+}
+
+func (a *OidcAuthenticator) signOut(c echo.Context) error {
+	c.SetCookie(a.cookie(a.config.CookieName, "", -1, a.config.CookieSameSite))
+	provider, err := a.discover(c.Request().Context())
+	if err != nil || provider.EndSessionEndpoint == "" {
+		return c.Redirect(http.StatusFound, a.cookiePath)
+	}
+	// See https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+	redirectURL, _ := url.Parse(a.config.RedirectURL)
+	afterLogout := url.URL{Scheme: redirectURL.Scheme, Host: redirectURL.Host, Path: a.cookiePath}
+	logoutURL, err := url.Parse(provider.EndSessionEndpoint)
+	if err != nil {
+		return c.Redirect(http.StatusFound, a.cookiePath)
+	}
+	query := logoutURL.Query()
+	query.Set("client_id", a.config.ClientID)
+	query.Set("post_logout_redirect_uri", afterLogout.String())
+	logoutURL.RawQuery = query.Encode()
+	return c.Redirect(http.StatusFound, logoutURL.String())
+}
+
+func (a *OidcAuthenticator) session(r *http.Request) (OidcSession, error) {
+	cookie, err := r.Cookie(a.config.CookieName)
+	if err != nil {
+		return OidcSession{}, err
+	}
+	session := OidcSession{}
+	if err := a.open(a.config.CookieName, cookie.Value, &session); err != nil {
+		return OidcSession{}, err
+	}
+	if a.now().Unix() > session.ExpiresAt {
+		return OidcSession{}, fmt.Errorf("the session has expired")
+	}
+	return session, nil
+}
+
+// authorize checks if the user is allowed to access the session. When there are no group or claim
+// rules the email of the user has to be in the list of authorized emails.
+func (a *OidcAuthenticator) authorize(claims jwt.MapClaims) error {
+	email, _ := claims["email"].(string)
+	if !a.config.AllowUnverifiedEmails && email != "" {
+		if verified, _ := claims["email_verified"].(bool); !verified {
+			return fmt.Errorf("the email %s is not verified", email)
+		}
+	}
+	if !a.config.HasRules() {
+		if email == "" || !slices.ContainsFunc(a.config.AuthorizedEmails, func(authorized string) bool {
+			return strings.EqualFold(strings.TrimSpace(authorized), email)
+		}) {
+			return fmt.Errorf("the user %q is not authorized", email)
+		}
+		return nil
+	}
+	if len(a.config.AllowedGroups) > 0 {
+		groups := ClaimRequirement{Claim: a.config.GroupsClaim, Values: a.config.AllowedGroups}
+		if !groups.Matches(claims) {
+			return fmt.Errorf("the user %q is not a member of an allowed group", email)
+		}
+	}
+	for _, req := range a.config.RequiredClaims {
+		if !req.Matches(claims) {
+			return fmt.Errorf("the claim %s does not have an accepted value", req.Claim)
+		}
+	}
+	return nil
+}
+
+func (a *OidcAuthenticator) verify(ctx context.Context, provider *oidcProvider, rawIDToken string, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return a.key(ctx, provider, kid)
+	},
+		jwt.WithIssuer(provider.Issuer),
+		jwt.WithAudience(a.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(a.now),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if tokenNonce, _ := claims["nonce"].(string); nonce != "" && subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("the nonce of the ID token does not match")
+	}
+	return claims, nil
+}
+
+// discover fetches the OpenID configuration of the identity provider, the result is kept once it succeeds.
+func (a *OidcAuthenticator) discover(ctx context.Context) (*oidcProvider, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.provider != nil {
+		return a.provider, nil
+	}
+	issuer := strings.TrimSuffix(a.config.IssuerURL, "/")
+	provider := oidcProvider{}
+	if err := a.getJSON(ctx, issuer+"/.well-known/openid-configuration", &provider); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("the issuer %s of the provider does not match the configured issuer %s", provider.Issuer, a.config.IssuerURL)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JwksURI == "" {
+		return nil, fmt.Errorf("the OpenID configuration of %s is incomplete", issuer)
+	}
+	a.provider = &provider
+	return a.provider, nil
+}
+
+// key returns the public key of the identity provider with the given id, the keys are
+// fetched again when the id is unknown to support the rotation of the keys.
+func (a *OidcAuthenticator) key(ctx context.Context, provider *oidcProvider, kid string) (any, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if key, ok := a.lookupKey(kid); ok {
+		return key, nil
+	}
+	if a.keys != nil && a.now().Sub(a.keysFetched) < oidcKeysRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	keySet := jsonWebKeySet{}
+	if err := a.getJSON(ctx, provider.JwksURI, &keySet); err != nil {
+		return nil, err
+	}
+	a.keys = keySet.publicKeys()
+	a.keysFetched = a.now()
+	if key, ok := a.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (a *OidcAuthenticator) lookupKey(kid string) (any, bool) {
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, true
+		}
+	}
+	key, ok := a.keys[kid]
+	return key, ok
+}
+
+func (a *OidcAuthenticator) getJSON(ctx context.Context, url string, target any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d from %s", res.StatusCode, url)
+	}
+	return json.NewDecoder(res.Body).Decode(target)
+}
+
+func (a *OidcAuthenticator) loginCookieName() string {
+	return a.config.CookieName + "_login"
+}
+
+func (a *OidcAuthenticator) cookie(name string, value string, maxAge int, sameSite http.SameSite) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     a.cookiePath,
+		MaxAge:   maxAge,
+		Secure:   a.secure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	}
+}
+
+// safeRedirect only allows redirects to paths on the session, to avoid open redirects. The browsers
+// remove the tabs and newlines and treat backslashes as slashes, e.g. /\t/evil.example is //evil.example.
+func (a *OidcAuthenticator) safeRedirect(redirect string) string {
+	if strings.ContainsFunc(redirect, func(r rune) bool { return unicode.IsControl(r) || r == '\\' }) {
+		return a.cookiePath
+	}
+	parsed, err := url.Parse(redirect)
+	if err != nil || parsed.Scheme != "" || parsed.Host != "" || parsed.User != nil || parsed.Opaque != "" {
+		return a.cookiePath
+	}
+	if !strings.HasPrefix(parsed.Path, a.cookiePath) || strings.HasPrefix(parsed.Path, "//") {
+		return a.cookiePath
+	}
+	return parsed.RequestURI()
+}
+
+// seal encrypts and authenticates the value, the name of the cookie is bound to the
+// ciphertext so that the value of a cookie cannot be used for another cookie.
+func (a *OidcAuthenticator) seal(name string, value any) (string, error) {
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, a.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(a.aead.Seal(nonce, nonce, plaintext, []byte(name))), nil
+}
+
+func (a *OidcAuthenticator) open(name string, sealed string, target any) error {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return err
+	}
+	if len(data) < a.aead.NonceSize() {
+		return fmt.Errorf("the cookie %s is too short", name)
+	}
+	nonce, ciphertext := data[:a.aead.NonceSize()], data[a.aead.NonceSize():]
+	plaintext, err := a.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return fmt.Errorf("cannot decrypt the cookie %s: %w", name, err)
+	}
+	return json.Unmarshal(plaintext, target)
+}
@@ -0,0 +1,341 @@
+package authproxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIdentityProvider issues ID tokens with the claims set by the test
+type fakeIdentityProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims jwt.MapClaims
+	nonce  string
+	// The status code returned to the refresh requests, they succeed when it is zero
+	refreshStatus int
+}
+
+func newFakeIdentityProvider(t *testing.T) *fakeIdentityProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	idp := &fakeIdentityProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcProvider{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JwksURI:               idp.server.URL + "/jwks",
+			EndSessionEndpoint:    idp.server.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jsonWebKeySet{Keys: []jsonWebKey{{
+			Kid: "key-1",
+			Kty: "RSA",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.FormValue("grant_type") == "refresh_token" && idp.refreshStatus != 0:
+			w.WriteHeader(idp.refreshStatus)
+			return
+		case r.FormValue("grant_type") == "refresh_token" && r.FormValue("refresh_token") == "the-refresh-token":
+		case r.FormValue("code") != "the-code" || r.FormValue("code_verifier") == "":
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		claims := jwt.MapClaims{
+			"iss":   idp.server.URL,
+			"aud":   "the-client",
+			"sub":   "user-1",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": idp.nonce,
+		}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "key-1"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "access-token",
+			"token_type":    "Bearer",
+			"id_token":      idToken,
+			"refresh_token": "the-refresh-token",
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func newOidcTestServer(t *testing.T, idp *fakeIdentityProvider, config OidcConfig) (*echo.Echo, *OidcAuthenticator) {
+	config.IssuerURL = idp.server.URL
+	config.ClientID = "the-client"
+	config.ClientSecret = "the-secret"
+	config.RedirectURL = "http://session.example.com/user/session/oauth2/callback"
+	config.CookieSecret = "a-very-secret-cookie-secret"
+	authenticator, err := NewOidcAuthenticator(config)
+	require.NoError(t, err)
+	e := echo.New()
+	e.Group("/*").Use(authenticator.Authenticate, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			session := c.Get(oidcSessionContextKey).(OidcSession)
+			return c.String(http.StatusOK, session.Email)
+		}
+	})
+	return e, authenticator
+}
+
+// login goes through the authorization code flow and returns the response of the callback
+func login(t *testing.T, e *echo.Echo, idp *fakeIdentityProvider) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/user/session/lab?reset", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusFound, rec.Code)
+	location, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, idp.server.URL+"/authorize", location.Scheme+"://"+location.Host+location.Path)
+	assert.Equal(t, "S256", location.Query().Get("code_challenge_method"))
+	idp.nonce = location.Query().Get("nonce")
+
+	callback := url.Values{"code": {"the-code"}, "state": {location.Query().Get("state")}}
+	req = httptest.NewRequest(http.MethodGet, "/user/session/oauth2/callback?"+callback.Encode(), nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestOidcLogin(t *testing.T) {
+	idp := newFakeIdentityProvider(t)
+	idp.claims = jwt.MapClaims{"email": "Alice@example.com", "email_verified": true}
+	e, _ := newOidcTestServer(t, idp, OidcConfig{AuthorizedEmails: []string{"alice@example.com"}})
+
+	// Requests that do not come from a browser are not redirected
+	req := httptest.NewRequest(http.MethodGet, "/user/session/api/kernels", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = login(t, e, idp)
+	require.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "/user/session/lab?reset", rec.Header().Get("Location"))
+	var sessionCookie *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "_amalthea_oidc" {
+			sessionCookie = cookie
+		}
+	}
+	require.NotNil(t, sessionCookie)
+	assert.Equal(t, "/user/session/", sessionCookie.Path)
+	assert.True(t, sessionCookie.HttpOnly)
+
+	req = httptest.NewRequest(http.MethodGet, "/user/session/api/kernels", nil)
+	req.AddCookie(sessionCookie)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "Alice@example.com", rec.Body.String())
+
+	// A modified cookie is rejected
+	tampered := *sessionCookie
+	tampered.Value = tampered.Value[:len(tampered.Value)-2] + "AA"
+	req = httptest.NewRequest(http.MethodGet, "/user/session/api/kernels", nil)
+	req.AddCookie(&tampered)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Logging out clears the cookie and redirects to the identity provider
+	req = httptest.NewRequest(http.MethodGet, "/user/session/oauth2/sign_out", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Contains(t, rec.Header().Get("Location"), idp.server.URL+"/logout?")
+	require.Len(t, rec.Result().Cookies(), 1)
+	assert.Equal(t, -1, rec.Result().Cookies()[0].MaxAge)
+}
+
+func TestOidcLoginAuthorization(t *testing.T) {
+	cases := []struct {
+		name   string
+		config OidcConfig
+		claims jwt.MapClaims
+		status int
+	}{
+		{
+			name:   "email not authorized",
+			config: OidcConfig{AuthorizedEmails: []string{"alice@example.com"}},
+			claims: jwt.MapClaims{"email": "bob@example.com", "email_verified": true},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "email not verified",
+			config: OidcConfig{AuthorizedEmails: []string{"alice@example.com"}},
+			claims: jwt.MapClaims{"email": "alice@example.com", "email_verified": false},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "unverified emails allowed",
+			config: OidcConfig{AuthorizedEmails: []string{"alice@example.com"}, AllowUnverifiedEmails: true},
+			claims: jwt.MapClaims{"email": "alice@example.com"},
+			status: http.StatusFound,
+		},
+		{
+			name:   "member of an allowed group",
+			config: OidcConfig{AllowedGroups: []string{"admins"}},
+			claims: jwt.MapClaims{"email": "bob@example.com", "email_verified": true, "groups": []any{"users", "admins"}},
+			status: http.StatusFound,
+		},
+		{
+			name:   "not a member of an allowed group",
+			config: OidcConfig{AllowedGroups: []string{"admins"}},
+			claims: jwt.MapClaims{"email": "bob@example.com", "email_verified": true, "groups": []any{"users"}},
+			status: http.StatusForbidden,
+		},
+		{
+			name: "missing required claim",
+			config: OidcConfig{
+				AllowedGroups:  []string{"admins"},
+				RequiredClaims: []ClaimRequirement{{Claim: "realm_access.roles", Values: []string{"session-user"}}},
+			},
+			claims: jwt.MapClaims{"email": "bob@example.com", "email_verified": true, "groups": []any{"admins"}},
+			status: http.StatusForbidden,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			idp := newFakeIdentityProvider(t)
+			idp.claims = tc.claims
+			e, _ := newOidcTestServer(t, idp, tc.config)
+			rec := login(t, e, idp)
+			assert.Equal(t, tc.status, rec.Code)
+		})
+	}
+}
+
+func TestOidcCallbackRejectsInvalidState(t *testing.T) {
+	idp := newFakeIdentityProvider(t)
+	idp.claims = jwt.MapClaims{"email": "alice@example.com", "email_verified": true}
+	e, _ := newOidcTestServer(t, idp, OidcConfig{AuthorizedEmails: []string{"alice@example.com"}})
+
+	req := httptest.NewRequest(http.MethodGet, "/user/session/oauth2/callback?code=the-code&state=forged", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/user/session/oauth2/sign_in?rd=https://evil.example.com", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusFound, rec.Code)
+	loginCookie := rec.Result().Cookies()[0]
+	req = httptest.NewRequest(http.MethodGet, "/user/session/oauth2/callback?code=the-code&state=forged", nil)
+	req.AddCookie(loginCookie)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestOidcSafeRedirect(t *testing.T) {
+	authenticator, err := NewOidcAuthenticator(OidcConfig{
+		IssuerURL:    "https://idp.example.com",
+		ClientID:     "the-client",
+		RedirectURL:  "https://session.example.com/user/session/oauth2/callback",
+		CookieSecret: "a-very-secret-cookie-secret",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "/user/session/lab", authenticator.safeRedirect("/user/session/lab"))
+	assert.Equal(t, "/user/session/", authenticator.safeRedirect("https://evil.example.com/user/session/"))
+	assert.Equal(t, "/user/session/", authenticator.safeRedirect("//evil.example.com"))
+	assert.Equal(t, "/user/session/", authenticator.safeRedirect("/other/session"))
+	assert.Equal(t, "/user/session/", authenticator.safeRedirect("/\t/evil.example"))
+	assert.Equal(t, "/user/session/", authenticator.safeRedirect("/user/session/\n/evil.example"))
+	assert.Equal(t, "/user/session/", authenticator.safeRedirect("/\\evil.example"))
+	assert.Equal(t, "/user/session/", authenticator.safeRedirect("https:/user/session/"))
+	assert.Equal(t, "/user/session/lab?reset", authenticator.safeRedirect("/user/session/lab?reset"))
+}
+
+func TestOidcRecheck(t *testing.T) {
+	idp := newFakeIdentityProvider(t)
+	idp.claims = jwt.MapClaims{"email": "bob@example.com", "email_verified": true, "groups": []any{"admins"}}
+	e, authenticator := newOidcTestServer(t, idp, OidcConfig{AllowedGroups: []string{"admins"}, RecheckInterval: 10 * time.Minute})
+	rec := login(t, e, idp)
+	require.Equal(t, http.StatusFound, rec.Code)
+	sessionCookie := func(rec *httptest.ResponseRecorder) *http.Cookie {
+		for _, cookie := range rec.Result().Cookies() {
+			if cookie.Name == "_amalthea_oidc" {
+				return cookie
+			}
+		}
+		return nil
+	}
+	cookie := sessionCookie(rec)
+	require.NotNil(t, cookie)
+	request := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/user/session/api/kernels", nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	start := time.Now()
+	at := func(d time.Duration) func() time.Time {
+		return func() time.Time { return start.Add(d) }
+	}
+
+	// The session is extended when the user is still allowed
+	authenticator.now = at(15 * time.Minute)
+	rec = request(cookie)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	cookie = sessionCookie(rec)
+	require.NotNil(t, cookie)
+
+	// The session is kept when the identity provider is not available
+	authenticator.now = at(30 * time.Minute)
+	idp.refreshStatus = http.StatusServiceUnavailable
+	rec = request(cookie)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	cookie = sessionCookie(rec)
+	require.NotNil(t, cookie)
+
+	// The session ends when the user is removed from the allowed groups
+	authenticator.now = at(35 * time.Minute)
+	idp.refreshStatus = 0
+	idp.claims["groups"] = []any{"users"}
+	rec = request(cookie)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.NotNil(t, sessionCookie(rec))
+	assert.Equal(t, -1, sessionCookie(rec).MaxAge)
+
+	// The session ends when the identity provider rejects the refresh token
+	idp.claims["groups"] = []any{"admins"}
+	idp.refreshStatus = http.StatusBadRequest
+	rec = request(cookie)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authproxy
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Role defines what a principal is allowed to do in the session
+type Role string
+
+const (
+	// Owners have full access to the session
+	RoleOwner Role = "owner"
+	// Editors have full access to the session, but they are not the owner of the session
+	RoleEditor Role = "editor"
+	// Viewers can only use safe HTTP methods without websockets, except on the paths from the viewer allowlist
+	RoleViewer Role = "viewer"
+)
+
+// The id of the principal created from the single token configuration option
+const defaultPrincipalID = "owner"
+
+// The key in the echo context where the authenticated principal is stored
+const principalContextKey = "authproxy.principal"
+
+// Principal is a user or a client that can access the session with a token
+type Principal struct {
+	ID string `mapstructure:"id"`
+	// The token of the principal, either in plain text or as a bcrypt or argon2 hash
+	Token string `mapstructure:"token"`
+	// Additional tokens for the principal, several tokens can be valid at the same
+	// time so that a token can be rotated without downtime
+	Tokens []TokenConfig `mapstructure:"tokens"`
+	Role   Role          `mapstructure:"role"`
+}
+
+func (p Principal) validate() error {
+	if p.ID == "" {
+		return fmt.Errorf("a principal must have an id")
+	}
+	if p.Token == "" && len(p.Tokens) == 0 {
+		return fmt.Errorf("the principal %s must have a token", p.ID)
+	}
+	for _, token := range p.Tokens {
+		if token.Value == "" {
+			return fmt.Errorf("the principal %s has an empty token", p.ID)
+		}
+	}
+	switch p.Role {
+	case RoleOwner, RoleEditor, RoleViewer:
+		return nil
+	default:
+		return fmt.Errorf("the principal %s has an invalid role %q", p.ID, p.Role)
+	}
+}
+
+func (p Principal) credentials() ([]credential, error) {
+	tokens := p.Tokens
+	if p.Token != "" {
+		tokens = append([]TokenConfig{{Value: p.Token}}, tokens...)
+	}
+	output := make([]credential, 0, len(tokens))
+	for _, token := range tokens {
+		cred, err := newCredential(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token for the principal %s: %w", p.ID, err)
+		}
+		output = append(output, cred)
+	}
+	return output, nil
+}
+
+type principalCredential struct {
+	principal int
+	credential
+}
+
+// Principals holds the principals that can access the session, it is safe for concurrent use
+// and it can be updated while the proxy is running.
+type Principals struct {
+	principals         []Principal
+	credentials        []principalCredential
+	viewerAllowedPaths []string
+	// Checking a hashed token is slow on purpose, the tokens that have already been
+	// verified are cached by their digest until the principals are updated.
+	verified map[[sha256.Size]byte]principalCredential
+	// Incremented on every update
+	generation uint64
+	now        func() time.Time
+	mutex      sync.RWMutex
+}
+
+// Update validates and replaces the principals and the viewer path allowlist.
+// If the validation fails the current principals are kept.
+func (p *Principals) Update(principals []Principal, viewerAllowedPaths []string) error {
+	ids := map[string]bool{}
+	credentials := []principalCredential{}
+	for i, principal := range principals {
+		if err := principal.validate(); err != nil {
+			return err
+		}
+		if ids[principal.ID] {
+			return fmt.Errorf("the principal id %s is not unique", principal.ID)
+		}
+		ids[principal.ID] = true
+		creds, err := principal.credentials()
+		if err != nil {
+			return err
+		}
+		for _, cred := range creds {
+			credentials = append(credentials, principalCredential{principal: i, credential: cred})
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.principals = principals
+	p.credentials = credentials
+	p.viewerAllowedPaths = viewerAllowedPaths
+	p.verified = map[[sha256.Size]byte]principalCredential{}
+	p.generation++
+	return nil
+}
+
+// Len returns the number of principals
+func (p *Principals) Len() int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return len(p.principals)
+}
+
+// Lookup returns the principal with the given token, expired tokens are not accepted.
+// The tokens which were already verified are found by their digest in the cache, otherwise all the
+// tokens are checked so that the time it takes does not depend on which token matches. The hashed
+// tokens are verified without holding the lock, the number of concurrent verifications is limited.
+func (p *Principals) Lookup(token string) (Principal, bool) {
+	now := time.Now()
+	if p.now != nil {
+		now = p.now()
+	}
+	digest := sha256.Sum256([]byte(token))
+	p.mutex.RLock()
+	cached, isCached := p.verified[digest]
+	if isCached {
+		defer p.mutex.RUnlock()
+		if cached.expired(now) {
+			return Principal{}, false
+		}
+		return p.principals[cached.principal], true
+	}
+	// NOTE: The principals and the credentials are replaced and never modified on updates
+	principals := p.principals
+	credentials := p.credentials
+	generation := p.generation
+	p.mutex.RUnlock()
+
+	found := -1
+	for i, cred := range credentials {
+		if cred.verifier.Verify(token) && !cred.expired(now) && found < 0 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return Principal{}, false
+	}
+	match := credentials[found]
+	principal := principals[match.principal]
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// NOTE: The principals may have been updated while the lock was released
+	if p.generation == generation {
+		p.verified[digest] = match
+	}
+	return principal, true
+}
+
+// Validator can be used as the validator for the echo key authentication middleware,
+// the matching principal is stored in the echo context.
+func (p *Principals) Validator(key string, c echo.Context) (bool, error) {
+	principal, ok := p.Lookup(key)
+	if !ok {
+		return false, nil
+	}
+	c.Set(principalContextKey, principal)
+	return true, nil
+}
+
+// pathHasPrefix tells whether a cleaned path is the prefix path or one of its descendants,
+// the whole segments of the paths are compared.
+func pathHasPrefix(urlPath string, prefix string) bool {
+	prefix = path.Clean("/" + prefix)
+	if prefix == "/" || urlPath == prefix {
+		return true
+	}
+	return strings.HasPrefix(urlPath, prefix+"/")
+}
+
+// viewerAllowed tells whether a viewer can send a request. The requests with an upgrade, e.g. websockets, are
+// not safe even though they use the GET method, e.g. the kernel channels of Jupyter run arbitrary code.
+// The paths are matched after the path prefix of the session was stripped.
+func (p *Principals) viewerAllowed(r *http.Request) bool {
+	upgrade := r.Header.Get(echo.HeaderUpgrade) != ""
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		if !upgrade {
+			return true
+		}
+	}
+	urlPath := path.Clean("/" + r.URL.Path)
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, allowed := range p.viewerAllowedPaths {
+		if pathHasPrefix(urlPath, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize is a middleware that enforces the role of the principal authenticated by the Validator
+func (p *Principals) Authorize(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		principal, ok := c.Get(principalContextKey).(Principal)
+		if !ok {
+			return echo.NewHTTPError(http.StatusUnauthorized)
+		}
+		if principal.Role == RoleViewer && !p.viewerAllowed(c.Request()) {
+			return echo.NewHTTPError(http.StatusForbidden, "viewers cannot modify the session")
+		}
+		return next(c)
+	}
+}
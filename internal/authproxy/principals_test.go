@@ -0,0 +1,129 @@
+package authproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrincipalsUpdate(t *testing.T) {
+	principals := &Principals{}
+	err := principals.Update([]Principal{
+		{ID: "alice", Token: "alice-token", Role: RoleOwner},
+		{ID: "bob", Token: "bob-token", Role: RoleViewer},
+	}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, principals.Len())
+
+	invalid := [][]Principal{
+		{{ID: "", Token: "token", Role: RoleOwner}},
+		{{ID: "alice", Token: "", Role: RoleOwner}},
+		{{ID: "alice", Token: "token", Role: "admin"}},
+		{{ID: "alice", Token: "token-1", Role: RoleOwner}, {ID: "alice", Token: "token-2", Role: RoleEditor}},
+	}
+	for _, list := range invalid {
+		assert.Error(t, principals.Update(list, nil))
+	}
+	// The previous principals are kept when the update is not valid
+	principal, ok := principals.Lookup("bob-token")
+	assert.True(t, ok)
+	assert.Equal(t, "bob", principal.ID)
+	_, ok = principals.Lookup("unknown")
+	assert.False(t, ok)
+}
+
+func TestPrincipalsAuthorize(t *testing.T) {
+	principals := &Principals{}
+	err := principals.Update([]Principal{
+		{ID: "alice", Token: "alice-token", Role: RoleOwner},
+		{ID: "carol", Token: "carol-token", Role: RoleEditor},
+		{ID: "bob", Token: "bob-token", Role: RoleViewer},
+	}, []string{"/api/kernels"})
+	require.NoError(t, err)
+
+	handler := principals.Authorize(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	cases := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		status int
+	}{
+		{"owner write", "alice-token", http.MethodPost, "/api/contents", http.StatusOK},
+		{"editor write", "carol-token", http.MethodDelete, "/api/contents/file.txt", http.StatusOK},
+		{"viewer read", "bob-token", http.MethodGet, "/api/contents", http.StatusOK},
+		{"viewer write", "bob-token", http.MethodPut, "/api/contents/file.txt", http.StatusForbidden},
+		{"viewer allowed path", "bob-token", http.MethodPost, "/api/kernels/1234/interrupt", http.StatusOK},
+		{"viewer allowed path only", "bob-token", http.MethodPost, "/api/kernels", http.StatusOK},
+		{"viewer partial segment", "bob-token", http.MethodPost, "/api/kernels-x/1234", http.StatusForbidden},
+		{"viewer parent segments", "bob-token", http.MethodPost, "/api/kernels/../contents/file.txt", http.StatusForbidden},
+		{"viewer websocket", "bob-token", http.MethodGet, "/api/terminals/websocket/1", http.StatusForbidden},
+		{"viewer allowed websocket", "bob-token", http.MethodGet, "/api/kernels/1234/channels", http.StatusOK},
+		{"editor websocket", "carol-token", http.MethodGet, "/api/terminals/websocket/1", http.StatusOK},
+		{"not authenticated", "", http.MethodGet, "/", http.StatusUnauthorized},
+	}
+	e := echo.New()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if strings.Contains(tc.path, "websocket") || strings.HasSuffix(tc.path, "/channels") {
+				req.Header.Set(echo.HeaderUpgrade, "websocket")
+				req.Header.Set(echo.HeaderConnection, "Upgrade")
+			}
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			if tc.token != "" {
+				ok, err := principals.Validator(tc.token, c)
+				require.NoError(t, err)
+				require.True(t, ok)
+			}
+			err := handler(c)
+			if tc.status == http.StatusOK {
+				assert.NoError(t, err)
+				return
+			}
+			var httpErr *echo.HTTPError
+			require.ErrorAs(t, err, &httpErr)
+			assert.Equal(t, tc.status, httpErr.Code)
+		})
+	}
+}
+
+func TestLoadPrincipals(t *testing.T) {
+	defer viper.Reset()
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, []byte(`authproxy:
+  token: owner-token
+  principals:
+    - id: bob
+      token: bob-token
+      role: viewer
+  viewer_allowed_paths:
+    - /api/kernels
+`), 0o600)
+	require.NoError(t, err)
+	viper.SetConfigType("yaml")
+	viper.SetConfigFile(configFile)
+	require.NoError(t, viper.ReadInConfig())
+
+	principals := &Principals{}
+	require.NoError(t, loadPrincipals(principals))
+	assert.Equal(t, 2, principals.Len())
+	owner, ok := principals.Lookup("owner-token")
+	assert.True(t, ok)
+	assert.Equal(t, Principal{ID: defaultPrincipalID, Token: "owner-token", Role: RoleOwner}, owner)
+	viewer, ok := principals.Lookup("bob-token")
+	assert.True(t, ok)
+	assert.Equal(t, RoleViewer, viewer.Role)
+	assert.Equal(t, []string{"/api/kernels"}, principals.viewerAllowedPaths)
+}
@@ -18,7 +18,11 @@ package authproxy
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/labstack/echo/v4"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -50,3 +54,40 @@ func loadConfig(cmd *cobra.Command, args []string) error {
 	})
 	return nil
 }
+
+// loadPrincipals reads the principals from the configuration, the single token and the list
+// of tokens options are added as a principal with the owner role. The format of every token
+// is detected automatically, it can be in plain text or a bcrypt or argon2 hash.
+func loadPrincipals(principals *Principals) error {
+	decodeHook := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeHookFunc(time.RFC3339),
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	))
+	list := []Principal{}
+	if err := viper.UnmarshalKey(prefix+"."+principalsKey, &list, decodeHook); err != nil {
+		return err
+	}
+	owner := Principal{ID: defaultPrincipalID, Token: viper.GetString(prefix + "." + tokenFlag), Role: RoleOwner}
+	if err := viper.UnmarshalKey(prefix+"."+tokensKey, &owner.Tokens, decodeHook); err != nil {
+		return err
+	}
+	if owner.Token != "" || len(owner.Tokens) > 0 {
+		list = append(list, owner)
+	}
+	return principals.Update(list, viper.GetStringSlice(prefix+"."+viewerAllowedPathsKey))
+}
+
+// watchPrincipals reloads the principals when the config file changes. This also works
+// with Kubernetes secrets mounted as volumes, which are updated by swapping symlinks.
+func watchPrincipals(principals *Principals, logger echo.Logger) {
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		err := loadPrincipals(principals)
+		if err != nil {
+			logger.Errorf("could not reload the principals from %s, keeping the previous ones: %v", e.Name, err)
+			return
+		}
+		logger.Infof("Reloaded %d principals from %s", principals.Len(), e.Name)
+	})
+	viper.WatchConfig()
+}
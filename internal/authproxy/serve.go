@@ -23,7 +23,6 @@ import (
 	"net/url"
 	"os/signal"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/SwissDataScienceCenter/amalthea/internal/common"
@@ -46,6 +45,60 @@ const cookieKeyFlag = "cookie_key"
 const verboseFlag = "verbose"
 const configFlag = "config"
 const stripPathPrefixFlag = "strip_path_prefix"
+const requiredClaimsFlag = "required_claims"
+const maxAuthFailuresFlag = "max_auth_failures"
+const authFailureWindowFlag = "auth_failure_window"
+const authLockoutFlag = "auth_lockout"
+const logAuthFailuresFlag = "log_auth_failures"
+const backgroundPathsFlag = "background_paths"
+const oidcIssuerURLFlag = "oidc_issuer_url"
+const oidcClientIDFlag = "oidc_client_id"
+const oidcClientSecretFlag = "oidc_client_secret"
+const oidcRedirectURLFlag = "oidc_redirect_url"
+const oidcScopesFlag = "oidc_scopes"
+const oidcCookieNameFlag = "oidc_cookie_name"
+const oidcCookieSecretFlag = "oidc_cookie_secret"
+const oidcCookieSameSiteFlag = "oidc_cookie_samesite"
+const oidcSessionLifetimeFlag = "oidc_session_lifetime"
+const oidcRecheckIntervalFlag = "oidc_recheck_interval"
+const oidcAuthorizedEmailsFlag = "oidc_authorized_emails"
+const oidcAllowUnverifiedEmailsFlag = "oidc_allow_unverified_emails"
+const oidcGroupsClaimFlag = "oidc_groups_claim"
+const oidcAllowedGroupsFlag = "oidc_allowed_groups"
+const websocketMaxConnectionsFlag = "websocket_max_connections"
+const websocketIdleTimeoutFlag = "websocket_idle_timeout"
+const websocketWriteTimeoutFlag = "websocket_write_timeout"
+const websocketPingIntervalFlag = "websocket_ping_interval"
+const websocketDrainTimeoutFlag = "websocket_drain_timeout"
+const auditLogFlag = "audit_log"
+const auditSampleRateFlag = "audit_sample_rate"
+const auditBackgroundSampleRateFlag = "audit_background_sample_rate"
+const auditPrincipalHeaderFlag = "audit_principal_header"
+
+// Options that can only be set in the config file, under the authproxy key:
+//
+//	authproxy:
+//	  tokens:
+//	    - value: $2y$10$hyaB8Rvuao8dPtx0gbXn1eqSVD2lK6ZA9vf8j9WXovVCSbwUP5Fu2
+//	      expires_at: 2026-12-31T00:00:00Z
+//	  principals:
+//	    - id: alice
+//	      token: some-very-complicated-random-value
+//	      role: owner
+//	    - id: bob
+//	      tokens:
+//	        - value: $argon2id$v=19$m=4096,t=3,p=1$c2FsdHNhbHQ$uAXOxtlWYAKrXsz/W7i8mg
+//	      role: viewer
+//	  viewer_allowed_paths:
+//	    - /api/kernels
+//
+// All tokens can be in plain text or a bcrypt or argon2 hash, the argon2 hashes can use at most
+// m=4096 (4 MiB), t=10 and p=4 to fit in the memory of the proxy. The tokens and the principals
+// are reloaded when the config file changes. The viewer allowed paths are matched by whole
+// segments against the path of the request once the strip_path_prefix is removed.
+const tokensKey = "tokens"
+const principalsKey = "principals"
+const viewerAllowedPathsKey = "viewer_allowed_paths"
 
 var remote string
 var port int
@@ -55,6 +108,35 @@ var cookieKey string
 var verbose bool
 var config string
 var stripPathPrefix string
+var requiredClaims string
+var maxAuthFailures int
+var authFailureWindow time.Duration
+var authLockout time.Duration
+var logAuthFailures bool
+var backgroundPaths []string
+var oidcIssuerURL string
+var oidcClientID string
+var oidcClientSecret string
+var oidcRedirectURL string
+var oidcScopes []string
+var oidcCookieName string
+var oidcCookieSecret string
+var oidcCookieSameSite string
+var oidcSessionLifetime time.Duration
+var oidcRecheckInterval time.Duration
+var oidcAuthorizedEmails string
+var oidcAllowUnverifiedEmails bool
+var oidcGroupsClaim string
+var oidcAllowedGroups []string
+var websocketMaxConnections int
+var websocketIdleTimeout time.Duration
+var websocketWriteTimeout time.Duration
+var websocketPingInterval time.Duration
+var websocketDrainTimeout time.Duration
+var auditLog string
+var auditSampleRate float64
+var auditBackgroundSampleRate float64
+var auditPrincipalHeader string
 
 const prefix = "authproxy"
 
@@ -119,7 +201,7 @@ func Command() (*cobra.Command, error) {
 		return nil, err
 	}
 
-	serveCmd.PersistentFlags().StringVar(&token, tokenFlag, "", "secret token for authentication, if not defined or left blank then there will be no authentication.")
+	serveCmd.PersistentFlags().StringVar(&token, tokenFlag, "", "secret token for authentication, either in plain text or as a bcrypt or argon2 hash, if no token is defined then there will be no authentication.")
 	err = viper.BindPFlag(prefix+"."+tokenFlag, serveCmd.PersistentFlags().Lookup(tokenFlag))
 	if err != nil {
 		return nil, err
@@ -129,6 +211,296 @@ func Command() (*cobra.Command, error) {
 		return nil, err
 	}
 
+	serveCmd.PersistentFlags().StringVar(&requiredClaims, requiredClaimsFlag, "", "JSON list of claims that the ID token passed by oauth2-proxy has to match, e.g. [{\"claim\": \"roles\", \"values\": [\"admin\"]}]")
+	err = viper.BindPFlag(prefix+"."+requiredClaimsFlag, serveCmd.PersistentFlags().Lookup(requiredClaimsFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+requiredClaimsFlag, strings.ToUpper(prefix+"_"+requiredClaimsFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().IntVar(&maxAuthFailures, maxAuthFailuresFlag, 10, "number of failed authentication attempts after which a client IP is locked out, 0 disables the lockout")
+	err = viper.BindPFlag(prefix+"."+maxAuthFailuresFlag, serveCmd.PersistentFlags().Lookup(maxAuthFailuresFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+maxAuthFailuresFlag, strings.ToUpper(prefix+"_"+maxAuthFailuresFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().DurationVar(&authFailureWindow, authFailureWindowFlag, time.Minute, "time window in which the failed authentication attempts of a client are counted")
+	err = viper.BindPFlag(prefix+"."+authFailureWindowFlag, serveCmd.PersistentFlags().Lookup(authFailureWindowFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+authFailureWindowFlag, strings.ToUpper(prefix+"_"+authFailureWindowFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().DurationVar(&authLockout, authLockoutFlag, 5*time.Minute, "how long a client IP is locked out after too many failed authentication attempts")
+	err = viper.BindPFlag(prefix+"."+authLockoutFlag, serveCmd.PersistentFlags().Lookup(authLockoutFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+authLockoutFlag, strings.ToUpper(prefix+"_"+authLockoutFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().BoolVar(&logAuthFailures, logAuthFailuresFlag, false, "write an audit log line for every failed authentication attempt")
+	err = viper.BindPFlag(prefix+"."+logAuthFailuresFlag, serveCmd.PersistentFlags().Lookup(logAuthFailuresFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+logAuthFailuresFlag, strings.ToUpper(prefix+"_"+logAuthFailuresFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringSliceVar(&backgroundPaths, backgroundPathsFlag, DefaultBackgroundPaths, "comma separated regular expressions for the paths of the polling and keepalive requests that do not count as an interaction with the session")
+	err = viper.BindPFlag(prefix+"."+backgroundPathsFlag, serveCmd.PersistentFlags().Lookup(backgroundPathsFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+backgroundPathsFlag, strings.ToUpper(prefix+"_"+backgroundPathsFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringVar(&oidcIssuerURL, oidcIssuerURLFlag, "", "issuer URL of the identity provider, setting it enables the built-in OIDC login instead of the token authentication")
+	err = viper.BindPFlag(prefix+"."+oidcIssuerURLFlag, serveCmd.PersistentFlags().Lookup(oidcIssuerURLFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+oidcIssuerURLFlag, strings.ToUpper(prefix+"_"+oidcIssuerURLFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringVar(&oidcClientID, oidcClientIDFlag, "", "OIDC client ID")
+	err = viper.BindPFlag(prefix+"."+oidcClientIDFlag, serveCmd.PersistentFlags().Lookup(oidcClientIDFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+oidcClientIDFlag, strings.ToUpper(prefix+"_"+oidcClientIDFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringVar(&oidcClientSecret, oidcClientSecretFlag, "", "OIDC client secret")
+	err = viper.BindPFlag(prefix+"."+oidcClientSecretFlag, serveCmd.PersistentFlags().Lookup(oidcClientSecretFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+oidcClientSecretFlag, strings.ToUpper(prefix+"_"+oidcClientSecretFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringVar(&oidcRedirectURL, oidcRedirectURLFlag, "", "OIDC callback URL, the sign_in and sign_out endpoints are served next to it and the cookies are limited to its parent path")
+	err = viper.BindPFlag(prefix+"."+oidcRedirectURLFlag, serveCmd.PersistentFlags().Lookup(oidcRedirectURLFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+oidcRedirectURLFlag, strings.ToUpper(prefix+"_"+oidcRedirectURLFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringSliceVar(&oidcScopes, oidcScopesFlag, []string{"openid", "email", "profile"}, "scopes requested from the identity provider")
+	err = viper.BindPFlag(prefix+"."+oidcScopesFlag, serveCmd.PersistentFlags().Lookup(oidcScopesFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+oidcScopesFlag, strings.ToUpper(prefix+"_"+oidcScopesFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringVar(&oidcCookieName, oidcCookieNameFlag, "_amalthea_oidc", "name of the cookie where the OIDC session is stored")
+	err = viper.BindPFlag(prefix+"."+oidcCookieNameFlag, serveCmd.PersistentFlags().Lookup(oidcCookieNameFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+oidcCookieNameFlag, strings.ToUpper(prefix+"_"+oidcCookieNameFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringVar(&oidcCookieSecret, oidcCookieSecretFlag, "", "secret used to encrypt the OIDC session cookie, at least 16 bytes long")
+	err = viper.BindPFlag(prefix+"."+oidcCookieSecretFlag, serveCmd.PersistentFlags().Lookup(oidcCookieSecretFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+oidcCookieSecretFlag, strings.ToUpper(prefix+"_"+oidcCookieSecretFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringVar(&oidcCookieSameSite, oidcCookieSameSiteFlag, "strict", "same site policy of the OIDC session cookie, one of strict, lax or none")
+	err = viper.BindPFlag(prefix+"."+oidcCookieSameSiteFlag, serveCmd.PersistentFlags().Lookup(oidcCookieSameSiteFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+oidcCookieSameSiteFlag, strings.ToUpper(prefix+"_"+oidcCookieSameSiteFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().DurationVar(&oidcSessionLifetime, oidcSessionLifetimeFlag, 7*24*time.Hour, "how long a user stays logged in with OIDC")
+	err = viper.BindPFlag(prefix+"."+oidcSessionLifetimeFlag, serveCmd.PersistentFlags().Lookup(oidcSessionLifetimeFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+oidcSessionLifetimeFlag, strings.ToUpper(prefix+"_"+oidcSessionLifetimeFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().DurationVar(&oidcRecheckInterval, oidcRecheckIntervalFlag, 15*time.Minute, "how often the emails, groups and claims of a user logged in with OIDC are checked again by refreshing the ID token")
+	err = viper.BindPFlag(prefix+"."+oidcRecheckIntervalFlag, serveCmd.PersistentFlags().Lookup(oidcRecheckIntervalFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+oidcRecheckIntervalFlag, strings.ToUpper(prefix+"_"+oidcRecheckIntervalFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringVar(&oidcAuthorizedEmails, oidcAuthorizedEmailsFlag, "", "newline or comma delimited list of the emails of the users that can access the session, ignored when allowed groups or required claims are set")
+	err = viper.BindPFlag(prefix+"."+oidcAuthorizedEmailsFlag, serveCmd.PersistentFlags().Lookup(oidcAuthorizedEmailsFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+oidcAuthorizedEmailsFlag, strings.ToUpper(prefix+"_"+oidcAuthorizedEmailsFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().BoolVar(&oidcAllowUnverifiedEmails, oidcAllowUnverifiedEmailsFlag, false, "allow users with unverified emails to log in with OIDC")
+	err = viper.BindPFlag(prefix+"."+oidcAllowUnverifiedEmailsFlag, serveCmd.PersistentFlags().Lookup(oidcAllowUnverifiedEmailsFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+oidcAllowUnverifiedEmailsFlag, strings.ToUpper(prefix+"_"+oidcAllowUnverifiedEmailsFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringVar(&oidcGroupsClaim, oidcGroupsClaimFlag, "groups", "claim of the ID token with the groups of the user, nested claims are separated by dots")
+	err = viper.BindPFlag(prefix+"."+oidcGroupsClaimFlag, serveCmd.PersistentFlags().Lookup(oidcGroupsClaimFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+oidcGroupsClaimFlag, strings.ToUpper(prefix+"_"+oidcGroupsClaimFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringSliceVar(&oidcAllowedGroups, oidcAllowedGroupsFlag, nil, "groups whose members can access the session")
+	err = viper.BindPFlag(prefix+"."+oidcAllowedGroupsFlag, serveCmd.PersistentFlags().Lookup(oidcAllowedGroupsFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+oidcAllowedGroupsFlag, strings.ToUpper(prefix+"_"+oidcAllowedGroupsFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().IntVar(&websocketMaxConnections, websocketMaxConnectionsFlag, 0, "maximum number of websocket connections that can be open at the same time, 0 means no limit")
+	err = viper.BindPFlag(prefix+"."+websocketMaxConnectionsFlag, serveCmd.PersistentFlags().Lookup(websocketMaxConnectionsFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+websocketMaxConnectionsFlag, strings.ToUpper(prefix+"_"+websocketMaxConnectionsFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().DurationVar(&websocketIdleTimeout, websocketIdleTimeoutFlag, 5*time.Minute, "close websocket connections where the client has not sent anything for this long, 0 disables the timeout")
+	err = viper.BindPFlag(prefix+"."+websocketIdleTimeoutFlag, serveCmd.PersistentFlags().Lookup(websocketIdleTimeoutFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+websocketIdleTimeoutFlag, strings.ToUpper(prefix+"_"+websocketIdleTimeoutFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().DurationVar(&websocketWriteTimeout, websocketWriteTimeoutFlag, 30*time.Second, "maximum time a write on a websocket connection can take, 0 disables the timeout")
+	err = viper.BindPFlag(prefix+"."+websocketWriteTimeoutFlag, serveCmd.PersistentFlags().Lookup(websocketWriteTimeoutFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+websocketWriteTimeoutFlag, strings.ToUpper(prefix+"_"+websocketWriteTimeoutFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().DurationVar(&websocketPingInterval, websocketPingIntervalFlag, 30*time.Second, "how often the clients of websocket connections are pinged to keep the connections alive, 0 disables the pings")
+	err = viper.BindPFlag(prefix+"."+websocketPingIntervalFlag, serveCmd.PersistentFlags().Lookup(websocketPingIntervalFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+websocketPingIntervalFlag, strings.ToUpper(prefix+"_"+websocketPingIntervalFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().DurationVar(&websocketDrainTimeout, websocketDrainTimeoutFlag, 5*time.Second, "how long the clients have to close their websocket connections when the proxy shuts down")
+	err = viper.BindPFlag(prefix+"."+websocketDrainTimeoutFlag, serveCmd.PersistentFlags().Lookup(websocketDrainTimeoutFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+websocketDrainTimeoutFlag, strings.ToUpper(prefix+"_"+websocketDrainTimeoutFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringVar(&auditLog, auditLogFlag, "", "where to write the audit records of the requests, either stdout or the path of a file, the audit log is disabled when empty")
+	err = viper.BindPFlag(prefix+"."+auditLogFlag, serveCmd.PersistentFlags().Lookup(auditLogFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+auditLogFlag, strings.ToUpper(prefix+"_"+auditLogFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().Float64Var(&auditSampleRate, auditSampleRateFlag, 1, "fraction of the requests that are written to the audit log, the rejected requests are always written")
+	err = viper.BindPFlag(prefix+"."+auditSampleRateFlag, serveCmd.PersistentFlags().Lookup(auditSampleRateFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+auditSampleRateFlag, strings.ToUpper(prefix+"_"+auditSampleRateFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().Float64Var(&auditBackgroundSampleRate, auditBackgroundSampleRateFlag, 1, "fraction of the polling and keepalive requests that are written to the audit log")
+	err = viper.BindPFlag(prefix+"."+auditBackgroundSampleRateFlag, serveCmd.PersistentFlags().Lookup(auditBackgroundSampleRateFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+auditBackgroundSampleRateFlag, strings.ToUpper(prefix+"_"+auditBackgroundSampleRateFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringVar(&auditPrincipalHeader, auditPrincipalHeaderFlag, "", "header with the identity of the user set by an authenticating proxy in front of the authproxy, e.g. X-Forwarded-Email for oauth2-proxy")
+	err = viper.BindPFlag(prefix+"."+auditPrincipalHeaderFlag, serveCmd.PersistentFlags().Lookup(auditPrincipalHeaderFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(prefix+"."+auditPrincipalHeaderFlag, strings.ToUpper(prefix+"_"+auditPrincipalHeaderFlag))
+	if err != nil {
+		return nil, err
+	}
+
 	serveCmd.PersistentFlags().BoolVar(&verbose, verboseFlag, false, "make the proxy verbose")
 	err = viper.BindPFlag(prefix+"."+verboseFlag, serveCmd.PersistentFlags().Lookup(verboseFlag))
 	if err != nil {
@@ -144,42 +516,48 @@ func Command() (*cobra.Command, error) {
 	return serveCmd, nil
 }
 
-type RequestStats struct {
-	LastRequest time.Time
-	mutex       sync.RWMutex
-}
-
-func NewStats() *RequestStats {
-	return &RequestStats{
-		LastRequest: time.Now(),
+// oidcConfigFromFlags builds the configuration of the built-in OIDC login from the options
+func oidcConfigFromFlags(requirements []ClaimRequirement) (OidcConfig, error) {
+	var sameSite http.SameSite
+	switch strings.ToLower(oidcCookieSameSite) {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "lax":
+		sameSite = http.SameSiteLaxMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	default:
+		return OidcConfig{}, fmt.Errorf("invalid cookie same site policy %q, expected strict, lax or none", oidcCookieSameSite)
 	}
-}
-
-type RequestStatsResponse struct {
-	LastRequestTime time.Time `json:"last_request_time"`
-}
-
-func (l *RequestStats) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-
-		if err := next(c); err != nil {
-			c.Error(err)
+	authorizedEmails := []string{}
+	for _, email := range strings.FieldsFunc(oidcAuthorizedEmails, func(r rune) bool { return r == '\n' || r == ',' }) {
+		if email = strings.TrimSpace(email); email != "" {
+			authorizedEmails = append(authorizedEmails, email)
 		}
-		l.mutex.Lock()
-		defer l.mutex.Unlock()
-		l.LastRequest = time.Now()
-		return nil
 	}
-}
-func (l *RequestStats) Handle(c echo.Context) error {
-	l.mutex.RLock()
-	defer l.mutex.RUnlock()
-	return c.JSON(http.StatusOK, RequestStatsResponse{LastRequestTime: l.LastRequest})
+	return OidcConfig{
+		IssuerURL:             oidcIssuerURL,
+		ClientID:              oidcClientID,
+		ClientSecret:          oidcClientSecret,
+		RedirectURL:           oidcRedirectURL,
+		Scopes:                oidcScopes,
+		CookieName:            oidcCookieName,
+		CookieSecret:          oidcCookieSecret,
+		CookieSameSite:        sameSite,
+		SessionLifetime:       oidcSessionLifetime,
+		RecheckInterval:       oidcRecheckInterval,
+		AuthorizedEmails:      authorizedEmails,
+		AllowUnverifiedEmails: oidcAllowUnverifiedEmails,
+		GroupsClaim:           oidcGroupsClaim,
+		AllowedGroups:         oidcAllowedGroups,
+		RequiredClaims:        requirements,
+	}, nil
 }
 
 func serve(cmd *cobra.Command, args []string) {
 
 	e := echo.New()
+	e.Server.ConnState = trackConnections
 
 	e.Use(middleware.Recover())
 	e.Logger.SetLevel(log.INFO)
@@ -187,22 +565,83 @@ func serve(cmd *cobra.Command, args []string) {
 		e.Logger.SetLevel(log.DEBUG)
 	}
 
-	rs := NewStats()
-	proxyMWs := []echo.MiddlewareFunc{middleware.RequestLogger(), rs.Process}
+	// NOTE: The session is reached through the ingress, the client IP is taken from the
+	// X-Forwarded-For header while skipping the addresses of the trusted internal proxies.
+	e.IPExtractor = echo.ExtractIPFromXFFHeader()
 
-	if len(token) > 0 {
+	rs, err := NewStats(backgroundPaths)
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	proxyMWs := []echo.MiddlewareFunc{middleware.RequestLogger()}
+	if auditLog != "" {
+		writer, err := openAuditLog(auditLog)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		audit, err := NewAuditLog(writer, AuditConfig{
+			SampleRate:           auditSampleRate,
+			BackgroundSampleRate: auditBackgroundSampleRate,
+			PrincipalHeader:      auditPrincipalHeader,
+		})
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		e.Logger.Infof("Writing the audit log to %s", auditLog)
+		proxyMWs = append(proxyMWs, audit.Process)
+	}
+	proxyMWs = append(proxyMWs, rs.Process)
+
+	requirements := []ClaimRequirement{}
+	if len(requiredClaims) > 0 {
+		requirements, err = parseClaimRequirements(requiredClaims)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		e.Logger.Infof("Requiring the claims %+v", requirements)
+	}
+
+	// NOTE: The roles are enforced after the path rewrite, so that the viewer allowed paths do not
+	// depend on the path prefix of the session
+	var authorizeMW echo.MiddlewareFunc
+	limiter := NewAuthFailureLimiter(maxAuthFailures, authFailureWindow, authLockout, logAuthFailures)
+	principals := &Principals{}
+	if err := loadPrincipals(principals); err != nil {
+		e.Logger.Fatal(err)
+	}
+	switch {
+	case oidcIssuerURL != "":
+		oidcConfig, err := oidcConfigFromFlags(requirements)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		authenticator, err := NewOidcAuthenticator(oidcConfig)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		e.Logger.Infof("Using the built-in OIDC login with the issuer %s", oidcIssuerURL)
+		// NOTE: The required claims are checked against the verified ID token when the user logs in
+		proxyMWs = append(proxyMWs, authenticator.Authenticate)
+	case principals.Len() > 0:
 		keyLookup := fmt.Sprintf("cookie:%v,header:Authorization", cookieKey)
 		authnMW := middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
-			KeyLookup: keyLookup,
-			Validator: func(key string, c echo.Context) (bool, error) {
-				return key == token, nil
-			},
+			KeyLookup:    keyLookup,
+			Validator:    limiter.Validator(principals.Validator),
+			ErrorHandler: limiter.ErrorHandler,
 		})
-		proxyMWs = append(proxyMWs, authnMW)
-	} else {
+		proxyMWs = append(proxyMWs, limiter.Reject, authnMW)
+		authorizeMW = principals.Authorize
+		if config != "" {
+			watchPrincipals(principals, e.Logger)
+		}
+	default:
 		e.Logger.Info("Token is not defined, running without authentication.")
 	}
 
+	if len(requirements) > 0 && oidcIssuerURL == "" {
+		proxyMWs = append(proxyMWs, requireClaims(requirements))
+	}
+
 	remoteURL, err := url.Parse(remote)
 	if err != nil {
 		e.Logger.Fatal(err)
@@ -243,17 +682,29 @@ func serve(cmd *cobra.Command, args []string) {
 	} else {
 		e.Logger.Info("Running without path rewriting")
 	}
+	if authorizeMW != nil {
+		proxyMWs = append(proxyMWs, authorizeMW)
+	}
 
-	proxyMWs = append(proxyMWs, middleware.Proxy(middleware.NewRoundRobinBalancer(targets)))
+	websocketProxy := NewWebsocketProxy(remoteURL, WebsocketConfig{
+		MaxConnections: websocketMaxConnections,
+		IdleTimeout:    websocketIdleTimeout,
+		WriteTimeout:   websocketWriteTimeout,
+		PingInterval:   websocketPingInterval,
+	})
+	proxyConfig := middleware.DefaultProxyConfig
+	proxyConfig.Balancer = middleware.NewRoundRobinBalancer(targets)
+	proxyConfig.ErrorHandler = countUpstreamErrors
+	proxyMWs = append(proxyMWs, websocketProxy.Proxy, middleware.ProxyWithConfig(proxyConfig))
 	proxy.Use(proxyMWs...)
 
 	// Healthcheck
-	health := e.Group("/__amalthea__")
+	health := e.Group("/__amalthea__", rs.Process)
 	health.GET("/health", func(c echo.Context) error {
 		return c.NoContent(http.StatusOK)
 	})
 
-	e.Logger.Infof("Starting proxy for remote: %s, cookie key: %s, token of length %d", remoteURL.String(), cookieKey, len(token))
+	e.Logger.Infof("Starting proxy for remote: %s, cookie key: %s, token of length %d, %d principals", remoteURL.String(), cookieKey, len(token), principals.Len())
 
 	ctx, stop := signal.NotifyContext(context.Background(), common.InterruptSignals...)
 	defer stop()
@@ -272,6 +723,9 @@ func serve(cmd *cobra.Command, args []string) {
 		meta.Logger.SetLevel(log.DEBUG)
 	}
 	meta.GET("/request_stats", rs.Handle)
+	meta.GET("/auth_stats", limiter.Handle)
+	meta.GET("/websocket_stats", websocketProxy.Handle)
+	meta.GET("/metrics", MetricsHandler())
 	go func() {
 		if err := meta.Start(fmt.Sprintf(":%d", metaPort)); err != nil && err != http.ErrServerClosed {
 			meta.Logger.Fatal("shutting down the server")
@@ -280,6 +734,11 @@ func serve(cmd *cobra.Command, args []string) {
 
 	// Wait for interrupt signal to gracefully shutdown the server with a timeout of 10 seconds.
 	<-ctx.Done()
+	// NOTE: The echo server does not wait for the hijacked websocket connections when it shuts down,
+	// so the clients are asked to close them first.
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), websocketDrainTimeout)
+	defer cancelDrain()
+	websocketProxy.Drain(drainCtx)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := e.Shutdown(ctx); err != nil {
@@ -0,0 +1,315 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RequestClass is the kind of a request as far as the session activity is concerned
+type RequestClass string
+
+const (
+	// Requests made by a user, they count as an interaction with the session
+	RequestInteractive RequestClass = "interactive"
+	// Polling and keepalive requests sent automatically by the frontends
+	RequestBackground RequestClass = "background"
+	// Websocket connections, the messages sent by the client count as an interaction
+	RequestWebsocket RequestClass = "websocket"
+	// Health checks of the proxy itself
+	RequestHealth RequestClass = "health"
+	// Requests that were rejected by the authentication or the authorization
+	RequestRejected RequestClass = "rejected"
+)
+
+// DefaultBackgroundPaths are the paths of the requests that the Jupyter and RStudio
+// frontends send on their own while they are open in a browser.
+var DefaultBackgroundPaths = []string{
+	`/api/(kernels|sessions|terminals)(/[^/]+)?/?$`,
+	`/api/(kernelspecs|status|me|metrics)(/.*)?$`,
+	`/lab/api/(settings|translations)(/.*)?$`,
+	`/events/get_events$`,
+	`/favicon\.ico$`,
+}
+
+const healthPathPrefix = "/__amalthea__/"
+
+// The key in the echo context where the class of the request is stored once it has been handled
+const requestClassContextKey = "authproxy.request_class"
+
+// RequestStats tracks the activity in the session. The last request time is updated on every
+// proxied request, while the last interaction time ignores background requests and only counts
+// the websocket messages that are sent by the client.
+type RequestStats struct {
+	LastRequest           time.Time
+	LastInteraction       time.Time
+	LastWebsocketActivity time.Time
+	OpenWebsockets        int
+	WebsocketMessages     uint64
+	Requests              map[RequestClass]uint64
+	backgroundPaths       []*regexp.Regexp
+	now                   func() time.Time
+	mutex                 sync.RWMutex
+}
+
+func NewStats(backgroundPaths []string) (*RequestStats, error) {
+	compiled := make([]*regexp.Regexp, 0, len(backgroundPaths))
+	for _, path := range backgroundPaths {
+		if path == "" {
+			continue
+		}
+		re, err := regexp.Compile(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid background path pattern %q: %w", path, err)
+		}
+		compiled = append(compiled, re)
+	}
+	now := time.Now()
+	return &RequestStats{
+		LastRequest:     now,
+		LastInteraction: now,
+		Requests:        map[RequestClass]uint64{},
+		backgroundPaths: compiled,
+		now:             time.Now,
+	}, nil
+}
+
+type RequestStatsResponse struct {
+	LastRequestTime           time.Time               `json:"last_request_time"`
+	LastInteractionTime       time.Time               `json:"last_interaction_time"`
+	LastWebsocketActivityTime *time.Time              `json:"last_websocket_activity_time,omitempty"`
+	OpenWebsockets            int                     `json:"open_websockets"`
+	WebsocketMessages         uint64                  `json:"websocket_messages"`
+	Requests                  map[RequestClass]uint64 `json:"requests"`
+}
+
+func (l *RequestStats) classify(r *http.Request) RequestClass {
+	if strings.HasPrefix(r.URL.Path, healthPathPrefix) {
+		return RequestHealth
+	}
+	if strings.EqualFold(r.Header.Get(echo.HeaderUpgrade), "websocket") {
+		return RequestWebsocket
+	}
+	for _, re := range l.backgroundPaths {
+		if re.MatchString(r.URL.Path) {
+			return RequestBackground
+		}
+	}
+	return RequestInteractive
+}
+
+func (l *RequestStats) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		class := l.classify(c.Request())
+		if class == RequestWebsocket {
+			// NOTE: The echo proxy hijacks the connection for websockets, the hijacked
+			// connection is wrapped so that the messages from the client can be tracked.
+			res := c.Response()
+			res.Writer = &websocketResponseWriter{ResponseWriter: res.Writer, stats: l}
+		}
+
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		switch c.Response().Status {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+			class = RequestRejected
+		}
+		c.Set(requestClassContextKey, class)
+		observeRequest(c, class, time.Since(start))
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.Requests[class]++
+		now := l.now()
+		switch class {
+		case RequestInteractive:
+			l.LastInteraction = now
+			l.LastRequest = now
+		case RequestBackground, RequestWebsocket, RequestRejected:
+			l.LastRequest = now
+		}
+		return nil
+	}
+}
+
+func (l *RequestStats) Handle(c echo.Context) error {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	res := RequestStatsResponse{
+		LastRequestTime:     l.LastRequest,
+		LastInteractionTime: l.LastInteraction,
+		OpenWebsockets:      l.OpenWebsockets,
+		WebsocketMessages:   l.WebsocketMessages,
+		Requests:            make(map[RequestClass]uint64, len(l.Requests)),
+	}
+	if !l.LastWebsocketActivity.IsZero() {
+		lastActivity := l.LastWebsocketActivity
+		res.LastWebsocketActivityTime = &lastActivity
+	}
+	for class, count := range l.Requests {
+		res.Requests[class] = count
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (l *RequestStats) websocketOpened() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.OpenWebsockets++
+	l.LastInteraction = now
+	l.LastWebsocketActivity = now
+}
+
+func (l *RequestStats) websocketClosed() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.OpenWebsockets--
+}
+
+func (l *RequestStats) websocketMessage() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.WebsocketMessages++
+	l.LastInteraction = now
+	l.LastWebsocketActivity = now
+}
+
+type websocketResponseWriter struct {
+	http.ResponseWriter
+	stats *RequestStats
+}
+
+func (w *websocketResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.stats.websocketOpened()
+	return &websocketConn{Conn: conn, stats: w.stats}, rw, nil
+}
+
+func (w *websocketResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// websocketConn counts the data messages that the client sends on a websocket connection.
+// Control frames such as ping and pong are sent automatically and they are not counted.
+type websocketConn struct {
+	net.Conn
+	stats     *RequestStats
+	scanner   frameScanner
+	closeOnce sync.Once
+}
+
+func (c *websocketConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.scanner.scan(p[:n], func(opcode byte) {
+			if opcode == opText || opcode == opBinary {
+				c.stats.websocketMessage()
+			}
+		})
+	}
+	return n, err
+}
+
+func (c *websocketConn) Close() error {
+	c.closeOnce.Do(c.stats.websocketClosed)
+	return c.Conn.Close()
+}
+
+// The websocket opcodes of the first frame of a data message
+const (
+	opText   byte = 0x1
+	opBinary byte = 0x2
+)
+
+// frameScanner follows the websocket frames in a stream of bytes without buffering
+// the payloads, see https://datatracker.ietf.org/doc/html/rfc6455#section-5.2
+type frameScanner struct {
+	header    []byte
+	remaining uint64
+}
+
+// headerLength returns the length of the frame header once enough of it has been read, or 0
+func (s *frameScanner) headerLength() int {
+	if len(s.header) < 2 {
+		return 0
+	}
+	length := 2
+	switch s.header[1] & 0x7f {
+	case 126:
+		length += 2
+	case 127:
+		length += 8
+	}
+	if s.header[1]&0x80 != 0 {
+		// The frames sent by clients are masked with a 4 byte key
+		length += 4
+	}
+	return length
+}
+
+func (s *frameScanner) payloadLength() uint64 {
+	switch s.header[1] & 0x7f {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(s.header[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(s.header[2:10])
+	default:
+		return uint64(s.header[1] & 0x7f)
+	}
+}
+
+// atBoundary returns true if the bytes scanned so far end with a complete frame
+func (s *frameScanner) atBoundary() bool {
+	return s.remaining == 0 && len(s.header) == 0
+}
+
+func (s *frameScanner) scan(p []byte, onFrame func(opcode byte)) {
+	for len(p) > 0 {
+		if s.remaining > 0 {
+			skip := min(s.remaining, uint64(len(p)))
+			s.remaining -= skip
+			p = p[skip:]
+			continue
+		}
+		s.header = append(s.header, p[0])
+		p = p[1:]
+		length := s.headerLength()
+		if length == 0 || len(s.header) < length {
+			continue
+		}
+		onFrame(s.header[0] & 0x0f)
+		s.remaining = s.payloadLength()
+		s.header = s.header[:0]
+	}
+}
@@ -0,0 +1,200 @@
+package authproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// maskedFrame builds a websocket frame as it is sent by a client
+func maskedFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	default:
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func getStats(t *testing.T, rs *RequestStats) RequestStatsResponse {
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	require.NoError(t, rs.Handle(e.NewContext(httptest.NewRequest(http.MethodGet, "/request_stats", nil), rec)))
+	stats := RequestStatsResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	return stats
+}
+
+func TestFrameScanner(t *testing.T) {
+	stream := []byte{}
+	stream = append(stream, maskedFrame(0x1, []byte("hello"))...)
+	stream = append(stream, maskedFrame(0x9, nil)...)
+	stream = append(stream, maskedFrame(0x2, make([]byte, 300))...)
+	stream = append(stream, maskedFrame(0xA, []byte("pong"))...)
+
+	// The frames are split at every possible position
+	for chunk := 1; chunk <= len(stream); chunk++ {
+		scanner := frameScanner{}
+		opcodes := []byte{}
+		for i := 0; i < len(stream); i += chunk {
+			scanner.scan(stream[i:min(i+chunk, len(stream))], func(opcode byte) {
+				opcodes = append(opcodes, opcode)
+			})
+		}
+		assert.Equal(t, []byte{0x1, 0x9, 0x2, 0xA}, opcodes, "chunk size %d", chunk)
+	}
+}
+
+func TestRequestStatsClasses(t *testing.T) {
+	rs, err := NewStats(DefaultBackgroundPaths)
+	require.NoError(t, err)
+	start := rs.LastInteraction
+	now := start
+	rs.now = func() time.Time { return now }
+
+	e := echo.New()
+	handler := rs.Process(func(c echo.Context) error {
+		if c.Request().Header.Get("Authorization") == "" {
+			return echo.NewHTTPError(http.StatusUnauthorized)
+		}
+		return c.NoContent(http.StatusOK)
+	})
+	do := func(path string, authorized bool) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if authorized {
+			req.Header.Set("Authorization", "Bearer token")
+		}
+		require.NoError(t, handler(e.NewContext(req, httptest.NewRecorder())))
+	}
+
+	now = start.Add(time.Minute)
+	do("/user/session/lab/tree/notebook.ipynb", true)
+	interaction := now
+	now = start.Add(2 * time.Minute)
+	do("/user/session/api/kernels", true)
+	do("/user/session/api/kernels/0d4d0a5e-3b6a-4d3c-8d5e-6d0d6b0c8a2f", true)
+	do("/user/session/api/status", true)
+	do("/rstudio/events/get_events", true)
+	do("/__amalthea__/health", true)
+	do("/user/session/lab/tree/notebook.ipynb", false)
+
+	stats := getStats(t, rs)
+	assert.True(t, interaction.Equal(stats.LastInteractionTime))
+	assert.True(t, now.Equal(stats.LastRequestTime))
+	assert.Nil(t, stats.LastWebsocketActivityTime)
+	assert.Equal(t, map[RequestClass]uint64{
+		RequestInteractive: 1,
+		RequestBackground:  4,
+		RequestHealth:      1,
+		RequestRejected:    1,
+	}, stats.Requests)
+
+	_, err = NewStats([]string{"/api/("})
+	assert.Error(t, err)
+}
+
+// newWebsocketUpstream starts a server that accepts websocket upgrades and echoes back everything
+// the client sends until it receives a close frame
+func newWebsocketUpstream(t *testing.T) *url.URL {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/forbidden" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = rw.Flush()
+		scanner := frameScanner{}
+		buf := make([]byte, 1024)
+		for closed := false; !closed; {
+			n, err := rw.Read(buf)
+			if err != nil {
+				return
+			}
+			scanner.scan(buf[:n], func(opcode byte) { closed = closed || opcode == 0x8 })
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	return upstreamURL
+}
+
+// dialWebsocket sends a websocket upgrade request to the server and returns the connection and the response
+func dialWebsocket(t *testing.T, server *httptest.Server, path string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", path, server.Listener.Addr())
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	return conn, reader, res
+}
+
+func TestRequestStatsWebsocket(t *testing.T) {
+	upstreamURL := newWebsocketUpstream(t)
+
+	rs, err := NewStats(DefaultBackgroundPaths)
+	require.NoError(t, err)
+	e := echo.New()
+	e.Group("/*").Use(rs.Process, middleware.Proxy(middleware.NewRoundRobinBalancer(
+		[]*middleware.ProxyTarget{{URL: upstreamURL}},
+	)))
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+
+	conn, reader, res := dialWebsocket(t, proxy, "/api/kernels/1234/channels")
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Eventually(t, func() bool { return getStats(t, rs).OpenWebsockets == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	frames := [][]byte{
+		maskedFrame(0x1, []byte(`{"msg_type": "execute_request"}`)),
+		maskedFrame(0x9, nil),
+		maskedFrame(0xA, nil),
+		maskedFrame(0x2, []byte("binary")),
+		maskedFrame(0x8, nil),
+	}
+	for _, frame := range frames {
+		_, err = conn.Write(frame)
+		require.NoError(t, err)
+		echoed := make([]byte, len(frame))
+		_, err = io.ReadFull(reader, echoed)
+		require.NoError(t, err)
+		assert.Equal(t, frame, echoed)
+	}
+	stats := getStats(t, rs)
+	assert.Equal(t, uint64(2), stats.WebsocketMessages)
+	assert.NotNil(t, stats.LastWebsocketActivityTime)
+
+	require.NoError(t, conn.Close())
+	assert.Eventually(t, func() bool { return getStats(t, rs).OpenWebsockets == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return getStats(t, rs).Requests[RequestWebsocket] == 1 }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authproxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TokenConfig is a token that is accepted for a principal, the value can be
+// the plain token or its bcrypt or argon2 hash.
+type TokenConfig struct {
+	Value string `mapstructure:"value"`
+	// The token is not accepted anymore after this time, if it is not set the token does not expire
+	ExpiresAt time.Time `mapstructure:"expires_at"`
+}
+
+// The maximum number of hashed tokens which are verified at the same time, each argon2
+// verification can use tens of MiB of memory and bcrypt is slow on purpose. The requests with
+// invalid tokens would otherwise exhaust the CPU and the memory of the proxy.
+const maxConcurrentHashVerifications = 2
+
+var hashVerifications = make(chan struct{}, maxConcurrentHashVerifications)
+
+// The maximum parameters of the argon2 hashes, the memory is in KiB. The proxy runs with a memory
+// limit of 16Mi so that the concurrent verifications have to fit in a few MiB.
+const maxArgon2Memory uint32 = 4096
+const maxArgon2Time uint32 = 10
+const maxArgon2Threads uint8 = 4
+
+// limitHashVerification runs the verification of a hashed token once a verification slot is free
+func limitHashVerification(verify func() bool) bool {
+	hashVerifications <- struct{}{}
+	defer func() {
+		<-hashVerifications
+	}()
+	return verify()
+}
+
+// tokenVerifier checks if a token matches the configured value
+type tokenVerifier interface {
+	Verify(token string) bool
+}
+
+type credential struct {
+	verifier  tokenVerifier
+	expiresAt time.Time
+}
+
+func (c credential) expired(now time.Time) bool {
+	return !c.expiresAt.IsZero() && !now.Before(c.expiresAt)
+}
+
+// newCredential detects the format of the token value and prepares the matching verifier.
+// Values starting with $2a$, $2b$ or $2y$ are bcrypt hashes, values starting with $argon2id$ or
+// $argon2i$ are argon2 hashes in the PHC string format and anything else is a plain token.
+func newCredential(token TokenConfig) (credential, error) {
+	var verifier tokenVerifier
+	var err error
+	switch {
+	case strings.HasPrefix(token.Value, "$2a$"), strings.HasPrefix(token.Value, "$2b$"), strings.HasPrefix(token.Value, "$2y$"):
+		verifier, err = newBcryptToken(token.Value)
+	case strings.HasPrefix(token.Value, "$argon2id$"), strings.HasPrefix(token.Value, "$argon2i$"):
+		verifier, err = newArgon2Token(token.Value)
+	default:
+		verifier = newPlainToken(token.Value)
+	}
+	if err != nil {
+		return credential{}, err
+	}
+	return credential{verifier: verifier, expiresAt: token.ExpiresAt}, nil
+}
+
+type plainToken [sha256.Size]byte
+
+func newPlainToken(token string) plainToken {
+	return sha256.Sum256([]byte(token))
+}
+
+func (p plainToken) Verify(token string) bool {
+	// NOTE: Comparing digests instead of the tokens avoids leaking the length of the tokens
+	digest := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(p[:], digest[:]) == 1
+}
+
+type bcryptToken []byte
+
+func newBcryptToken(hash string) (bcryptToken, error) {
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return nil, fmt.Errorf("invalid bcrypt hash: %w", err)
+	}
+	return bcryptToken(hash), nil
+}
+
+func (b bcryptToken) Verify(token string) bool {
+	return limitHashVerification(func() bool {
+		return bcrypt.CompareHashAndPassword(b, []byte(token)) == nil
+	})
+}
+
+type argon2Token struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	hash    []byte
+}
+
+// newArgon2Token parses a hash in the PHC string format, e.g. $argon2id$v=19$m=4096,t=3,p=1$<salt>$<hash>,
+// the hashes with parameters above maxArgon2Memory, maxArgon2Time or maxArgon2Threads are rejected.
+func newArgon2Token(hash string) (argon2Token, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return argon2Token{}, fmt.Errorf("invalid argon2 hash: expected 6 parts separated by $, got %d", len(parts))
+	}
+	token := argon2Token{variant: parts[1]}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return argon2Token{}, fmt.Errorf("invalid argon2 hash version: %w", err)
+	}
+	if version != argon2.Version {
+		return argon2Token{}, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &token.memory, &token.time, &token.threads); err != nil {
+		return argon2Token{}, fmt.Errorf("invalid argon2 hash parameters: %w", err)
+	}
+	if token.memory > maxArgon2Memory {
+		return argon2Token{}, fmt.Errorf("the argon2 memory m=%d is larger than the maximum of %d KiB supported by the proxy", token.memory, maxArgon2Memory)
+	}
+	if token.time < 1 || token.time > maxArgon2Time {
+		return argon2Token{}, fmt.Errorf("the argon2 iterations t=%d are not between 1 and %d", token.time, maxArgon2Time)
+	}
+	if token.threads < 1 || token.threads > maxArgon2Threads {
+		return argon2Token{}, fmt.Errorf("the argon2 parallelism p=%d is not between 1 and %d", token.threads, maxArgon2Threads)
+	}
+	var err error
+	token.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return argon2Token{}, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	token.hash, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return argon2Token{}, fmt.Errorf("invalid argon2 hash: %w", err)
+	}
+	if len(token.hash) == 0 {
+		return argon2Token{}, fmt.Errorf("invalid argon2 hash: the hash is empty")
+	}
+	return token, nil
+}
+
+func (a argon2Token) Verify(token string) bool {
+	return limitHashVerification(func() bool {
+		var computed []byte
+		keyLength := uint32(len(a.hash))
+		if a.variant == "argon2id" {
+			computed = argon2.IDKey([]byte(token), a.salt, a.time, a.memory, a.threads, keyLength)
+		} else {
+			computed = argon2.Key([]byte(token), a.salt, a.time, a.memory, a.threads, keyLength)
+		}
+		return subtle.ConstantTimeCompare(a.hash, computed) == 1
+	})
+}
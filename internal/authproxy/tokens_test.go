@@ -0,0 +1,154 @@
+package authproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, token string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(hash)
+}
+
+func argon2idHash(token string) string {
+	salt := []byte("some-random-salt")
+	hash := argon2.IDKey([]byte(token), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash))
+}
+
+func TestNewCredential(t *testing.T) {
+	cases := []struct {
+		name  string
+		value string
+	}{
+		{"plain", "the-token"},
+		{"bcrypt", bcryptHash(t, "the-token")},
+		{"argon2id", argon2idHash("the-token")},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cred, err := newCredential(TokenConfig{Value: tc.value})
+			require.NoError(t, err)
+			assert.True(t, cred.verifier.Verify("the-token"))
+			assert.False(t, cred.verifier.Verify("another-token"))
+			assert.False(t, cred.verifier.Verify(""))
+		})
+	}
+
+	invalid := []string{
+		"$2y$10$too-short",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA",
+		"$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$",
+		"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=100,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=1,p=0$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=1,p=16$c2FsdA$aGFzaA",
+	}
+	for _, value := range invalid {
+		_, err := newCredential(TokenConfig{Value: value})
+		assert.Error(t, err, value)
+	}
+}
+
+func TestPrincipalsTokenRotationAndExpiry(t *testing.T) {
+	now := time.Now()
+	principals := &Principals{now: func() time.Time { return now }}
+	err := principals.Update([]Principal{
+		{
+			ID:   "alice",
+			Role: RoleOwner,
+			Tokens: []TokenConfig{
+				{Value: bcryptHash(t, "old-token"), ExpiresAt: now.Add(time.Hour)},
+				{Value: argon2idHash("new-token")},
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	for _, token := range []string{"old-token", "new-token"} {
+		principal, ok := principals.Lookup(token)
+		assert.True(t, ok, token)
+		assert.Equal(t, "alice", principal.ID)
+	}
+	// The verified tokens are cached
+	assert.Len(t, principals.verified, 2)
+
+	now = now.Add(time.Hour)
+	_, ok := principals.Lookup("old-token")
+	assert.False(t, ok)
+	_, ok = principals.Lookup("new-token")
+	assert.True(t, ok)
+
+	// Updating the principals clears the cache
+	err = principals.Update([]Principal{{ID: "bob", Token: "bob-token", Role: RoleViewer}}, nil)
+	require.NoError(t, err)
+	_, ok = principals.Lookup("new-token")
+	assert.False(t, ok)
+}
+
+func TestLoadPrincipalsHashedTokens(t *testing.T) {
+	defer viper.Reset()
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, []byte(fmt.Sprintf(`authproxy:
+  tokens:
+    - value: '%s'
+      expires_at: 2000-01-01T00:00:00Z
+    - value: '%s'
+`, bcryptHash(t, "expired-token"), argon2idHash("valid-token"))), 0o600)
+	require.NoError(t, err)
+	viper.SetConfigType("yaml")
+	viper.SetConfigFile(configFile)
+	require.NoError(t, viper.ReadInConfig())
+
+	principals := &Principals{}
+	require.NoError(t, loadPrincipals(principals))
+	assert.Equal(t, 1, principals.Len())
+	_, ok := principals.Lookup("expired-token")
+	assert.False(t, ok)
+	owner, ok := principals.Lookup("valid-token")
+	assert.True(t, ok)
+	assert.Equal(t, defaultPrincipalID, owner.ID)
+	assert.Equal(t, RoleOwner, owner.Role)
+}
+
+func TestLimitHashVerification(t *testing.T) {
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limitHashVerification(func() bool {
+				current := atomic.AddInt32(&running, 1)
+				for {
+					previous := atomic.LoadInt32(&maxRunning)
+					if current <= previous || atomic.CompareAndSwapInt32(&maxRunning, previous, current) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return false
+			})
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(maxConcurrentHashVerifications), maxRunning)
+}
@@ -0,0 +1,412 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The frames that the proxy sends to the clients, frames sent by a server are not masked
+var (
+	pingFrame = []byte{0x89, 0x00}
+	// Close frame with the status code 1001 (going away)
+	goingAwayFrame = []byte{0x88, 0x02, 0x03, 0xe9}
+)
+
+// WebsocketConfig controls how the websocket connections are proxied, a zero value disables the option
+type WebsocketConfig struct {
+	// The maximum number of websocket connections that can be open at the same time
+	MaxConnections int
+	// Connections where the client does not send anything for this long are closed,
+	// the pongs that the clients send back when the proxy pings them also count.
+	IdleTimeout time.Duration
+	// The maximum time a write to the client or the upstream can take
+	WriteTimeout time.Duration
+	// How often the proxy pings the clients to keep the connections alive
+	PingInterval time.Duration
+}
+
+// WebsocketProxy proxies the websocket connections to the upstream, all other requests are passed
+// on to the next handler. Unlike the echo proxy it closes both sides of a connection as soon as one
+// of them is closed and it can notify the clients when the proxy shuts down.
+type WebsocketProxy struct {
+	config   WebsocketConfig
+	target   *url.URL
+	dialer   net.Dialer
+	tunnels  map[*websocketTunnel]struct{}
+	draining bool
+	stats    WebsocketStatsResponse
+	mutex    sync.Mutex
+}
+
+type WebsocketStatsResponse struct {
+	OpenConnections     int    `json:"open_connections"`
+	MaxConnections      int    `json:"max_connections"`
+	TotalConnections    uint64 `json:"total_connections"`
+	RejectedConnections uint64 `json:"rejected_connections"`
+	UpstreamErrors      uint64 `json:"upstream_errors"`
+	IdleTimeouts        uint64 `json:"idle_timeouts"`
+	DrainedConnections  uint64 `json:"drained_connections"`
+	BytesFromClients    uint64 `json:"bytes_from_clients"`
+	BytesToClients      uint64 `json:"bytes_to_clients"`
+}
+
+func NewWebsocketProxy(target *url.URL, config WebsocketConfig) *WebsocketProxy {
+	return &WebsocketProxy{
+		config:  config,
+		target:  target,
+		dialer:  net.Dialer{Timeout: 10 * time.Second},
+		tunnels: map[*websocketTunnel]struct{}{},
+		stats:   WebsocketStatsResponse{MaxConnections: config.MaxConnections},
+	}
+}
+
+// Proxy is a middleware that handles the websocket upgrade requests
+func (p *WebsocketProxy) Proxy(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !c.IsWebSocket() {
+			return next(c)
+		}
+		tunnel := &websocketTunnel{proxy: p, done: make(chan struct{})}
+		if err := p.register(tunnel); err != nil {
+			return err
+		}
+		defer p.unregister(tunnel)
+		return tunnel.serve(c)
+	}
+}
+
+// Handle serves the websocket statistics
+func (p *WebsocketProxy) Handle(c echo.Context) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return c.JSON(http.StatusOK, p.stats)
+}
+
+func (p *WebsocketProxy) register(tunnel *websocketTunnel) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.draining {
+		p.stats.RejectedConnections++
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "the proxy is shutting down")
+	}
+	if p.config.MaxConnections > 0 && len(p.tunnels) >= p.config.MaxConnections {
+		p.stats.RejectedConnections++
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "too many websocket connections")
+	}
+	p.tunnels[tunnel] = struct{}{}
+	p.stats.OpenConnections = len(p.tunnels)
+	p.stats.TotalConnections++
+	openWebsockets.Inc()
+	return nil
+}
+
+func (p *WebsocketProxy) unregister(tunnel *websocketTunnel) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.tunnels, tunnel)
+	p.stats.OpenConnections = len(p.tunnels)
+	openWebsockets.Dec()
+}
+
+func (p *WebsocketProxy) recordUpstreamError() {
+	p.record(func(stats *WebsocketStatsResponse) { stats.UpstreamErrors++ })
+	upstreamErrors.WithLabelValues("websocket").Inc()
+}
+
+func (p *WebsocketProxy) record(update func(stats *WebsocketStatsResponse)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	update(&p.stats)
+}
+
+// Drain stops accepting new websocket connections and asks the clients to close the open ones.
+// The connections that are still open when the context is done are closed.
+func (p *WebsocketProxy) Drain(ctx context.Context) {
+	p.mutex.Lock()
+	p.draining = true
+	tunnels := make([]*websocketTunnel, 0, len(p.tunnels))
+	for tunnel := range p.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	p.mutex.Unlock()
+
+	wg := sync.WaitGroup{}
+	for _, tunnel := range tunnels {
+		wg.Go(func() {
+			tunnel.drain(ctx)
+		})
+	}
+	wg.Wait()
+}
+
+// websocketTunnel is a single websocket connection between a client and the upstream
+type websocketTunnel struct {
+	proxy     *WebsocketProxy
+	done      chan struct{}
+	closeOnce sync.Once
+	// The connections are set while the tunnel may already be closed by a drain
+	connMutex sync.Mutex
+	client    net.Conn
+	upstream  net.Conn
+	// The writes to the client are serialized so that the proxy can add its own
+	// frames between the frames of the upstream
+	writeMutex sync.Mutex
+	written    frameScanner
+	closeSent  bool
+}
+
+func (t *websocketTunnel) serve(c echo.Context) error {
+	req := c.Request()
+	// NOTE: The same headers are set by the echo proxy for the other requests
+	if req.Header.Get(echo.HeaderXRealIP) == "" || c.Echo().IPExtractor != nil {
+		req.Header.Set(echo.HeaderXRealIP, c.RealIP())
+	}
+	if req.Header.Get(echo.HeaderXForwardedProto) == "" {
+		req.Header.Set(echo.HeaderXForwardedProto, c.Scheme())
+	}
+	if req.Header.Get(echo.HeaderXForwardedFor) == "" {
+		req.Header.Set(echo.HeaderXForwardedFor, c.RealIP())
+	}
+
+	upstream, err := t.proxy.dialer.DialContext(req.Context(), "tcp", t.proxy.target.Host)
+	if err != nil {
+		t.proxy.recordUpstreamError()
+		return echo.NewHTTPError(http.StatusBadGateway, "cannot connect to the session").SetInternal(err)
+	}
+	defer t.close()
+	if !t.setConns(nil, upstream) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "the proxy is shutting down")
+	}
+	if err := req.Write(upstream); err != nil {
+		t.proxy.recordUpstreamError()
+		return echo.NewHTTPError(http.StatusBadGateway, "cannot send the request to the session").SetInternal(err)
+	}
+	upstreamReader := bufio.NewReader(upstream)
+	res, err := http.ReadResponse(upstreamReader, req)
+	if err != nil {
+		t.proxy.recordUpstreamError()
+		return echo.NewHTTPError(http.StatusBadGateway, "invalid response from the session").SetInternal(err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		// The upstream refused the upgrade, its response is passed on as is
+		for key, values := range res.Header {
+			c.Response().Header()[key] = values
+		}
+		c.Response().WriteHeader(res.StatusCode)
+		_, err = io.Copy(c.Response(), res.Body)
+		return err
+	}
+
+	client, clientBuffer, err := c.Response().Hijack()
+	if err != nil {
+		return err
+	}
+	if !t.setConns(client, upstream) {
+		return nil
+	}
+	if err := res.Write(client); err != nil {
+		return nil
+	}
+	// The client may have sent frames before it received the response
+	var clientReader io.Reader = client
+	if clientBuffer != nil && clientBuffer.Reader.Buffered() > 0 {
+		buffered, _ := clientBuffer.Reader.Peek(clientBuffer.Reader.Buffered())
+		clientReader = io.MultiReader(bytes.NewReader(bytes.Clone(buffered)), client)
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Go(func() {
+		defer t.close()
+		t.copyFromClient(clientReader)
+	})
+	wg.Go(func() {
+		defer t.close()
+		t.copyToClient(upstreamReader)
+	})
+	if t.proxy.config.PingInterval > 0 {
+		wg.Go(t.ping)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (t *websocketTunnel) copyFromClient(clientReader io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		if t.proxy.config.IdleTimeout > 0 {
+			_ = t.client.SetReadDeadline(time.Now().Add(t.proxy.config.IdleTimeout))
+		}
+		n, err := clientReader.Read(buf)
+		if n > 0 {
+			if t.proxy.config.WriteTimeout > 0 {
+				_ = t.upstream.SetWriteDeadline(time.Now().Add(t.proxy.config.WriteTimeout))
+			}
+			if _, writeErr := t.upstream.Write(buf[:n]); writeErr != nil {
+				return
+			}
+			t.proxy.record(func(stats *WebsocketStatsResponse) { stats.BytesFromClients += uint64(n) })
+			receivedBytes.WithLabelValues(string(RequestWebsocket)).Add(float64(n))
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				t.proxy.record(func(stats *WebsocketStatsResponse) { stats.IdleTimeouts++ })
+			}
+			return
+		}
+	}
+}
+
+func (t *websocketTunnel) copyToClient(upstreamReader io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := upstreamReader.Read(buf)
+		if n > 0 {
+			if writeErr := t.writeToClient(buf[:n]); writeErr != nil {
+				return
+			}
+			t.proxy.record(func(stats *WebsocketStatsResponse) { stats.BytesToClients += uint64(n) })
+			sentBytes.WithLabelValues(string(RequestWebsocket)).Add(float64(n))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeToClient passes on the frames from the upstream, they are dropped once the
+// proxy has sent a close frame because nothing can be sent after a close frame.
+func (t *websocketTunnel) writeToClient(p []byte) error {
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+	if t.closeSent {
+		return nil
+	}
+	if t.proxy.config.WriteTimeout > 0 {
+		_ = t.client.SetWriteDeadline(time.Now().Add(t.proxy.config.WriteTimeout))
+	}
+	n, err := t.client.Write(p)
+	t.written.scan(p[:n], func(byte) {})
+	return err
+}
+
+// writeControlFrame sends a frame of the proxy to the client, this is only possible
+// between two frames of the upstream. It returns false if the frame was not sent.
+func (t *websocketTunnel) writeControlFrame(frame []byte) bool {
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+	client := t.clientConn()
+	if t.closeSent || !t.written.atBoundary() || client == nil {
+		return false
+	}
+	if t.proxy.config.WriteTimeout > 0 {
+		_ = client.SetWriteDeadline(time.Now().Add(t.proxy.config.WriteTimeout))
+	}
+	if _, err := client.Write(frame); err != nil {
+		return false
+	}
+	t.closeSent = frame[0]&0x0f == 0x8
+	return true
+}
+
+func (t *websocketTunnel) ping() {
+	ticker := time.NewTicker(t.proxy.config.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			t.writeControlFrame(pingFrame)
+		}
+	}
+}
+
+// drain sends a going away close frame to the client and waits for the client to close the
+// connection. The connection is closed when the context is done.
+func (t *websocketTunnel) drain(ctx context.Context) {
+	retry := time.NewTicker(50 * time.Millisecond)
+	defer retry.Stop()
+	sent := false
+	for {
+		if !sent && t.writeControlFrame(goingAwayFrame) {
+			sent = true
+			t.proxy.record(func(stats *WebsocketStatsResponse) { stats.DrainedConnections++ })
+		}
+		select {
+		case <-t.done:
+			return
+		case <-ctx.Done():
+			t.close()
+			return
+		case <-retry.C:
+		}
+	}
+}
+
+// setConns sets the connections of the tunnel, they are closed and false is returned
+// if the tunnel has already been closed.
+func (t *websocketTunnel) setConns(client net.Conn, upstream net.Conn) bool {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+	t.client = client
+	t.upstream = upstream
+	select {
+	case <-t.done:
+		closeConns(client, upstream)
+		return false
+	default:
+		return true
+	}
+}
+
+// clientConn returns the client connection, it is nil until the upgrade is done
+func (t *websocketTunnel) clientConn() net.Conn {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+	return t.client
+}
+
+func (t *websocketTunnel) close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.connMutex.Lock()
+		defer t.connMutex.Unlock()
+		closeConns(t.client, t.upstream)
+	})
+}
+
+func closeConns(conns ...net.Conn) {
+	for _, conn := range conns {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package authproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newWebsocketProxyTestServer(t *testing.T, config WebsocketConfig) (*WebsocketProxy, *httptest.Server) {
+	websocketProxy := NewWebsocketProxy(newWebsocketUpstream(t), config)
+	e := echo.New()
+	e.Group("/*").Use(websocketProxy.Proxy, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			return c.String(http.StatusOK, "not a websocket")
+		}
+	})
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	return websocketProxy, server
+}
+
+func getWebsocketStats(t *testing.T, websocketProxy *WebsocketProxy) WebsocketStatsResponse {
+	rec := httptest.NewRecorder()
+	require.NoError(t, websocketProxy.Handle(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/websocket_stats", nil), rec)))
+	stats := WebsocketStatsResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	return stats
+}
+
+// readFrame reads a frame without a mask and with a payload shorter than 126 bytes
+func readFrame(t *testing.T, reader *bufio.Reader) []byte {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(reader, header)
+	require.NoError(t, err)
+	length := int(header[1] & 0x7f)
+	if header[1]&0x80 != 0 {
+		length += 4
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	require.NoError(t, err)
+	return append(header, payload...)
+}
+
+func TestWebsocketProxyPing(t *testing.T) {
+	websocketProxy, server := newWebsocketProxyTestServer(t, WebsocketConfig{PingInterval: 20 * time.Millisecond})
+
+	res, err := http.Get(server.URL + "/api/contents")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	assert.Equal(t, "not a websocket", string(body))
+
+	conn, reader, res := dialWebsocket(t, server, "/api/kernels/1234/channels")
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Equal(t, pingFrame, readFrame(t, reader))
+
+	frame := maskedFrame(0x1, []byte("hello"))
+	_, err = conn.Write(frame)
+	require.NoError(t, err)
+	// The pings are only sent between the frames of the upstream
+	for {
+		received := readFrame(t, reader)
+		if received[0] == pingFrame[0] {
+			continue
+		}
+		assert.Equal(t, frame, received)
+		break
+	}
+	stats := getWebsocketStats(t, websocketProxy)
+	assert.Equal(t, 1, stats.OpenConnections)
+	assert.Equal(t, uint64(len(frame)), stats.BytesFromClients)
+
+	require.NoError(t, conn.Close())
+	assert.Eventually(t, func() bool { return getWebsocketStats(t, websocketProxy).OpenConnections == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWebsocketProxyLimitsAndUpstreamErrors(t *testing.T) {
+	websocketProxy, server := newWebsocketProxyTestServer(t, WebsocketConfig{MaxConnections: 1})
+
+	// The response of the upstream is passed on when it does not accept the upgrade
+	_, _, res := dialWebsocket(t, server, "/forbidden")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	_, _, res = dialWebsocket(t, server, "/api/kernels/1/channels")
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	_, _, res = dialWebsocket(t, server, "/api/kernels/2/channels")
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+
+	stats := getWebsocketStats(t, websocketProxy)
+	assert.Equal(t, 1, stats.OpenConnections)
+	assert.Equal(t, 1, stats.MaxConnections)
+	assert.Equal(t, uint64(2), stats.TotalConnections)
+	assert.Equal(t, uint64(1), stats.RejectedConnections)
+}
+
+func TestWebsocketProxyIdleTimeout(t *testing.T) {
+	websocketProxy, server := newWebsocketProxyTestServer(t, WebsocketConfig{IdleTimeout: 50 * time.Millisecond})
+
+	_, reader, res := dialWebsocket(t, server, "/api/kernels/1234/channels")
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	// The proxy closes the connection because the client is idle
+	_, err := reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Eventually(t, func() bool {
+		stats := getWebsocketStats(t, websocketProxy)
+		return stats.OpenConnections == 0 && stats.IdleTimeouts == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWebsocketProxyDrain(t *testing.T) {
+	websocketProxy, server := newWebsocketProxyTestServer(t, WebsocketConfig{})
+
+	conn, reader, res := dialWebsocket(t, server, "/api/kernels/1234/channels")
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Eventually(t, func() bool { return getWebsocketStats(t, websocketProxy).OpenConnections == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	drained := make(chan struct{})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		websocketProxy.Drain(ctx)
+		close(drained)
+	}()
+	// The client is notified and it closes the connection like a browser would
+	assert.Equal(t, goingAwayFrame, readFrame(t, reader))
+	_, err := conn.Write(maskedFrame(0x8, []byte{0x03, 0xe9}))
+	require.NoError(t, err)
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the websocket connections were not drained")
+	}
+	assert.Eventually(t, func() bool { return getWebsocketStats(t, websocketProxy).OpenConnections == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(1), getWebsocketStats(t, websocketProxy).DrainedConnections)
+
+	// No new connections are accepted while draining
+	_, _, res = dialWebsocket(t, server, "/api/kernels/1234/channels")
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
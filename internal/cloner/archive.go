@@ -0,0 +1,420 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloner
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// The extensions removed from the name of an archive to name its clone path, the longest first
+var archiveExtensions []string = []string{".tar.gz", ".tar.bz2", ".tgz", ".tbz2", ".tar", ".zip"}
+
+// The checksums of the archives are sha256 digests
+var checksumRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// The limits of the archives and of the OCI artifacts, the sources which exceed them are not cloned so that
+// a slow server, a large download or a zip or tar bomb cannot block the session or fill its volume.
+var (
+	// The time to download and extract a source, or to download the LFS objects of a repository
+	sourceFetchTimeout = time.Hour
+	// The bytes downloaded for a source, the sum of its layers for an OCI artifact
+	maxSourceDownloadSize int64 = 10 << 30
+	// The bytes written when extracting a source
+	maxSourceExtractedSize int64 = 20 << 30
+	// The files, directories and links written when extracting a source
+	maxSourceEntries = 1_000_000
+)
+
+// The client that downloads the sources and the LFS objects, the whole download is bounded by the context
+// of the request
+var sourceHTTPClient = newSourceHTTPClient()
+
+func newSourceHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Minute
+	return &http.Client{Transport: transport}
+}
+
+var errExtractedTooLarge = errors.New("the extracted content is larger than the maximum size")
+
+// extractionBudget is what remains of the limits of a source while it is extracted, it is shared by all the
+// archives and layers of the source.
+type extractionBudget struct {
+	ctx     context.Context
+	bytes   int64
+	entries int
+}
+
+func newExtractionBudget(ctx context.Context) *extractionBudget {
+	return &extractionBudget{ctx: ctx, bytes: maxSourceExtractedSize, entries: maxSourceEntries}
+}
+
+// entry counts an extracted file, directory or link
+func (b *extractionBudget) entry() error {
+	if err := b.ctx.Err(); err != nil {
+		return fmt.Errorf("the source was not extracted in time: %w", err)
+	}
+	b.entries -= 1
+	if b.entries < 0 {
+		return fmt.Errorf("the source has more than %d entries", maxSourceEntries)
+	}
+	return nil
+}
+
+// copy writes the content of an extracted file
+func (b *extractionBudget) copy(dst io.Writer, src io.Reader) error {
+	n, err := io.Copy(dst, io.LimitReader(src, b.bytes+1))
+	b.bytes -= n
+	if err == nil && b.bytes < 0 {
+		return errExtractedTooLarge
+	}
+	return err
+}
+
+// limitedDownload reads at most limit bytes from a response body
+func limitedDownload(dst io.Writer, res *http.Response, limit int64) (int64, error) {
+	if res.ContentLength > limit {
+		return 0, fmt.Errorf("the download of %d bytes is larger than the maximum size of %d bytes", res.ContentLength, limit)
+	}
+	n, err := io.Copy(dst, io.LimitReader(res.Body, limit+1))
+	if err == nil && n > limit {
+		return n, fmt.Errorf("the download is larger than the maximum size of %d bytes", limit)
+	}
+	return n, err
+}
+
+// The formats of the archives, detected from their first bytes
+const (
+	zipFormat   string = "zip"
+	tarFormat   string = "tar"
+	gzipFormat  string = "gzip"
+	bzip2Format string = "bzip2"
+)
+
+// archiveName returns the name of the archive at a URL without its extension
+func archiveName(remote string) (string, error) {
+	archiveURL, err := url.Parse(remote)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse remote: %w", err)
+	}
+	name := archiveURL.Path[strings.LastIndex(archiveURL.Path, "/")+1:]
+	for _, extension := range archiveExtensions {
+		if strings.HasSuffix(strings.ToLower(name), extension) {
+			name = name[:len(name)-len(extension)]
+			break
+		}
+	}
+	if name == "" || name == "." {
+		return "", fmt.Errorf("expecting an archive in url path, received: %s", archiveURL.Path)
+	}
+	return name, nil
+}
+
+// archiveFormat detects the format of an archive from its first bytes
+func archiveFormat(file io.ReaderAt) (string, error) {
+	header := make([]byte, 512)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return zipFormat, nil
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return gzipFormat, nil
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return bzip2Format, nil
+	case len(header) >= 262 && bytes.HasPrefix(header[257:], []byte("ustar")):
+		return tarFormat, nil
+	}
+	return "", errors.New("the archive is not a tar, gzip or bzip2 compressed tar or zip archive")
+}
+
+// archiveEntryPath returns the path of an archive entry relative to the extraction directory,
+// the leading slashes and the parent directories above the root are dropped as tar does.
+func archiveEntryPath(name string) string {
+	entryPath := strings.TrimPrefix(filepath.Clean(filepath.FromSlash("/"+name)), string(filepath.Separator))
+	if entryPath == "" {
+		return "."
+	}
+	return entryPath
+}
+
+// writeArchiveFile writes a regular file of an archive
+func writeArchiveFile(root *os.Root, name string, mode fs.FileMode, content io.Reader, budget *extractionBudget) error {
+	if err := budget.entry(); err != nil {
+		return err
+	}
+	if err := root.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	file, err := root.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	err = budget.copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeArchiveSymlink creates a symbolic link of an archive, the links are never followed outside of the root
+func writeArchiveSymlink(root *os.Root, name string, target string) error {
+	if err := root.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return root.Symlink(target, name)
+}
+
+// extractTar extracts a tar archive in root
+func extractTar(reader io.Reader, root *os.Root, budget *extractionBudget) error {
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := archiveEntryPath(header.Name)
+		if header.Typeflag != tar.TypeReg {
+			if err := budget.entry(); err != nil {
+				return err
+			}
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = root.MkdirAll(name, header.FileInfo().Mode().Perm()|0700)
+		case tar.TypeReg:
+			err = writeArchiveFile(root, name, header.FileInfo().Mode(), archive, budget)
+		case tar.TypeSymlink:
+			err = writeArchiveSymlink(root, name, header.Linkname)
+		case tar.TypeLink:
+			err = root.Link(archiveEntryPath(header.Linkname), name)
+		default:
+			// The devices, fifos and extended headers have no use in a session
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+		}
+	}
+}
+
+// extractZipEntry extracts an entry of a zip archive in root
+func extractZipEntry(entry *zip.File, root *os.Root, budget *extractionBudget) error {
+	name := archiveEntryPath(entry.Name)
+	mode := entry.Mode()
+	if mode.IsDir() {
+		if err := budget.entry(); err != nil {
+			return err
+		}
+		return root.MkdirAll(name, mode.Perm()|0700)
+	}
+	content, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = content.Close()
+	}()
+	if mode&fs.ModeSymlink != 0 {
+		if err := budget.entry(); err != nil {
+			return err
+		}
+		// The target of a link is a path, a larger entry is not a valid link
+		target, err := io.ReadAll(io.LimitReader(content, 4096))
+		if err != nil {
+			return err
+		}
+		return writeArchiveSymlink(root, name, string(target))
+	}
+	return writeArchiveFile(root, name, mode, content, budget)
+}
+
+// extractArchive extracts an archive of any of the supported formats in root
+func extractArchive(file *os.File, root *os.Root, budget *extractionBudget) error {
+	format, err := archiveFormat(file)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	switch format {
+	case zipFormat:
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		archive, err := zip.NewReader(file, info.Size())
+		if err != nil {
+			return err
+		}
+		for _, entry := range archive.File {
+			if err := extractZipEntry(entry, root, budget); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", entry.Name, err)
+			}
+		}
+		return nil
+	case gzipFormat:
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = reader.Close()
+		}()
+		return extractTar(reader, root, budget)
+	case bzip2Format:
+		return extractTar(bzip2.NewReader(file), root, budget)
+	default:
+		return extractTar(file, root, budget)
+	}
+}
+
+// installExtracted moves the extracted content to the clone path, when the content is a single directory
+// its content is moved instead, as in the archives of the git forges.
+func installExtracted(contentDir string, clonePath string) error {
+	entries, err := os.ReadDir(contentDir)
+	if err != nil {
+		return err
+	}
+	source := contentDir
+	if len(entries) == 1 && entries[0].IsDir() {
+		source = filepath.Join(contentDir, entries[0].Name())
+	}
+	if err := os.Chmod(source, 0755); err != nil {
+		return err
+	}
+	return os.Rename(source, clonePath)
+}
+
+// newSourceWorkDir creates a temporary directory next to the clone path to download and extract a source,
+// the extracted content is then moved to the clone path on the same volume.
+func newSourceWorkDir(clonePath string) (string, error) {
+	parent := filepath.Dir(clonePath)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(parent, "."+filepath.Base(clonePath)+"-*")
+}
+
+// downloadArchive downloads an archive in a file, it returns the sha256 digest of the archive
+func downloadArchive(ctx context.Context, remote string, auth *githttp.BasicAuth, file *os.File) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, remote, nil)
+	if err != nil {
+		return "", err
+	}
+	if auth != nil {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	res, err := sourceHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the download of %s failed with status %d", req.URL.Redacted(), res.StatusCode)
+	}
+	hash := sha256.New()
+	if _, err := limitedDownload(io.MultiWriter(file, hash), res, maxSourceDownloadSize); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// fetchArchive downloads the archive of the spec and extracts it to the clone path,
+// it returns the digest of the archive.
+func fetchArchive(spec CloneSpec, clonePath string, auth *githttp.BasicAuth, logger *log.Logger) (string, error) {
+	archiveURL, err := url.Parse(spec.Remote)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse remote: %w", err)
+	}
+	if archiveURL.Scheme != "https" {
+		return "", errors.New("the archives can only be downloaded over https")
+	}
+	workDir, err := newSourceWorkDir(clonePath)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = os.RemoveAll(workDir)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), sourceFetchTimeout)
+	defer cancel()
+
+	logger.Print("downloading ", archiveURL.Redacted())
+	file, err := os.Create(filepath.Join(workDir, "archive"))
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	digest, err := downloadArchive(ctx, spec.Remote, auth, file)
+	if err != nil {
+		return "", err
+	}
+	if spec.Checksum != "" && digest != spec.Checksum {
+		return "", fmt.Errorf("the checksum of the archive %s does not match the expected checksum %s", digest, spec.Checksum)
+	}
+
+	logger.Print("extracting the archive ", digest, " to ", clonePath)
+	contentDir := filepath.Join(workDir, "content")
+	if err := os.Mkdir(contentDir, 0755); err != nil {
+		return "", err
+	}
+	root, err := os.OpenRoot(contentDir)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+	if err := extractArchive(file, root, newExtractionBudget(ctx)); err != nil {
+		return "", err
+	}
+	return digest, installExtracted(contentDir, clonePath)
+}
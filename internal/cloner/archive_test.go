@@ -0,0 +1,336 @@
+package cloner
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testArchiveEntry is a file, a directory or a link of a test archive
+type testArchiveEntry struct {
+	name     string
+	content  string
+	typeflag byte
+	link     string
+}
+
+func tarArchive(t *testing.T, entries []testArchiveEntry) []byte {
+	t.Helper()
+	buffer := bytes.Buffer{}
+	writer := tar.NewWriter(&buffer)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Linkname: entry.link, Mode: 0o644}
+		switch entry.typeflag {
+		case tar.TypeReg:
+			header.Size = int64(len(entry.content))
+		case tar.TypeDir:
+			header.Mode = 0o755
+		}
+		require.NoError(t, writer.WriteHeader(header))
+		if entry.typeflag == tar.TypeReg {
+			_, err := io.WriteString(writer, entry.content)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+func gzipArchive(t *testing.T, content []byte) []byte {
+	t.Helper()
+	buffer := bytes.Buffer{}
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+func zipArchive(t *testing.T, entries []testArchiveEntry) []byte {
+	t.Helper()
+	buffer := bytes.Buffer{}
+	writer := zip.NewWriter(&buffer)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		content := entry.content
+		switch entry.typeflag {
+		case tar.TypeSymlink:
+			header.SetMode(os.ModeSymlink | 0o777)
+			content = entry.link
+		case tar.TypeDir:
+			header.SetMode(os.ModeDir | 0o755)
+		default:
+			header.SetMode(0o644)
+		}
+		file, err := writer.CreateHeader(header)
+		require.NoError(t, err)
+		_, err = io.WriteString(file, content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+// extractTestArchive extracts an archive in a directory of a temporary directory, so that
+// the escapes can be detected in its parent.
+func extractTestArchive(t *testing.T, archive []byte) (string, error) {
+	t.Helper()
+	parent := t.TempDir()
+	archivePath := filepath.Join(parent, "archive")
+	require.NoError(t, os.WriteFile(archivePath, archive, 0o644))
+	file, err := os.Open(archivePath)
+	require.NoError(t, err)
+	defer func() {
+		_ = file.Close()
+	}()
+	contentDir := filepath.Join(parent, "content")
+	require.NoError(t, os.Mkdir(contentDir, 0o755))
+	root, err := os.OpenRoot(contentDir)
+	require.NoError(t, err)
+	defer func() {
+		_ = root.Close()
+	}()
+	return contentDir, extractArchive(file, root, newExtractionBudget(context.Background()))
+}
+
+// setSourceLimits lowers the limits of the sources for a test
+func setSourceLimits(t *testing.T, download int64, extracted int64, entries int) {
+	t.Helper()
+	previousDownload, previousExtracted, previousEntries := maxSourceDownloadSize, maxSourceExtractedSize, maxSourceEntries
+	maxSourceDownloadSize, maxSourceExtractedSize, maxSourceEntries = download, extracted, entries
+	t.Cleanup(func() {
+		maxSourceDownloadSize, maxSourceExtractedSize, maxSourceEntries = previousDownload, previousExtracted, previousEntries
+	})
+}
+
+func TestArchiveFormat(t *testing.T) {
+	tarContent := tarArchive(t, []testArchiveEntry{{name: "README.md", content: "hello", typeflag: tar.TypeReg}})
+	cases := []struct {
+		name    string
+		content []byte
+		format  string
+	}{
+		{name: "zip", content: zipArchive(t, []testArchiveEntry{{name: "README.md", content: "hello"}}), format: zipFormat},
+		{name: "empty zip", content: zipArchive(t, nil), format: zipFormat},
+		{name: "gzip", content: gzipArchive(t, tarContent), format: gzipFormat},
+		{name: "bzip2", content: []byte("BZh91AY&SY"), format: bzip2Format},
+		{name: "tar", content: tarContent, format: tarFormat},
+		{name: "text", content: []byte("<html>not found</html>")},
+		{name: "empty", content: []byte{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			format, err := archiveFormat(bytes.NewReader(tc.content))
+			if tc.format == "" {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.format, format)
+			}
+		})
+	}
+}
+
+func TestArchiveName(t *testing.T) {
+	for remote, expected := range map[string]string{
+		"https://example.org/files/data.tar.gz":                "data",
+		"https://example.org/files/data.TGZ?download=1":        "data",
+		"https://example.org/group/project/-/archive/main.zip": "main",
+		"https://example.org/files/data":                       "data",
+	} {
+		name, err := archiveName(remote)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, name, remote)
+	}
+	_, err := archiveName("https://example.org/files/.tar.gz")
+	assert.Error(t, err)
+}
+
+func TestExtractArchiveEscapes(t *testing.T) {
+	cases := []struct {
+		name    string
+		archive func(t *testing.T) []byte
+		// The files expected in the extraction directory
+		files map[string]string
+		err   bool
+	}{
+		{
+			name: "parent directories are dropped",
+			archive: func(t *testing.T) []byte {
+				return tarArchive(t, []testArchiveEntry{
+					{name: "../../escaped.txt", content: "parent", typeflag: tar.TypeReg},
+					{name: "/absolute.txt", content: "absolute", typeflag: tar.TypeReg},
+					{name: "dir/../../inner.txt", content: "inner", typeflag: tar.TypeReg},
+				})
+			},
+			files: map[string]string{"escaped.txt": "parent", "absolute.txt": "absolute", "inner.txt": "inner"},
+		},
+		{
+			name: "zip parent directories are dropped",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, []testArchiveEntry{{name: "../escaped.txt", content: "parent"}})
+			},
+			files: map[string]string{"escaped.txt": "parent"},
+		},
+		{
+			name: "file through a symlink to the parent",
+			archive: func(t *testing.T) []byte {
+				return tarArchive(t, []testArchiveEntry{
+					{name: "link", typeflag: tar.TypeSymlink, link: ".."},
+					{name: "link/escaped.txt", content: "escaped", typeflag: tar.TypeReg},
+				})
+			},
+			err: true,
+		},
+		{
+			name: "file through an absolute symlink",
+			archive: func(t *testing.T) []byte {
+				return gzipArchive(t, tarArchive(t, []testArchiveEntry{
+					{name: "link", typeflag: tar.TypeSymlink, link: "/tmp"},
+					{name: "link/escaped.txt", content: "escaped", typeflag: tar.TypeReg},
+				}))
+			},
+			err: true,
+		},
+		{
+			name: "zip file through a symlink to the parent",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, []testArchiveEntry{
+					{name: "link", typeflag: tar.TypeSymlink, link: "../"},
+					{name: "link/escaped.txt", content: "escaped"},
+				})
+			},
+			err: true,
+		},
+		{
+			name: "hard link to a file outside",
+			archive: func(t *testing.T) []byte {
+				return tarArchive(t, []testArchiveEntry{
+					{name: "passwd", typeflag: tar.TypeLink, link: "../../../../etc/passwd"},
+				})
+			},
+			err: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			contentDir, err := extractTestArchive(t, tc.archive(t))
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			for name, content := range tc.files {
+				assert.Equal(t, content, readTestFile(t, contentDir, name))
+			}
+			// Nothing is written next to the extraction directory
+			entries, err := os.ReadDir(filepath.Dir(contentDir))
+			require.NoError(t, err)
+			names := []string{}
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			assert.ElementsMatch(t, []string{"archive", "content"}, names)
+			_, err = os.Stat("/tmp/escaped.txt")
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	bomb := gzipArchive(t, tarArchive(t, []testArchiveEntry{
+		{name: "zeros-1", content: strings.Repeat("\x00", 4096), typeflag: tar.TypeReg},
+		{name: "zeros-2", content: strings.Repeat("\x00", 4096), typeflag: tar.TypeReg},
+	}))
+	setSourceLimits(t, 1<<20, 6000, 100)
+	_, err := extractTestArchive(t, bomb)
+	assert.ErrorIs(t, err, errExtractedTooLarge)
+
+	zipBomb := zipArchive(t, []testArchiveEntry{{name: "zeros", content: strings.Repeat("\x00", 8192)}})
+	_, err = extractTestArchive(t, zipBomb)
+	assert.ErrorIs(t, err, errExtractedTooLarge)
+
+	manyEntries := []testArchiveEntry{}
+	for range 101 {
+		manyEntries = append(manyEntries, testArchiveEntry{name: "dir/", typeflag: tar.TypeDir})
+	}
+	_, err = extractTestArchive(t, tarArchive(t, manyEntries))
+	assert.ErrorContains(t, err, "more than 100 entries")
+}
+
+// serveArchive serves an archive over https and makes the sources use the client of the server
+func serveArchive(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	previous := sourceHTTPClient
+	sourceHTTPClient = server.Client()
+	t.Cleanup(func() { sourceHTTPClient = previous })
+	return server
+}
+
+func TestFetchArchive(t *testing.T) {
+	archive := gzipArchive(t, tarArchive(t, []testArchiveEntry{
+		{name: "project-main/", typeflag: tar.TypeDir},
+		{name: "project-main/README.md", content: "hello", typeflag: tar.TypeReg},
+	}))
+	sum := sha256.Sum256(archive)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	server := serveArchive(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(archive)
+	})
+	logger := log.New(io.Discard, "", 0)
+
+	cases := []struct {
+		name     string
+		checksum string
+		download int64
+		err      string
+	}{
+		{name: "without checksum"},
+		{name: "matching checksum", checksum: digest},
+		{name: "checksum mismatch", checksum: "sha256:" + strings.Repeat("0", 64), err: "does not match the expected checksum"},
+		{name: "download too large", download: int64(len(archive) - 1), err: "larger than the maximum size"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.download > 0 {
+				setSourceLimits(t, tc.download, maxSourceExtractedSize, maxSourceEntries)
+			}
+			clonePath := filepath.Join(t.TempDir(), "project")
+			fetched, err := fetchArchive(CloneSpec{Remote: server.URL + "/project-main.tar.gz", Checksum: tc.checksum}, clonePath, nil, logger)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				_, err = os.Stat(clonePath)
+				assert.True(t, os.IsNotExist(err), "nothing is installed at the clone path")
+				entries, err := os.ReadDir(filepath.Dir(clonePath))
+				require.NoError(t, err)
+				assert.Empty(t, entries, "the work directory is removed")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, digest, fetched)
+			assert.Equal(t, "hello", readTestFile(t, clonePath, "README.md"))
+		})
+	}
+}
+
+func TestFetchArchiveRequiresHTTPS(t *testing.T) {
+	_, err := fetchArchive(CloneSpec{Remote: "http://example.org/data.tar.gz"}, filepath.Join(t.TempDir(), "data"), nil, log.New(io.Discard, "", 0))
+	assert.ErrorContains(t, err, "https")
+}
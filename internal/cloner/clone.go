@@ -18,8 +18,11 @@ package cloner
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -39,12 +42,30 @@ const RevisionFlag string = "revision"
 const PathFlag string = "path"
 const VerboseFlag string = "verbose"
 const StrategyFlag string = "strategy"
+const DepthFlag string = "depth"
+const SparseCheckoutFlag string = "sparse-checkout"
+const SubmodulesFlag string = "submodules"
+const TypeFlag string = "type"
+const ChecksumFlag string = "checksum"
+
+// Source types
+
+const GitSource string = "git"         // A git repository
+const ArchiveSource string = "archive" // A tar or zip archive downloaded over https
+const OCISource string = "oci"         // An OCI artifact pulled from a registry
 
 // Pre cloning strategies
 
 const NotIfExist string = "notifexist" // Do not clone if target already exists
 const Overwrite string = "overwrite"   // Remove target first if it exists
 const NoStrategy string = "nostrategy" // Let git handle the situation
+const Update string = "update"         // Fast-forward the target if it exists and its worktree is clean
+
+// Submodule policies
+
+const NoSubmodules string = "none"             // Do not clone the submodules
+const ShallowSubmodules string = "shallow"     // Clone the submodules with a depth of 1
+const RecursiveSubmodules string = "recursive" // Clone the submodules recursively with their whole history
 
 var (
 	configPath           string
@@ -52,22 +73,146 @@ var (
 	revision             string
 	path                 string
 	verbose              bool
+	depth                int
+	sparseCheckout       []string
 	PreCloningStrategies []string = []string{
-		NotIfExist, Overwrite, NoStrategy,
+		NotIfExist, Overwrite, NoStrategy, Update,
 	}
 	preCloningStrategy = newEnum(PreCloningStrategies, NoStrategy)
 )
 
+var (
+	checksum    string
+	SourceTypes []string = []string{
+		GitSource, ArchiveSource, OCISource,
+	}
+	sourceType = newEnum(SourceTypes, GitSource)
+)
+
+var (
+	SubmodulePolicies []string = []string{
+		NoSubmodules, ShallowSubmodules, RecursiveSubmodules,
+	}
+	submodulePolicy = newEnum(SubmodulePolicies, RecursiveSubmodules)
+)
+
 type CloneFonfig struct {
 	Username   *string `yaml:"username,omitempty"`
 	PrivateKey *string `yaml:"privateKey,omitempty"`
 	Password   string  `yaml:"password"`
 }
 
-func applyPreCloningStrategy(clonePath string) {
-	if preCloningStrategy.Equal(NoStrategy) {
-		log.Print("no strategy selected, let git handle the this.")
-		return
+// CloneSpec is the configuration of a repository to clone
+type CloneSpec struct {
+	// The type of the source, a git repository when empty
+	Type       string `json:"type,omitempty"`
+	Remote     string `json:"remote"`
+	Revision   string `json:"revision,omitempty"`
+	Path       string `json:"path,omitempty"`
+	ConfigPath string `json:"configPath,omitempty"`
+	// The pre cloning strategy, no strategy is applied when empty
+	Strategy       string   `json:"strategy,omitempty"`
+	Depth          int      `json:"depth,omitempty"`
+	SparseCheckout []string `json:"sparseCheckout,omitempty"`
+	// The submodule policy, the submodules are cloned recursively when empty
+	Submodules string `json:"submodules,omitempty"`
+	// The LFS configuration, the LFS pointers are left as they are when nil
+	LFS *LFSSpec `json:"lfs,omitempty"`
+	// The sha256 digest of an archive, e.g. sha256:<hex>, the archive is not verified when empty
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// isGit tells whether the source of the spec is a git repository
+func (s CloneSpec) isGit() bool {
+	return s.Type == "" || s.Type == GitSource
+}
+
+// validate checks the options of the spec which are not validated by the flags of the clone command
+func (s CloneSpec) validate() error {
+	if s.Remote == "" {
+		return errors.New("the remote is required")
+	}
+	if s.Type != "" && !slices.Contains(SourceTypes, s.Type) {
+		return fmt.Errorf("%s is not included in %s", s.Type, strings.Join(SourceTypes, ","))
+	}
+	if !s.isGit() && s.Strategy == Update {
+		return fmt.Errorf("the %s strategy only applies to git repositories", Update)
+	}
+	if s.Checksum != "" && s.Type != ArchiveSource {
+		return errors.New("the checksum only applies to archives")
+	}
+	if s.Checksum != "" && !checksumRegexp.MatchString(s.Checksum) {
+		return fmt.Errorf("the checksum %s is not a sha256 digest", s.Checksum)
+	}
+	if s.Strategy != "" && !slices.Contains(PreCloningStrategies, s.Strategy) {
+		return fmt.Errorf("%s is not included in %s", s.Strategy, strings.Join(PreCloningStrategies, ","))
+	}
+	if s.Submodules != "" && !slices.Contains(SubmodulePolicies, s.Submodules) {
+		return fmt.Errorf("%s is not included in %s", s.Submodules, strings.Join(SubmodulePolicies, ","))
+	}
+	if s.LFS != nil {
+		return s.LFS.validate()
+	}
+	return nil
+}
+
+// projectName returns the name of the repository, the archive or the OCI artifact
+func (s CloneSpec) projectName() (string, error) {
+	switch s.Type {
+	case ArchiveSource:
+		return archiveName(s.Remote)
+	case OCISource:
+		reference, err := parseOCIReference(s.Remote)
+		if err != nil {
+			return "", err
+		}
+		return reference.name(), nil
+	}
+
+	endpoint, err := transport.NewEndpoint(s.Remote)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse remote: %w", err)
+	}
+
+	splittedRepo := strings.FieldsFunc(endpoint.Path, func(c rune) bool { return c == '/' }) // FieldsFunc handles repeated and beginning/ending separator characters more sanely than Split
+	if len(splittedRepo) == 0 {
+		return "", fmt.Errorf("expecting repo in url path, received: %s", endpoint.Path)
+	}
+	projectName := splittedRepo[len(splittedRepo)-1]
+	return strings.TrimSuffix(projectName, ".git"), nil
+}
+
+// clonePath returns the path of the repository, the name of the project is appended to the path of the spec
+func (s CloneSpec) clonePath() (string, error) {
+	projectName, err := s.projectName()
+	if err != nil {
+		return "", err
+	}
+
+	if s.Path != "" {
+		return s.Path + "/" + projectName, nil
+	}
+	return projectName, nil
+}
+
+// CloneOutcome describes the repository left by cloneRepository
+type CloneOutcome struct {
+	ClonePath string
+	// The commit checked out in the repository
+	Commit string
+	// Whether the clone was skipped because the repository already exists
+	Skipped bool
+	// The outcome of fetching the LFS objects, nil when the spec has no LFS configuration
+	LFS *LFSResult
+	// How the existing repository was updated, nil unless the update strategy is used
+	Update *UpdateResult
+}
+
+// applyPreCloningStrategy prepares the clone path, it returns true when the existing clone has to be kept
+func applyPreCloningStrategy(clonePath string, strategy string, logger *log.Logger) (bool, error) {
+	if strategy == "" || strategy == NoStrategy {
+		logger.Print("no strategy selected, let git handle the this.")
+		return false, nil
 	}
 
 	// check if target exists
@@ -75,93 +220,293 @@ func applyPreCloningStrategy(clonePath string) {
 
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			log.Print(clonePath, " does not exist, nothing to be done.")
-			return
+			logger.Print(clonePath, " does not exist, nothing to be done.")
+			return false, nil
 		}
 
-		log.Fatal("unexpected error: ", err)
+		return false, fmt.Errorf("unexpected error: %w", err)
+	}
+
+	if strategy == NotIfExist {
+		logger.Print(clonePath, " already exist, doing nothing.")
+		return true, nil
 	}
 
-	if preCloningStrategy.Equal(NotIfExist) {
-		log.Print(clonePath, " already exist, doing nothing.")
-		os.Exit(0)
+	if strategy == Update {
+		logger.Print(clonePath, " already exist, updating it.")
+		return true, nil
 	}
 
-	if preCloningStrategy.Equal(Overwrite) {
-		log.Print(clonePath, " exists, deleting it.")
+	if strategy == Overwrite {
+		logger.Print(clonePath, " exists, deleting it.")
 		err = os.RemoveAll(clonePath + "/")
 		if err != nil {
-			log.Fatal("failed to remove existing clone: ", err)
+			return false, fmt.Errorf("failed to remove existing clone: %w", err)
 		}
 	}
+	return false, nil
 }
 
-func clone(cmd *cobra.Command, args []string) {
+// cloneAuth returns the credentials of the spec, it is nil for the repositories without a configuration
+func cloneAuth(spec CloneSpec) (transport.AuthMethod, error) {
+	if spec.ConfigPath == "" {
+		return nil, nil
+	}
+	return readCloneConfig(spec.ConfigPath)
+}
+
+// sourceAuth returns the credentials used to download an archive or pull an OCI artifact,
+// the configuration is the same as for the git repositories without the private key.
+func sourceAuth(spec CloneSpec) (*http.BasicAuth, error) {
+	auth, err := cloneAuth(spec)
+	if err != nil || auth == nil {
+		return nil, err
+	}
+	basicAuth, ok := auth.(*http.BasicAuth)
+	if !ok {
+		return nil, fmt.Errorf("an %s source cannot be fetched with a private key", spec.Type)
+	}
+	return basicAuth, nil
+}
+
+// fetchSource downloads the archive or pulls the OCI artifact of the spec to the clone path,
+// it returns the digest of the archive or of the manifest of the artifact.
+func fetchSource(spec CloneSpec, clonePath string, logger *log.Logger) (string, error) {
+	auth, err := sourceAuth(spec)
+	if err != nil {
+		return "", err
+	}
+	if spec.Type == ArchiveSource {
+		return fetchArchive(spec, clonePath, auth, logger)
+	}
+	return fetchOCIArtifact(spec, clonePath, auth, logger)
+}
 
-	endpoint, err := transport.NewEndpoint(remote)
+// readCloneConfig reads the credentials used to clone a repository
+func readCloneConfig(configPath string) (transport.AuthMethod, error) {
+	buf, err := os.ReadFile(configPath)
 	if err != nil {
-		log.Fatal("failed to parse remote: ", err)
+		return nil, fmt.Errorf("failed to read configuration file: %w", err)
 	}
 
-	splittedRepo := strings.FieldsFunc(endpoint.Path, func(c rune) bool { return c == '/' }) // FieldsFunc handles repeated and beginning/ending separator characters more sanely than Split
-	if len(splittedRepo) == 0 {
-		log.Fatal("expecting repo in url path, received: ", endpoint.Path)
+	cloneFonfig := &CloneFonfig{}
+	err = yaml.Unmarshal(buf, cloneFonfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse configuration: %w", err)
 	}
-	projectName := splittedRepo[len(splittedRepo)-1]
-	projectName = strings.TrimSuffix(projectName, ".git")
 
-	clonePath := projectName
-	if path != "" {
-		clonePath = path + "/" + projectName
+	if cloneFonfig.PrivateKey == nil && cloneFonfig.Username == nil {
+		return nil, errors.New("invalid authentication configuration one username or privateKey must be set")
 	}
 
-	applyPreCloningStrategy(clonePath)
+	if cloneFonfig.PrivateKey != nil {
+		publicKeys, err := ssh.NewPublicKeys("git", []byte(*cloneFonfig.PrivateKey), cloneFonfig.Password)
+		if err != nil {
+			return nil, fmt.Errorf("generate public keys failed: %w", err)
+		}
+		return publicKeys, nil
+	}
+	return &http.BasicAuth{
+		Username: *cloneFonfig.Username,
+		Password: cloneFonfig.Password,
+	}, nil
+}
+
+// headCommit returns the commit checked out in a repository
+func headCommit(repository *git.Repository) (string, error) {
+	head, err := repository.Head()
+	if err != nil {
+		return "", err
+	}
+	return head.Hash().String(), nil
+}
+
+// cloneRepository clones the repository of the spec, the progress of the clone is written to progress when it is not nil
+func cloneRepository(spec CloneSpec, logger *log.Logger, progress io.Writer) (CloneOutcome, error) {
+	if err := spec.validate(); err != nil {
+		return CloneOutcome{}, err
+	}
+	clonePath, err := spec.clonePath()
+	if err != nil {
+		return CloneOutcome{}, err
+	}
+	outcome := CloneOutcome{ClonePath: clonePath}
+
+	exists, err := applyPreCloningStrategy(clonePath, spec.Strategy, logger)
+	if err != nil {
+		return outcome, err
+	}
+	if exists {
+		outcome.Skipped = true
+		if spec.Strategy == Update {
+			return updateExistingRepository(spec, outcome, progress, logger)
+		}
+		// The existing directory may not be a repository, e.g. when a previous clone failed
+		if repository, err := git.PlainOpen(clonePath); err == nil {
+			outcome.Commit, _ = headCommit(repository)
+		}
+		return outcome, nil
+	}
+
+	if !spec.isGit() {
+		outcome.Commit, err = fetchSource(spec, clonePath, logger)
+		if err != nil {
+			return outcome, fmt.Errorf("%s fetch failed: %w", spec.Type, err)
+		}
+		return outcome, nil
+	}
 
 	// Clone the given repository to the given directory
-	log.Print("git clone ", remote, " to ", clonePath)
+	logger.Print("git clone ", spec.Remote, " to ", clonePath)
 
 	cloneOptions := git.CloneOptions{
-		URL:               remote,
+		URL:               spec.Remote,
 		SingleBranch:      true,
-		ReferenceName:     plumbing.ReferenceName(revision),
+		ReferenceName:     plumbing.ReferenceName(spec.Revision),
 		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
-		Progress:          os.Stdout,
+		ShallowSubmodules: spec.Submodules == ShallowSubmodules,
+		Depth:             spec.Depth,
+		// The sparse checkout is done after the clone
+		NoCheckout: len(spec.SparseCheckout) > 0,
+		Progress:   progress,
+	}
+	if spec.Submodules == NoSubmodules {
+		cloneOptions.RecurseSubmodules = git.NoRecurseSubmodules
 	}
 
-	if configPath != "" {
-		buf, err := os.ReadFile(configPath)
-		if err != nil {
-			log.Fatal("failed to read configuration file: ", err)
-		}
+	cloneOptions.Auth, err = cloneAuth(spec)
+	if err != nil {
+		return outcome, err
+	}
+
+	repository, err := git.PlainClone(clonePath, false, &cloneOptions)
+	if err != nil {
+		return outcome, fmt.Errorf("clone failed: %w", err)
+	}
 
-		cloneFonfig := &CloneFonfig{}
-		err = yaml.Unmarshal(buf, cloneFonfig)
+	if len(spec.SparseCheckout) > 0 {
+		err = checkoutSparsely(repository, &cloneOptions, spec, logger)
 		if err != nil {
-			log.Fatal("failed to parse configuration: ", err)
+			return outcome, fmt.Errorf("sparse checkout failed: %w", err)
 		}
+	}
 
-		if cloneFonfig.PrivateKey == nil && cloneFonfig.Username == nil {
-			log.Fatal("Invalid authentication configuration one username or privateKey must be set")
-		}
+	outcome.Commit, err = headCommit(repository)
+	if err != nil {
+		return outcome, err
+	}
+
+	if spec.LFS != nil {
+		outcome.LFS = applyLFSSpec(repository, clonePath, spec, cloneOptions.Auth, logger)
+	}
+	return outcome, nil
+}
+
+// applyLFSSpec fetches the LFS objects of a cloned repository according to its spec
+func applyLFSSpec(repository *git.Repository, clonePath string, spec CloneSpec, auth transport.AuthMethod, logger *log.Logger) *LFSResult {
+	// The repository is usable without its LFS objects, a failure is only reported
+	result := fetchLFSObjects(repository, clonePath, spec.Remote, auth, spec.LFS, logger)
+	if result.Error != "" {
+		logger.Print("the LFS objects were not fetched: ", result.Error)
+	}
+	return result
+}
+
+// updateExistingRepository applies the update strategy to an existing repository, since the repository is
+// usable as it is the failures are only reported in the update result.
+func updateExistingRepository(spec CloneSpec, outcome CloneOutcome, progress io.Writer, logger *log.Logger) (CloneOutcome, error) {
+	auth, err := cloneAuth(spec)
+	if err != nil {
+		outcome.Update = &UpdateResult{State: UpdateFailed, Error: err.Error()}
+		return outcome, nil
+	}
+	repository, update := updateRepository(spec, outcome.ClonePath, auth, progress, logger)
+	outcome.Update = update
+	if repository == nil {
+		return outcome, nil
+	}
+	outcome.Commit, _ = headCommit(repository)
+	if update.State != FastForwarded {
+		return outcome, nil
+	}
 
-		if cloneFonfig.PrivateKey != nil {
-			publicKeys, err := ssh.NewPublicKeys("git", []byte(*cloneFonfig.PrivateKey), cloneFonfig.Password)
-			if err != nil {
-				log.Fatal("generate public keys failed: ", err)
-			}
-			cloneOptions.Auth = publicKeys
-		} else if cloneFonfig.Username != nil {
-			cloneOptions.Auth = &http.BasicAuth{
-				Username: *cloneFonfig.Username,
-				Password: cloneFonfig.Password,
-			}
+	if spec.Submodules != NoSubmodules {
+		worktree, err := repository.Worktree()
+		if err == nil {
+			err = updateSubmodules(worktree, spec, auth)
 		}
+		if err != nil {
+			logger.Print("the submodules were not updated: ", err)
+			update.Error = err.Error()
+		}
+	}
+	if spec.LFS != nil {
+		outcome.LFS = applyLFSSpec(repository, outcome.ClonePath, spec, auth, logger)
+	}
+	return outcome, nil
+}
+
+func clone(cmd *cobra.Command, args []string) {
+	spec := CloneSpec{
+		Type:           sourceType.Value,
+		Remote:         remote,
+		Revision:       revision,
+		Path:           path,
+		ConfigPath:     configPath,
+		Strategy:       preCloningStrategy.Value,
+		Depth:          depth,
+		SparseCheckout: sparseCheckout,
+		Submodules:     submodulePolicy.Value,
+		Checksum:       checksum,
+	}
+	result := cloneWithResult(spec, log.Default(), os.Stdout)
+	reportResults([]CloneResult{result}, "", terminationMessagePath)
+	if result.State == Failed {
+		log.Fatal(result.Error)
+	}
+}
 
+// checkoutSparsely checks out the sparse checkout directories of a repository cloned without a checkout,
+// the submodules are then updated as they would have been by the clone.
+func checkoutSparsely(repository *git.Repository, cloneOptions *git.CloneOptions, spec CloneSpec, logger *log.Logger) error {
+	logger.Print("checking out ", strings.Join(spec.SparseCheckout, ", "))
+	head, err := repository.Head()
+	if err != nil {
+		return err
+	}
+	worktree, err := repository.Worktree()
+	if err != nil {
+		return err
+	}
+	checkoutOptions := git.CheckoutOptions{SparseCheckoutDirectories: spec.SparseCheckout}
+	if head.Name().IsBranch() {
+		checkoutOptions.Branch = head.Name()
+	} else {
+		checkoutOptions.Hash = head.Hash()
+	}
+	if err := worktree.Checkout(&checkoutOptions); err != nil {
+		return err
 	}
 
-	_, err = git.PlainClone(clonePath, false, &cloneOptions)
+	if cloneOptions.RecurseSubmodules == git.NoRecurseSubmodules {
+		return nil
+	}
+	return updateSubmodules(worktree, spec, cloneOptions.Auth)
+}
 
+// updateSubmodules initializes and updates the submodules of a worktree as the clone does with the submodule policy
+func updateSubmodules(worktree *git.Worktree, spec CloneSpec, auth transport.AuthMethod) error {
+	submodules, err := worktree.Submodules()
 	if err != nil {
-		log.Fatal("clone failed: ", err)
+		return err
+	}
+	submoduleOptions := git.SubmoduleUpdateOptions{
+		Init:              true,
+		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+		Auth:              auth,
+	}
+	if spec.Submodules == ShallowSubmodules {
+		submoduleOptions.Depth = 1
 	}
+	return submodules.Update(&submoduleOptions)
 }
@@ -0,0 +1,134 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const ParallelismFlag string = "parallelism"
+
+var (
+	parallelism            int
+	resultsDir             string
+	terminationMessagePath string
+)
+
+// CloneAllConfig is the configuration of the repositories cloned by the clone-all command
+type CloneAllConfig struct {
+	Repositories []CloneSpec `json:"repositories"`
+}
+
+func readCloneAllConfig(configPath string) (CloneAllConfig, error) {
+	config := CloneAllConfig{}
+	buf, err := os.ReadFile(configPath)
+	if err != nil {
+		return config, fmt.Errorf("failed to read configuration file: %w", err)
+	}
+	err = json.Unmarshal(buf, &config)
+	if err != nil {
+		return config, fmt.Errorf("failed to parse configuration: %w", err)
+	}
+	return config, nil
+}
+
+// cloneWithResult clones a repository and reports the outcome as a result
+func cloneWithResult(spec CloneSpec, logger *log.Logger, progress io.Writer) CloneResult {
+	start := time.Now()
+	outcome, err := cloneRepository(spec, logger, progress)
+	result := CloneResult{
+		Remote:    spec.Remote,
+		ClonePath: outcome.ClonePath,
+		Commit:    outcome.Commit,
+		LFS:       outcome.LFS,
+		Update:    outcome.Update,
+		Duration:  time.Since(start).Round(time.Millisecond).String(),
+	}
+	switch {
+	case err != nil:
+		logger.Print(err)
+		result.State = Failed
+		result.Error = err.Error()
+	case outcome.Update != nil && outcome.Update.updated():
+		result.State = Updated
+	case outcome.Skipped:
+		result.State = Skipped
+	default:
+		logger.Print("cloned ", outcome.Commit)
+		result.State = Cloned
+	}
+	return result
+}
+
+// cloneAllRepositories clones the repositories with at most parallelism clones at the same time,
+// the results are in the order of the repositories.
+func cloneAllRepositories(repositories []CloneSpec, parallelism int) []CloneResult {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	results := make([]CloneResult, len(repositories))
+	semaphore := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, spec := range repositories {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			// The logs of the repositories are interleaved, each line is prefixed with the remote
+			logger := log.New(log.Writer(), fmt.Sprintf("[%s] ", spec.Remote), log.Flags())
+			var progress io.Writer
+			if verbose {
+				progress = os.Stdout
+			}
+			results[i] = cloneWithResult(spec, logger, progress)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func cloneAll(cmd *cobra.Command, args []string) {
+	config, err := readCloneAllConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("cloning %d repositories, %d at a time", len(config.Repositories), parallelism)
+	results := cloneAllRepositories(config.Repositories, parallelism)
+
+	reportResults(results, resultsDir, terminationMessagePath)
+
+	failed := 0
+	for _, result := range results {
+		if result.State == Failed {
+			failed += 1
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d repositories could not be cloned", failed, len(results))
+	}
+}
@@ -1,45 +1,105 @@
 package cloner
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
-	"golang.org/x/sys/unix"
+	"github.com/SwissDataScienceCenter/amalthea/internal/oauth"
 )
 
 type Cloner struct {
 	config     CloneConfig
 	user       User
 	remoteName string
+	// The git tokens of the providers, reused for the repositories of the same provider until they expire
+	tokenSources map[string]*oauth.TokenSource
 }
 
 func (c *Cloner) Run() error {
+	results := []CloneResult{}
+	var err error
 	for _, repository := range c.config.Repositories {
 		log.Println("Processing", repository.URL)
-		err := c.execute(repository)
+		start := time.Now()
+		var result CloneResult
+		result, err = c.execute(repository)
+		result.Duration = time.Since(start).Round(time.Millisecond).String()
+		if err != nil && result.Error == "" {
+			result.State = Failed
+			result.Error = err.Error()
+		}
+		results = append(results, result)
 		if err != nil {
-			return err
+			break
 		}
 	}
-	return nil
+	reportResults(results, c.config.ResultsDir, c.config.TerminationMessagePath)
+	return err
 }
 
 func (c *Cloner) proxyURL() string {
 	return fmt.Sprintf("http://localhost:%v", c.config.GitProxyPort)
 }
 
-func (c *Cloner) execute(repository Repository) error {
+// execute clones a repository, a failed clone is reported in the result while the returned
+// error stops the cloning of the remaining repositories.
+func (c *Cloner) execute(repository Repository) (CloneResult, error) {
+	result := CloneResult{Remote: repository.URL, ClonePath: repository.clonePath}
 	if repository.Exists() {
-		log.Println("Repository exists, skipping cloning.")
-		return c.setupProxy(repository)
+		result.State = Skipped
+		switch repository.Strategy {
+		case "", NotIfExist:
+			log.Println("Repository exists, skipping cloning.")
+		case Update:
+			log.Println("Repository exists, updating it.")
+			c.setCredentials(repository)
+			result.Update = c.update(repository)
+			if result.Update.updated() {
+				result.State = Updated
+			}
+		default:
+			return result, fmt.Errorf("unknown strategy %s for an existing repository", repository.Strategy)
+		}
+		result.Commit = repository.HeadCommit()
+		return result, c.setupProxy(repository)
 	}
 	log.Println("Setting up repository.")
 
+	err := c.initializeRepository(repository)
+	if err != nil {
+		return result, err
+	}
+
+	c.setCredentials(repository)
+
+	result.LFS, err = c.clone(repository)
+	if err != nil {
+		log.Printf("Cloning failed for %v: %v\n", repository.URL, err)
+		result.State = Failed
+		result.Error = err.Error()
+		return result, os.WriteFile(
+			filepath.Join(repository.clonePath, "ERROR"),
+			[]byte(fmt.Sprintf("Cannot clone %v:\n %v", repository.URL, err)),
+			0644,
+		)
+	}
+	result.State = Cloned
+	result.Commit = repository.HeadCommit()
+
+	return result, c.setupProxy(repository)
+}
+
+// setCredentials sets the credentials of the provider of the repository in its git client,
+// the repository is fetched without credentials when no token can be acquired.
+func (c *Cloner) setCredentials(repository Repository) {
 	gitUser := "oauth2"
 	var gitAccessToken string
 	var err error
@@ -50,13 +110,6 @@ func (c *Cloner) execute(repository Repository) error {
 			log.Printf("Failed to acquire token: %v\n", err)
 			log.Println("Continuing without credentials")
 		}
-	} else {
-		gitAccessToken = ""
-	}
-
-	err = c.initializeRepository(repository)
-	if err != nil {
-		return err
 	}
 
 	if c.user.IsAnonymous() || gitAccessToken == "" {
@@ -64,18 +117,6 @@ func (c *Cloner) execute(repository Repository) error {
 	}
 
 	repository.Cli.SetCredentials(gitUser, gitAccessToken)
-
-	err = c.clone(repository)
-	if err != nil {
-		log.Printf("Cloning failed for %v: %v\n", repository.URL, err)
-		return os.WriteFile(
-			filepath.Join(repository.clonePath, "ERROR"),
-			[]byte(fmt.Sprintf("Cannot clone %v:\n %v", repository.URL, err)),
-			0644,
-		)
-	}
-
-	return c.setupProxy(repository)
 }
 
 func (c *Cloner) setupProxy(repository Repository) error {
@@ -89,8 +130,49 @@ func (c *Cloner) setupProxy(repository Repository) error {
 	if err != nil {
 		return err
 	}
-	_, err = repository.Cli.Config([]string{"http.sslVerify", "false"})
-	return err
+	if c.config.GitProxyCACertPath == "" {
+		log.Println("Warning: The git proxy has no CA, disabling SSL verification")
+		_, err = repository.Cli.Config([]string{"http.sslVerify", "false"})
+		return err
+	}
+
+	// Repositories cloned by a previous version have SSL verification disabled, the error
+	// returned when the option is not set is ignored.
+	_, _ = repository.Cli.Config([]string{"--unset", "http.sslVerify"})
+	// NOTE: The proxy intercepts only the connections to the hosts of the repositories with a provider,
+	// the other hosts present their own certificate which is verified with the system CAs.
+	for _, remote := range c.interceptedRemotes() {
+		log.Println("Trusting the git proxy CA for", remote)
+		_, err = repository.Cli.Config([]string{fmt.Sprintf("http.%s.sslCAInfo", remote), c.config.GitProxyCACertPath})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interceptedRemotes returns the scheme and host of the repositories for which the git proxy adds credentials
+func (c *Cloner) interceptedRemotes() []string {
+	remotes := []string{}
+	for _, repository := range c.config.Repositories {
+		if repository.Provider == "" || !slices.ContainsFunc(c.config.GitProviders, func(provider GitProvider) bool {
+			return provider.Id == repository.Provider
+		}) {
+			continue
+		}
+		remoteURL, err := url.Parse(repository.URL)
+		if err != nil || remoteURL.Scheme != "https" {
+			continue
+		}
+		// The proxy treats the host with and without "www." as the same host
+		host := strings.TrimPrefix(remoteURL.Host, "www.")
+		for _, remote := range []string{"https://" + host + "/", "https://www." + host + "/"} {
+			if !slices.Contains(remotes, remote) {
+				remotes = append(remotes, remote)
+			}
+		}
+	}
+	return remotes
 }
 
 func (c *Cloner) getAccessToken(providerId string) (string, error) {
@@ -108,42 +190,22 @@ func (c *Cloner) getAccessToken(providerId string) (string, error) {
 		return "", nil
 	}
 
-	log.Printf("Get token for: %v\n", provider.Id)
-	req, err := http.NewRequest(http.MethodGet, provider.AccessTokenUrl, nil)
-	if err != nil {
-		return "", err
-	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.user.RenkuToken))
-	// NOTE: Without the function below the authorization header is taken out before the request
-	// even hits the gateway proxy and therefore the token never reaches the gateway-auth module
-	// that swaps this authorization token for a gitlab token.
-	preserveAuthzHeader := func(req *http.Request, via []*http.Request) error {
-		if len(via) == 0 {
-			return nil
-		}
-		authz := via[0].Header.Get("Authorization")
-		if authz == "" {
-			return nil
-		}
-		req.Header.Set("Authorization", authz)
-		return nil
-	}
-	cl := http.Client{Timeout: time.Second * 30, CheckRedirect: preserveAuthzHeader}
-	res, err := cl.Do(req)
-	if err != nil {
-		return "", err
-	}
-	if res.StatusCode != 200 {
-		return "", fmt.Errorf("cannot exchange renku token for git token, failed with status code: %d", res.StatusCode)
-	}
-	var parsed RefreshTokenAnswer
-	err = json.NewDecoder(res.Body).Decode(&parsed)
-	if err != nil {
-		return "", err
+	source, exists := c.tokenSources[provider.Id]
+	if !exists {
+		accessTokenURL := provider.AccessTokenUrl
+		source = oauth.NewTokenSource(
+			"git-"+provider.Id,
+			func(ctx context.Context) (oauth.Token, error) {
+				log.Printf("Get token for: %v\n", providerId)
+				return oauth.ExchangeRenkuToken(ctx, nil, accessTokenURL, c.user.RenkuToken)
+			},
+			// The token is exchanged for every repository when its expiry is unknown
+			oauth.WithExpiryRequired(),
+			oauth.WithRetry(3, time.Second),
+		)
+		c.tokenSources[provider.Id] = source
 	}
-
-	return parsed.AccessToken, nil
+	return source.AccessToken(context.Background())
 }
 
 func (c *Cloner) initializeRepository(repository Repository) error {
@@ -174,34 +236,63 @@ func (c *Cloner) initializeRepository(repository Repository) error {
 	return err
 }
 
-func (c *Cloner) clone(repository Repository) error {
+// clone fetches and checks out a repository, the outcome of fetching the LFS objects is returned.
+func (c *Cloner) clone(repository Repository) (*LFSResult, error) {
 	log.Printf("Cloning repository %v from %v\n", repository.clonePath, repository.URL)
-	args := []string{"install"}
-	if !c.config.LfsAutoFetch {
-		args = append(args, "--skip-smudge")
+	lfsSpec := c.lfsSpec(repository)
+	if err := lfsSpec.validate(); err != nil {
+		return nil, err
 	}
-	args = append(args, "--local")
-	_, err := repository.Cli.Lfs(args)
+	// The LFS objects are fetched after the checkout according to the LFS policy
+	_, err := repository.Cli.Lfs([]string{"install", "--skip-smudge", "--local"})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// The only possible error is that the remote already exists
 	_, err = repository.Cli.Remote([]string{"add", c.remoteName, repository.URL})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = repository.Cli.Fetch([]string{c.remoteName})
+	if repository.Filter != "" {
+		// The same configuration as set by git clone --filter
+		log.Println("Fetching with the partial clone filter", repository.Filter)
+		for _, option := range [][]string{
+			{fmt.Sprintf("remote.%s.promisor", c.remoteName), "true"},
+			{fmt.Sprintf("remote.%s.partialclonefilter", c.remoteName), repository.Filter},
+		} {
+			if _, err = repository.Cli.Config(option); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	fetchArgs := []string{c.remoteName}
+	if repository.Depth > 0 {
+		fetchArgs = append(fetchArgs, "--depth", strconv.Itoa(repository.Depth))
+	}
+	if repository.Filter != "" {
+		fetchArgs = append(fetchArgs, "--filter", repository.Filter)
+	}
+	_, err = repository.Cli.Fetch(fetchArgs)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if len(repository.SparseCheckout) > 0 {
+		log.Println("Checking out the directories", strings.Join(repository.SparseCheckout, ", "))
+		_, err = repository.Cli.SparseCheckout(append([]string{"set", "--cone", "--"}, repository.SparseCheckout...))
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	var branch string
 	if repository.Branch == nil {
 		branch, err = repository.DefaultBranch(c.remoteName)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	} else {
 		branch = *repository.Branch
@@ -210,41 +301,229 @@ func (c *Cloner) clone(repository Repository) error {
 		log.Println("Checking out branch", branch)
 		_, err = repository.Cli.Checkout([]string{branch})
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	if c.config.LfsAutoFetch {
-		log.Println("Dealing with LFS")
-		totalLfsSize := repository.GetLFSTotalSizeBytes()
-		log.Println("Lfs size:", totalLfsSize)
+	// The repository is usable without its LFS objects, a failure is only reported
+	lfs := c.applyLFSPolicy(repository, lfsSpec)
+	if lfs.Error != "" {
+		log.Println("The LFS objects were not fetched:", lfs.Error)
+	}
+
+	return lfs, c.updateSubmodules(repository)
+}
+
+// updateSubmodules initializes and updates the submodules of a repository according to its submodule policy
+func (c *Cloner) updateSubmodules(repository Repository) error {
+	var submoduleArgs []string
+	switch repository.Submodules {
+	case NoSubmodules:
+		log.Println("Skipping submodules")
+		return nil
+	case ShallowSubmodules:
+		submoduleArgs = []string{"update", "--init", "--recursive", "--depth", "1"}
+	case RecursiveSubmodules:
+		submoduleArgs = []string{"update", "--init", "--recursive"}
+	case "":
+		submoduleArgs = []string{"update", "--init"}
+	default:
+		return fmt.Errorf("unknown submodule policy %s", repository.Submodules)
+	}
+	log.Println("Dealing with submodules")
+	_, err := repository.Cli.Submodule(submoduleArgs)
+	if err != nil {
+		return fmt.Errorf("failed to inialize submodules: %v", err)
+	}
+	return nil
+}
+
+// update fetches the remote of an existing repository and fast-forwards the checked out branch
+// when the worktree is clean, otherwise the repository is left as it is and the divergence is reported.
+func (c *Cloner) update(repository Repository) *UpdateResult {
+	result := &UpdateResult{}
+	fail := func(err error) *UpdateResult {
+		log.Println("The repository was not updated:", err)
+		result.State = UpdateFailed
+		result.Error = err.Error()
+		return result
+	}
 
-		var stat unix.Statfs_t
-		err = unix.Statfs(repository.clonePath, &stat)
+	branch, err := repository.Cli.SymbolicRef([]string{"--short", "-q", "HEAD"})
+	if err != nil {
+		log.Println("No branch is checked out, nothing to update")
+		result.State = Detached
+		return result
+	}
+	branch = strings.TrimSpace(branch)
+
+	remoteBranch := fmt.Sprintf("%s/%s", c.remoteName, branch)
+	if err = c.fetchBranch(repository, remoteBranch); err != nil {
+		return fail(err)
+	}
+	counts, err := repository.Cli.RevList([]string{"--left-right", "--count", "HEAD..." + remoteBranch})
+	if err != nil {
+		return fail(err)
+	}
+	if _, err = fmt.Sscan(counts, &result.Ahead, &result.Behind); err != nil {
+		return fail(fmt.Errorf("unexpected rev-list output %q: %w", counts, err))
+	}
+	status, err := repository.Cli.Status([]string{"--porcelain", "--untracked-files=no"})
+	if err != nil {
+		return fail(err)
+	}
+	for _, line := range strings.Split(status, "\n") {
+		// Each line is the two letter status of a file followed by its path
+		if len(line) > 3 {
+			result.DirtyFiles = append(result.DirtyFiles, line[3:])
+		}
+	}
+	// The fast-forward refuses to overwrite the untracked files which are in the new commit
+	if len(result.DirtyFiles) == 0 && result.Ahead == 0 && result.Behind > 0 {
+		result.DirtyFiles, err = overwrittenUntrackedFiles(repository.Cli, remoteBranch)
 		if err != nil {
-			return err
+			return fail(err)
+		}
+	}
+
+	switch {
+	case len(result.DirtyFiles) > 0:
+		result.State = Dirty
+	case result.Ahead > 0 && result.Behind > 0:
+		result.State = Diverged
+	case result.Ahead > 0:
+		result.State = Ahead
+	case result.Behind == 0:
+		result.State = UpToDate
+	default:
+		log.Println("Fast-forwarding", branch, "to", remoteBranch)
+		if _, err = repository.Cli.Merge([]string{"--ff-only", remoteBranch}); err != nil {
+			return fail(err)
 		}
-		// Available blocks * size per block = available space in bytes
-		availableSpace := stat.Bavail * uint64(stat.Bsize)
-		if availableSpace < totalLfsSize {
-			return fmt.Errorf("not enough free space")
+		result.State = FastForwarded
+		if err = c.updateSubmodules(repository); err != nil {
+			log.Println("The submodules were not updated:", err)
+			result.Error = err.Error()
+		}
+	}
+	log.Printf("The repository is %s, %d commits ahead and %d behind with %d dirty files\n", result.State, result.Ahead, result.Behind, len(result.DirtyFiles))
+	return result
+}
+
+// fetchBranch fetches the remote, a shallow repository is deepened until the branch and its remote have
+// a commit in common so that a branch which is more commits behind than the depth is not reported as diverged.
+func (c *Cloner) fetchBranch(repository Repository, remoteBranch string) error {
+	fetchArgs := []string{c.remoteName}
+	if repository.Depth > 0 {
+		fetchArgs = append(fetchArgs, "--depth", strconv.Itoa(repository.Depth))
+	}
+	if _, err := repository.Cli.Fetch(fetchArgs); err != nil {
+		return err
+	}
+	depth := max(repository.Depth, 1)
+	for {
+		if _, err := repository.Cli.MergeBase([]string{"HEAD", remoteBranch}); err == nil {
+			return nil
 		}
-		_, err = repository.Cli.Lfs([]string{"install", "--local"})
+		shallow, err := repository.Cli.RevParse([]string{"--is-shallow-repository"})
 		if err != nil {
 			return err
 		}
-		_, err = repository.Cli.Lfs([]string{"pull"})
-		if err != nil {
+		// The whole history is fetched, the branch and its remote are unrelated
+		if strings.TrimSpace(shallow) != "true" {
+			return nil
+		}
+		if depth >= maxUpdateDepth {
+			return fmt.Errorf("the branch and its remote have no commit in common in the last %d commits", depth)
+		}
+		deepen := min(depth*4, maxUpdateDepth) - depth
+		log.Println("Deepening the history of", remoteBranch, "by", deepen, "commits")
+		if _, err := repository.Cli.Fetch([]string{c.remoteName, fmt.Sprintf("--deepen=%d", deepen)}); err != nil {
 			return err
 		}
-
+		depth += deepen
 	}
+}
 
-	log.Println("Dealing with submodules")
-	_, err = repository.Cli.Submodule([]string{"update", "--init"})
+// overwrittenUntrackedFiles returns the untracked files of the worktree which the checkout of a commit would
+// overwrite, either because the commit has a file or a directory at their path or because it has a file at one
+// of their parents.
+func overwrittenUntrackedFiles(cli *GitCli, target string) ([]string, error) {
+	untracked, err := cli.LsFiles([]string{"-z", "--others", "--exclude-standard"})
 	if err != nil {
-		return fmt.Errorf("failed to inialize submodules: %v", err)
+		return nil, err
+	}
+	if untracked == "" {
+		return nil, nil
+	}
+	tree, err := cli.LsTree([]string{"-z", "-r", "--name-only", target})
+	if err != nil {
+		return nil, err
+	}
+	targetFiles := map[string]bool{}
+	targetDirectories := map[string]bool{}
+	for _, file := range strings.Split(strings.TrimSuffix(tree, "\x00"), "\x00") {
+		targetFiles[file] = true
+		for _, parent := range parents(file) {
+			targetDirectories[parent] = true
+		}
+	}
+	var files []string
+	for _, file := range strings.Split(strings.TrimSuffix(untracked, "\x00"), "\x00") {
+		if targetFiles[file] || targetDirectories[file] || slices.ContainsFunc(parents(file), func(parent string) bool { return targetFiles[parent] }) {
+			files = append(files, file)
+		}
 	}
+	slices.Sort(files)
+	return files, nil
+}
 
-	return nil
+// lfsSpec returns the LFS configuration of a repository, the repositories without one follow the LFS auto fetch setting
+func (c *Cloner) lfsSpec(repository Repository) *LFSSpec {
+	if repository.LFS != nil {
+		return repository.LFS
+	}
+	if c.config.LfsAutoFetch {
+		return &LFSSpec{Fetch: EagerLFSFetch}
+	}
+	return &LFSSpec{Fetch: NoLFSFetch}
+}
+
+// applyLFSPolicy configures git-lfs in a repository checked out without the LFS objects and fetches them
+// when the policy is eager.
+func (c *Cloner) applyLFSPolicy(repository Repository, spec *LFSSpec) *LFSResult {
+	policy := spec.policy()
+	if policy == NoLFSFetch {
+		return lfsResult(LFSSkipped, nil)
+	}
+	log.Println("Dealing with LFS")
+	if len(spec.Include) > 0 {
+		if _, err := repository.Cli.Config([]string{"lfs.fetchinclude", strings.Join(spec.Include, ",")}); err != nil {
+			return lfsResult("", err)
+		}
+	}
+	if len(spec.Exclude) > 0 {
+		if _, err := repository.Cli.Config([]string{"lfs.fetchexclude", strings.Join(spec.Exclude, ",")}); err != nil {
+			return lfsResult("", err)
+		}
+	}
+
+	if policy == EagerLFSFetch {
+		totalLfsSize := repository.GetLFSTotalSizeBytes(spec.Include, spec.Exclude)
+		log.Println("Lfs size:", totalLfsSize)
+		if err := checkLFSSize(repository.clonePath, totalLfsSize, spec.MaxSize); err != nil {
+			return lfsResult("", err)
+		}
+	}
+
+	// Git LFS fetches the objects when the files are checked out from now on
+	if _, err := repository.Cli.Lfs([]string{"install", "--local", "--force"}); err != nil {
+		return lfsResult("", err)
+	}
+	if policy == LazyLFSFetch {
+		return lfsResult(LFSSkipped, nil)
+	}
+	// The objects are filtered by lfs.fetchinclude and lfs.fetchexclude
+	_, err := repository.Cli.Lfs([]string{"pull"})
+	return lfsResult(LFSFetched, err)
 }
@@ -98,6 +98,26 @@ func (g *GitCli) Fetch(args []string) (string, error) {
 	return g.execute("fetch", args)
 }
 
+func (g *GitCli) Merge(args []string) (string, error) {
+	return g.execute("merge", args)
+}
+
+func (g *GitCli) RevList(args []string) (string, error) {
+	return g.execute("rev-list", args)
+}
+
+func (g *GitCli) MergeBase(args []string) (string, error) {
+	return g.execute("merge-base", args)
+}
+
+func (g *GitCli) LsFiles(args []string) (string, error) {
+	return g.execute("ls-files", args)
+}
+
+func (g *GitCli) LsTree(args []string) (string, error) {
+	return g.execute("ls-tree", args)
+}
+
 func (g *GitCli) RevParse(args []string) (string, error) {
 	return g.execute("rev-parse", args)
 }
@@ -134,6 +154,10 @@ func (g *GitCli) Diff(args []string) (string, error) {
 	return g.execute("diff", args)
 }
 
+func (g *GitCli) SparseCheckout(args []string) (string, error) {
+	return g.execute("sparse-checkout", args)
+}
+
 func (g *GitCli) SymbolicRef(args []string) (string, error) {
 	return g.execute("symbolic-ref", args)
 }
@@ -0,0 +1,543 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"golang.org/x/sys/unix"
+)
+
+// LFS fetch policies
+
+const EagerLFSFetch string = "eager" // Fetch the LFS objects when cloning
+const LazyLFSFetch string = "lazy"   // Let git-lfs fetch the LFS objects in the session
+const NoLFSFetch string = "none"     // Leave the LFS pointers
+
+var LFSFetchPolicies []string = []string{
+	EagerLFSFetch, LazyLFSFetch, NoLFSFetch,
+}
+
+// LFS pointers are small text files, larger files are never pointers
+const maxLFSPointerSize int64 = 1024
+
+const lfsPointerVersion string = "version https://git-lfs.github.com/spec/v1"
+
+const lfsMediaType string = "application/vnd.git-lfs+json"
+
+// The number of objects requested at once from the LFS batch API
+const lfsBatchSize int = 100
+
+// LFSSpec is the LFS configuration of a repository, the maximum size is in bytes
+type LFSSpec struct {
+	// The fetch policy, the objects are fetched eagerly when empty
+	Fetch   string   `json:"fetch,omitempty"`
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	MaxSize int64    `json:"maxSize,omitempty"`
+}
+
+func (s *LFSSpec) policy() string {
+	if s.Fetch == "" {
+		return EagerLFSFetch
+	}
+	return s.Fetch
+}
+
+func (s *LFSSpec) validate() error {
+	if !slices.Contains(LFSFetchPolicies, s.policy()) {
+		return fmt.Errorf("%s is not included in %s", s.Fetch, strings.Join(LFSFetchPolicies, ","))
+	}
+	if s.MaxSize < 0 {
+		return fmt.Errorf("the maximum LFS size cannot be negative")
+	}
+	return nil
+}
+
+// lfsTooLargeError is returned when the LFS objects are not fetched because of their size
+type lfsTooLargeError struct {
+	size  uint64
+	limit uint64
+	// What limits the size, e.g. the maximum size of the repository
+	limitedBy string
+}
+
+func (e *lfsTooLargeError) Error() string {
+	return fmt.Sprintf("the LFS objects total %d bytes which is more than the %s of %d bytes", e.size, e.limitedBy, e.limit)
+}
+
+// checkLFSSize returns an lfsTooLargeError when the LFS objects do not fit in the maximum size or in the volume
+func checkLFSSize(clonePath string, size uint64, maxSize int64) error {
+	if maxSize > 0 && size > uint64(maxSize) {
+		return &lfsTooLargeError{size, uint64(maxSize), "maximum size"}
+	}
+	var stat unix.Statfs_t
+	err := unix.Statfs(clonePath, &stat)
+	if err != nil {
+		return err
+	}
+	// Available blocks * size per block = available space in bytes
+	availableSpace := stat.Bavail * uint64(stat.Bsize)
+	if availableSpace < size {
+		return &lfsTooLargeError{size, availableSpace, "free space"}
+	}
+	return nil
+}
+
+// lfsResult reports the outcome of fetching the LFS objects
+func lfsResult(state string, err error) *LFSResult {
+	var tooLarge *lfsTooLargeError
+	switch {
+	case errors.As(err, &tooLarge):
+		return &LFSResult{State: LFSTooLarge, Error: err.Error()}
+	case err != nil:
+		return &LFSResult{State: LFSFailed, Error: err.Error()}
+	default:
+		return &LFSResult{State: state}
+	}
+}
+
+// lfsPointer is the content of a file stored with Git LFS
+type lfsPointer struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+// parseLFSPointer returns the pointer in the content of a file, if the file is an LFS pointer
+func parseLFSPointer(content []byte) (lfsPointer, bool) {
+	pointer := lfsPointer{Size: -1}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	if !scanner.Scan() || scanner.Text() != lfsPointerVersion {
+		return pointer, false
+	}
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), " ")
+		if !found {
+			return pointer, false
+		}
+		switch key {
+		case "oid":
+			oid, found := strings.CutPrefix(value, "sha256:")
+			if !found || len(oid) != sha256.Size*2 {
+				return pointer, false
+			}
+			pointer.Oid = oid
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return pointer, false
+			}
+			pointer.Size = size
+		}
+	}
+	return pointer, pointer.Oid != "" && pointer.Size >= 0
+}
+
+// lfsPathMatcher matches the paths with the include and exclude patterns of lfs.fetchinclude and lfs.fetchexclude
+type lfsPathMatcher struct {
+	include []gitignore.Pattern
+	exclude []gitignore.Pattern
+}
+
+func newLFSPathMatcher(include []string, exclude []string) lfsPathMatcher {
+	matcher := lfsPathMatcher{}
+	for _, pattern := range include {
+		matcher.include = append(matcher.include, gitignore.ParsePattern(pattern, nil))
+	}
+	for _, pattern := range exclude {
+		matcher.exclude = append(matcher.exclude, gitignore.ParsePattern(pattern, nil))
+	}
+	return matcher
+}
+
+func (m lfsPathMatcher) Match(path string) bool {
+	segments := strings.Split(path, "/")
+	matches := func(patterns []gitignore.Pattern) bool {
+		return slices.ContainsFunc(patterns, func(pattern gitignore.Pattern) bool {
+			return pattern.Match(segments, false) == gitignore.Exclude
+		})
+	}
+	if len(m.include) > 0 && !matches(m.include) {
+		return false
+	}
+	return !matches(m.exclude)
+}
+
+// lfsFile is a file of the worktree which is an LFS pointer
+type lfsFile struct {
+	Path    string
+	Pointer lfsPointer
+}
+
+// findLFSFiles returns the LFS pointers checked out in the worktree which match the patterns
+func findLFSFiles(repository *git.Repository, worktree string, matcher lfsPathMatcher) ([]lfsFile, error) {
+	head, err := repository.Head()
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repository.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	files := []lfsFile{}
+	err = tree.Files().ForEach(func(file *object.File) error {
+		if file.Size > maxLFSPointerSize || (file.Mode != filemode.Regular && file.Mode != filemode.Executable) {
+			return nil
+		}
+		if !matcher.Match(file.Name) {
+			return nil
+		}
+		// The files outside of a sparse checkout are not in the worktree
+		if _, err := os.Lstat(filepath.Join(worktree, filepath.FromSlash(file.Name))); err != nil {
+			return nil
+		}
+		content, err := file.Contents()
+		if err != nil {
+			return err
+		}
+		if pointer, ok := parseLFSPointer([]byte(content)); ok {
+			files = append(files, lfsFile{file.Name, pointer})
+		}
+		return nil
+	})
+	return files, err
+}
+
+// lfsTotalSize returns the size of the distinct LFS objects of the files
+func lfsTotalSize(files []lfsFile) uint64 {
+	seen := map[string]bool{}
+	total := uint64(0)
+	for _, file := range files {
+		if seen[file.Pointer.Oid] {
+			continue
+		}
+		seen[file.Pointer.Oid] = true
+		total += uint64(file.Pointer.Size)
+	}
+	return total
+}
+
+// lfsEndpoint returns the default LFS server of a remote, only the http remotes are supported
+func lfsEndpoint(remote string) (*url.URL, error) {
+	endpoint, err := url.Parse(remote)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("the LFS objects can only be fetched from http remotes")
+	}
+	endpoint.User = nil
+	path := strings.TrimSuffix(endpoint.Path, "/")
+	if !strings.HasSuffix(path, ".git") {
+		path += ".git"
+	}
+	endpoint.Path = path + "/info/lfs"
+	return endpoint, nil
+}
+
+// lfsClient downloads the LFS objects of a repository with the basic transfer adapter of the batch API
+type lfsClient struct {
+	client   *http.Client
+	endpoint *url.URL
+	auth     transport.AuthMethod
+	// The directory where git-lfs stores the objects, .git/lfs/objects
+	objectsDir string
+}
+
+type lfsBatchRequest struct {
+	Operation string       `json:"operation"`
+	Transfers []string     `json:"transfers"`
+	Objects   []lfsPointer `json:"objects"`
+}
+
+type lfsBatchObject struct {
+	lfsPointer
+	Actions struct {
+		Download *struct {
+			Href   string            `json:"href"`
+			Header map[string]string `json:"header"`
+		} `json:"download"`
+	} `json:"actions"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type lfsBatchResponse struct {
+	Objects []lfsBatchObject `json:"objects"`
+}
+
+func (c *lfsClient) authorize(req *http.Request) {
+	if auth, ok := c.auth.(*githttp.BasicAuth); ok && auth != nil {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+}
+
+func (c *lfsClient) batch(ctx context.Context, pointers []lfsPointer) ([]lfsBatchObject, error) {
+	body, err := json.Marshal(lfsBatchRequest{Operation: "download", Transfers: []string{"basic"}, Objects: pointers})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint.JoinPath("objects", "batch").String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	c.authorize(req)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the LFS batch request to %s failed with status %d", req.URL.Redacted(), res.StatusCode)
+	}
+	response := lfsBatchResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response.Objects, nil
+}
+
+// objectPath returns where git-lfs stores an object
+func (c *lfsClient) objectPath(oid string) string {
+	return filepath.Join(c.objectsDir, oid[0:2], oid[2:4], oid)
+}
+
+// download stores an object in the LFS objects directory after verifying its content
+func (c *lfsClient) download(ctx context.Context, object lfsBatchObject) error {
+	if object.Error != nil {
+		return fmt.Errorf("cannot download the LFS object %s: %s", object.Oid, object.Error.Message)
+	}
+	if object.Actions.Download == nil {
+		// The server does not return an action for the objects which the client already has
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, object.Actions.Download.Href, nil)
+	if err != nil {
+		return err
+	}
+	if len(object.Actions.Download.Header) > 0 {
+		for key, value := range object.Actions.Download.Header {
+			req.Header.Set(key, value)
+		}
+	} else {
+		c.authorize(req)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("the download of the LFS object %s failed with status %d", object.Oid, res.StatusCode)
+	}
+
+	path := c.objectPath(object.Oid)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), object.Oid+"-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	hash := sha256.New()
+	// The object is not read past the size of its pointer
+	size, err := limitedDownload(io.MultiWriter(tmp, hash), res, object.Size)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size != object.Size || hex.EncodeToString(hash.Sum(nil)) != object.Oid {
+		return fmt.Errorf("the content of the LFS object %s does not match its pointer", object.Oid)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// fetch downloads the objects of the files
+func (c *lfsClient) fetch(ctx context.Context, files []lfsFile) error {
+	pointers := []lfsPointer{}
+	for _, file := range files {
+		if slices.Contains(pointers, file.Pointer) {
+			continue
+		}
+		if _, err := os.Stat(c.objectPath(file.Pointer.Oid)); err == nil {
+			continue
+		}
+		pointers = append(pointers, file.Pointer)
+	}
+	for batch := range slices.Chunk(pointers, lfsBatchSize) {
+		objects, err := c.batch(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			if err := c.download(ctx, object); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// smudge replaces the pointers of the worktree with the content of their objects
+func (c *lfsClient) smudge(worktree string, files []lfsFile) error {
+	for _, file := range files {
+		path := filepath.Join(worktree, filepath.FromSlash(file.Path))
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		tmp := path + ".lfs-tmp"
+		if err := copyLFSObject(tmp, c.objectPath(file.Pointer.Oid), info.Mode().Perm()); err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyLFSObject streams the content of an object to a new file
+func copyLFSObject(dst string, object string, perm os.FileMode) error {
+	src, err := os.Open(object)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, src)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// configureLFS sets the git-lfs configuration of a repository as git lfs install --local would,
+// the session uses it to fetch the objects with git-lfs.
+func configureLFS(repository *git.Repository, spec *LFSSpec, smudge bool) error {
+	cfg, err := repository.Config()
+	if err != nil {
+		return err
+	}
+	filter := cfg.Raw.Section("filter").Subsection("lfs")
+	filter.SetOption("clean", "git-lfs clean -- %f")
+	filter.SetOption("required", "true")
+	if smudge {
+		filter.SetOption("smudge", "git-lfs smudge -- %f")
+		filter.SetOption("process", "git-lfs filter-process")
+	} else {
+		filter.SetOption("smudge", "git-lfs smudge --skip -- %f")
+		filter.SetOption("process", "git-lfs filter-process --skip")
+	}
+	lfs := cfg.Raw.Section("lfs")
+	if len(spec.Include) > 0 {
+		lfs.SetOption("fetchinclude", strings.Join(spec.Include, ","))
+	}
+	if len(spec.Exclude) > 0 {
+		lfs.SetOption("fetchexclude", strings.Join(spec.Exclude, ","))
+	}
+	return repository.SetConfig(cfg)
+}
+
+// fetchLFSObjects applies the LFS policy to a repository cloned with go-git, which leaves the LFS pointers
+func fetchLFSObjects(repository *git.Repository, clonePath string, remote string, auth transport.AuthMethod, spec *LFSSpec, logger *log.Logger) *LFSResult {
+	if err := spec.validate(); err != nil {
+		return lfsResult("", err)
+	}
+	policy := spec.policy()
+	if err := configureLFS(repository, spec, policy != NoLFSFetch); err != nil {
+		return lfsResult("", err)
+	}
+	if policy != EagerLFSFetch {
+		logger.Print("the LFS objects are not fetched with the ", policy, " policy")
+		return lfsResult(LFSSkipped, nil)
+	}
+
+	files, err := findLFSFiles(repository, clonePath, newLFSPathMatcher(spec.Include, spec.Exclude))
+	if err != nil {
+		return lfsResult("", err)
+	}
+	if len(files) == 0 {
+		return lfsResult(LFSFetched, nil)
+	}
+	size := lfsTotalSize(files)
+	logger.Printf("fetching %d LFS files of %d bytes", len(files), size)
+	if err := checkLFSSize(clonePath, size, spec.MaxSize); err != nil {
+		return lfsResult("", err)
+	}
+	endpoint, err := lfsEndpoint(remote)
+	if err != nil {
+		return lfsResult("", err)
+	}
+	client := lfsClient{
+		client:     sourceHTTPClient,
+		endpoint:   endpoint,
+		auth:       auth,
+		objectsDir: filepath.Join(clonePath, ".git", "lfs", "objects"),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sourceFetchTimeout)
+	defer cancel()
+	if err := client.fetch(ctx, files); err != nil {
+		return lfsResult("", err)
+	}
+	return lfsResult(LFSFetched, client.smudge(clonePath, files))
+}
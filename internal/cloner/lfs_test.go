@@ -0,0 +1,278 @@
+package cloner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSignature = &object.Signature{Name: "Test", Email: "test@example.org", When: time.Unix(1700000000, 0)}
+
+// commitFiles writes the files in the worktree of the repository and commits them
+func commitFiles(t *testing.T, repository *git.Repository, files map[string]string, message string) {
+	t.Helper()
+	worktree, err := repository.Worktree()
+	require.NoError(t, err)
+	root := worktree.Filesystem.Root()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		_, err = worktree.Add(name)
+		require.NoError(t, err)
+	}
+	_, err = worktree.Commit(message, &git.CommitOptions{Author: testSignature})
+	require.NoError(t, err)
+}
+
+// newTestRepository creates a repository in a temporary directory with a single commit of the files
+func newTestRepository(t *testing.T, files map[string]string) (*git.Repository, string) {
+	t.Helper()
+	dir := t.TempDir()
+	repository, err := git.PlainInit(dir, false)
+	require.NoError(t, err)
+	commitFiles(t, repository, files, "initial commit")
+	return repository, dir
+}
+
+// lfsObject returns the pointer to a content and the content of the pointer file
+func lfsObject(content string) (lfsPointer, string) {
+	sum := sha256.Sum256([]byte(content))
+	pointer := lfsPointer{Oid: hex.EncodeToString(sum[:]), Size: int64(len(content))}
+	return pointer, fmt.Sprintf("%s\noid sha256:%s\nsize %d\n", lfsPointerVersion, pointer.Oid, pointer.Size)
+}
+
+// newLFSServer serves the objects with the batch API, the handler of the downloads can be replaced
+func newLFSServer(t *testing.T, objects map[string]string, download http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /repo.git/info/lfs/objects/batch", func(w http.ResponseWriter, r *http.Request) {
+		request := lfsBatchRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response := map[string]any{}
+		responseObjects := []map[string]any{}
+		for _, pointer := range request.Objects {
+			responseObjects = append(responseObjects, map[string]any{
+				"oid":  pointer.Oid,
+				"size": pointer.Size,
+				"actions": map[string]any{
+					"download": map[string]any{"href": server.URL + "/objects/" + pointer.Oid},
+				},
+			})
+		}
+		response["objects"] = responseObjects
+		w.Header().Set("Content-Type", lfsMediaType)
+		_ = json.NewEncoder(w).Encode(response)
+	})
+	if download == nil {
+		download = func(w http.ResponseWriter, r *http.Request) {
+			content, found := objects[r.PathValue("oid")]
+			if !found {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = io.WriteString(w, content)
+		}
+	}
+	mux.HandleFunc("GET /objects/{oid}", download)
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLFSPathMatcher(t *testing.T) {
+	cases := []struct {
+		name    string
+		include []string
+		exclude []string
+		path    string
+		match   bool
+	}{
+		{name: "no patterns", path: "data/file.bin", match: true},
+		{name: "included extension", include: []string{"*.csv"}, path: "data/train.csv", match: true},
+		{name: "not included extension", include: []string{"*.csv"}, path: "data/model.bin", match: false},
+		{name: "included directory", include: []string{"data/"}, path: "data/nested/file.bin", match: true},
+		{name: "other directory", include: []string{"data/"}, path: "models/file.bin", match: false},
+		{name: "anchored pattern", include: []string{"/data/*.csv"}, path: "data/train.csv", match: true},
+		{name: "anchored pattern in a subdirectory", include: []string{"/data/*.csv"}, path: "other/data/train.csv", match: false},
+		{name: "double star", include: []string{"data/**/*.csv"}, path: "data/a/b/train.csv", match: true},
+		{name: "excluded file", exclude: []string{"*.bin"}, path: "models/model.bin", match: false},
+		{name: "excluded wins over included", include: []string{"data/"}, exclude: []string{"data/large/"}, path: "data/large/file.csv", match: false},
+		{name: "included and not excluded", include: []string{"data/"}, exclude: []string{"data/large/"}, path: "data/small/file.csv", match: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.match, newLFSPathMatcher(tc.include, tc.exclude).Match(tc.path))
+		})
+	}
+}
+
+func TestParseLFSPointer(t *testing.T) {
+	pointer, content := lfsObject("large content")
+	cases := []struct {
+		name    string
+		content string
+		pointer lfsPointer
+		ok      bool
+	}{
+		{name: "pointer", content: content, pointer: pointer, ok: true},
+		{name: "regular file", content: "just some text\n"},
+		{name: "missing oid", content: fmt.Sprintf("%s\nsize 12\n", lfsPointerVersion)},
+		{name: "missing size", content: fmt.Sprintf("%s\noid sha256:%s\n", lfsPointerVersion, pointer.Oid)},
+		{name: "short oid", content: fmt.Sprintf("%s\noid sha256:abcd\nsize 12\n", lfsPointerVersion)},
+		{name: "negative size", content: fmt.Sprintf("%s\noid sha256:%s\nsize -1\n", lfsPointerVersion, pointer.Oid)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			parsed, ok := parseLFSPointer([]byte(tc.content))
+			assert.Equal(t, tc.ok, ok)
+			if tc.ok {
+				assert.Equal(t, tc.pointer, parsed)
+			}
+		})
+	}
+}
+
+func TestFetchLFSObjects(t *testing.T) {
+	dataContent := "a,b,c\n1,2,3\n"
+	modelContent := strings.Repeat("model", 100)
+	dataPointer, dataPointerFile := lfsObject(dataContent)
+	modelPointer, modelPointerFile := lfsObject(modelContent)
+	objects := map[string]string{dataPointer.Oid: dataContent, modelPointer.Oid: modelContent}
+
+	cases := []struct {
+		name     string
+		spec     LFSSpec
+		download http.HandlerFunc
+		state    string
+		error    string
+		// The expected content of the worktree files after fetching the objects
+		files map[string]string
+	}{
+		{
+			name:  "eager",
+			spec:  LFSSpec{},
+			state: LFSFetched,
+			files: map[string]string{"data/train.csv": dataContent, "models/model.bin": modelContent},
+		},
+		{
+			name:  "include patterns",
+			spec:  LFSSpec{Include: []string{"data/"}},
+			state: LFSFetched,
+			files: map[string]string{"data/train.csv": dataContent, "models/model.bin": modelPointerFile},
+		},
+		{
+			name:  "lazy",
+			spec:  LFSSpec{Fetch: LazyLFSFetch},
+			state: LFSSkipped,
+			files: map[string]string{"data/train.csv": dataPointerFile, "models/model.bin": modelPointerFile},
+		},
+		{
+			name:  "larger than the maximum size",
+			spec:  LFSSpec{MaxSize: int64(len(dataContent))},
+			state: LFSTooLarge,
+			error: "more than the maximum size",
+			files: map[string]string{"data/train.csv": dataPointerFile, "models/model.bin": modelPointerFile},
+		},
+		{
+			name:  "excluded files do not count in the size",
+			spec:  LFSSpec{MaxSize: int64(len(dataContent)), Exclude: []string{"*.bin"}},
+			state: LFSFetched,
+			files: map[string]string{"data/train.csv": dataContent, "models/model.bin": modelPointerFile},
+		},
+		{
+			name: "download fails",
+			spec: LFSSpec{},
+			download: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			},
+			state: LFSFailed,
+			error: "failed with status 503",
+			files: map[string]string{"data/train.csv": dataPointerFile, "models/model.bin": modelPointerFile},
+		},
+		{
+			name: "content does not match the pointer",
+			spec: LFSSpec{},
+			download: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "tampered")
+			},
+			state: LFSFailed,
+			error: "does not match its pointer",
+			files: map[string]string{"data/train.csv": dataPointerFile, "models/model.bin": modelPointerFile},
+		},
+		{
+			name: "content larger than the pointer",
+			spec: LFSSpec{},
+			download: func(w http.ResponseWriter, r *http.Request) {
+				// The response is streamed without a content length
+				for range 1000 {
+					_, _ = io.WriteString(w, modelContent)
+					w.(http.Flusher).Flush()
+				}
+			},
+			state: LFSFailed,
+			error: "larger than the maximum size",
+			files: map[string]string{"data/train.csv": dataPointerFile, "models/model.bin": modelPointerFile},
+		},
+		{
+			name:  "invalid policy",
+			spec:  LFSSpec{Fetch: "sometimes"},
+			state: LFSFailed,
+			error: "sometimes is not included",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			repository, dir := newTestRepository(t, map[string]string{
+				"README.md":        "# Test\n",
+				"data/train.csv":   dataPointerFile,
+				"models/model.bin": modelPointerFile,
+			})
+			server := newLFSServer(t, objects, tc.download)
+
+			result := fetchLFSObjects(repository, dir, server.URL+"/repo.git", nil, &tc.spec, log.New(io.Discard, "", 0))
+
+			assert.Equal(t, tc.state, result.State)
+			if tc.error == "" {
+				assert.Empty(t, result.Error)
+			} else {
+				assert.Contains(t, result.Error, tc.error)
+			}
+			// The repository stays usable when the objects are not fetched, the pointers are left in the worktree
+			for name, expected := range tc.files {
+				content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+				require.NoError(t, err)
+				assert.Equal(t, expected, string(content), name)
+			}
+			entries, err := os.ReadDir(filepath.Join(dir, "data"))
+			require.NoError(t, err)
+			assert.Len(t, entries, 1, "no temporary file is left in the worktree")
+		})
+	}
+}
+
+func TestLFSResult(t *testing.T) {
+	assert.Equal(t, &LFSResult{State: LFSFetched}, lfsResult(LFSFetched, nil))
+	tooLarge := &lfsTooLargeError{size: 10, limit: 5, limitedBy: "free space"}
+	assert.Equal(t, &LFSResult{State: LFSTooLarge, Error: "wrapped: " + tooLarge.Error()}, lfsResult("", fmt.Errorf("wrapped: %w", tooLarge)))
+	assert.Equal(t, &LFSResult{State: LFSFailed, Error: "boom"}, lfsResult(LFSFetched, fmt.Errorf("boom")))
+}
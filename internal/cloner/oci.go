@@ -0,0 +1,443 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+const ociManifestMediaType string = "application/vnd.oci.image.manifest.v1+json"
+const ociIndexMediaType string = "application/vnd.oci.image.index.v1+json"
+const dockerManifestMediaType string = "application/vnd.docker.distribution.manifest.v2+json"
+const dockerManifestListMediaType string = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+// The annotation with the name of the file of a layer, as set by oras push
+const ociTitleAnnotation string = "org.opencontainers.image.title"
+
+// The annotation of the layers which are directories pushed by oras as a gzip compressed tar archive
+const orasUnpackAnnotation string = "io.deis.oras.content.unpack"
+
+// The registry of the references without a registry
+const defaultOCIRegistry string = "registry-1.docker.io"
+
+// Manifests are small documents, larger responses are rejected
+const maxOCIManifestSize int64 = 4 << 20
+
+// ociReference is a reference to an artifact, [registry/]repository[:tag][@digest]
+type ociReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// parseOCIReference parses a reference with an optional oci:// scheme, the tag is latest when the
+// reference has neither a tag nor a digest.
+func parseOCIReference(remote string) (ociReference, error) {
+	reference := ociReference{}
+	name, digest, _ := strings.Cut(strings.TrimPrefix(remote, "oci://"), "@")
+	reference.Digest = digest
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		reference.Tag = name[i+1:]
+		name = name[:i]
+	}
+	registry, repository, found := strings.Cut(name, "/")
+	// As with docker, the first component is a registry when it looks like a host
+	if found && (strings.ContainsAny(registry, ".:") || registry == "localhost") {
+		reference.Registry = registry
+		reference.Repository = repository
+	} else {
+		reference.Registry = defaultOCIRegistry
+		reference.Repository = name
+		if !found {
+			reference.Repository = "library/" + name
+		}
+	}
+	if name == "" || strings.HasSuffix(reference.Repository, "/") {
+		return reference, fmt.Errorf("expecting a repository in the OCI reference, received: %s", remote)
+	}
+	if reference.Digest != "" && !checksumRegexp.MatchString(reference.Digest) {
+		return reference, fmt.Errorf("unsupported digest %s, only sha256 digests are supported", reference.Digest)
+	}
+	if reference.Tag == "" && reference.Digest == "" {
+		reference.Tag = "latest"
+	}
+	return reference, nil
+}
+
+// name returns the last component of the repository
+func (r ociReference) name() string {
+	return r.Repository[strings.LastIndex(r.Repository, "/")+1:]
+}
+
+// manifestReference returns the digest of the manifest when it is pinned, its tag otherwise
+func (r ociReference) manifestReference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+type ociPlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+// ociManifest is an image manifest or an index, only the fields used to pull the layers are decoded
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests,omitempty"`
+	Layers    []ociDescriptor `json:"layers,omitempty"`
+}
+
+// digestOf returns the sha256 digest of content
+func digestOf(content []byte) string {
+	hash := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// parseAuthChallenge parses a WWW-Authenticate header such as Bearer realm="...",service="...",scope="..."
+func parseAuthChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, ", "), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return strings.ToLower(scheme), params
+}
+
+// ociClient pulls the manifests and blobs of an artifact with the OCI distribution API
+type ociClient struct {
+	client    *http.Client
+	reference ociReference
+	auth      *githttp.BasicAuth
+	// The bearer token returned by the token service of the registry
+	token string
+	// Whether the registry asked for basic authentication
+	basic bool
+}
+
+func (c *ociClient) url(kind string, reference string) string {
+	return (&url.URL{Scheme: "https", Host: c.reference.Registry, Path: fmt.Sprintf("/v2/%s/%s/%s", c.reference.Repository, kind, reference)}).String()
+}
+
+func (c *ociClient) authorize(req *http.Request) {
+	switch {
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	case c.basic && c.auth != nil:
+		req.SetBasicAuth(c.auth.Username, c.auth.Password)
+	}
+}
+
+// authenticate answers the authentication challenge of the registry, anonymous tokens are requested
+// when there are no credentials.
+func (c *ociClient) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseAuthChallenge(challenge)
+	if scheme == "basic" {
+		if c.auth == nil {
+			return errors.New("the registry requires credentials")
+		}
+		c.basic = true
+		return nil
+	}
+	if scheme != "bearer" || params["realm"] == "" {
+		return fmt.Errorf("unsupported authentication challenge %s", challenge)
+	}
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil {
+		return err
+	}
+	query := tokenURL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	if params["scope"] == "" {
+		query.Set("scope", fmt.Sprintf("repository:%s:pull", c.reference.Repository))
+	}
+	tokenURL.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.auth != nil {
+		req.SetBasicAuth(c.auth.Username, c.auth.Password)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("the token request to %s failed with status %d", tokenURL.Redacted(), res.StatusCode)
+	}
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return err
+	}
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	if c.token == "" {
+		return errors.New("the token service of the registry returned no token")
+	}
+	return nil
+}
+
+// get requests a manifest or a blob, the request is authenticated when the registry asks for it
+func (c *ociClient) get(ctx context.Context, target string, accept []string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		c.authorize(req)
+		res, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode == http.StatusOK {
+			return res, nil
+		}
+		_ = res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return nil, fmt.Errorf("the request to %s failed with status %d", req.URL.Redacted(), res.StatusCode)
+		}
+		if err := c.authenticate(ctx, res.Header.Get("WWW-Authenticate")); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// manifest returns the image manifest of a reference and its digest, the manifest of the platform
+// of the cloner is selected from an index.
+func (c *ociClient) manifest(ctx context.Context, reference string) (ociManifest, string, error) {
+	manifest := ociManifest{}
+	res, err := c.get(ctx, c.url("manifests", reference), []string{
+		ociManifestMediaType, ociIndexMediaType, dockerManifestMediaType, dockerManifestListMediaType,
+	})
+	if err != nil {
+		return manifest, "", err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	content, err := io.ReadAll(io.LimitReader(res.Body, maxOCIManifestSize+1))
+	if err != nil {
+		return manifest, "", err
+	}
+	if int64(len(content)) > maxOCIManifestSize {
+		return manifest, "", fmt.Errorf("the manifest %s is larger than %d bytes", reference, maxOCIManifestSize)
+	}
+	digest := digestOf(content)
+	if strings.HasPrefix(reference, "sha256:") && digest != reference {
+		return manifest, "", fmt.Errorf("the digest of the manifest %s does not match %s", digest, reference)
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return manifest, "", fmt.Errorf("failed to parse the manifest %s: %w", reference, err)
+	}
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		mediaType = res.Header.Get("Content-Type")
+	}
+	if mediaType != ociIndexMediaType && mediaType != dockerManifestListMediaType {
+		return manifest, digest, nil
+	}
+
+	if len(manifest.Manifests) == 0 {
+		return manifest, "", fmt.Errorf("the index %s has no manifests", reference)
+	}
+	selected := manifest.Manifests[0]
+	for _, descriptor := range manifest.Manifests {
+		if descriptor.Platform != nil && descriptor.Platform.OS == runtime.GOOS && descriptor.Platform.Architecture == runtime.GOARCH {
+			selected = descriptor
+			break
+		}
+	}
+	if !checksumRegexp.MatchString(selected.Digest) {
+		return manifest, "", fmt.Errorf("unsupported digest %s, only sha256 digests are supported", selected.Digest)
+	}
+	manifest, _, err = c.manifest(ctx, selected.Digest)
+	// The digest of the index is the digest of the reference
+	return manifest, digest, err
+}
+
+// blob downloads a blob in a file of dir after verifying its digest and size
+func (c *ociClient) blob(ctx context.Context, descriptor ociDescriptor, dir string) (*os.File, error) {
+	if !checksumRegexp.MatchString(descriptor.Digest) {
+		return nil, fmt.Errorf("unsupported digest %s, only sha256 digests are supported", descriptor.Digest)
+	}
+	res, err := c.get(ctx, c.url("blobs", descriptor.Digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	file, err := os.CreateTemp(dir, "blob-*")
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	size, err := limitedDownload(io.MultiWriter(file, hash), res, descriptor.Size)
+	if err == nil && (size != descriptor.Size || "sha256:"+hex.EncodeToString(hash.Sum(nil)) != descriptor.Digest) {
+		err = fmt.Errorf("the content of the blob %s does not match its descriptor", descriptor.Digest)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// unpackLayer writes a layer in root, the layers with a title are files or directories pushed by oras
+// and the other layers are tar archives as in the images.
+func unpackLayer(layer ociDescriptor, blob *os.File, root *os.Root, budget *extractionBudget) error {
+	title := layer.Annotations[ociTitleAnnotation]
+	if title == "" {
+		if !strings.Contains(layer.MediaType, "tar") {
+			return fmt.Errorf("the layer %s of type %s has no title and is not a tar archive", layer.Digest, layer.MediaType)
+		}
+		return extractArchive(blob, root, budget)
+	}
+	name := archiveEntryPath(title)
+	if layer.Annotations[orasUnpackAnnotation] != "true" {
+		return writeArchiveFile(root, name, 0644, blob, budget)
+	}
+	// The entries of the archive of a directory are in a directory named after the title
+	parent := filepath.Dir(name)
+	if err := root.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	directory, err := root.OpenRoot(parent)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = directory.Close()
+	}()
+	return extractArchive(blob, directory, budget)
+}
+
+// fetchOCIArtifact pulls the artifact of the spec and unpacks its layers to the clone path,
+// it returns the digest of the manifest.
+func fetchOCIArtifact(spec CloneSpec, clonePath string, auth *githttp.BasicAuth, logger *log.Logger) (string, error) {
+	reference, err := parseOCIReference(spec.Remote)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sourceFetchTimeout)
+	defer cancel()
+	client := ociClient{client: sourceHTTPClient, reference: reference, auth: auth}
+	logger.Printf("pulling %s/%s:%s", reference.Registry, reference.Repository, reference.manifestReference())
+	manifest, digest, err := client.manifest(ctx, reference.manifestReference())
+	if err != nil {
+		return "", err
+	}
+	if len(manifest.Layers) == 0 {
+		return "", fmt.Errorf("the artifact %s has no layers", digest)
+	}
+	size := int64(0)
+	for _, layer := range manifest.Layers {
+		if layer.Size < 0 {
+			return "", fmt.Errorf("the layer %s has a negative size", layer.Digest)
+		}
+		size += layer.Size
+	}
+	if size > maxSourceDownloadSize {
+		return "", fmt.Errorf("the layers of %s total %d bytes which is more than the maximum size of %d bytes", digest, size, maxSourceDownloadSize)
+	}
+
+	workDir, err := newSourceWorkDir(clonePath)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = os.RemoveAll(workDir)
+	}()
+	contentDir := filepath.Join(workDir, "content")
+	if err := os.Mkdir(contentDir, 0755); err != nil {
+		return "", err
+	}
+	root, err := os.OpenRoot(contentDir)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	logger.Printf("unpacking %d layers of %s to %s", len(manifest.Layers), digest, clonePath)
+	budget := newExtractionBudget(ctx)
+	for _, layer := range manifest.Layers {
+		blob, err := client.blob(ctx, layer, workDir)
+		if err != nil {
+			return "", err
+		}
+		err = unpackLayer(layer, blob, root, budget)
+		_ = blob.Close()
+		_ = os.Remove(blob.Name())
+		if err != nil {
+			return "", fmt.Errorf("failed to unpack the layer %s: %w", layer.Digest, err)
+		}
+	}
+	return digest, installExtracted(contentDir, clonePath)
+}
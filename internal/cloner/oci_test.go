@@ -0,0 +1,195 @@
+package cloner
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRegistry serves the manifests and the blobs of a repository by tag or digest
+type testRegistry struct {
+	manifests map[string][]byte
+	blobs     map[string][]byte
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+}
+
+// addBlob stores a blob and returns its descriptor
+func (r *testRegistry) addBlob(mediaType string, content []byte, annotations map[string]string) ociDescriptor {
+	digest := digestOf(content)
+	r.blobs[digest] = content
+	return ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(content)), Annotations: annotations}
+}
+
+// addManifest stores a manifest under its digest and the tags, it returns its descriptor
+func (r *testRegistry) addManifest(t *testing.T, manifest ociManifest, tags ...string) ociDescriptor {
+	t.Helper()
+	content, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	digest := digestOf(content)
+	r.manifests[digest] = content
+	for _, tag := range tags {
+		r.manifests[tag] = content
+	}
+	return ociDescriptor{MediaType: manifest.MediaType, Digest: digest, Size: int64(len(content))}
+}
+
+// serve starts the registry over https and makes the sources use the client of the server,
+// it returns the host of the registry.
+func (r *testRegistry) serve(t *testing.T) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v2/group/artifact/manifests/{reference}", func(w http.ResponseWriter, req *http.Request) {
+		content, found := r.manifests[req.PathValue("reference")]
+		if !found {
+			http.NotFound(w, req)
+			return
+		}
+		_, _ = w.Write(content)
+	})
+	mux.HandleFunc("GET /v2/group/artifact/blobs/{digest}", func(w http.ResponseWriter, req *http.Request) {
+		content, found := r.blobs[req.PathValue("digest")]
+		if !found {
+			http.NotFound(w, req)
+			return
+		}
+		_, _ = w.Write(content)
+	})
+	server := serveArchive(t, mux.ServeHTTP)
+	return strings.TrimPrefix(server.URL, "https://")
+}
+
+func TestParseOCIReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	cases := []struct {
+		remote    string
+		reference ociReference
+		err       bool
+	}{
+		{remote: "oci://ghcr.io/group/artifact:v1", reference: ociReference{Registry: "ghcr.io", Repository: "group/artifact", Tag: "v1"}},
+		{remote: "localhost:5000/artifact", reference: ociReference{Registry: "localhost:5000", Repository: "artifact", Tag: "latest"}},
+		{remote: "group/artifact@" + digest, reference: ociReference{Registry: defaultOCIRegistry, Repository: "group/artifact", Digest: digest}},
+		{remote: "artifact", reference: ociReference{Registry: defaultOCIRegistry, Repository: "library/artifact", Tag: "latest"}},
+		{remote: "ghcr.io/group/artifact@md5:abcd", err: true},
+		{remote: "oci://", err: true},
+	}
+	for _, tc := range cases {
+		reference, err := parseOCIReference(tc.remote)
+		if tc.err {
+			assert.Error(t, err, tc.remote)
+			continue
+		}
+		assert.NoError(t, err, tc.remote)
+		assert.Equal(t, tc.reference, reference, tc.remote)
+	}
+}
+
+func TestOCIManifestPlatform(t *testing.T) {
+	registry := newTestRegistry()
+	otherArchitecture := "s390x"
+	if runtime.GOARCH == otherArchitecture {
+		otherArchitecture = "amd64"
+	}
+	other := registry.addManifest(t, ociManifest{
+		MediaType: ociManifestMediaType,
+		Layers:    []ociDescriptor{registry.addBlob("application/vnd.oci.image.layer.v1.tar", []byte("other"), nil)},
+	})
+	other.Platform = &ociPlatform{OS: runtime.GOOS, Architecture: otherArchitecture}
+	native := registry.addManifest(t, ociManifest{
+		MediaType: ociManifestMediaType,
+		Layers:    []ociDescriptor{registry.addBlob("application/vnd.oci.image.layer.v1.tar", []byte("native"), nil)},
+	})
+	native.Platform = &ociPlatform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	index := registry.addManifest(t, ociManifest{MediaType: ociIndexMediaType, Manifests: []ociDescriptor{other, native}}, "multi")
+	registry.addManifest(t, ociManifest{MediaType: ociIndexMediaType, Manifests: []ociDescriptor{other}}, "foreign")
+	registry.addManifest(t, ociManifest{MediaType: ociIndexMediaType}, "empty")
+	host := registry.serve(t)
+	client := ociClient{client: sourceHTTPClient, reference: ociReference{Registry: host, Repository: "group/artifact"}}
+
+	manifest, digest, err := client.manifest(context.Background(), "multi")
+	require.NoError(t, err)
+	assert.Equal(t, index.Digest, digest, "the digest is the digest of the index")
+	assert.Equal(t, digestOf([]byte("native")), manifest.Layers[0].Digest, "the manifest of the platform is selected")
+
+	manifest, _, err = client.manifest(context.Background(), index.Digest)
+	require.NoError(t, err)
+	assert.Equal(t, digestOf([]byte("native")), manifest.Layers[0].Digest)
+
+	manifest, _, err = client.manifest(context.Background(), "foreign")
+	require.NoError(t, err)
+	assert.Equal(t, digestOf([]byte("other")), manifest.Layers[0].Digest, "the first manifest is used without a matching platform")
+
+	_, _, err = client.manifest(context.Background(), "empty")
+	assert.ErrorContains(t, err, "has no manifests")
+
+	// A manifest pinned by a digest which does not match its content is rejected
+	registry.manifests[native.Digest] = registry.manifests[other.Digest]
+	_, _, err = client.manifest(context.Background(), native.Digest)
+	assert.ErrorContains(t, err, "does not match")
+}
+
+func TestOCIBlob(t *testing.T) {
+	registry := newTestRegistry()
+	descriptor := registry.addBlob("application/octet-stream", []byte("content"), nil)
+	host := registry.serve(t)
+	client := ociClient{client: sourceHTTPClient, reference: ociReference{Registry: host, Repository: "group/artifact"}}
+
+	blob, err := client.blob(context.Background(), descriptor, t.TempDir())
+	require.NoError(t, err)
+	content, err := io.ReadAll(blob)
+	_ = blob.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(content))
+
+	registry.blobs[descriptor.Digest] = []byte("tampere")
+	_, err = client.blob(context.Background(), descriptor, t.TempDir())
+	assert.ErrorContains(t, err, "does not match its descriptor")
+
+	registry.blobs[descriptor.Digest] = []byte("longer content")
+	_, err = client.blob(context.Background(), descriptor, t.TempDir())
+	assert.ErrorContains(t, err, "larger than the maximum size")
+
+	_, err = client.blob(context.Background(), ociDescriptor{Digest: "md5:abcd"}, t.TempDir())
+	assert.ErrorContains(t, err, "unsupported digest")
+}
+
+func TestFetchOCIArtifact(t *testing.T) {
+	registry := newTestRegistry()
+	layer := tarArchive(t, []testArchiveEntry{{name: "data/train.csv", content: "a,b\n", typeflag: tar.TypeReg}})
+	manifest := registry.addManifest(t, ociManifest{
+		MediaType: ociManifestMediaType,
+		Layers: []ociDescriptor{
+			registry.addBlob("application/vnd.oci.image.layer.v1.tar", layer, nil),
+			registry.addBlob("text/markdown", []byte("# Data\n"), map[string]string{ociTitleAnnotation: "README.md"}),
+		},
+	}, "v1")
+	host := registry.serve(t)
+	logger := log.New(io.Discard, "", 0)
+
+	clonePath := filepath.Join(t.TempDir(), "artifact")
+	digest, err := fetchOCIArtifact(CloneSpec{Remote: "oci://" + host + "/group/artifact:v1"}, clonePath, nil, logger)
+	require.NoError(t, err)
+	assert.Equal(t, manifest.Digest, digest)
+	assert.Equal(t, "a,b\n", readTestFile(t, clonePath, "data/train.csv"))
+	assert.Equal(t, "# Data\n", readTestFile(t, clonePath, "README.md"))
+
+	setSourceLimits(t, int64(len(layer)), maxSourceExtractedSize, maxSourceEntries)
+	clonePath = filepath.Join(t.TempDir(), "artifact")
+	_, err = fetchOCIArtifact(CloneSpec{Remote: "oci://" + host + "/group/artifact:v1"}, clonePath, nil, logger)
+	assert.ErrorContains(t, err, "more than the maximum size")
+	_, err = os.Stat(clonePath)
+	assert.True(t, os.IsNotExist(err))
+}
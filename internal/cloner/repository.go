@@ -32,6 +32,18 @@ type Repository struct {
 	Provider  string
 	Branch    *string
 	CommitSha *string
+	// The number of commits to fetch, the whole history is fetched when 0
+	Depth int
+	// The partial clone filter, e.g. blob:none
+	Filter string
+	// The directories to check out, the whole repository is checked out when empty
+	SparseCheckout []string
+	// The submodule policy, only the top level submodules are initialized when empty
+	Submodules string
+	// The LFS configuration, the LFS auto fetch setting of the cloner applies when nil
+	LFS *LFSSpec
+	// What to do when the repository already exists, either notifexist (default) or update
+	Strategy string
 
 	clonePath string
 	Cli       *GitCli
@@ -64,6 +76,15 @@ func (r *Repository) Exists() bool {
 	return strings.Contains(strings.ToLower(is_inside), "true")
 }
 
+// HeadCommit returns the commit checked out in the repository, it is empty when it cannot be determined
+func (r *Repository) HeadCommit() string {
+	commit, err := r.Cli.RevParse([]string{"HEAD"})
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(commit)
+}
+
 func (r *Repository) DefaultBranch(remoteName string) (string, error) {
 	_, err := r.Cli.Remote([]string{"set-head", remoteName, "--auto"})
 	if err != nil {
@@ -85,9 +106,16 @@ func (r *Repository) DefaultBranch(remoteName string) (string, error) {
 	return branch, nil
 }
 
-// Get the total size of all LFS files in bytes.
-func (r *Repository) GetLFSTotalSizeBytes() uint64 {
-	res, err := r.Cli.Lfs([]string{"ls-files", "--json"})
+// Get the total size of the LFS files matching the include and exclude patterns in bytes.
+func (r *Repository) GetLFSTotalSizeBytes(include []string, exclude []string) uint64 {
+	args := []string{"ls-files", "--json"}
+	if len(include) > 0 {
+		args = append(args, "--include", strings.Join(include, ","))
+	}
+	if len(exclude) > 0 {
+		args = append(args, "--exclude", strings.Join(exclude, ","))
+	}
+	res, err := r.Cli.Lfs(args)
 	if err != nil {
 		return 0
 	}
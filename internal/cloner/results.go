@@ -0,0 +1,163 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloner
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const ResultsDirFlag string = "results-dir"
+const TerminationMessagePathFlag string = "termination-message-path"
+
+// The states of a cloned repository
+
+const Cloned string = "Cloned"   // The repository was cloned
+const Skipped string = "Skipped" // The repository already exists and was kept
+const Updated string = "Updated" // The repository already exists and is at the commit of its remote
+const Failed string = "Failed"   // The repository could not be cloned
+
+// The states of the LFS objects of a cloned repository
+
+const LFSFetched string = "Fetched"   // The LFS objects were fetched
+const LFSSkipped string = "Skipped"   // The LFS objects were not fetched, they can be pulled from the session
+const LFSTooLarge string = "TooLarge" // The LFS objects exceed the maximum size or the free space and were not fetched
+const LFSFailed string = "Failed"     // The LFS objects could not be fetched, the repository is cloned without them
+
+// The default path of the termination message of a Kubernetes container
+const defaultTerminationMessagePath string = "/dev/termination-log"
+
+// Kubernetes truncates the termination messages longer than 4096 bytes
+const maxTerminationMessageSize int = 4096
+
+// The length of the errors in the termination message when all the errors do not fit
+const truncatedErrorLength int = 200
+
+// LFSResult is the outcome of fetching the LFS objects of a repository
+type LFSResult struct {
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// CloneResult is the result of cloning a repository, it is written in the results directory and
+// the results of all the repositories are summarized in the termination message of the container.
+type CloneResult struct {
+	Remote    string     `json:"remote"`
+	ClonePath string     `json:"clonePath,omitempty"`
+	State     string     `json:"state"`
+	Commit    string     `json:"commit,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Duration  string     `json:"duration,omitempty"`
+	LFS       *LFSResult `json:"lfs,omitempty"`
+	// How the existing repository was updated, only set with the update strategy
+	Update *UpdateResult `json:"update,omitempty"`
+}
+
+// CloneResults is the termination message of the cloners, the controller reads it into the session status
+type CloneResults struct {
+	CodeRepositories []CloneResult `json:"codeRepositories"`
+}
+
+// writeResults writes the result of each repository in its own file of the results directory
+func writeResults(dir string, results []CloneResult) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, result := range results {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.json", i)), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncateErrors shortens the errors of the results to at most length bytes
+func truncateErrors(results []CloneResult, length int) {
+	for i := range results {
+		if len(results[i].Error) > length {
+			results[i].Error = results[i].Error[:length]
+		}
+		if results[i].LFS != nil && len(results[i].LFS.Error) > length {
+			lfs := *results[i].LFS
+			lfs.Error = lfs.Error[:length]
+			results[i].LFS = &lfs
+		}
+		if results[i].Update != nil && len(results[i].Update.Error) > length {
+			update := *results[i].Update
+			update.Error = update.Error[:length]
+			results[i].Update = &update
+		}
+	}
+}
+
+// truncateDirtyFiles shortens the lists of dirty files of the results to at most count files
+func truncateDirtyFiles(results []CloneResult, count int) {
+	for i := range results {
+		if results[i].Update != nil && len(results[i].Update.DirtyFiles) > count {
+			update := *results[i].Update
+			update.DirtyFiles = update.DirtyFiles[:count]
+			results[i].Update = &update
+		}
+	}
+}
+
+// terminationMessage summarizes the results so that they fit in the termination message of the container,
+// the dirty files are limited and the errors are truncated and then dropped when the summary is too long.
+func terminationMessage(results []CloneResult) ([]byte, error) {
+	summary := make([]CloneResult, len(results))
+	copy(summary, results)
+	truncateDirtyFiles(summary, maxReportedDirtyFiles)
+	for _, errorLength := range []int{-1, truncatedErrorLength, 0} {
+		if errorLength >= 0 {
+			truncateErrors(summary, errorLength)
+		}
+		data, err := json.Marshal(CloneResults{CodeRepositories: summary})
+		if err != nil {
+			return nil, err
+		}
+		if len(data) <= maxTerminationMessageSize {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("the results of %d repositories do not fit in the termination message", len(results))
+}
+
+// reportResults writes the results in the results directory and in the termination message,
+// nothing is written where the path is empty. The failures are logged since the clones are done.
+func reportResults(results []CloneResult, resultsDir string, terminationMessagePath string) {
+	if resultsDir != "" {
+		if err := writeResults(resultsDir, results); err != nil {
+			log.Print("failed to write the results: ", err)
+		}
+	}
+	if terminationMessagePath != "" {
+		message, err := terminationMessage(results)
+		if err == nil {
+			err = os.WriteFile(terminationMessagePath, message, 0644)
+		}
+		if err != nil {
+			log.Print("failed to write the termination message: ", err)
+		}
+	}
+}
@@ -52,12 +52,36 @@ func Command() (*cobra.Command, error) {
 	cmd.Flags().BoolVar(&verbose, VerboseFlag, false, "make the command verbose")
 	cmd.Flags().VarP(preCloningStrategy, StrategyFlag, "", "the pre cloning strategy")
 
+	cmd.Flags().IntVar(&depth, DepthFlag, 0, "the number of commits to fetch, the whole history is fetched when 0")
+	cmd.Flags().StringArrayVar(&sparseCheckout, SparseCheckoutFlag, nil, "a directory to check out, can be repeated")
+	cmd.Flags().VarP(submodulePolicy, SubmodulesFlag, "", "the submodule policy: none, shallow or recursive")
+	cmd.Flags().VarP(sourceType, TypeFlag, "", "the type of the source: git, archive or oci")
+	cmd.Flags().StringVar(&checksum, ChecksumFlag, "", "the sha256 digest of an archive, e.g. sha256:<hex>")
+	cmd.Flags().StringVar(&terminationMessagePath, TerminationMessagePathFlag, defaultTerminationMessagePath, "the file where the result is written")
+
+	cloneAllCmd := &cobra.Command{
+		Use:   "clone-all",
+		Short: "Clone several repositories concurrently",
+		Long:  `clone-all clones the repositories of a configuration file concurrently and reports the result of each repository`,
+		Run:   cloneAll,
+	}
+	cloneAllCmd.Flags().StringVar(&configPath, ConfigFlag, "", "Path to the configuration file with the repositories")
+	err = cloneAllCmd.MarkFlagRequired(ConfigFlag)
+	if err != nil {
+		return nil, err
+	}
+	cloneAllCmd.Flags().IntVar(&parallelism, ParallelismFlag, 4, "the number of repositories cloned at the same time")
+	cloneAllCmd.Flags().StringVar(&resultsDir, ResultsDirFlag, "", "the directory where the result of each repository is written")
+	cloneAllCmd.Flags().StringVar(&terminationMessagePath, TerminationMessagePathFlag, defaultTerminationMessagePath, "the file where the summary of the results is written")
+	cloneAllCmd.Flags().BoolVar(&verbose, VerboseFlag, false, "make the command verbose")
+
 	shellCloneCmd := &cobra.Command{
 		Use: "shellclone",
 		Run: shellClone,
 	}
 
 	clonerRoot.AddCommand(cmd)
+	clonerRoot.AddCommand(cloneAllCmd)
 	clonerRoot.AddCommand(shellCloneCmd)
 	return clonerRoot, nil
 }
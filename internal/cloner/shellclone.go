@@ -12,6 +12,8 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/SwissDataScienceCenter/amalthea/internal/oauth"
+
 	_ "github.com/joho/godotenv/autoload"
 )
 
@@ -36,13 +38,14 @@ type CloneConfig struct {
 	LfsAutoFetch      bool   `mapstructure:"lfs_auto_fetch"`
 	IsGitProxyEnabled bool   `mapstructure:"is_git_proxy_enabled"`
 	GitProxyPort      int    `mapstructure:"git_proxy_port"`
-	Repositories      []Repository
-	GitProviders      []GitProvider
-}
-
-type RefreshTokenAnswer struct {
-	AccessToken string `json:"access_token"`
-	ExpiresAt   int64  `json:"expires_at"`
+	// The path of the certificate of the CA used by the git proxy, as seen from the session
+	GitProxyCACertPath string `mapstructure:"git_proxy_ca_cert_path"`
+	// The directory where the result of each repository is written, no results are written when empty
+	ResultsDir string `mapstructure:"results_dir"`
+	// The file where the summary of the results is written, read by Kubernetes when the container terminates
+	TerminationMessagePath string `mapstructure:"termination_message_path"`
+	Repositories           []Repository
+	GitProviders           []GitProvider
 }
 
 func loadRepositories(config CloneConfig) []Repository {
@@ -115,6 +118,9 @@ func shellClone(cmd *cobra.Command, args []string) {
 	v.SetDefault("lfs_auto_fetch", false)
 	v.SetDefault("is_git_proxy_enabled", false)
 	v.SetDefault("git_proxy_port", 8080)
+	v.SetDefault("git_proxy_ca_cert_path", "")
+	v.SetDefault("results_dir", "")
+	v.SetDefault("termination_message_path", defaultTerminationMessagePath)
 	v.SetDefault("user__username", "")
 	v.SetDefault("user__email", "")
 	v.SetDefault("user__full_name", "")
@@ -139,7 +145,7 @@ func shellClone(cmd *cobra.Command, args []string) {
 	config.Repositories = loadRepositories(config)
 	config.GitProviders = loadGitProviders()
 
-	cloner := Cloner{config, user, "origin"}
+	cloner := Cloner{config, user, "origin", map[string]*oauth.TokenSource{}}
 
 	if err := cloner.Run(); err != nil {
 		log.Fatal("failed to clone repo:", err)
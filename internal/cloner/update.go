@@ -0,0 +1,331 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// The states of a repository updated with the update strategy
+
+const UpToDate string = "UpToDate"           // The branch already points to the commit of the remote
+const FastForwarded string = "FastForwarded" // The branch was fast-forwarded to the commit of the remote
+const Ahead string = "Ahead"                 // The branch has local commits which are not on the remote
+const Diverged string = "Diverged"           // The branch and the remote both have commits which the other does not have
+const Dirty string = "Dirty"                 // The worktree has local changes, the branch is left as it is
+const Detached string = "Detached"           // No branch is checked out, there is nothing to fast-forward
+const UpdateFailed string = "Failed"         // The remote could not be fetched
+
+// The maximum number of dirty files listed in the termination message
+const maxReportedDirtyFiles int = 10
+
+// The maximum depth to which the history of a shallow repository is deepened to find where the branch and its remote meet
+const maxUpdateDepth int = 4096
+
+// UpdateResult describes how an existing repository was updated, the repository is only
+// fast-forwarded when its worktree is clean and the branch is behind its remote.
+type UpdateResult struct {
+	State string `json:"state"`
+	// The number of local commits which are not on the remote
+	Ahead int `json:"ahead,omitempty"`
+	// The number of commits of the remote which are not on the branch
+	Behind int `json:"behind,omitempty"`
+	// The files with uncommitted changes, the untracked files are only included when the update would overwrite them
+	DirtyFiles []string `json:"dirtyFiles,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// updated tells whether the worktree is at the commit of the remote after the update
+func (r *UpdateResult) updated() bool {
+	return r.State == UpToDate || r.State == FastForwarded
+}
+
+// ancestors returns the commits reachable from a commit, the history of a shallow
+// repository ends at the commits whose parents were not fetched.
+func ancestors(repository *git.Repository, from plumbing.Hash) (map[plumbing.Hash]bool, error) {
+	seen := map[plumbing.Hash]bool{}
+	queue := []plumbing.Hash{from}
+	for len(queue) > 0 {
+		hash := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if seen[hash] {
+			continue
+		}
+		commit, err := repository.CommitObject(hash)
+		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		seen[hash] = true
+		queue = append(queue, commit.ParentHashes...)
+	}
+	return seen, nil
+}
+
+// aheadBehind counts the commits of local which are not in remote and the commits of remote which are not in local,
+// related is false when the histories have no commit in common, e.g. when a shallow fetch did not reach the branch.
+func aheadBehind(repository *git.Repository, local plumbing.Hash, remote plumbing.Hash) (ahead int, behind int, related bool, err error) {
+	localCommits, err := ancestors(repository, local)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	remoteCommits, err := ancestors(repository, remote)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	for hash := range localCommits {
+		if !remoteCommits[hash] {
+			ahead += 1
+		}
+	}
+	for hash := range remoteCommits {
+		if !localCommits[hash] {
+			behind += 1
+		}
+	}
+	return ahead, behind, ahead < len(localCommits), nil
+}
+
+// isSmudgedLFSFile tells whether a modified file is an LFS pointer of the index replaced by the content of its object,
+// go-git does not run the clean filter of git-lfs so these files are reported as modified.
+func isSmudgedLFSFile(repository *git.Repository, worktree string, path string) bool {
+	index, err := repository.Storer.Index()
+	if err != nil {
+		return false
+	}
+	entry, err := index.Entry(path)
+	if err != nil {
+		return false
+	}
+	blob, err := repository.BlobObject(entry.Hash)
+	if err != nil || blob.Size > maxLFSPointerSize {
+		return false
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return false
+	}
+	pointer, ok := parseLFSPointer(content)
+	if !ok {
+		return false
+	}
+	file, err := os.Open(filepath.Join(worktree, filepath.FromSlash(path)))
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	return err == nil && size == pointer.Size && hex.EncodeToString(hash.Sum(nil)) == pointer.Oid
+}
+
+// dirtyFiles returns the files of the worktree with uncommitted changes
+func dirtyFiles(repository *git.Repository, worktree *git.Worktree, clonePath string) ([]string, error) {
+	status, err := worktree.Status()
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for path, fileStatus := range status {
+		switch {
+		case fileStatus.Staging == git.Untracked && fileStatus.Worktree == git.Untracked:
+			continue
+		case fileStatus.Staging == git.Unmodified && fileStatus.Worktree == git.Unmodified:
+			continue
+		case fileStatus.Staging == git.Unmodified && fileStatus.Worktree == git.Modified && isSmudgedLFSFile(repository, clonePath, path):
+			continue
+		}
+		files = append(files, path)
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// untrackedConflicts returns the untracked files of the worktree which the checkout of a commit would overwrite,
+// either because the commit has a file or a directory at their path or because it has a file at one of their parents.
+func untrackedConflicts(repository *git.Repository, worktree *git.Worktree, target plumbing.Hash) ([]string, error) {
+	status, err := worktree.Status()
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repository.CommitObject(target)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for path, fileStatus := range status {
+		if fileStatus.Worktree != git.Untracked {
+			continue
+		}
+		if _, err := tree.FindEntry(path); err == nil {
+			files = append(files, path)
+			continue
+		}
+		for parent := filepath.ToSlash(filepath.Dir(path)); parent != "."; parent = filepath.ToSlash(filepath.Dir(parent)) {
+			if entry, err := tree.FindEntry(parent); err == nil && entry.Mode != filemode.Dir {
+				files = append(files, path)
+				break
+			}
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// fetchBranch fetches the branch from the remote, a shallow repository is deepened until the branch and its remote
+// have a commit in common so that a branch which is more commits behind than the depth is not reported as diverged.
+// It returns the commits ahead and behind of the remote and the commit of the remote.
+func fetchBranch(repository *git.Repository, head *plumbing.Reference, remoteName string, spec CloneSpec, auth transport.AuthMethod, progress io.Writer) (int, int, plumbing.Hash, error) {
+	remoteRefName := plumbing.NewRemoteReferenceName(remoteName, head.Name().Short())
+	depth := spec.Depth
+	for {
+		// The refspec of a single branch clone only tracks the HEAD of the remote, the branch is fetched explicitly
+		err := repository.Fetch(&git.FetchOptions{
+			RemoteName: remoteName,
+			RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", head.Name(), remoteRefName))},
+			Auth:       auth,
+			Depth:      depth,
+			Progress:   progress,
+		})
+		if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return 0, 0, plumbing.ZeroHash, err
+		}
+		remoteRef, err := repository.Reference(remoteRefName, true)
+		if err != nil {
+			return 0, 0, plumbing.ZeroHash, err
+		}
+		ahead, behind, related, err := aheadBehind(repository, head.Hash(), remoteRef.Hash())
+		if err != nil || related || depth == 0 {
+			return ahead, behind, remoteRef.Hash(), err
+		}
+		shallow, err := repository.Storer.Shallow()
+		if err != nil {
+			return 0, 0, plumbing.ZeroHash, err
+		}
+		if len(shallow) == 0 {
+			return ahead, behind, remoteRef.Hash(), nil
+		}
+		if depth >= maxUpdateDepth {
+			return 0, 0, plumbing.ZeroHash, fmt.Errorf("the branch and its remote have no commit in common in the last %d commits", depth)
+		}
+		depth = min(depth*4, maxUpdateDepth)
+	}
+}
+
+// updateRepository fetches the remote of an existing repository and fast-forwards the checked out branch
+// when the worktree is clean, otherwise the repository is left as it is and the divergence is reported.
+func updateRepository(spec CloneSpec, clonePath string, auth transport.AuthMethod, progress io.Writer, logger *log.Logger) (*git.Repository, *UpdateResult) {
+	result := &UpdateResult{}
+	repository, err := git.PlainOpen(clonePath)
+	fail := func(err error) (*git.Repository, *UpdateResult) {
+		logger.Print("the repository was not updated: ", err)
+		result.State = UpdateFailed
+		result.Error = err.Error()
+		return repository, result
+	}
+	if err != nil {
+		return fail(err)
+	}
+	head, err := repository.Head()
+	if err != nil {
+		return fail(err)
+	}
+	if !head.Name().IsBranch() {
+		logger.Print("no branch is checked out in ", clonePath, ", nothing to update")
+		result.State = Detached
+		return repository, result
+	}
+
+	remoteName := "origin"
+	branch := head.Name().Short()
+	logger.Print("fetching ", branch, " from ", remoteName, " to update ", clonePath)
+	var remoteHash plumbing.Hash
+	result.Ahead, result.Behind, remoteHash, err = fetchBranch(repository, head, remoteName, spec, auth, progress)
+	if err != nil {
+		return fail(err)
+	}
+	worktree, err := repository.Worktree()
+	if err != nil {
+		return fail(err)
+	}
+	result.DirtyFiles, err = dirtyFiles(repository, worktree, clonePath)
+	if err != nil {
+		return fail(err)
+	}
+	// The hard reset of the fast-forward would silently replace the untracked files which are in the new commit
+	if len(result.DirtyFiles) == 0 && result.Ahead == 0 && result.Behind > 0 {
+		result.DirtyFiles, err = untrackedConflicts(repository, worktree, remoteHash)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	switch {
+	case len(result.DirtyFiles) > 0:
+		result.State = Dirty
+	case result.Ahead > 0 && result.Behind > 0:
+		result.State = Diverged
+	case result.Ahead > 0:
+		result.State = Ahead
+	case result.Behind == 0:
+		result.State = UpToDate
+	default:
+		logger.Print("fast-forwarding ", branch, " to ", remoteHash)
+		// A hard reset of a clean worktree to a descendant of its commit is a fast-forward
+		resetOptions := git.ResetOptions{Commit: remoteHash, Mode: git.HardReset}
+		if len(spec.SparseCheckout) > 0 {
+			err = worktree.ResetSparsely(&resetOptions, spec.SparseCheckout)
+		} else {
+			err = worktree.Reset(&resetOptions)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		result.State = FastForwarded
+	}
+	logger.Printf("%s is %s, %d commits ahead and %d behind with %d dirty files", clonePath, result.State, result.Ahead, result.Behind, len(result.DirtyFiles))
+	return repository, result
+}
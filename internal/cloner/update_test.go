@@ -0,0 +1,248 @@
+package cloner
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cloneTestRepository clones the upstream repository in a temporary directory
+func cloneTestRepository(t *testing.T, upstream string, depth int) (*git.Repository, string) {
+	t.Helper()
+	dir := t.TempDir()
+	repository, err := git.PlainClone(dir, false, &git.CloneOptions{URL: "file://" + upstream, Depth: depth})
+	require.NoError(t, err)
+	return repository, dir
+}
+
+func readTestFile(t *testing.T, dir string, name string) string {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestUpdateRepository(t *testing.T) {
+	cases := []struct {
+		name string
+		// The depth of the clone and of the update
+		depth int
+		// The number of commits added upstream after the clone
+		upstreamCommits int
+		// Changes the clone before the update
+		prepare func(t *testing.T, repository *git.Repository, dir string)
+		state   string
+		ahead   int
+		behind  int
+		dirty   []string
+		// The expected content of the README of the clone after the update
+		readme string
+	}{
+		{
+			name:   "up to date",
+			state:  UpToDate,
+			readme: "initial",
+		},
+		{
+			name:            "clean fast-forward",
+			upstreamCommits: 2,
+			state:           FastForwarded,
+			behind:          2,
+			readme:          "upstream 2",
+		},
+		{
+			name:            "untracked files which are not in the new commit are kept",
+			upstreamCommits: 1,
+			prepare: func(t *testing.T, repository *git.Repository, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("mine"), 0o644))
+			},
+			state:  FastForwarded,
+			behind: 1,
+			readme: "upstream 1",
+		},
+		{
+			name:            "dirty worktree",
+			upstreamCommits: 1,
+			prepare: func(t *testing.T, repository *git.Repository, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("local change"), 0o644))
+			},
+			state:  Dirty,
+			behind: 1,
+			dirty:  []string{"README.md"},
+			readme: "local change",
+		},
+		{
+			name:            "untracked file in the new commit",
+			upstreamCommits: 1,
+			prepare: func(t *testing.T, repository *git.Repository, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "upstream-1.txt"), []byte("mine"), 0o644))
+			},
+			state:  Dirty,
+			behind: 1,
+			dirty:  []string{"upstream-1.txt"},
+			readme: "initial",
+		},
+		{
+			name:            "untracked file under a file of the new commit",
+			upstreamCommits: 1,
+			prepare: func(t *testing.T, repository *git.Repository, dir string) {
+				require.NoError(t, os.MkdirAll(filepath.Join(dir, "upstream-1.txt"), 0o755))
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "upstream-1.txt", "notes.txt"), []byte("mine"), 0o644))
+			},
+			state:  Dirty,
+			behind: 1,
+			dirty:  []string{"upstream-1.txt/notes.txt"},
+			readme: "initial",
+		},
+		{
+			name: "ahead",
+			prepare: func(t *testing.T, repository *git.Repository, dir string) {
+				commitFiles(t, repository, map[string]string{"local.txt": "local"}, "local commit")
+			},
+			state:  Ahead,
+			ahead:  1,
+			readme: "initial",
+		},
+		{
+			name:            "diverged branch",
+			upstreamCommits: 2,
+			prepare: func(t *testing.T, repository *git.Repository, dir string) {
+				commitFiles(t, repository, map[string]string{"local.txt": "local"}, "local commit")
+			},
+			state:  Diverged,
+			ahead:  1,
+			behind: 2,
+			readme: "initial",
+		},
+		{
+			name:            "shallow clone more commits behind than the depth",
+			depth:           1,
+			upstreamCommits: 6,
+			state:           FastForwarded,
+			behind:          6,
+			readme:          "upstream 6",
+		},
+		{
+			name:            "shallow clone diverged",
+			depth:           1,
+			upstreamCommits: 6,
+			prepare: func(t *testing.T, repository *git.Repository, dir string) {
+				commitFiles(t, repository, map[string]string{"local.txt": "local"}, "local commit")
+			},
+			state:  Diverged,
+			ahead:  1,
+			behind: 6,
+			readme: "initial",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream, upstreamDir := newTestRepository(t, map[string]string{"README.md": "initial"})
+			// Some history before the clone so that a shallow clone does not have all the commits
+			for i := range 3 {
+				commitFiles(t, upstream, map[string]string{fmt.Sprintf("history-%d.txt", i): "history"}, "history")
+			}
+			repository, dir := cloneTestRepository(t, upstreamDir, tc.depth)
+			for i := 1; i <= tc.upstreamCommits; i++ {
+				commitFiles(t, upstream, map[string]string{
+					"README.md":                       fmt.Sprintf("upstream %d", i),
+					fmt.Sprintf("upstream-%d.txt", i): "upstream",
+				}, fmt.Sprintf("upstream %d", i))
+			}
+			if tc.prepare != nil {
+				tc.prepare(t, repository, dir)
+			}
+
+			_, result := updateRepository(CloneSpec{Remote: "file://" + upstreamDir, Depth: tc.depth}, dir, nil, io.Discard, log.New(io.Discard, "", 0))
+
+			assert.Empty(t, result.Error)
+			assert.Equal(t, tc.state, result.State)
+			assert.Equal(t, tc.ahead, result.Ahead)
+			assert.Equal(t, tc.behind, result.Behind)
+			if len(tc.dirty) > 0 {
+				assert.Equal(t, tc.dirty, result.DirtyFiles)
+			} else {
+				assert.Empty(t, result.DirtyFiles)
+			}
+			assert.Equal(t, tc.readme, readTestFile(t, dir, "README.md"))
+		})
+	}
+}
+
+func TestUpdateRepositoryUntrackedFileIsKept(t *testing.T) {
+	upstream, upstreamDir := newTestRepository(t, map[string]string{"README.md": "initial"})
+	_, dir := cloneTestRepository(t, upstreamDir, 0)
+	commitFiles(t, upstream, map[string]string{"config.yaml": "upstream"}, "add the configuration")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("mine"), 0o644))
+
+	_, result := updateRepository(CloneSpec{Remote: "file://" + upstreamDir}, dir, nil, io.Discard, log.New(io.Discard, "", 0))
+
+	assert.Equal(t, Dirty, result.State)
+	assert.Equal(t, "mine", readTestFile(t, dir, "config.yaml"))
+	assert.False(t, result.updated())
+}
+
+func TestClonerUpdate(t *testing.T) {
+	cases := []struct {
+		name            string
+		upstreamCommits int
+		// Changes the clone before the update
+		prepare func(t *testing.T, dir string)
+		state   string
+		behind  int
+		dirty   []string
+		readme  string
+	}{
+		{
+			name:            "shallow clone more commits behind than its depth",
+			upstreamCommits: 6,
+			state:           FastForwarded,
+			behind:          6,
+			readme:          "upstream 6",
+		},
+		{
+			name:            "untracked file in the new commit",
+			upstreamCommits: 1,
+			prepare: func(t *testing.T, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "upstream-1.txt"), []byte("mine"), 0o644))
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("mine"), 0o644))
+			},
+			state:  Dirty,
+			behind: 1,
+			dirty:  []string{"upstream-1.txt"},
+			readme: "initial",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream, upstreamDir := newTestRepository(t, map[string]string{"README.md": "initial"})
+			dir := t.TempDir()
+			_, err := NewGitCli(dir).Clone([]string{"--depth", "1", "file://" + upstreamDir, "."})
+			require.NoError(t, err)
+			for i := 1; i <= tc.upstreamCommits; i++ {
+				commitFiles(t, upstream, map[string]string{
+					"README.md":                       fmt.Sprintf("upstream %d", i),
+					fmt.Sprintf("upstream-%d.txt", i): "upstream",
+				}, fmt.Sprintf("upstream commit %d", i))
+			}
+			if tc.prepare != nil {
+				tc.prepare(t, dir)
+			}
+			cloner := Cloner{remoteName: "origin"}
+
+			result := cloner.update(Repository{Depth: 1, Submodules: NoSubmodules, clonePath: dir, Cli: NewGitCli(dir)})
+
+			assert.Equal(t, tc.state, result.State, result.Error)
+			assert.Equal(t, tc.behind, result.Behind)
+			assert.Equal(t, tc.dirty, result.DirtyFiles)
+			assert.Equal(t, tc.readme, readTestFile(t, dir, "README.md"))
+		})
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"slices"
 	"time"
 
 	"github.com/getsentry/sentry-go"
@@ -32,6 +33,7 @@ import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	metricsv1beta1 "k8s.io/metrics/pkg/client/clientset/versioned/typed/metrics/v1beta1"
 
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -59,7 +61,7 @@ const secretCleanupFinalizerName = "amalthea.dev/secrets-finalizer"
 // +kubebuilder:rbac:groups=amalthea.dev,resources=amaltheasessions/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=amalthea.dev,resources=amaltheasessions/finalizers,verbs=update
 // +kubebuilder:rbac:groups=core,resources=secrets,verbs=list;watch;delete;create;patch
-// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;delete
 // +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;create;watch;patch
 // +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch
 // +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch
@@ -271,6 +273,11 @@ func (r *AmaltheaSessionReconciler) reconcileInner(ctx context.Context, req ctrl
 		return ctrl.Result{}, err
 	}
 
+	err = r.restartWithoutSkippedDataSources(ctx, amaltheasession)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
 	// Now requeue to make sure we can watch for idleness and other status changes
 	requeueAfter := time.Second * 10
 	if statusChanged {
@@ -305,6 +312,45 @@ func (r *AmaltheaSessionReconciler) deleteSecrets(ctx context.Context, cr *amalt
 	return error_list
 }
 
+// restartWithoutSkippedDataSources deletes the session pod when it waits for the volume of an optional data source
+// which failed to mount and which was removed from the statefulset, the pod is then recreated without the volume.
+// The statefulset controller does not replace a pod which is stuck in its rollout.
+func (r *AmaltheaSessionReconciler) restartWithoutSkippedDataSources(ctx context.Context, cr *amaltheadevv1alpha1.AmaltheaSession) error {
+	if cr.Spec.SessionType == amaltheadevv1alpha1.SessionTypeNonInteractive || cr.Spec.Hibernated {
+		return nil
+	}
+	pod, err := cr.GetPod(ctx, r.Client)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if pod.GetDeletionTimestamp() != nil || podVolumesMounted(pod) {
+		return nil
+	}
+	sts := appsv1.StatefulSet{}
+	err = r.Get(ctx, types.NamespacedName{Name: cr.Name, Namespace: cr.Namespace}, &sts)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hasVolume := func(spec corev1.PodSpec, name string) bool {
+		return slices.ContainsFunc(spec.Volumes, func(volume corev1.Volume) bool { return volume.Name == name })
+	}
+	for ids := range cr.Spec.DataSources {
+		name := cr.DataSourceVolumeName(ids)
+		if cr.DataSourceSkipped(ids) && hasVolume(pod.Spec, name) && !hasVolume(sts.Spec.Template.Spec, name) {
+			logger := log.FromContext(ctx)
+			logger.Info("restarting the session without the optional data source which failed to mount", "volume", name)
+			return client.IgnoreNotFound(r.Delete(ctx, pod))
+		}
+	}
+	return nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *AmaltheaSessionReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
@@ -3,6 +3,8 @@ package controller
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
 	"time"
 
@@ -64,6 +66,10 @@ const freshContainerMinimalAge = 15 * time.Second
 
 const maxWaitForClearFailedScheduling = 10 * time.Minute
 
+// The time during which the warnings of the claims and the mount events of a data source
+// are reported before the data source is considered failed
+const maxWaitForClearDataSourceFailure = 3 * time.Minute
+
 // Return whether the session is failed or hibernated
 func isFailedOrHibernated(as *amaltheadevv1alpha1.AmaltheaSession) bool {
 	return as.Status.State == amaltheadevv1alpha1.Failed ||
@@ -94,6 +100,53 @@ func cleanWellKnown(current map[string]string, desired map[string]string) map[st
 	return clean
 }
 
+// syncOptionalDataSources adds or removes the volumes and the volume mounts of the optional data sources
+// of the current pod spec so that they match the desired pod spec. Nothing changes when the data sources
+// are already in the same state, so that the session is not restarted.
+func syncOptionalDataSources(cr *amaltheadevv1alpha1.AmaltheaSession, current *v1.PodSpec, desired *v1.PodSpec) {
+	for ids, ds := range cr.Spec.DataSources {
+		if !ds.Optional {
+			continue
+		}
+		name := cr.DataSourceVolumeName(ids)
+		isVolume := func(volume v1.Volume) bool { return volume.Name == name }
+		desiredIndex := slices.IndexFunc(desired.Volumes, isVolume)
+		currentIndex := slices.IndexFunc(current.Volumes, isVolume)
+		switch {
+		case desiredIndex >= 0 && currentIndex < 0:
+			current.Volumes = append(current.Volumes, desired.Volumes[desiredIndex])
+		case desiredIndex < 0 && currentIndex >= 0:
+			current.Volumes = slices.Delete(current.Volumes, currentIndex, currentIndex+1)
+		}
+		syncVolumeMounts(name, current.InitContainers, desired.InitContainers)
+		syncVolumeMounts(name, current.Containers, desired.Containers)
+	}
+}
+
+// syncVolumeMounts adds or removes the mounts of a volume in the current containers as in the desired containers
+func syncVolumeMounts(volume string, current []v1.Container, desired []v1.Container) {
+	isMount := func(mount v1.VolumeMount) bool { return mount.Name == volume }
+	for i := range current {
+		idesired := slices.IndexFunc(desired, func(container v1.Container) bool { return container.Name == current[i].Name })
+		if idesired < 0 {
+			continue
+		}
+		desiredMounts := []v1.VolumeMount{}
+		for _, mount := range desired[idesired].VolumeMounts {
+			if isMount(mount) {
+				desiredMounts = append(desiredMounts, mount)
+			}
+		}
+		hasMount := slices.ContainsFunc(current[i].VolumeMounts, isMount)
+		switch {
+		case len(desiredMounts) > 0 && !hasMount:
+			current[i].VolumeMounts = append(current[i].VolumeMounts, desiredMounts...)
+		case len(desiredMounts) == 0 && hasMount:
+			current[i].VolumeMounts = slices.DeleteFunc(current[i].VolumeMounts, isMount)
+		}
+	}
+}
+
 func (c ChildResource[T]) Reconcile(ctx context.Context, clnt client.Client, cr *amaltheadevv1alpha1.AmaltheaSession) ChildResourceUpdate[T] { //nolint:gocyclo
 	logger := log.FromContext(ctx)
 	if c.Current == nil {
@@ -178,6 +231,8 @@ func (c ChildResource[T]) Reconcile(ctx context.Context, clnt client.Client, cr
 			current.Spec.Template.Spec.NodeSelector = desired.Spec.Template.Spec.NodeSelector
 			current.Spec.Template.Spec.PriorityClassName = desired.Spec.Template.Spec.PriorityClassName
 			current.Spec.Replicas = desired.Spec.Replicas
+			// The session is restarted without the optional data sources which failed to mount whatever the strategy
+			syncOptionalDataSources(cr, &current.Spec.Template.Spec, &desired.Spec.Template.Spec)
 			switch strategy := cr.Spec.ReconcileStrategy; strategy {
 			case amaltheadevv1alpha1.Never:
 				return nil
@@ -280,11 +335,21 @@ func (c ChildResource[T]) Reconcile(ctx context.Context, clnt client.Client, cr
 			}
 			if current.CreationTimestamp.IsZero() {
 				logger.Info("Creating a secret")
+				caData, err := cr.GitProxyCAData(nil)
+				if err != nil {
+					return err
+				}
 				current.Data = desired.Data
 				current.StringData = desired.StringData
+				if len(caData) > 0 {
+					current.StringData = maps.Clone(desired.StringData)
+					if current.StringData == nil {
+						current.StringData = map[string]string{}
+					}
+					maps.Copy(current.StringData, caData)
+				}
 				current.ObjectMeta = desired.ObjectMeta
-				err := ctrl.SetControllerReference(cr, current, clnt.Scheme())
-				return err
+				return ctrl.SetControllerReference(cr, current, clnt.Scheme())
 			}
 			switch strategy := cr.Spec.ReconcileStrategy; strategy {
 			case amaltheadevv1alpha1.Never:
@@ -295,7 +360,7 @@ func (c ChildResource[T]) Reconcile(ctx context.Context, clnt client.Client, cr
 				}
 				fallthrough
 			case amaltheadevv1alpha1.Always:
-				// Preserve existing random tunnel secret values when updating
+				// Preserve existing random tunnel and cookie secret values when updating
 				preservedStringData := make(map[string]string)
 				for k, v := range desired.StringData {
 					preservedStringData[k] = v
@@ -304,7 +369,17 @@ func (c ChildResource[T]) Reconcile(ctx context.Context, clnt client.Client, cr
 					if existingTunnel, exists := current.Data["WSTUNNEL_SECRET"]; exists {
 						preservedStringData["WSTUNNEL_SECRET"] = string(existingTunnel)
 					}
+					_, desiredCookieSecret := desired.StringData[amaltheadevv1alpha1.OidcCookieSecretKey]
+					if existingCookieSecret, exists := current.Data[amaltheadevv1alpha1.OidcCookieSecretKey]; exists && desiredCookieSecret {
+						preservedStringData[amaltheadevv1alpha1.OidcCookieSecretKey] = string(existingCookieSecret)
+					}
 				}
+				// The CA of the git proxy is only generated when the secret does not have one yet
+				caData, err := cr.GitProxyCAData(current.Data)
+				if err != nil {
+					return err
+				}
+				maps.Copy(preservedStringData, caData)
 				current.Data = desired.Data
 				current.StringData = preservedStringData
 				current.Labels = cleanWellKnown(current.Labels, desired.Labels)
@@ -478,12 +553,14 @@ func NewInteractiveChildResources(cr *amaltheadevv1alpha1.AmaltheaSession, cfg c
 }
 
 func (c ChildResources) Reconcile(ctx context.Context, clnt client.Client, cr *amaltheadevv1alpha1.AmaltheaSession) (ChildResourceUpdates, error) {
+	// The secret is reconciled first so that a pod restarted by the update of the statefulset
+	// mounts the new configuration of the cloner
 	output := ChildResourceUpdates{
+		Secret:      c.Secret.Reconcile(ctx, clnt, cr),
 		StatefulSet: c.StatefulSet.Reconcile(ctx, clnt, cr),
 		PVC:         c.PVC.Reconcile(ctx, clnt, cr),
 		Service:     c.Service.Reconcile(ctx, clnt, cr),
 		Ingress:     c.Ingress.Reconcile(ctx, clnt, cr),
-		Secret:      c.Secret.Reconcile(ctx, clnt, cr),
 		Job:         c.Job.Reconcile(ctx, clnt, cr),
 	}
 
@@ -526,7 +603,7 @@ func (c ChildResourceUpdates) IsRunning(pod *v1.Pod) bool {
 }
 
 func (c ChildResourceUpdates) State(cr *amaltheadevv1alpha1.AmaltheaSession, pod *v1.Pod, job *batchv1.Job) (amaltheadevv1alpha1.State, string) {
-	msg := c.failureMessage(pod, job)
+	msg := c.failureMessage(cr, pod, job)
 	switch {
 	case cr.GetDeletionTimestamp() != nil:
 		return amaltheadevv1alpha1.NotReady, ""
@@ -547,7 +624,7 @@ func (c ChildResourceUpdates) State(cr *amaltheadevv1alpha1.AmaltheaSession, pod
 	}
 }
 
-func (c ChildResourceUpdates) failureMessage(pod *v1.Pod, job *batchv1.Job) string {
+func (c ChildResourceUpdates) failureMessage(cr *amaltheadevv1alpha1.AmaltheaSession, pod *v1.Pod, job *batchv1.Job) string {
 	msg := podFailureReason(pod)
 	if msg != "" {
 		return msg
@@ -556,7 +633,12 @@ func (c ChildResourceUpdates) failureMessage(pod *v1.Pod, job *batchv1.Job) stri
 	if msg != "" {
 		return msg
 	}
+	optional := optionalDataSourceClaims(cr)
 	for ipvc := range c.DataSourcesPVCs {
+		if c.DataSourcesPVCs[ipvc].Manifest == nil || optional[c.DataSourcesPVCs[ipvc].Manifest.Name] {
+			// NOTE: The optional data sources which cannot be mounted only degrade the session
+			continue
+		}
 		msg = pvcFailureReason(c.DataSourcesPVCs[ipvc].Manifest)
 		if msg != "" {
 			return msg
@@ -578,6 +660,17 @@ func (c ChildResourceUpdates) failureMessage(pod *v1.Pod, job *batchv1.Job) stri
 	return ""
 }
 
+// optionalDataSourceClaims returns the names of the PVCs created for the optional data sources
+func optionalDataSourceClaims(cr *amaltheadevv1alpha1.AmaltheaSession) map[string]bool {
+	claims := map[string]bool{}
+	for ids, ds := range cr.Spec.DataSources {
+		if ds.Optional && ds.Type == amaltheadevv1alpha1.Rclone {
+			claims[cr.DataSourceVolumeName(ids)] = true
+		}
+	}
+	return claims
+}
+
 type EventsInferedStateResult string
 
 const (
@@ -679,7 +772,7 @@ func Conditions(
 		now := metav1.Now()
 		switch condition.Type {
 		case amaltheadevv1alpha1.AmaltheaSessionReady:
-			stateIsRunning := state == amaltheadevv1alpha1.Running
+			stateIsRunning := state == amaltheadevv1alpha1.Running || state == amaltheadevv1alpha1.RunningDegraded
 			if stateIsRunning && condition.Status == metav1.ConditionFalse {
 				condition.Status = metav1.ConditionTrue
 				condition.LastTransitionTime = now
@@ -806,6 +899,14 @@ func (c ChildResourceUpdates) Status(
 		failMsg = err.Error()
 	}
 
+	dataSources := dataSourceStatuses(ctx, r.Client, cr, pod, c.DataSourcesPVCs)
+	if state == amaltheadevv1alpha1.Running {
+		if msg := dataSourceFailures(cr, dataSources, true); msg != "" {
+			state = amaltheadevv1alpha1.RunningDegraded
+			failMsg = fmt.Sprintf("the session runs without its optional data sources which cannot be mounted: %s", msg)
+		}
+	}
+
 	if pod != nil {
 		oldEnough := false
 		for _, containerStatus := range pod.Status.ContainerStatuses {
@@ -817,7 +918,7 @@ func (c ChildResourceUpdates) Status(
 			}
 		}
 
-		if state == amaltheadevv1alpha1.Running && oldEnough {
+		if (state == amaltheadevv1alpha1.Running || state == amaltheadevv1alpha1.RunningDegraded) && oldEnough {
 			idleSince, idle = getIdleState(ctx, r, cr)
 		}
 		if cr.Spec.SessionType == amaltheadevv1alpha1.SessionTypeNonInteractive {
@@ -882,8 +983,15 @@ func (c ChildResourceUpdates) Status(
 		WillHibernateAt:       hibernationDate,
 		RunID:                 cr.Status.RunID,
 		Error:                 failMsg,
+		CodeRepositories:      cr.Status.CodeRepositories,
+		DataSources:           dataSources,
 	}
 	warning := c.warningMessage(pod)
+	if warning == "" && state == amaltheadevv1alpha1.NotReady {
+		if msg := dataSourceFailures(cr, dataSources, false); msg != "" {
+			warning = fmt.Sprintf("the session cannot start until its data sources are mounted: %s", msg)
+		}
+	}
 	if status.Error == "" && warning != "" {
 		status.Error = warning
 	}
@@ -892,13 +1000,20 @@ func (c ChildResourceUpdates) Status(
 		initCounts, counts := containerCounts(pod)
 		status.InitContainerCounts = initCounts
 		status.ContainerCounts = counts
+
+		codeRepositories, err := codeRepositoryStatuses(pod)
+		if err != nil {
+			logger.Error(err, "Could not read the status of the code repositories")
+		} else if codeRepositories != nil {
+			status.CodeRepositories = codeRepositories
+		}
 	}
 	if state == amaltheadevv1alpha1.Hibernated || cr.DeletionTimestamp != nil {
 		status.ContainerCounts.Ready = 0
 		status.InitContainerCounts.Ready = 0
 	}
 
-	if state == amaltheadevv1alpha1.Hibernated || state == amaltheadevv1alpha1.Running || state == amaltheadevv1alpha1.Succeeded {
+	if state == amaltheadevv1alpha1.Hibernated || state == amaltheadevv1alpha1.Running || state == amaltheadevv1alpha1.RunningDegraded || state == amaltheadevv1alpha1.Succeeded {
 		status.FailedSchedulingSince = metav1.Time{}
 	}
 
@@ -72,8 +72,15 @@ func podFailureReason(pod *v1.Pod) string {
 			if slices.Contains(valid_waiting_reasons, contStatus.State.Waiting.Reason) {
 				continue
 			}
+			// NOTE: A crashing cloner reports which repositories could not be cloned and why
+			if results, ok := containerCloneResults(contStatus); ok && cloneFailureReason(results) != "" {
+				return cloneFailureReason(results)
+			}
 			return handleBadWaitingState(contStatus)
 		case contStatus.State.Terminated != nil && contStatus.State.Terminated.ExitCode != 0:
+			if results, ok := containerCloneResults(contStatus); ok && cloneFailureReason(results) != "" {
+				return cloneFailureReason(results)
+			}
 			if contStatus.State.Terminated.Message != "" {
 				return fmt.Sprintf("the container %s terminated with an error %s", contStatus.Name, contStatus.State.Terminated.Message)
 			}
@@ -13,6 +13,7 @@ import (
 	"testing"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 type TestClient struct {
@@ -165,3 +166,294 @@ func TestEventsInferredStateWhereFailedAfterScheduled(t *testing.T) {
 	assert.Equal(t, EisrInitiallyFailed, result)
 	assert.Nil(t, err)
 }
+
+func TestCodeRepositoryStatuses(t *testing.T) {
+	pod := &v1.Pod{Status: v1.PodStatus{InitContainerStatuses: []v1.ContainerStatus{
+		{Name: v1alpha.GitCloneContainerName, State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}},
+	}}}
+	statuses, err := codeRepositoryStatuses(pod)
+	assert.Nil(t, err)
+	assert.Nil(t, statuses)
+
+	// The results of a failed run are read from the last termination state while the container restarts
+	pod.Status.InitContainerStatuses[0].State = v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}
+	pod.Status.InitContainerStatuses[0].LastTerminationState = v1.ContainerState{Terminated: &v1.ContainerStateTerminated{
+		ExitCode: 1,
+		Message:  `{"codeRepositories":[{"remote":"https://example.org/a.git","clonePath":"/workspace/a","state":"Cloned","commit":"abc","duration":"1.5s"},{"remote":"https://example.org/b.git","state":"Failed","error":"authentication required","duration":"20ms"}]}`,
+	}}
+	statuses, err = codeRepositoryStatuses(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, []v1alpha.CodeRepositoryStatus{
+		{Remote: "https://example.org/a.git", ClonePath: "/workspace/a", State: v1alpha.CodeRepositoryCloned, Commit: "abc", Duration: metav1.Duration{Duration: 1500 * time.Millisecond}},
+		{Remote: "https://example.org/b.git", State: v1alpha.CodeRepositoryFailed, Error: "authentication required", Duration: metav1.Duration{Duration: 20 * time.Millisecond}},
+	}, statuses)
+	// The failure of the cloner names the repository instead of the container
+	assert.Equal(t, "the repository https://example.org/b.git failed to clone: authentication required", podFailureReason(pod))
+
+	pod.Status.InitContainerStatuses[0].State = v1.ContainerState{Terminated: &v1.ContainerStateTerminated{Message: "not json"}}
+	_, err = codeRepositoryStatuses(pod)
+	assert.NotNil(t, err)
+}
+
+func TestCodeRepositoryStatusesFromExtraInitContainers(t *testing.T) {
+	pod := &v1.Pod{Status: v1.PodStatus{InitContainerStatuses: []v1.ContainerStatus{
+		{Name: "setup", State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{Message: "done"}}},
+		{Name: "git-clone-shell", State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{
+			Reason:  "Completed",
+			Message: `{"codeRepositories":[{"remote":"https://example.org/a.git","state":"Cloned","commit":"abc","lfs":{"state":"Failed","error":"not enough free space"}}]}`,
+		}}},
+	}}}
+	statuses, err := codeRepositoryStatuses(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, []v1alpha.CodeRepositoryStatus{
+		{
+			Remote: "https://example.org/a.git",
+			State:  v1alpha.CodeRepositoryCloned,
+			Commit: "abc",
+			LFS:    &v1alpha.CodeRepositoryLFSStatus{State: v1alpha.LFSFailed, Error: "not enough free space"},
+		},
+	}, statuses)
+	assert.Empty(t, podFailureReason(pod))
+}
+
+func TestCodeRepositoryStatusesOfUpdatedRepositories(t *testing.T) {
+	pod := &v1.Pod{Status: v1.PodStatus{InitContainerStatuses: []v1.ContainerStatus{
+		{Name: v1alpha.GitCloneContainerName, State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{
+			Reason:  "Completed",
+			Message: `{"codeRepositories":[{"remote":"https://example.org/a.git","state":"Updated","commit":"def","update":{"state":"FastForwarded","behind":2}},{"remote":"https://example.org/b.git","state":"Skipped","commit":"abc","update":{"state":"Dirty","ahead":1,"dirtyFiles":["README.md"]}}]}`,
+		}}},
+	}}}
+	statuses, err := codeRepositoryStatuses(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, []v1alpha.CodeRepositoryStatus{
+		{
+			Remote: "https://example.org/a.git",
+			State:  v1alpha.CodeRepositoryUpdated,
+			Commit: "def",
+			Update: &v1alpha.CodeRepositoryUpdateStatus{State: v1alpha.UpdateFastForwarded, Behind: 2},
+		},
+		{
+			Remote: "https://example.org/b.git",
+			State:  v1alpha.CodeRepositorySkipped,
+			Commit: "abc",
+			Update: &v1alpha.CodeRepositoryUpdateStatus{State: v1alpha.UpdateDirty, Ahead: 1, DirtyFiles: []string{"README.md"}},
+		},
+	}, statuses)
+	// A repository which cannot be updated does not fail the session
+	assert.Empty(t, podFailureReason(pod))
+}
+
+func eventsIndexedClient(objects ...client.Object) client.Client {
+	builder := fake.NewClientBuilder().WithObjects(objects...)
+	for field, value := range map[string]func(v1.ObjectReference) string{
+		"involvedObject.name":      func(ref v1.ObjectReference) string { return ref.Name },
+		"involvedObject.namespace": func(ref v1.ObjectReference) string { return ref.Namespace },
+		"involvedObject.kind":      func(ref v1.ObjectReference) string { return ref.Kind },
+	} {
+		builder = builder.WithIndex(&v1.Event{}, field, func(obj client.Object) []string {
+			return []string{value(obj.(*v1.Event).InvolvedObject)}
+		})
+	}
+	return builder.Build()
+}
+
+func TestDataSourceStatuses(t *testing.T) {
+	created := metav1.NewTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+	session := &v1alpha.AmaltheaSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: v1alpha.AmaltheaSessionSpec{
+			DataSources: []v1alpha.DataSource{
+				{Type: v1alpha.Rclone, MountPath: "/data/s3", SecretRef: &v1alpha.SessionSecretRef{Name: "rclone"}},
+				{Type: v1alpha.PVCStorage, MountPath: "/data/shared", PVC: &v1alpha.PVCDataSource{ClaimName: "shared"}},
+				{Type: v1alpha.PVCStorage, MountPath: "/data/missing", PVC: &v1alpha.PVCDataSource{ClaimName: "missing"}},
+				{Type: v1alpha.EmptyDirStorage, MountPath: "/scratch"},
+				{Type: v1alpha.PVCStorage, MountPath: "/data/bound", PVC: &v1alpha.PVCDataSource{ClaimName: "bound"}},
+				{Type: v1alpha.NFSStorage, MountPath: "/data/nfs", NFS: &v1alpha.NFSDataSource{Server: "nfs", Path: "/"}},
+			},
+		},
+	}
+	event := func(kind string, name string, reason string, message string, at metav1.Time) *v1.Event {
+		return &v1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: fmt.Sprintf("%s.%d", name, at.Unix()), Namespace: "default"},
+			InvolvedObject: v1.ObjectReference{Kind: kind, Name: name, Namespace: "default"},
+			Type:           v1.EventTypeWarning,
+			Reason:         reason,
+			Message:        message,
+			LastTimestamp:  at,
+		}
+	}
+	clnt := eventsIndexedClient(
+		&v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "shared", Namespace: "default"},
+			Status:     v1.PersistentVolumeClaimStatus{Phase: v1.ClaimLost},
+		},
+		&v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "bound", Namespace: "default"},
+			Status:     v1.PersistentVolumeClaimStatus{Phase: v1.ClaimBound},
+		},
+		event("PersistentVolumeClaim", "amalthea-test-ds-0", "ProvisioningFailed", "invalid rclone configuration", created),
+		event("Pod", "test-0", "FailedMount", `MountVolume.SetUp failed for volume "amalthea-test-ds-5" : mount.nfs: access denied`, created),
+		// The events of the previous pods are ignored
+		event("Pod", "test-0", "FailedMount", `MountVolume.SetUp failed for volume "amalthea-test-ds-3" : out of space`, metav1.NewTime(created.Add(-time.Hour))),
+	)
+	pvcs := []ChildResourceUpdate[v1.PersistentVolumeClaim]{
+		{Manifest: &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "amalthea-test-ds-0", Namespace: "default"},
+			Status:     v1.PersistentVolumeClaimStatus{Phase: v1.ClaimPending},
+		}},
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-0", Namespace: "default", CreationTimestamp: created},
+		Status: v1.PodStatus{InitContainerStatuses: []v1.ContainerStatus{
+			{Name: v1alpha.GitCloneContainerName, State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "PodInitializing"}}},
+		}},
+	}
+
+	expected := []v1alpha.DataSourceStatus{
+		{
+			Type:      v1alpha.Rclone,
+			MountPath: "/data/s3",
+			Phase:     v1alpha.DataSourcePending,
+			PVCName:   "amalthea-test-ds-0",
+			LastError: `the PVC "amalthea-test-ds-0" cannot be provisioned: invalid rclone configuration`,
+		},
+		{Type: v1alpha.PVCStorage, MountPath: "/data/shared", Phase: v1alpha.DataSourceFailed, PVCName: "shared", LastError: `the PVC "shared" lost its volume`},
+		{Type: v1alpha.PVCStorage, MountPath: "/data/missing", Phase: v1alpha.DataSourcePending, PVCName: "missing", LastError: `the PVC "missing" does not exist`},
+		{Type: v1alpha.EmptyDirStorage, MountPath: "/scratch", Phase: v1alpha.DataSourcePending},
+		{Type: v1alpha.PVCStorage, MountPath: "/data/bound", Phase: v1alpha.DataSourceBound, PVCName: "bound"},
+		{
+			Type:      v1alpha.NFSStorage,
+			MountPath: "/data/nfs",
+			Phase:     v1alpha.DataSourcePending,
+			LastError: `MountVolume.SetUp failed for volume "amalthea-test-ds-5" : mount.nfs: access denied`,
+		},
+	}
+	// withoutFailingSince checks when the data sources started failing and clears it for the comparisons
+	withoutFailingSince := func(statuses []v1alpha.DataSourceStatus, since metav1.Time) []v1alpha.DataSourceStatus {
+		cleared := []v1alpha.DataSourceStatus{}
+		for _, status := range statuses {
+			if status.LastError != "" && status.Phase != v1alpha.DataSourceMounted {
+				assert.WithinDuration(t, since.Time, status.FailingSince.Time, 5*time.Second, status.MountPath)
+			} else {
+				assert.True(t, status.FailingSince.IsZero(), status.MountPath)
+			}
+			status.FailingSince = metav1.Time{}
+			cleared = append(cleared, status)
+		}
+		return cleared
+	}
+
+	// The warnings and the mount events do not fail the data sources right away, the lost claim does
+	statuses := dataSourceStatuses(context.TODO(), clnt, session, pod, pvcs)
+	assert.Equal(t, expected, withoutFailingSince(statuses, metav1.Now()))
+
+	// The data sources are failed once the failures persisted for the grace period
+	failingSince := metav1.NewTime(time.Now().Add(-maxWaitForClearDataSourceFailure).Truncate(time.Second))
+	for ids := range statuses {
+		if !statuses[ids].FailingSince.IsZero() {
+			statuses[ids].FailingSince = failingSince
+		}
+	}
+	session.Status.DataSources = statuses
+	statuses = dataSourceStatuses(context.TODO(), clnt, session, pod, pvcs)
+	for _, ids := range []int{0, 2, 5} {
+		expected[ids].Phase = v1alpha.DataSourceFailed
+	}
+	assert.Equal(t, expected, withoutFailingSince(statuses, failingSince))
+
+	// The volumes are mounted once a container has started, the last errors are kept
+	session.Status.DataSources = statuses
+	pod.Status.InitContainerStatuses[0].State = v1.ContainerState{Running: &v1.ContainerStateRunning{}}
+	statuses = dataSourceStatuses(context.TODO(), clnt, session, pod, pvcs)
+	for ids, status := range statuses {
+		assert.Equal(t, v1alpha.DataSourceMounted, status.Phase)
+		assert.Equal(t, session.Status.DataSources[ids].LastError, status.LastError)
+		assert.True(t, status.FailingSince.IsZero())
+	}
+}
+
+func TestOptionalDataSources(t *testing.T) {
+	session := &v1alpha.AmaltheaSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: v1alpha.AmaltheaSessionSpec{
+			DataSources: []v1alpha.DataSource{
+				{Type: v1alpha.Rclone, MountPath: "/data/s3", SecretRef: &v1alpha.SessionSecretRef{Name: "rclone"}, Optional: true},
+				{Type: v1alpha.EmptyDirStorage, MountPath: "/scratch"},
+			},
+		},
+		Status: v1alpha.AmaltheaSessionStatus{
+			DataSources: []v1alpha.DataSourceStatus{
+				{Type: v1alpha.Rclone, MountPath: "/data/s3", Phase: v1alpha.DataSourceFailed, PVCName: "amalthea-test-ds-0", LastError: "invalid rclone configuration"},
+				{Type: v1alpha.EmptyDirStorage, MountPath: "/scratch", Phase: v1alpha.DataSourcePending},
+			},
+		},
+	}
+	failedPVC := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "amalthea-test-ds-0", Namespace: "default"},
+		Status: v1.PersistentVolumeClaimStatus{
+			Phase:                     v1.ClaimPending,
+			AllocatedResourceStatuses: map[v1.ResourceName]v1.ClaimResourceStatus{v1.ResourceStorage: v1.PersistentVolumeClaimControllerResizeInfeasible},
+		},
+	}
+	updates := ChildResourceUpdates{
+		DataSourcesPVCs: []ChildResourceUpdate[v1.PersistentVolumeClaim]{{Manifest: failedPVC}},
+	}
+	// The claim of an optional data source does not fail the session
+	assert.Empty(t, updates.failureMessage(session, nil, nil))
+	session.Spec.DataSources[0].Optional = false
+	assert.NotEmpty(t, updates.failureMessage(session, nil, nil))
+	session.Spec.DataSources[0].Optional = true
+
+	// A failed optional data source keeps its status once the session runs without it
+	pod := &v1.Pod{Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{
+		{Name: v1alpha.SessionContainerName, State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}},
+	}}}
+	statuses := dataSourceStatuses(context.TODO(), eventsIndexedClient(), session, pod, updates.DataSourcesPVCs)
+	assert.Equal(t, session.Status.DataSources[0], statuses[0])
+	assert.Equal(t, v1alpha.DataSourceMounted, statuses[1].Phase)
+	assert.Equal(t, "the data source mounted at /data/s3 failed: invalid rclone configuration", dataSourceFailures(session, statuses, true))
+	assert.Empty(t, dataSourceFailures(session, statuses, false))
+
+	// The optional data source is mounted again when the session is resumed
+	session.Spec.Hibernated = true
+	assert.False(t, session.DataSourceSkipped(0))
+}
+
+func TestSyncOptionalDataSources(t *testing.T) {
+	session := &v1alpha.AmaltheaSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: v1alpha.AmaltheaSessionSpec{
+			DataSources: []v1alpha.DataSource{
+				{Type: v1alpha.EmptyDirStorage, MountPath: "/data/optional", Optional: true},
+				{Type: v1alpha.EmptyDirStorage, MountPath: "/data/required"},
+			},
+		},
+	}
+	optional := v1.Volume{Name: "amalthea-test-ds-0"}
+	optionalMount := v1.VolumeMount{Name: "amalthea-test-ds-0", MountPath: "/data/optional"}
+	required := v1.Volume{Name: "amalthea-test-ds-1"}
+	requiredMount := v1.VolumeMount{Name: "amalthea-test-ds-1", MountPath: "/data/required"}
+	podSpec := func(volumes []v1.Volume, mounts []v1.VolumeMount) *v1.PodSpec {
+		return &v1.PodSpec{
+			Volumes:    volumes,
+			Containers: []v1.Container{{Name: v1alpha.SessionContainerName, VolumeMounts: mounts}},
+		}
+	}
+	withOptional := podSpec([]v1.Volume{optional, required}, []v1.VolumeMount{optionalMount, requiredMount})
+	withoutOptional := podSpec([]v1.Volume{required}, []v1.VolumeMount{requiredMount})
+
+	// The optional data source which failed to mount is removed
+	current := podSpec([]v1.Volume{optional, required}, []v1.VolumeMount{optionalMount, requiredMount})
+	syncOptionalDataSources(session, current, withoutOptional)
+	assert.Equal(t, withoutOptional, current)
+
+	// It is added back when the session is resumed
+	syncOptionalDataSources(session, current, withOptional)
+	assert.ElementsMatch(t, withOptional.Volumes, current.Volumes)
+	assert.ElementsMatch(t, withOptional.Containers[0].VolumeMounts, current.Containers[0].VolumeMounts)
+
+	// The other data sources and the order of the volumes are left as they are
+	current = podSpec([]v1.Volume{optional}, []v1.VolumeMount{optionalMount})
+	syncOptionalDataSources(session, current, withOptional)
+	assert.Equal(t, podSpec([]v1.Volume{optional}, []v1.VolumeMount{optionalMount}), current)
+}
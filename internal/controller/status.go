@@ -2,15 +2,20 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	amaltheadevv1alpha1 "github.com/SwissDataScienceCenter/amalthea/api/v1alpha1"
 	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	resource "k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	metricsv1beta1 "k8s.io/metrics/pkg/client/clientset/versioned/typed/metrics/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
@@ -67,6 +72,265 @@ func isContainerSidecar(status v1.ContainerStatus, pod v1.Pod) bool {
 	return false
 }
 
+// podVolumesMounted tells whether the volumes of the pod are mounted, the kubelet mounts all
+// the volumes before it starts the first container.
+func podVolumesMounted(pod *v1.Pod) bool {
+	if pod == nil {
+		return false
+	}
+	for _, statuses := range [][]v1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, status := range statuses {
+			if status.State.Running != nil || status.State.Terminated != nil || status.LastTerminationState.Terminated != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimFailureReason returns why the claim of a data source cannot be mounted, it is empty when the claim can be mounted
+func claimFailureReason(pvc *v1.PersistentVolumeClaim) string {
+	if pvc.Status.Phase == v1.ClaimLost {
+		return fmt.Sprintf("the PVC %q lost its volume", pvc.GetName())
+	}
+	return pvcFailureReason(pvc)
+}
+
+// claimEventsFailure returns the message of the last warning event of a claim which is not bound,
+// e.g. when the csi-rclone driver cannot provision the volume of an rclone data source.
+func claimEventsFailure(ctx context.Context, clnt client.Reader, pvc *v1.PersistentVolumeClaim) string {
+	if pvc.Status.Phase == v1.ClaimBound {
+		return ""
+	}
+	events := v1.EventList{}
+	err := clnt.List(ctx,
+		&events,
+		client.MatchingFields{
+			"involvedObject.namespace": pvc.Namespace,
+			"involvedObject.kind":      "PersistentVolumeClaim",
+			"involvedObject.name":      pvc.Name,
+		},
+	)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "couldn't list the events of the PVC", "pvc", pvc.Name)
+		return ""
+	}
+	var last *v1.Event
+	for i, event := range events.Items {
+		if event.Type != v1.EventTypeWarning || getEventTime(&event).Time.Before(pvc.CreationTimestamp.Time) {
+			continue
+		}
+		if last == nil || getEventTime(last).Time.Before(getEventTime(&event).Time) {
+			last = &events.Items[i]
+		}
+	}
+	if last == nil {
+		return ""
+	}
+	return fmt.Sprintf("the PVC %q cannot be provisioned: %s", pvc.Name, last.Message)
+}
+
+// mountEventsFailure returns the message of the last FailedMount event of the pod for one of the volumes,
+// the kubelet names the volumes backed by a claim after their persistent volume. The events are sorted
+// by time, the events of the previous pods of the session are ignored.
+func mountEventsFailure(pod *v1.Pod, events *v1.EventList, volumes ...string) string {
+	if pod == nil || events == nil {
+		return ""
+	}
+	msg := ""
+	for _, event := range events.Items {
+		if event.Reason != "FailedMount" || getEventTime(&event).Time.Before(pod.CreationTimestamp.Time) {
+			continue
+		}
+		for _, volume := range volumes {
+			if volume != "" && strings.Contains(event.Message, fmt.Sprintf("volume %q", volume)) {
+				msg = event.Message
+			}
+		}
+	}
+	return msg
+}
+
+// dataSourceStatuses returns the state of the data sources of the session. The data sources are mounted
+// once a container of the pod has started, until then the claims of the data sources and the mount events
+// of the pod are checked. The warnings and mount events only fail a data source once they persisted for
+// maxWaitForClearDataSourceFailure. The optional data sources which are left out of the session keep their status.
+func dataSourceStatuses(
+	ctx context.Context,
+	clnt client.Reader,
+	cr *amaltheadevv1alpha1.AmaltheaSession,
+	pod *v1.Pod,
+	pvcs []ChildResourceUpdate[v1.PersistentVolumeClaim],
+) []amaltheadevv1alpha1.DataSourceStatus {
+	if len(cr.Spec.DataSources) == 0 || cr.Spec.SessionLocation == amaltheadevv1alpha1.Remote {
+		return nil
+	}
+	mounted := podVolumesMounted(pod)
+	var podEvents *v1.EventList
+	if pod != nil && !mounted {
+		var err error
+		podEvents, err = cr.GetPodEvents(ctx, clnt)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "couldn't list the events of the session pod")
+		}
+	}
+	statuses := make([]amaltheadevv1alpha1.DataSourceStatus, 0, len(cr.Spec.DataSources))
+	for ids, ds := range cr.Spec.DataSources {
+		if cr.DataSourceSkipped(ids) {
+			statuses = append(statuses, cr.Status.DataSources[ids])
+			continue
+		}
+		status := amaltheadevv1alpha1.DataSourceStatus{
+			Type:      ds.Type,
+			MountPath: ds.MountPath,
+			Phase:     amaltheadevv1alpha1.DataSourcePending,
+			PVCName:   cr.DataSourceClaimName(ids),
+		}
+		var previous *amaltheadevv1alpha1.DataSourceStatus
+		if ids < len(cr.Status.DataSources) && cr.Status.DataSources[ids].Type == ds.Type && cr.Status.DataSources[ids].MountPath == ds.MountPath {
+			previous = &cr.Status.DataSources[ids]
+		}
+		var claim *v1.PersistentVolumeClaim
+		// Whether the failure can clear up by itself, e.g. a warning event or a claim which does not exist yet
+		transient := true
+		switch {
+		case mounted:
+			status.Phase = amaltheadevv1alpha1.DataSourceMounted
+		case ds.Type == amaltheadevv1alpha1.Rclone:
+			for _, pvc := range pvcs {
+				if pvc.Manifest != nil && pvc.Manifest.Name == status.PVCName {
+					claim = pvc.Manifest
+				}
+			}
+		case ds.Type == amaltheadevv1alpha1.PVCStorage && status.PVCName != "":
+			claim = &v1.PersistentVolumeClaim{}
+			err := clnt.Get(ctx, types.NamespacedName{Name: status.PVCName, Namespace: cr.Namespace}, claim)
+			if apierrors.IsNotFound(err) {
+				status.LastError = fmt.Sprintf("the PVC %q does not exist", status.PVCName)
+			}
+			if err != nil {
+				claim = nil
+			}
+		}
+		if !mounted {
+			if status.LastError == "" && claim != nil {
+				status.LastError = claimFailureReason(claim)
+				transient = status.LastError == ""
+				if transient {
+					status.LastError = claimEventsFailure(ctx, clnt, claim)
+				}
+			}
+			if status.LastError == "" {
+				volumes := []string{cr.DataSourceVolumeName(ids)}
+				if claim != nil {
+					volumes = append(volumes, claim.Spec.VolumeName)
+				}
+				status.LastError = mountEventsFailure(pod, podEvents, volumes...)
+			}
+		}
+		if status.LastError != "" {
+			status.FailingSince = metav1.Now()
+			if previous != nil && !previous.FailingSince.IsZero() {
+				status.FailingSince = previous.FailingSince
+			}
+		}
+		switch {
+		case status.LastError != "" && (!transient || time.Since(status.FailingSince.Time) >= maxWaitForClearDataSourceFailure):
+			status.Phase = amaltheadevv1alpha1.DataSourceFailed
+		case claim != nil && claim.Status.Phase == v1.ClaimBound:
+			status.Phase = amaltheadevv1alpha1.DataSourceBound
+		}
+		// The last error is kept once the data source is mounted, until the session is hibernated
+		if status.LastError == "" && !cr.Spec.Hibernated && previous != nil {
+			status.LastError = previous.LastError
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// dataSourceFailures describes the required or optional data sources which cannot be mounted
+func dataSourceFailures(
+	cr *amaltheadevv1alpha1.AmaltheaSession,
+	statuses []amaltheadevv1alpha1.DataSourceStatus,
+	optional bool,
+) string {
+	failures := []string{}
+	for ids, status := range statuses {
+		if ids >= len(cr.Spec.DataSources) || cr.Spec.DataSources[ids].Optional != optional {
+			continue
+		}
+		if status.Phase != amaltheadevv1alpha1.DataSourceFailed {
+			continue
+		}
+		failures = append(failures, fmt.Sprintf("the data source mounted at %s failed: %s", status.MountPath, status.LastError))
+	}
+	return strings.Join(failures, ", ")
+}
+
+// cloneResults is the termination message of the init containers that clone the code repositories
+type cloneResults struct {
+	CodeRepositories []amaltheadevv1alpha1.CodeRepositoryStatus `json:"codeRepositories"`
+}
+
+// cloneTermination returns the last termination of an init container, a container which is
+// restarted after a failure keeps the termination of the failed run until it terminates again.
+func cloneTermination(status v1.ContainerStatus) *v1.ContainerStateTerminated {
+	if status.State.Terminated != nil {
+		return status.State.Terminated
+	}
+	return status.LastTerminationState.Terminated
+}
+
+// containerCloneResults parses the clone results in the termination message of an init container,
+// it returns false when the container has not terminated or its termination message has no clone results.
+func containerCloneResults(status v1.ContainerStatus) ([]amaltheadevv1alpha1.CodeRepositoryStatus, bool) {
+	terminated := cloneTermination(status)
+	if terminated == nil || terminated.Message == "" {
+		return nil, false
+	}
+	results := cloneResults{}
+	if err := json.Unmarshal([]byte(terminated.Message), &results); err != nil || results.CodeRepositories == nil {
+		return nil, false
+	}
+	return results.CodeRepositories, true
+}
+
+// codeRepositoryStatuses reads the result of cloning the code repositories from the termination messages
+// of the init containers. Besides the init container of the session, the cloners can run in extra init
+// containers, their termination messages are used when they contain clone results. It returns nil when
+// none of the cloners has terminated.
+func codeRepositoryStatuses(pod *v1.Pod) ([]amaltheadevv1alpha1.CodeRepositoryStatus, error) {
+	if pod == nil {
+		return nil, nil
+	}
+	var statuses []amaltheadevv1alpha1.CodeRepositoryStatus
+	for _, container := range pod.Status.InitContainerStatuses {
+		results, ok := containerCloneResults(container)
+		if !ok {
+			terminated := cloneTermination(container)
+			if container.Name == amaltheadevv1alpha1.GitCloneContainerName && terminated != nil && terminated.Message != "" {
+				return nil, fmt.Errorf("the termination message of %s does not contain the clone results", container.Name)
+			}
+			continue
+		}
+		statuses = append(statuses, results...)
+	}
+	return statuses, nil
+}
+
+// cloneFailureReason describes the code repositories which could not be cloned
+func cloneFailureReason(statuses []amaltheadevv1alpha1.CodeRepositoryStatus) string {
+	failures := []string{}
+	for _, status := range statuses {
+		if status.State != amaltheadevv1alpha1.CodeRepositoryFailed {
+			continue
+		}
+		failures = append(failures, fmt.Sprintf("the repository %s failed to clone: %s", status.Remote, status.Error))
+	}
+	return strings.Join(failures, ", ")
+}
+
 func podIsReady(pod *v1.Pod) bool {
 	if pod == nil || pod.GetDeletionTimestamp() != nil {
 		return false
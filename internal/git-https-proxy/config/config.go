@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"path"
 	"reflect"
 	"time"
 
@@ -11,14 +12,80 @@ import (
 	"github.com/spf13/viper"
 )
 
+// NOTE: The push policies are enforced by the proxy, the token of a provider with a repository that has
+// a policy is therefore not handed out through the credential helper or the token endpoints.
 type GitRepository struct {
 	Url      string `json:"url"`
 	Provider string `json:"provider"`
+	// Only let the fetches through to the repository, including the LFS downloads, all the other requests
+	// to the repository are rejected
+	ReadOnly bool `json:"read_only,omitempty"`
+	// Branches that cannot be updated or deleted with a push, e.g. "main" or "release/*".
+	// Patterns starting with "refs/" are matched against the full ref, e.g. "refs/tags/*".
+	ProtectedBranches []string `json:"protected_branches,omitempty"`
+	// The maximum size of a push in bytes, 0 means no limit
+	MaxPushSize int64 `json:"max_push_size,omitempty"`
 }
 
+// The backends that get the git tokens of a provider
+const (
+	// Exchange the renku access token at the access token URL of the provider
+	RenkuTokenBackend = "renku"
+	// Read a token from a file, e.g. a mounted secret, it is reloaded when the file changes
+	StaticTokenBackend = "static"
+	// Exchange a token read from a file with an OAuth2 token exchange (RFC 8693)
+	TokenExchangeBackend = "token_exchange"
+	// Mint GitHub App installation tokens with the private key of the app
+	GitHubAppBackend = "github_app"
+)
+
 type GitProvider struct {
 	Id             string `json:"id"`
 	AccessTokenUrl string `json:"access_token_url"`
+	// The backend that gets the tokens, renku when it is not set
+	Type string `json:"type,omitempty"`
+	// The file with the token of the static backend
+	TokenFile     string               `json:"token_file,omitempty"`
+	TokenExchange *TokenExchangeConfig `json:"token_exchange,omitempty"`
+	GitHubApp     *GitHubAppConfig     `json:"github_app,omitempty"`
+}
+
+// TokenExchangeConfig configures an OAuth2 token exchange, see https://www.rfc-editor.org/rfc/rfc8693
+type TokenExchangeConfig struct {
+	TokenURL string `json:"token_url"`
+	// The file with the token that is exchanged, e.g. a projected service account token.
+	// It is read before every exchange.
+	SubjectTokenFile string `json:"subject_token_file"`
+	// The type of the subject token, urn:ietf:params:oauth:token-type:jwt when it is not set
+	SubjectTokenType   string `json:"subject_token_type,omitempty"`
+	RequestedTokenType string `json:"requested_token_type,omitempty"`
+	Audience           string `json:"audience,omitempty"`
+	Resource           string `json:"resource,omitempty"`
+	Scope              string `json:"scope,omitempty"`
+	// The client credentials, the client is not authenticated when the ID is not set
+	ClientID         string `json:"client_id,omitempty"`
+	ClientSecretFile string `json:"client_secret_file,omitempty"`
+	// The username used with the exchanged token, oauth2 when it is not set
+	Username string `json:"username,omitempty"`
+}
+
+// GitHubAppConfig configures the installation tokens of a GitHub App,
+// see https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/generating-an-installation-access-token-for-a-github-app
+type GitHubAppConfig struct {
+	AppID          string `json:"app_id"`
+	InstallationID int64  `json:"installation_id"`
+	// The file with the PEM encoded private key of the app
+	PrivateKeyFile string `json:"private_key_file"`
+	// The URL of the GitHub API, https://api.github.com when it is not set
+	APIURL string `json:"api_url,omitempty"`
+}
+
+// TokenBackend returns the type of the backend of the provider
+func (p GitProvider) TokenBackend() string {
+	if p.Type == "" {
+		return RenkuTokenBackend
+	}
+	return p.Type
 }
 
 type GitProxyConfig struct {
@@ -26,6 +93,8 @@ type GitProxyConfig struct {
 	ProxyPort int `mapstructure:"port"`
 	// The port (separate from the proxy) where the proxy will respond to status probes
 	HealthPort int `mapstructure:"health_port"`
+	// The port of the credential helper and token endpoints, they only listen on 127.0.0.1
+	CredentialsPort int `mapstructure:"credentials_port"`
 	// True if this is an anonymous session
 	AnonymousSession bool `mapstructure:"anonymous_session"`
 	// The Renku authentication version, set to "v2" when using internal tokens
@@ -53,6 +122,10 @@ type GitProxyConfig struct {
 	Providers []GitProvider `mapstructure:"providers"`
 	// The time interval used for refreshing renku tokens
 	RefreshCheckPeriodSeconds int64 `mapstructure:"refresh_check_period_seconds"`
+	// The PEM encoded certificate and private key of the CA used to sign the certificates of the intercepted
+	// git hosts, the built-in CA of goproxy is used when they are not set
+	CACert string `mapstructure:"ca_cert"`
+	CAKey  string `mapstructure:"ca_key"`
 }
 
 func GetConfig() (GitProxyConfig, error) {
@@ -63,6 +136,7 @@ func GetConfig() (GitProxyConfig, error) {
 
 	v.SetDefault("port", 8080)
 	v.SetDefault("health_port", 8081)
+	v.SetDefault("credentials_port", 8082)
 	v.SetDefault("anonymous_session", true)
 	v.SetDefault("renku_authentication_version", "")
 	v.SetDefault("renku_access_token", "")
@@ -75,6 +149,8 @@ func GetConfig() (GitProxyConfig, error) {
 	v.SetDefault("repositories", []GitRepository{})
 	v.SetDefault("providers", []GitProvider{})
 	v.SetDefault("refresh_check_period_seconds", 600)
+	v.SetDefault("ca_cert", "")
+	v.SetDefault("ca_key", "")
 
 	var config GitProxyConfig
 	dh := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
@@ -90,10 +166,23 @@ func GetConfig() (GitProxyConfig, error) {
 }
 
 func (c *GitProxyConfig) Validate() error {
+	if err := c.validateRepositoryPolicies(); err != nil {
+		return err
+	}
+	if (c.CACert == "") != (c.CAKey == "") {
+		return fmt.Errorf("both the certificate and the private key of the CA have to be defined")
+	}
 	// INFO: The proxy is a pass-through for anonymous sessions, so no config is required.
 	if c.AnonymousSession {
 		return nil
 	}
+	if err := c.validateProviders(); err != nil {
+		return err
+	}
+	// The renku tokens are only needed when they are exchanged for the git tokens
+	if !c.UsesRenkuTokens() {
+		return nil
+	}
 	// Validate "v2" authentication separately
 	if c.RenkuAuthenticationVersion == "v2" {
 		return c.validateRenkuAuthenticationV2()
@@ -122,6 +211,61 @@ func (c *GitProxyConfig) Validate() error {
 	return nil
 }
 
+func (c *GitProxyConfig) validateRepositoryPolicies() error {
+	for _, repo := range c.Repositories {
+		if repo.MaxPushSize < 0 {
+			return fmt.Errorf("the max push size of the repository %s is negative", repo.Url)
+		}
+		for _, pattern := range repo.ProtectedBranches {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("the protected branch pattern %q of the repository %s is invalid: %w", pattern, repo.Url, err)
+			}
+		}
+	}
+	return nil
+}
+
+// UsesRenkuTokens returns true when the git tokens of a provider are exchanged for the renku tokens of the user
+func (c *GitProxyConfig) UsesRenkuTokens() bool {
+	if len(c.Providers) == 0 {
+		return true
+	}
+	for _, provider := range c.Providers {
+		if provider.TokenBackend() == RenkuTokenBackend {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *GitProxyConfig) validateProviders() error {
+	for _, provider := range c.Providers {
+		switch provider.TokenBackend() {
+		case RenkuTokenBackend:
+			if provider.AccessTokenUrl == "" {
+				return fmt.Errorf("the access token url of the provider %s is not defined", provider.Id)
+			}
+		case StaticTokenBackend:
+			if provider.TokenFile == "" {
+				return fmt.Errorf("the token file of the provider %s is not defined", provider.Id)
+			}
+		case TokenExchangeBackend:
+			exchange := provider.TokenExchange
+			if exchange == nil || exchange.TokenURL == "" || exchange.SubjectTokenFile == "" {
+				return fmt.Errorf("the token url and the subject token file of the provider %s are not defined", provider.Id)
+			}
+		case GitHubAppBackend:
+			app := provider.GitHubApp
+			if app == nil || app.AppID == "" || app.InstallationID == 0 || app.PrivateKeyFile == "" {
+				return fmt.Errorf("the app id, installation id and private key file of the provider %s are not defined", provider.Id)
+			}
+		default:
+			return fmt.Errorf("the token backend %s of the provider %s is not supported", provider.Type, provider.Id)
+		}
+	}
+	return nil
+}
+
 func (c *GitProxyConfig) GetRefreshCheckPeriod() time.Duration {
 	return time.Duration(c.RefreshCheckPeriodSeconds) * time.Second
 }
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+
+	configLib "github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+	"github.com/elazarl/goproxy"
+)
+
+// mitmAction returns the action that intercepts the HTTPS connections to the git hosts, the certificates
+// presented to the git client are signed with the CA of the session when it is configured.
+func mitmAction(config configLib.GitProxyConfig) (*goproxy.ConnectAction, error) {
+	if config.CACert == "" {
+		log.Println("Warning: No CA is configured, the certificates of the git hosts are signed with the built-in CA of goproxy which git cannot verify.")
+		return goproxy.MitmConnect, nil
+	}
+	ca, err := tls.X509KeyPair([]byte(config.CACert), []byte(config.CAKey))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load the CA of the git proxy: %w", err)
+	}
+	ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the certificate of the CA of the git proxy: %w", err)
+	}
+	if !ca.Leaf.IsCA {
+		return nil, fmt.Errorf("the certificate of the git proxy is not a CA")
+	}
+	return &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(&ca)}, nil
+}
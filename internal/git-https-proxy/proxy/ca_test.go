@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	configLib "github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func generateCA(t *testing.T, isCA bool) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}))
+}
+
+func TestMitmActionWithSessionCA(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello from git"))
+	}))
+	defer upstream.Close()
+
+	caCert, caKey := generateCA(t, true)
+	mitm, err := mitmAction(configLib.GitProxyConfig{CACert: caCert, CAKey: caKey})
+	require.NoError(t, err)
+	proxyHandler := goproxy.NewProxyHttpServer()
+	proxyHandler.Tr = &http.Transport{TLSClientConfig: upstream.Client().Transport.(*http.Transport).TLSClientConfig}
+	proxyHandler.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return mitm, host
+	})
+	proxyServer := httptest.NewServer(proxyHandler)
+	defer proxyServer.Close()
+	proxyURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+
+	// The client trusts only the CA of the session and verifies the certificate presented by the proxy
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM([]byte(caCert)))
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	res, err := client.Get(upstream.URL)
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello from git", string(body))
+	require.NotNil(t, res.TLS)
+	assert.Equal(t, "test CA", res.TLS.PeerCertificates[0].Issuer.CommonName)
+}
+
+func TestMitmActionErrors(t *testing.T) {
+	mitm, err := mitmAction(configLib.GitProxyConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, goproxy.MitmConnect, mitm)
+
+	caCert, caKey := generateCA(t, true)
+	otherCert, otherKey := generateCA(t, false)
+	_, err = mitmAction(configLib.GitProxyConfig{CACert: caCert, CAKey: otherKey})
+	assert.Error(t, err)
+	_, err = mitmAction(configLib.GitProxyConfig{CACert: otherCert, CAKey: otherKey})
+	assert.ErrorContains(t, err, "not a CA")
+	_, err = mitmAction(configLib.GitProxyConfig{CACert: caCert, CAKey: caKey})
+	assert.NoError(t, err)
+}
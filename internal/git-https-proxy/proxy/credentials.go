@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	configLib "github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+)
+
+// gitTokenSource returns the username and the current git token of a provider
+type gitTokenSource interface {
+	GetGitCredentials(provider string) (string, string, error)
+}
+
+// The maximum size of the body of a credential helper request
+const maxCredentialRequestSize = 64 * 1024
+
+// restrictedProviderError is returned instead of the token of a provider with push policies, the policies are
+// only enforced by the proxy so a client holding the token could push to the provider directly.
+func restrictedProviderError(w http.ResponseWriter, provider string) {
+	http.Error(w, fmt.Sprintf("the token of the provider %s is not available because its repositories have push policies", provider), http.StatusForbidden)
+}
+
+// credentialProvider returns the provider for a credential request. git sends only the host by default
+// (credential.useHttpPath is false), in which case the host must have a single provider.
+func (t routingTable) credentialProvider(requestURL *url.URL) (string, bool) {
+	if route, found := t.match(requestURL); found {
+		return route.provider, true
+	}
+	if strings.Trim(requestURL.Path, "/") != "" {
+		return "", false
+	}
+	provider := ""
+	for _, route := range t.hosts[stripWww(requestURL.Hostname())] {
+		if route.scheme != requestURL.Scheme || route.port != getPort(requestURL) {
+			continue
+		}
+		if provider != "" && provider != route.provider {
+			return "", false
+		}
+		provider = route.provider
+	}
+	return provider, provider != ""
+}
+
+// sessionOnly rejects the requests that do not come from a container of the session. Browsers are also
+// rejected, so that a web application running in the session cannot be used to read the tokens.
+// NOTE: The handlers are served on 127.0.0.1 only and the proxy does not connect to loopback addresses,
+// so that the requests sent through the proxy do not look like they come from the session.
+func sessionOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "the credentials are only available from within the session", http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != "" {
+			http.Error(w, "the credentials are not available to browsers", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// CredentialHandler implements the git credential helper protocol (https://git-scm.com/docs/git-credential)
+// over HTTP: the body of a POST request is the input of the "get" action and the response is its output.
+// It can be used by any tool through a helper such as:
+//
+//	git config --global credential.helper '!f() { test "$1" = get && curl -sf --data-binary @- http://127.0.0.1:8082/credential; }; f'
+//
+// An empty response is returned for the hosts that the proxy does not handle so that git tries the next helper.
+// The token of a provider with a read-only repository or protected branches is never returned.
+func CredentialHandler(config configLib.GitProxyConfig, tokens gitTokenSource) http.Handler {
+	routes := newRoutingTable(config.Repositories, config.Providers)
+	restricted := routes.restrictedProviders()
+	return sessionOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		attributes, err := readCredentialAttributes(http.MaxBytesReader(w, r.Body, maxCredentialRequestSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requestURL, err := credentialURL(attributes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		provider, found := routes.credentialProvider(requestURL)
+		if !found {
+			return
+		}
+		if _, isRestricted := restricted[provider]; isRestricted {
+			restrictedProviderError(w, provider)
+			return
+		}
+		username, token, err := tokens.GetGitCredentials(provider)
+		if err != nil {
+			log.Printf("The git token for %s cannot be refreshed, error: %s\n", provider, err.Error())
+			http.Error(w, "the git token could not be refreshed", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = fmt.Fprintf(w, "username=%s\npassword=%s\n", username, token)
+	}))
+}
+
+// TokenHandler returns the current token of the provider given in the provider query parameter as plain text,
+// the parameter can be omitted when there is a single provider. Like for the credential helper, the token of
+// a provider with push policies is never returned.
+func TokenHandler(config configLib.GitProxyConfig, tokens gitTokenSource) http.Handler {
+	providers := make(map[string]struct{}, len(config.Providers))
+	for _, p := range config.Providers {
+		providers[p.Id] = struct{}{}
+	}
+	restricted := newRoutingTable(config.Repositories, config.Providers).restrictedProviders()
+	return sessionOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		provider := r.URL.Query().Get("provider")
+		if provider == "" && len(config.Providers) == 1 {
+			provider = config.Providers[0].Id
+		}
+		if provider == "" {
+			http.Error(w, "the provider query parameter is required", http.StatusBadRequest)
+			return
+		}
+		if _, exists := providers[provider]; !exists {
+			http.Error(w, fmt.Sprintf("the provider %s is not configured", provider), http.StatusNotFound)
+			return
+		}
+		if _, isRestricted := restricted[provider]; isRestricted {
+			restrictedProviderError(w, provider)
+			return
+		}
+		_, token, err := tokens.GetGitCredentials(provider)
+		if err != nil {
+			log.Printf("The git token for %s cannot be refreshed, error: %s\n", provider, err.Error())
+			http.Error(w, "the git token could not be refreshed", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = fmt.Fprintln(w, token)
+	}))
+}
+
+// readCredentialAttributes parses the key=value lines of the credential helper protocol
+func readCredentialAttributes(body io.Reader) (map[string]string, error) {
+	attributes := map[string]string{}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid credential attribute %q", line)
+		}
+		attributes[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return attributes, nil
+}
+
+// credentialURL returns the URL described by the attributes of a credential request
+func credentialURL(attributes map[string]string) (*url.URL, error) {
+	if attributes["protocol"] != "" && attributes["host"] != "" {
+		return &url.URL{Scheme: attributes["protocol"], Host: attributes["host"], Path: "/" + attributes["path"]}, nil
+	}
+	requestURL, err := url.Parse(attributes["url"])
+	if err != nil || requestURL.Scheme == "" || requestURL.Host == "" {
+		return nil, fmt.Errorf("the protocol and the host or a valid url are required")
+	}
+	return requestURL, nil
+}
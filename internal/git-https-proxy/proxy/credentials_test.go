@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	configLib "github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeTokens map[string]string
+
+func (f fakeTokens) GetGitCredentials(provider string) (string, string, error) {
+	token, found := f[provider]
+	if !found {
+		return "", "", fmt.Errorf("no token for %s", provider)
+	}
+	return "oauth2", token, nil
+}
+
+func credentialsTestConfig() configLib.GitProxyConfig {
+	return configLib.GitProxyConfig{
+		Repositories: []configLib.GitRepository{
+			{Url: "https://gitlab.com/group/project.git", Provider: "gitlab"},
+			{Url: "https://gitlab.com/other/project.git", Provider: "gitlab-other"},
+			{Url: "https://github.com/org/repo.git", Provider: "github"},
+			{Url: "https://example.org/broken.git", Provider: "broken"},
+		},
+		Providers: []configLib.GitProvider{{Id: "gitlab"}, {Id: "gitlab-other"}, {Id: "github"}, {Id: "broken"}},
+	}
+}
+
+var testTokens = fakeTokens{"gitlab": "gitlab-token", "gitlab-other": "other-token", "github": "github-token"}
+
+func TestCredentialHandler(t *testing.T) {
+	handler := CredentialHandler(credentialsTestConfig(), testTokens)
+	cases := []struct {
+		name   string
+		input  string
+		status int
+		output string
+	}{
+		{name: "host with a single provider", input: "protocol=https\nhost=github.com\n\n", status: 200, output: "username=oauth2\npassword=github-token\n"},
+		{name: "www prefix", input: "protocol=https\nhost=www.github.com\n", status: 200, output: "username=oauth2\npassword=github-token\n"},
+		{name: "path selects the provider", input: "protocol=https\nhost=gitlab.com\npath=other/project.git\n", status: 200, output: "username=oauth2\npassword=other-token\n"},
+		{name: "url attribute", input: "url=https://gitlab.com/group/project.git/info/refs\n", status: 200, output: "username=oauth2\npassword=gitlab-token\n"},
+		{name: "host with several providers", input: "protocol=https\nhost=gitlab.com\n", status: 200, output: ""},
+		{name: "unknown host", input: "protocol=https\nhost=bitbucket.org\n", status: 200, output: ""},
+		{name: "other protocol", input: "protocol=http\nhost=github.com\n", status: 200, output: ""},
+		{name: "token refresh fails", input: "protocol=https\nhost=example.org\n", status: 502},
+		{name: "missing host", input: "protocol=https\n", status: 400},
+		{name: "invalid line", input: "protocol\n", status: 400},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/credential", strings.NewReader(tc.input))
+			req.RemoteAddr = "127.0.0.1:40000"
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tc.status, rec.Code)
+			if tc.status == http.StatusOK {
+				assert.Equal(t, tc.output, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestTokenHandler(t *testing.T) {
+	handler := TokenHandler(credentialsTestConfig(), testTokens)
+	get := func(target string, remoteAddr string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = remoteAddr
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/token?provider=github", "127.0.0.1:40000", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "github-token\n", rec.Body.String())
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	assert.Equal(t, http.StatusOK, get("/token?provider=gitlab", "[::1]:40000", nil).Code)
+
+	assert.Equal(t, http.StatusBadRequest, get("/token", "127.0.0.1:40000", nil).Code)
+	assert.Equal(t, http.StatusNotFound, get("/token?provider=bitbucket", "127.0.0.1:40000", nil).Code)
+	assert.Equal(t, http.StatusBadGateway, get("/token?provider=broken", "127.0.0.1:40000", nil).Code)
+	// Only the session can get the tokens
+	assert.Equal(t, http.StatusForbidden, get("/token?provider=github", "10.0.0.12:40000", nil).Code)
+	assert.Equal(t, http.StatusForbidden, get("/token?provider=github", "127.0.0.1:40000", map[string]string{"Origin": "https://evil.example.org"}).Code)
+
+	// The provider is optional when there is only one
+	single := TokenHandler(configLib.GitProxyConfig{Providers: []configLib.GitProvider{{Id: "github"}}}, testTokens)
+	req := httptest.NewRequest(http.MethodGet, "/token", nil)
+	req.RemoteAddr = "127.0.0.1:40000"
+	rec = httptest.NewRecorder()
+	single.ServeHTTP(rec, req)
+	assert.Equal(t, "github-token\n", rec.Body.String())
+}
+
+func TestCredentialHandlerOverLoopback(t *testing.T) {
+	server := httptest.NewServer(CredentialHandler(credentialsTestConfig(), testTokens))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("protocol=https\nhost=github.com\n"))
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "username=oauth2\npassword=github-token\n", string(body))
+}
+
+func TestRestrictedProviderTokens(t *testing.T) {
+	config := configLib.GitProxyConfig{
+		Repositories: []configLib.GitRepository{
+			{Url: "https://gitlab.com/group/project.git", Provider: "gitlab", ReadOnly: true},
+			{Url: "https://gitlab.com/group/other.git", Provider: "gitlab"},
+			{Url: "https://github.com/org/repo.git", Provider: "github", ProtectedBranches: []string{"main"}},
+			{Url: "https://example.org/repo.git", Provider: "example"},
+		},
+		Providers: []configLib.GitProvider{{Id: "gitlab"}, {Id: "github"}, {Id: "example"}},
+	}
+	tokens := fakeTokens{"gitlab": "gitlab-token", "github": "github-token", "example": "example-token"}
+
+	credential := func(input string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/credential", strings.NewReader(input))
+		req.RemoteAddr = "127.0.0.1:40000"
+		rec := httptest.NewRecorder()
+		CredentialHandler(config, tokens).ServeHTTP(rec, req)
+		return rec
+	}
+	token := func(provider string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/token?provider="+provider, nil)
+		req.RemoteAddr = "127.0.0.1:40000"
+		rec := httptest.NewRecorder()
+		TokenHandler(config, tokens).ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The policy of one repository restricts the token of the provider for all its repositories
+	for _, input := range []string{
+		"protocol=https\nhost=gitlab.com\npath=group/project.git\n",
+		"protocol=https\nhost=gitlab.com\npath=group/other.git\n",
+		"protocol=https\nhost=github.com\n",
+	} {
+		rec := credential(input)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.NotContains(t, rec.Body.String(), "-token")
+	}
+	for _, provider := range []string{"gitlab", "github"} {
+		rec := token(provider)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.NotContains(t, rec.Body.String(), "-token")
+	}
+
+	rec := credential("protocol=https\nhost=example.org\n")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "username=oauth2\npassword=example-token\n", rec.Body.String())
+	assert.Equal(t, "example-token\n", token("example").Body.String())
+}
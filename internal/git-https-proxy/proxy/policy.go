@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	receivePackService = "git-receive-pack"
+	uploadPackService  = "git-upload-pack"
+	lfsBatchPath       = "/info/lfs/objects/batch"
+	// The maximum size of the body of a LFS batch request that is checked for read-only repositories
+	maxLFSBatchSize         = 4 << 20
+	receivePackResultType   = "application/x-git-receive-pack-result"
+	receivePackAdvertisType = "application/x-git-receive-pack-advertisement"
+	// The maximum length of a pkt-line, see https://git-scm.com/docs/protocol-common#_pkt_line_format
+	maxPktLineLength = 65520
+)
+
+// pushPolicy restricts the pushes to a repository
+type pushPolicy struct {
+	readOnly bool
+	// Patterns for the branches that cannot be updated, patterns starting with refs/ match the full ref
+	protectedBranches []string
+	// The maximum size of the body of a push request in bytes, 0 means no limit
+	maxPushSize int64
+}
+
+func (p pushPolicy) enabled() bool {
+	return p.readOnly || len(p.protectedBranches) > 0 || p.maxPushSize > 0
+}
+
+// refUpdate is a command sent by the client at the start of a push, see
+// https://git-scm.com/docs/pack-protocol#_reference_update_request_and_packfile_transfer
+type refUpdate struct {
+	oldID string
+	newID string
+	ref   string
+}
+
+func (p pushPolicy) protects(ref string) bool {
+	for _, pattern := range p.protectedBranches {
+		name := ref
+		if !strings.HasPrefix(pattern, "refs/") {
+			if !strings.HasPrefix(ref, "refs/heads/") {
+				continue
+			}
+			name = strings.TrimPrefix(ref, "refs/heads/")
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+const readOnlyMessage = "this repository is read-only in this session, pushing is not allowed"
+
+// normalizePath cleans the path of the request so that the policy checks the path the remote serves,
+// e.g. group/repo.git/info/../git-receive-pack is a push.
+func normalizePath(requestURL *url.URL) {
+	cleaned := path.Clean("/" + requestURL.Path)
+	if cleaned != requestURL.Path {
+		requestURL.Path = cleaned
+		requestURL.RawPath = ""
+	}
+}
+
+// isPush returns true for the requests of the git client that are part of a push
+func isPush(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/"+receivePackService) ||
+		(strings.HasSuffix(r.URL.Path, "/info/refs") && r.URL.Query().Get("service") == receivePackService)
+}
+
+// isFetch returns true for the requests that only read the repository: the GET and HEAD requests
+// other than the advertisement of a push, the upload-pack requests and the LFS batch requests
+// that download objects. The body of the LFS batch requests is put back after it is read.
+func isFetch(r *http.Request) (bool, error) {
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return !isPush(r), nil
+	case r.Method != http.MethodPost:
+		return false, nil
+	case strings.HasSuffix(r.URL.Path, "/"+uploadPackService):
+		return true, nil
+	case !strings.HasSuffix(r.URL.Path, lfsBatchPath) || r.Body == nil:
+		return false, nil
+	}
+	content, err := io.ReadAll(io.LimitReader(r.Body, maxLFSBatchSize+1))
+	_ = r.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	if len(content) > maxLFSBatchSize {
+		return false, fmt.Errorf("the LFS batch request is larger than %d bytes", maxLFSBatchSize)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(content))
+	batch := struct {
+		Operation string `json:"operation"`
+	}{}
+	if err := json.Unmarshal(content, &batch); err != nil {
+		return false, fmt.Errorf("cannot parse the LFS batch request: %w", err)
+	}
+	return batch.Operation == "download", nil
+}
+
+// limitedBody fails the reads once the body is larger than the limit, the upload of the push to
+// the remote is then aborted before the remote can update the refs.
+type limitedBody struct {
+	io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, fmt.Errorf("the push is larger than the limit of %d bytes", b.limit)
+	}
+	return n, err
+}
+
+// check returns the response that rejects the request when the push is not allowed, or nil.
+// Only the fetches are let through for the read-only repositories.
+func (p pushPolicy) check(r *http.Request) (*http.Response, error) {
+	if !p.enabled() {
+		return nil, nil
+	}
+	normalizePath(r.URL)
+	if p.readOnly && !isPush(r) {
+		fetch, err := isFetch(r)
+		if err != nil {
+			return nil, err
+		}
+		if !fetch {
+			return goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, readOnlyMessage), nil
+		}
+		return nil, nil
+	}
+	if !isPush(r) {
+		return nil, nil
+	}
+	if strings.HasSuffix(r.URL.Path, "/info/refs") {
+		if p.readOnly {
+			return advertisementError(r, readOnlyMessage), nil
+		}
+		return nil, nil
+	}
+
+	var body io.ReadCloser = http.NoBody
+	if r.Body != nil {
+		body = r.Body
+	}
+	var reader io.Reader = body
+	if p.maxPushSize > 0 {
+		if r.ContentLength > p.maxPushSize {
+			return pushError(r, nil, nil, fmt.Sprintf("the push is larger than the limit of %d bytes", p.maxPushSize)), nil
+		}
+		// NOTE: The size of chunked requests is only known at the end, so the body is counted as it is sent
+		reader = &limitedBody{Reader: body, remaining: p.maxPushSize, limit: p.maxPushSize}
+	}
+
+	// The commands are read at the start of the body and put back in front of the remaining data
+	var consumed bytes.Buffer
+	updates, capabilities, err := readRefUpdates(r, io.TeeReader(reader, &consumed))
+	r.Body = readCloser{Reader: io.MultiReader(&consumed, reader), Closer: body}
+	if err != nil {
+		return nil, err
+	}
+	if p.readOnly {
+		return pushError(r, updates, capabilities, readOnlyMessage), nil
+	}
+	for _, update := range updates {
+		if p.protects(update.ref) {
+			return pushError(r, updates, capabilities, fmt.Sprintf("%s is protected in this session, pushing to it is not allowed", update.ref)), nil
+		}
+	}
+	return nil, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// readRefUpdates parses the commands at the start of a push request
+func readRefUpdates(r *http.Request, body io.Reader) ([]refUpdate, []string, error) {
+	reader := body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader = gzipReader
+	}
+	buffered := bufio.NewReader(reader)
+	updates := []refUpdate{}
+	var capabilities []string
+	inCertificate := false
+	for {
+		line, flush, err := readPktLine(buffered)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot parse the push commands: %w", err)
+		}
+		if flush {
+			return updates, capabilities, nil
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if command, caps, found := strings.Cut(line, "\x00"); found {
+			line = command
+			capabilities = strings.Fields(caps)
+		}
+		switch {
+		case strings.HasPrefix(line, "shallow "):
+			continue
+		case line == "push-cert":
+			inCertificate = true
+			continue
+		case line == "push-cert-end":
+			inCertificate = false
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !isObjectID(fields[0]) || !isObjectID(fields[1]) {
+			if inCertificate {
+				// The header and the signature of a signed push
+				continue
+			}
+			return nil, nil, fmt.Errorf("unexpected push command %q", line)
+		}
+		updates = append(updates, refUpdate{oldID: fields[0], newID: fields[1], ref: fields[2]})
+	}
+}
+
+func isObjectID(value string) bool {
+	if len(value) != 40 && len(value) != 64 {
+		return false
+	}
+	for _, c := range value {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// readPktLine reads a single pkt-line, it returns true for a flush packet
+func readPktLine(reader io.Reader) (string, bool, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", false, err
+	}
+	length, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid pkt-line length %q", header)
+	}
+	if length == 0 {
+		return "", true, nil
+	}
+	if length < 4 || length > maxPktLineLength {
+		return "", false, errors.New("invalid pkt-line length")
+	}
+	payload := make([]byte, length-4)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return "", false, err
+	}
+	return string(payload), false, nil
+}
+
+func pktLine(payload string) []byte {
+	return fmt.Appendf(nil, "%04x%s", len(payload)+4, payload)
+}
+
+const flushPkt = "0000"
+
+// advertisementError makes the git client stop with "fatal: remote error: <message>"
+func advertisementError(r *http.Request, message string) *http.Response {
+	res := goproxy.NewResponse(r, receivePackAdvertisType, http.StatusOK, string(pktLine("ERR "+message+"\n")))
+	res.Header.Set("Cache-Control", "no-cache")
+	return res
+}
+
+// pushError rejects all the ref updates of a push with the report-status format expected by the
+// git client, see https://git-scm.com/docs/pack-protocol#_report_status
+func pushError(r *http.Request, updates []refUpdate, capabilities []string, message string) *http.Response {
+	hasCapability := func(name string) bool {
+		for _, capability := range capabilities {
+			if capability == name {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasCapability("report-status") && !hasCapability("report-status-v2") {
+		return goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, message)
+	}
+
+	var status bytes.Buffer
+	status.Write(pktLine("unpack ok\n"))
+	for _, update := range updates {
+		status.Write(pktLine(fmt.Sprintf("ng %s %s\n", update.ref, message)))
+	}
+	status.WriteString(flushPkt)
+
+	var body bytes.Buffer
+	sideband := hasCapability("side-band-64k") || hasCapability("side-band")
+	if !sideband {
+		body.Write(status.Bytes())
+	} else {
+		chunkSize := 65515
+		if !hasCapability("side-band-64k") {
+			chunkSize = 995
+		}
+		// The message is shown by the client as "remote: <message>"
+		body.Write(pktLine("\x02" + message + "\n"))
+		data := status.Bytes()
+		for len(data) > 0 {
+			n := min(len(data), chunkSize)
+			body.Write(pktLine("\x01" + string(data[:n])))
+			data = data[n:]
+		}
+		body.WriteString(flushPkt)
+	}
+	res := goproxy.NewResponse(r, receivePackResultType, http.StatusOK, body.String())
+	res.Header.Set("Cache-Control", "no-cache")
+	return res
+}
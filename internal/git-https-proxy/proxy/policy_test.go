@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	oldID = "1111111111111111111111111111111111111111"
+	newID = "2222222222222222222222222222222222222222"
+)
+
+// pushBody returns the body of a push request with the ref updates followed by a fake packfile
+func pushBody(capabilities string, refs ...string) []byte {
+	var body bytes.Buffer
+	for i, ref := range refs {
+		line := oldID + " " + newID + " " + ref
+		if i == 0 {
+			line += "\x00" + capabilities
+		}
+		body.Write(pktLine(line + "\n"))
+	}
+	body.WriteString(flushPkt)
+	body.WriteString("PACK-the-packfile-data")
+	return body.Bytes()
+}
+
+func newPushRequest(body []byte) *http.Request {
+	return httptest.NewRequest(http.MethodPost, "https://gitlab.com/group/repo.git/git-receive-pack", bytes.NewReader(body))
+}
+
+func TestPushPolicy(t *testing.T) {
+	capabilities := "report-status side-band-64k agent=git/2.43.0"
+	cases := []struct {
+		name     string
+		policy   pushPolicy
+		request  *http.Request
+		rejected bool
+	}{
+		{
+			name:    "no policy",
+			policy:  pushPolicy{},
+			request: newPushRequest(pushBody(capabilities, "refs/heads/main")),
+		},
+		{
+			name:     "read-only advertisement",
+			policy:   pushPolicy{readOnly: true},
+			request:  httptest.NewRequest(http.MethodGet, "https://gitlab.com/group/repo.git/info/refs?service=git-receive-pack", nil),
+			rejected: true,
+		},
+		{
+			name:    "read-only allows fetching",
+			policy:  pushPolicy{readOnly: true},
+			request: httptest.NewRequest(http.MethodGet, "https://gitlab.com/group/repo.git/info/refs?service=git-upload-pack", nil),
+		},
+		{
+			name:     "read-only push",
+			policy:   pushPolicy{readOnly: true},
+			request:  newPushRequest(pushBody(capabilities, "refs/heads/feature")),
+			rejected: true,
+		},
+		{
+			name:     "read-only push through a parent directory",
+			policy:   pushPolicy{readOnly: true},
+			request:  httptest.NewRequest(http.MethodPost, "https://gitlab.com/group/repo.git/info/../git-receive-pack", bytes.NewReader(pushBody(capabilities, "refs/heads/main"))),
+			rejected: true,
+		},
+		{
+			name:     "read-only push advertisement through a parent directory",
+			policy:   pushPolicy{readOnly: true},
+			request:  httptest.NewRequest(http.MethodGet, "https://gitlab.com/group/repo.git/objects/../info/refs?service=git-receive-pack", nil),
+			rejected: true,
+		},
+		{
+			name:    "read-only allows upload-pack",
+			policy:  pushPolicy{readOnly: true},
+			request: httptest.NewRequest(http.MethodPost, "https://gitlab.com/group/repo.git/git-upload-pack", strings.NewReader("0000")),
+		},
+		{
+			name:    "read-only allows LFS downloads",
+			policy:  pushPolicy{readOnly: true},
+			request: httptest.NewRequest(http.MethodPost, "https://gitlab.com/group/repo.git/info/lfs/objects/batch", strings.NewReader(`{"operation":"download","objects":[]}`)),
+		},
+		{
+			name:     "read-only LFS upload",
+			policy:   pushPolicy{readOnly: true},
+			request:  httptest.NewRequest(http.MethodPost, "https://gitlab.com/group/repo.git/info/lfs/objects/batch", strings.NewReader(`{"operation":"upload","objects":[]}`)),
+			rejected: true,
+		},
+		{
+			name:     "read-only LFS lock",
+			policy:   pushPolicy{readOnly: true},
+			request:  httptest.NewRequest(http.MethodPost, "https://gitlab.com/group/repo.git/info/lfs/locks", strings.NewReader(`{"path":"data.bin"}`)),
+			rejected: true,
+		},
+		{
+			name:     "read-only other write",
+			policy:   pushPolicy{readOnly: true},
+			request:  httptest.NewRequest(http.MethodPut, "https://gitlab.com/group/repo.git/gitlab-lfs/objects/abcd/4", strings.NewReader("data")),
+			rejected: true,
+		},
+		{
+			name:     "protected branch",
+			policy:   pushPolicy{protectedBranches: []string{"main"}},
+			request:  newPushRequest(pushBody(capabilities, "refs/heads/feature", "refs/heads/main")),
+			rejected: true,
+		},
+		{
+			name:    "unprotected branch",
+			policy:  pushPolicy{protectedBranches: []string{"main", "release/*"}},
+			request: newPushRequest(pushBody(capabilities, "refs/heads/feature", "refs/heads/maintenance")),
+		},
+		{
+			name:     "protected branch pattern",
+			policy:   pushPolicy{protectedBranches: []string{"release/*"}},
+			request:  newPushRequest(pushBody(capabilities, "refs/heads/release/1.0")),
+			rejected: true,
+		},
+		{
+			name:    "branch patterns do not match tags",
+			policy:  pushPolicy{protectedBranches: []string{"*"}},
+			request: newPushRequest(pushBody(capabilities, "refs/tags/v1.0")),
+		},
+		{
+			name:     "full ref pattern",
+			policy:   pushPolicy{protectedBranches: []string{"refs/tags/*"}},
+			request:  newPushRequest(pushBody(capabilities, "refs/tags/v1.0")),
+			rejected: true,
+		},
+		{
+			name:     "push larger than the limit",
+			policy:   pushPolicy{maxPushSize: 64},
+			request:  newPushRequest(pushBody(capabilities, "refs/heads/main")),
+			rejected: true,
+		},
+		{
+			name:    "push within the limit",
+			policy:  pushPolicy{maxPushSize: 1024},
+			request: newPushRequest(pushBody(capabilities, "refs/heads/main")),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var original []byte
+			if tc.request.Body != nil {
+				original, _ = io.ReadAll(tc.request.Body)
+				tc.request.Body = io.NopCloser(bytes.NewReader(original))
+			}
+			res, err := tc.policy.check(tc.request)
+			require.NoError(t, err)
+			if tc.rejected {
+				assert.NotNil(t, res)
+				return
+			}
+			assert.Nil(t, res)
+			// The request is passed on unchanged
+			if tc.request.Body != nil {
+				body, err := io.ReadAll(tc.request.Body)
+				require.NoError(t, err)
+				assert.Equal(t, original, body)
+			}
+		})
+	}
+}
+
+func TestPushPolicyChunkedPushLimit(t *testing.T) {
+	body := pushBody("report-status", "refs/heads/main")
+	policy := pushPolicy{maxPushSize: int64(len(body) - 1)}
+	req := newPushRequest(body)
+	// The size of a chunked request is not known in advance
+	req.ContentLength = -1
+	res, err := policy.check(req)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+	_, err = io.ReadAll(req.Body)
+	assert.ErrorContains(t, err, "larger than the limit")
+
+	policy = pushPolicy{maxPushSize: int64(len(body))}
+	req = newPushRequest(body)
+	req.ContentLength = -1
+	res, err = policy.check(req)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+	forwarded, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, forwarded)
+}
+
+func TestPushPolicyErrorMessages(t *testing.T) {
+	policy := pushPolicy{readOnly: true, protectedBranches: []string{"main"}}
+
+	res, err := policy.check(httptest.NewRequest(http.MethodGet, "https://gitlab.com/group/repo.git/info/refs?service=git-receive-pack", nil))
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, receivePackAdvertisType, res.Header.Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(string(body), "004dERR this repository is read-only"))
+
+	// Without side band the report status is sent as is
+	policy = pushPolicy{protectedBranches: []string{"main"}}
+	res, err = policy.check(newPushRequest(pushBody("report-status", "refs/heads/main")))
+	require.NoError(t, err)
+	body, _ = io.ReadAll(res.Body)
+	assert.Equal(t, receivePackResultType, res.Header.Get("Content-Type"))
+	assert.Equal(t, "000eunpack ok\n"+
+		"0062ng refs/heads/main refs/heads/main is protected in this session, pushing to it is not allowed\n"+
+		"0000", string(body))
+
+	// With side band the report status is in the first band and the message in the second one
+	res, err = policy.check(newPushRequest(pushBody("report-status side-band-64k", "refs/heads/main")))
+	require.NoError(t, err)
+	body, _ = io.ReadAll(res.Body)
+	reader := bytes.NewReader(body)
+	line, _, err := readPktLine(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "\x02refs/heads/main is protected in this session, pushing to it is not allowed\n", line)
+	line, _, err = readPktLine(reader)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "\x01000eunpack ok\n0062ng refs/heads/main"))
+	_, flush, err := readPktLine(reader)
+	require.NoError(t, err)
+	assert.True(t, flush)
+
+	// Clients that do not ask for a report status get an HTTP error
+	res, err = policy.check(newPushRequest(pushBody("", "refs/heads/main")))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestPushPolicyGzipAndInvalidRequests(t *testing.T) {
+	policy := pushPolicy{protectedBranches: []string{"main"}}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err := writer.Write(pushBody("report-status", "refs/heads/main"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	req := newPushRequest(compressed.Bytes())
+	req.Header.Set("Content-Encoding", "gzip")
+	res, err := policy.check(req)
+	require.NoError(t, err)
+	assert.NotNil(t, res)
+
+	_, err = policy.check(newPushRequest([]byte("zzzz")))
+	assert.Error(t, err)
+	_, err = policy.check(newPushRequest(append(pktLine("not a command\n"), []byte(flushPkt)...)))
+	assert.Error(t, err)
+
+	_, err = pushPolicy{readOnly: true}.check(httptest.NewRequest(http.MethodPost, "https://gitlab.com/group/repo.git/info/lfs/objects/batch", strings.NewReader("{")))
+	assert.Error(t, err)
+}
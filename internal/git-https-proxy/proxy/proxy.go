@@ -3,10 +3,12 @@ package proxy
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
-	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 
 	configLib "github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
 	"github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/tokenstore"
@@ -15,98 +17,104 @@ import (
 
 // Returns a server handler that contains the proxy that injects the Git aithorization header when
 // the conditions for doing so are met.
-func GetProxyHandler(config configLib.GitProxyConfig) *goproxy.ProxyHttpServer {
+func GetProxyHandler(config configLib.GitProxyConfig, tokenStore *tokenstore.TokenStore) (*goproxy.ProxyHttpServer, error) {
 	proxyHandler := goproxy.NewProxyHttpServer()
 	proxyHandler.Verbose = false
+	guardLocalDestinations(proxyHandler, config.HealthPort)
 
 	if config.AnonymousSession {
-		return proxyHandler
+		return proxyHandler, nil
 	}
 
-	tokenStore := tokenstore.New(&config)
-
-	providers := make(map[string]configLib.GitProvider, len(config.Providers))
-	for _, p := range config.Providers {
-		providers[p.Id] = p
+	routes := newRoutingTable(config.Repositories, config.Providers)
+	if len(routes.hosts) == 0 {
+		return proxyHandler, nil
+	}
+	mitm, err := mitmAction(config)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, repo := range config.Repositories {
-		repoURL, err := url.Parse(repo.Url)
-		if err != nil {
-			log.Printf("Cannot parse repository URL (%s), skipping proxy setup.", repo.Url)
-			continue
+	// NOTE: Several repositories on the same host can use different providers, so a single handler
+	// picks the repository with the longest matching path and every request gets at most one token.
+	handlerFunc := func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		route, found := routes.match(r.URL)
+		if !found {
+			// Skip logging healthcheck requests
+			if r.URL.Path != "/ping" && r.URL.Path != "/ping/" {
+				log.Printf("The request %s does not match any git repository letting request through without adding auth headers\n", r.URL.String())
+			}
+			return r, nil
 		}
-		provider := repo.Provider
-		if provider == "" {
-			log.Printf("Repository (%s) has no provider, skipping proxy setup.", repo.Url)
-			continue
+		if rejection, err := route.policy.check(r); err != nil {
+			log.Printf("The request %s cannot be checked against the policy of the repository, returning 400, error: %s\n", r.URL.String(), err.Error())
+			return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadRequest, "The request could not be checked against the policy of the repository")
+		} else if rejection != nil {
+			log.Printf("The request %s is not allowed by the policy of the git repository %s\n", r.URL.String(), route.repoURL.String())
+			return r, rejection
 		}
-		if _, providerExists := providers[provider]; !providerExists {
-			log.Printf("The provider (%s) for repository (%s) is not configured, skipping proxy setup.", provider, repo.Url)
-			continue
+		log.Printf("The request %s matches the git repository %s [%s], adding auth headers\n", r.URL.String(), route.repoURL.String(), route.provider)
+		gitToken, err := tokenStore.GetGitAccessToken(route.provider, true)
+		if err != nil {
+			log.Printf("The git token cannot be refreshed, returning 401, error: %s\n", err.Error())
+			return r, goproxy.NewResponse(r, goproxy.ContentTypeText, 401, "The git token could not be refreshed")
 		}
-		log.Printf("Setting up proxy for repository: %s [%s]", repo.Url, provider)
+		r.Header.Set("Authorization", fmt.Sprintf("Basic %s", gitToken))
+		return r, nil
+	}
 
-		gitRepoHostWithWww := fmt.Sprintf("www.%s", repoURL.Hostname())
+	conditions := goproxy.ReqHostIs(routes.hostnames()...)
+	// NOTE: We need to eavesdrop on the HTTPS connection to insert the Auth header
+	// we do this only for the case where the request host matches the host of a git repo
+	// in all other cases we leave the request alone.
+	proxyHandler.OnRequest(conditions).HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return mitm, host
+	})
+	proxyHandler.OnRequest(conditions).DoFunc(handlerFunc)
+	return proxyHandler, nil
+}
 
-		handlerFunc := func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-			validGitRequest := r.URL.Scheme == repoURL.Scheme &&
-				hostsMatch(r.URL, repoURL) &&
-				getPort(r.URL) == getPort(repoURL) &&
-				strings.HasPrefix(strings.TrimLeft(r.URL.Path, "/"), strings.TrimLeft(repoURL.Path, "/"))
-			if !validGitRequest {
-				// Skip logging healthcheck requests
-				if r.URL.Path != "/ping" && r.URL.Path != "/ping/" {
-					log.Printf("The request %s does not match the git repository %s letting request through without adding auth headers\n", r.URL.String(), repoURL.String())
-				}
-				return r, nil
-			}
-			log.Printf("The request %s matches the git repository %s [%s], adding auth headers\n", r.URL.String(), repoURL.String(), provider)
-			gitToken, err := tokenStore.GetGitAccessToken(provider, true)
-			if err != nil {
-				log.Printf("The git token cannot be refreshed, returning 401, error: %s\n", err.Error())
-				return r, goproxy.NewResponse(r, goproxy.ContentTypeText, 401, "The git token could not be refreshed")
-			}
-			r.Header.Set("Authorization", fmt.Sprintf("Basic %s", gitToken))
-			return r, nil
-		}
+// isLocalAddress returns true for the addresses of the pod and of the node that the proxy must not connect to,
+// e.g. the credential endpoints on the loopback interface or the metadata service of the cloud provider
+func isLocalAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
 
-		conditions := goproxy.ReqHostIs(
-			repoURL.Hostname(),
-			gitRepoHostWithWww,
-			fmt.Sprintf("%s:443", repoURL.Hostname()),
-			fmt.Sprintf("%s:443", gitRepoHostWithWww),
-		)
-		// NOTE: We need to eavesdrop on the HTTPS connection to insert the Auth header
-		// we do this only for the case where the request host matches the host of the git repo
-		// in all other cases we leave the request alone.
-		proxyHandler.OnRequest(conditions).HandleConnect(goproxy.AlwaysMitm)
-		proxyHandler.OnRequest(conditions).DoFunc(handlerFunc)
-	}
-	return proxyHandler
+// isHealthPing returns true for the request sent through the proxy by the health check of the health server
+func isHealthPing(r *http.Request, healthPort int) bool {
+	host := r.URL.Hostname()
+	ip := net.ParseIP(host)
+	return (host == "localhost" || (ip != nil && ip.IsLoopback())) &&
+		getPort(r.URL) == strconv.Itoa(healthPort) && strings.TrimSuffix(r.URL.Path, "/") == "/ping"
 }
 
-// Ensure that hosts name match with/without www. I.e.
-// ensure www.hostname.com matches hostname.com and vice versa
-func hostsMatch(url1 *url.URL, url2 *url.URL) bool {
-	var err error
-	var url1ContainsWww, url2ContainsWww bool
-	wwwRegex := fmt.Sprintf("^%s", regexp.QuoteMeta("www."))
-	url1ContainsWww, err = regexp.MatchString(wwwRegex, url1.Hostname())
-	if err != nil {
-		log.Fatalln(err)
-	}
-	url2ContainsWww, err = regexp.MatchString(wwwRegex, url2.Hostname())
-	if err != nil {
-		log.Fatalln(err)
-	}
-	if url1ContainsWww && !url2ContainsWww {
-		return url1.Hostname() == fmt.Sprintf("www.%s", url2.Hostname())
-	} else if !url1ContainsWww && url2ContainsWww {
-		return fmt.Sprintf("www.%s", url1.Hostname()) == url2.Hostname()
-	} else {
-		return url1.Hostname() == url2.Hostname()
+// guardLocalDestinations makes the proxy refuse the loopback and link-local destinations, only the /ping
+// request of the health check can reach the health server. The addresses are checked when the connections
+// are opened so that host names resolving to local addresses are refused as well.
+func guardLocalDestinations(proxyHandler *goproxy.ProxyHttpServer, healthPort int) {
+	healthPortStr := strconv.Itoa(healthPort)
+	dialer := &net.Dialer{
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !isLocalAddress(ip) || (ip.IsLoopback() && port == healthPortStr) {
+				return nil
+			}
+			return fmt.Errorf("the git proxy does not connect to the local address %s", address)
+		},
 	}
+	proxyHandler.Tr.DialContext = dialer.DialContext
+	proxyHandler.OnRequest(goproxy.ReqConditionFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) bool {
+		ip := net.ParseIP(r.URL.Hostname())
+		local := r.URL.Hostname() == "localhost" || (ip != nil && isLocalAddress(ip))
+		return local && !isHealthPing(r, healthPort)
+	})).DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		log.Printf("The request %s is for a local address, returning 403\n", r.URL.String())
+		return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, "The git proxy does not forward requests to local addresses")
+	})
 }
 
 // Infer port if not explicitly specified
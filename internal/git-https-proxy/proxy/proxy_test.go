@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	configLib "github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyRefusesLocalDestinations(t *testing.T) {
+	// The health server and the credentials server both listen on the loopback interface
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "local "+r.URL.Path)
+	}))
+	t.Cleanup(local.Close)
+	localURL, err := url.Parse(local.URL)
+	require.NoError(t, err)
+	healthPort, err := strconv.Atoi(localURL.Port())
+	require.NoError(t, err)
+	tlsLocal := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(tlsLocal.Close)
+
+	handler, err := GetProxyHandler(configLib.GitProxyConfig{AnonymousSession: true, HealthPort: healthPort}, nil)
+	require.NoError(t, err)
+	proxyServer := httptest.NewServer(handler)
+	t.Cleanup(proxyServer.Close)
+	proxyURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func(target string) (int, string) {
+		res, err := client.Get(target)
+		require.NoError(t, err)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	// The ping of the health check is the only request that reaches the health server
+	status, body := get("http://localhost:" + localURL.Port() + "/ping")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "local /ping", body)
+	status, _ = get("http://localhost:" + localURL.Port() + "/token")
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = get("http://127.0.0.1:" + localURL.Port() + "/credential")
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = get("http://169.254.169.254/latest/meta-data/")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// The tunnels are refused when the connection is opened
+	_, err = client.Get(tlsLocal.URL)
+	assert.Error(t, err)
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	configLib "github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+)
+
+// A repository for which the proxy injects the token of its provider
+type repositoryRoute struct {
+	scheme string
+	port   string
+	// The path of the repository without the leading slash and the .git suffix
+	pathPrefix string
+	provider   string
+	repoURL    *url.URL
+	policy     pushPolicy
+}
+
+// matches returns true if the request is for the repository, the path has to match full path segments
+// so that the repository group/repo does not match group/repository. The path is cleaned as the remote
+// would do so that group/other/../repo is the repository group/repo.
+func (r repositoryRoute) matches(requestURL *url.URL) bool {
+	if requestURL.Scheme != r.scheme || getPort(requestURL) != r.port {
+		return false
+	}
+	if r.pathPrefix == "" {
+		return true
+	}
+	requestPath := strings.TrimLeft(path.Clean("/"+requestURL.Path), "/")
+	if !strings.HasPrefix(requestPath, r.pathPrefix) {
+		return false
+	}
+	rest := requestPath[len(r.pathPrefix):]
+	rest = strings.TrimPrefix(rest, ".git")
+	return rest == "" || strings.HasPrefix(rest, "/")
+}
+
+// routingTable finds the repository of a request, the routes are indexed by host without the www. prefix
+// and sorted from the longest to the shortest path so that the most specific repository is used.
+type routingTable struct {
+	hosts map[string][]repositoryRoute
+}
+
+func newRoutingTable(repositories []configLib.GitRepository, providers []configLib.GitProvider) routingTable {
+	configuredProviders := make(map[string]struct{}, len(providers))
+	for _, p := range providers {
+		configuredProviders[p.Id] = struct{}{}
+	}
+
+	table := routingTable{hosts: map[string][]repositoryRoute{}}
+	for _, repo := range repositories {
+		repoURL, err := url.Parse(repo.Url)
+		if err != nil {
+			log.Printf("Cannot parse repository URL (%s), skipping proxy setup.", repo.Url)
+			continue
+		}
+		provider := repo.Provider
+		if provider == "" {
+			log.Printf("Repository (%s) has no provider, skipping proxy setup.", repo.Url)
+			continue
+		}
+		if _, providerExists := configuredProviders[provider]; !providerExists {
+			log.Printf("The provider (%s) for repository (%s) is not configured, skipping proxy setup.", provider, repo.Url)
+			continue
+		}
+		log.Printf("Setting up proxy for repository: %s [%s]", repo.Url, provider)
+		host := stripWww(repoURL.Hostname())
+		table.hosts[host] = append(table.hosts[host], repositoryRoute{
+			scheme:     repoURL.Scheme,
+			port:       getPort(repoURL),
+			pathPrefix: strings.TrimSuffix(strings.Trim(repoURL.Path, "/"), ".git"),
+			provider:   provider,
+			repoURL:    repoURL,
+			policy: pushPolicy{
+				readOnly:          repo.ReadOnly,
+				protectedBranches: repo.ProtectedBranches,
+				maxPushSize:       repo.MaxPushSize,
+			},
+		})
+	}
+	for _, routes := range table.hosts {
+		sort.SliceStable(routes, func(i, j int) bool {
+			return len(routes[i].pathPrefix) > len(routes[j].pathPrefix)
+		})
+	}
+	return table
+}
+
+// match returns the repository with the longest path that matches the request
+func (t routingTable) match(requestURL *url.URL) (repositoryRoute, bool) {
+	for _, route := range t.hosts[stripWww(requestURL.Hostname())] {
+		if route.matches(requestURL) {
+			return route, true
+		}
+	}
+	return repositoryRoute{}, false
+}
+
+// restrictedProviders returns the providers with at least one repository that has a push policy
+func (t routingTable) restrictedProviders() map[string]struct{} {
+	providers := map[string]struct{}{}
+	for _, routes := range t.hosts {
+		for _, route := range routes {
+			if route.policy.enabled() {
+				providers[route.provider] = struct{}{}
+			}
+		}
+	}
+	return providers
+}
+
+// hostnames returns the hosts for which the HTTPS connections have to be intercepted
+func (t routingTable) hostnames() []string {
+	hostnames := []string{}
+	for host := range t.hosts {
+		hostWithWww := fmt.Sprintf("www.%s", host)
+		hostnames = append(hostnames, host, hostWithWww, fmt.Sprintf("%s:443", host), fmt.Sprintf("%s:443", hostWithWww))
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+// Ensure that hosts name match with/without www. I.e.
+// ensure www.hostname.com matches hostname.com and vice versa
+func stripWww(hostname string) string {
+	return strings.TrimPrefix(hostname, "www.")
+}
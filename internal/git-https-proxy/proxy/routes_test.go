@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+
+	configLib "github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutingTable(t *testing.T) {
+	providers := []configLib.GitProvider{
+		{Id: "gitlab-group"},
+		{Id: "gitlab-oauth"},
+		{Id: "github"},
+	}
+	repositories := []configLib.GitRepository{
+		{Url: "https://gitlab.com/group", Provider: "gitlab-group"},
+		{Url: "https://gitlab.com/group/private/project.git", Provider: "gitlab-oauth"},
+		{Url: "https://gitlab.com/group/private", Provider: "gitlab-group"},
+		{Url: "https://gitlab.com/user/repo", Provider: "gitlab-oauth"},
+		{Url: "https://www.github.com/org/repo.git", Provider: "github"},
+		{Url: "https://gitlab.com/no-provider/repo"},
+		{Url: "https://gitlab.com/unknown-provider/repo", Provider: "bitbucket"},
+	}
+	table := newRoutingTable(repositories, providers)
+
+	cases := []struct {
+		name     string
+		url      string
+		provider string
+	}{
+		{name: "group prefix", url: "https://gitlab.com/group/other/info/refs?service=git-upload-pack", provider: "gitlab-group"},
+		{name: "longest prefix wins", url: "https://gitlab.com/group/private/project.git/info/refs", provider: "gitlab-oauth"},
+		{name: "longest prefix without .git", url: "https://gitlab.com/group/private/project/info/refs", provider: "gitlab-oauth"},
+		{name: "shorter prefix for a sibling", url: "https://gitlab.com/group/private/other.git/git-upload-pack", provider: "gitlab-group"},
+		{name: "prefix must match full segments", url: "https://gitlab.com/group/private/project-fork.git/info/refs", provider: "gitlab-group"},
+		{name: "parent directories are cleaned", url: "https://gitlab.com/group/other/../private/project.git/info/refs", provider: "gitlab-oauth"},
+		{name: "parent directories out of a repository", url: "https://gitlab.com/user/repo/../repository.git/info/refs"},
+		{name: "other repository on the same host", url: "https://gitlab.com/user/repo.git/info/refs", provider: "gitlab-oauth"},
+		{name: "partial segment does not match", url: "https://gitlab.com/user/repository.git/info/refs"},
+		{name: "host with www", url: "https://www.gitlab.com/user/repo.git/info/refs", provider: "gitlab-oauth"},
+		{name: "host without www", url: "https://github.com/org/repo/info/refs", provider: "github"},
+		{name: "explicit default port", url: "https://github.com:443/org/repo/info/refs", provider: "github"},
+		{name: "other port", url: "https://github.com:8443/org/repo/info/refs"},
+		{name: "other scheme", url: "http://github.com/org/repo/info/refs"},
+		{name: "other host", url: "https://example.com/group/repo"},
+		{name: "repository without provider", url: "https://gitlab.com/no-provider/repo.git/info/refs"},
+		{name: "repository with unknown provider", url: "https://gitlab.com/unknown-provider/repo.git/info/refs"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			requestURL, err := url.Parse(tc.url)
+			assert.NoError(t, err)
+			route, found := table.match(requestURL)
+			if tc.provider == "" {
+				assert.False(t, found, "matched %s", route.repoURL)
+				return
+			}
+			assert.True(t, found)
+			assert.Equal(t, tc.provider, route.provider)
+		})
+	}
+
+	assert.Equal(t, []string{
+		"github.com", "github.com:443", "gitlab.com", "gitlab.com:443",
+		"www.github.com", "www.github.com:443", "www.gitlab.com", "www.gitlab.com:443",
+	}, table.hostnames())
+}
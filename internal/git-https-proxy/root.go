@@ -31,6 +31,8 @@ import (
 
 	configLib "github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
 	"github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/proxy"
+	"github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/tokenstore"
+	"github.com/SwissDataScienceCenter/amalthea/internal/oauth"
 )
 
 func Command() (*cobra.Command, error) {
@@ -64,15 +66,36 @@ func gitproxy(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 
 	// INFO: Setup servers
-	proxyHandler := proxy.GetProxyHandler(config)
+	var tokenStore *tokenstore.TokenStore
+	if !config.AnonymousSession {
+		tokenStore, err = tokenstore.New(&config)
+		if err != nil {
+			return err
+		}
+	}
+	proxyHandler, err := proxy.GetProxyHandler(config, tokenStore)
+	if err != nil {
+		return err
+	}
 	proxyServer := http.Server{
 		Addr:    fmt.Sprintf(":%d", config.ProxyPort),
 		Handler: proxyHandler,
 	}
-	healthHandler := getHealthHandler(config)
 	healthServer := http.Server{
 		Addr:    fmt.Sprintf(":%d", config.HealthPort),
-		Handler: healthHandler,
+		Handler: getHealthHandler(config, tokenStore),
+	}
+	// Credentials for the tools that do not use the proxy, they are only served on the loopback interface
+	// and apart from the health server which is reachable from outside of the pod
+	var credentialsServer *http.Server
+	if tokenStore != nil {
+		credentialsHandler := http.NewServeMux()
+		credentialsHandler.Handle("/credential", proxy.CredentialHandler(config, tokenStore))
+		credentialsHandler.Handle("/token", proxy.TokenHandler(config, tokenStore))
+		credentialsServer = &http.Server{
+			Addr:    fmt.Sprintf("127.0.0.1:%d", config.CredentialsPort),
+			Handler: credentialsHandler,
+		}
 	}
 
 	// INFO: Run servers in the background
@@ -83,6 +106,15 @@ func gitproxy(cmd *cobra.Command, args []string) error {
 			cmd.Printf("An error occurred running the git proxy health server: %v", err)
 		}
 	}()
+	if credentialsServer != nil {
+		go func() {
+			cmd.Printf("Credentials server active on 127.0.0.1:%d\n", config.CredentialsPort)
+			err := credentialsServer.ListenAndServe()
+			if err != nil {
+				cmd.Printf("An error occurred running the git proxy credentials server: %v", err)
+			}
+		}()
+	}
 	go func() {
 		cmd.Printf("Git proxy active on port %d\n", config.ProxyPort)
 		err := proxyServer.ListenAndServe()
@@ -100,6 +132,12 @@ func gitproxy(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		log.Println("Graceful shutdown healthserver with errors:", err)
 	}
+	if credentialsServer != nil {
+		err = credentialsServer.Shutdown(ctx)
+		if err != nil {
+			log.Println("Graceful shutdown credentials server with errors:", err)
+		}
+	}
 	err = proxyServer.Shutdown(ctx)
 	if err != nil {
 		log.Println("Graceful shutdown proxyserver with errors:", err)
@@ -113,7 +151,8 @@ func gitproxy(cmd *cobra.Command, args []string) error {
 // and running the health server will use the proxy as a proxy for the health endpoint.
 // This is necessary because sending any requests directly to the proxy results in a 500
 // with a message that the proxy only accepts proxy requests and no direct requests.
-func getHealthHandler(config configLib.GitProxyConfig) *http.ServeMux {
+// The health endpoint also fails when the git credentials cannot be refreshed anymore.
+func getHealthHandler(config configLib.GitProxyConfig, tokenStore *tokenstore.TokenStore) *http.ServeMux {
 	handler := http.NewServeMux()
 	handler.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -129,6 +168,13 @@ func getHealthHandler(config configLib.GitProxyConfig) *http.ServeMux {
 		}
 	})
 	handler.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if tokenStore != nil {
+			if status := tokenStore.Status(); !status.Healthy {
+				log.Println("The git credentials cannot be refreshed anymore, see /status for details")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
 		proxyUrl, err := url.Parse(fmt.Sprintf("http://localhost:%d", config.ProxyPort))
 		if err != nil {
 			log.Fatalln(err)
@@ -138,6 +184,7 @@ func getHealthHandler(config configLib.GitProxyConfig) *http.ServeMux {
 		if err != nil {
 			log.Println("The GET request to /ping from within /health failed with:", err)
 			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
 		defer func() {
 			_ = resp.Body.Close()
@@ -148,5 +195,20 @@ func getHealthHandler(config configLib.GitProxyConfig) *http.ServeMux {
 			w.WriteHeader(http.StatusBadRequest)
 		}
 	})
+	handler.Handle("/metrics", oauth.MetricsHandler())
+	// The state of the tokens of the session, without the tokens themselves
+	handler.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status := tokenstore.Status{Healthy: true, Providers: map[string]tokenstore.ProviderStatus{}}
+		if tokenStore != nil {
+			status = tokenStore.Status()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Println("Cannot write the status of the git proxy:", err)
+		}
+	})
 	return handler
 }
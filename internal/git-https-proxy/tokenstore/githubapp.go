@@ -0,0 +1,79 @@
+package tokenstore
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+	"github.com/SwissDataScienceCenter/amalthea/internal/oauth"
+)
+
+const (
+	defaultGitHubAPIURL = "https://api.github.com"
+	// The username used with the installation tokens
+	gitHubAppUsername = "x-access-token"
+)
+
+// gitHubAppBackend mints installation tokens of a GitHub App with the private key of the app
+type gitHubAppBackend struct {
+	client *http.Client
+}
+
+func newGitHubAppBackend() *gitHubAppBackend {
+	return &gitHubAppBackend{client: &http.Client{Timeout: oauth.DefaultTimeout}}
+}
+
+type gitHubInstallationTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (b *gitHubAppBackend) GetToken(provider config.GitProvider) (TokenSet, error) {
+	app := provider.GitHubApp
+	appToken, err := gitHubAppJWT(app)
+	if err != nil {
+		return TokenSet{}, err
+	}
+	apiURL := app.APIURL
+	if apiURL == "" {
+		apiURL = defaultGitHubAPIURL
+	}
+	tokenURL := fmt.Sprintf("%s/app/installations/%d/access_tokens", strings.TrimSuffix(apiURL, "/"), app.InstallationID)
+	req, err := http.NewRequest(http.MethodPost, tokenURL, nil)
+	if err != nil {
+		return TokenSet{}, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", appToken))
+	req.Header.Set("Accept", "application/vnd.github+json")
+	var resParsed gitHubInstallationTokenResponse
+	if err := oauth.Do(b.client, req, &resParsed); err != nil {
+		return TokenSet{}, err
+	}
+	return TokenSet{AccessToken: resParsed.Token, ExpiresAt: resParsed.ExpiresAt.Unix(), Username: gitHubAppUsername}, nil
+}
+
+// gitHubAppJWT returns the token that authenticates as the app, see
+// https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/generating-a-json-web-token-jwt-for-a-github-app
+func gitHubAppJWT(app *config.GitHubAppConfig) (string, error) {
+	privateKeyPEM, err := os.ReadFile(app.PrivateKeyFile)
+	if err != nil {
+		return "", err
+	}
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(privateKeyPEM)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse the private key of the GitHub App: %w", err)
+	}
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Issuer: app.AppID,
+		// Allow for clock drift with the GitHub servers
+		IssuedAt:  jwt.NewNumericDate(now.Add(-time.Minute)),
+		ExpiresAt: jwt.NewNumericDate(now.Add(9 * time.Minute)),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(privateKey)
+}
@@ -0,0 +1,71 @@
+package tokenstore
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	configLib "github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitHubAppBackend(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	privateKeyFile := filepath.Join(t.TempDir(), "app.pem")
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	require.NoError(t, os.WriteFile(privateKeyFile, privateKeyPEM, 0o600))
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("POST /app/installations/42/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		appToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		require.True(t, found)
+		claims := jwt.RegisteredClaims{}
+		_, err := jwt.ParseWithClaims(appToken, &claims, func(*jwt.Token) (any, error) { return &privateKey.PublicKey, nil },
+			jwt.WithValidMethods([]string{"RS256"}))
+		require.NoError(t, err)
+		assert.Equal(t, "1234", claims.Issuer)
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(gitHubInstallationTokenResponse{Token: "installation-token", ExpiresAt: expiresAt})
+	})
+	serverURL, serverClose := setUpTestServer(handler)
+	defer serverClose()
+
+	config := configLib.GitProxyConfig{
+		Providers: []configLib.GitProvider{{
+			Id:   "github",
+			Type: configLib.GitHubAppBackend,
+			GitHubApp: &configLib.GitHubAppConfig{
+				AppID:          "1234",
+				InstallationID: 42,
+				PrivateKeyFile: privateKeyFile,
+				APIURL:         serverURL.String() + "/",
+			},
+		}},
+	}
+	store, err := New(&config)
+	require.NoError(t, err)
+	encoded, err := store.GetGitAccessToken("github", true)
+	require.NoError(t, err)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("x-access-token:installation-token")), encoded)
+	assert.Equal(t, expiresAt, *store.Status().Providers["github"].ExpiresAt)
+
+	// An unknown installation is reported
+	config.Providers[0].GitHubApp.InstallationID = 7
+	store, err = New(&config)
+	require.NoError(t, err)
+	_, err = store.GetGitAccessToken("github", false)
+	assert.ErrorContains(t, err, "404")
+}
@@ -0,0 +1,139 @@
+package tokenstore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+	"github.com/SwissDataScienceCenter/amalthea/internal/oauth"
+	"github.com/SwissDataScienceCenter/amalthea/internal/utils"
+)
+
+// How long a git token is used when the gateway does not report its expiry, on top of the expiration leeway
+const renkuGitTokenDefaultLifetime = time.Minute
+
+// renkuBackend exchanges the renku access token of the user for the git tokens at the access token URL
+// of each provider. The renku access token is refreshed with Keycloak (v1) or with the Renku token
+// endpoint (v2) when it expires.
+type renkuBackend struct {
+	config *config.GitProxyConfig
+	// Safety margin for when to consider a token expired
+	expirationLeeway time.Duration
+
+	// The renku access and refresh tokens
+	source *oauth.TokenSource
+	// Channel that is populated by the timer that triggers the automated renku access token refresh
+	refreshTicker *time.Ticker
+	// The result of the last refresh of the renku access token
+	refreshResult *RefreshResult
+	// Protects refreshResult
+	lock *sync.RWMutex
+}
+
+func newRenkuBackend(c *config.GitProxyConfig) *renkuBackend {
+	backend := renkuBackend{
+		config:           c,
+		expirationLeeway: c.GetExpirationLeeway(),
+		refreshTicker:    time.NewTicker(c.GetRefreshCheckPeriod()),
+		lock:             &sync.RWMutex{},
+	}
+	initialToken := oauth.Token{AccessToken: c.RenkuAccessToken, RefreshToken: c.RenkuRefreshToken}
+	initialToken.ExpiresAt, _ = oauth.JWTExpiry(c.RenkuAccessToken)
+	backend.source = oauth.NewTokenSource(
+		"renku",
+		backend.requestAccessToken,
+		oauth.WithInitialToken(initialToken),
+		oauth.WithLeeway(backend.expirationLeeway),
+		oauth.WithExpiryRequired(),
+	)
+	// Start a go routine to keep the refresh token valid
+	go backend.periodicTokenRefresh()
+	return &backend
+}
+
+// Exchange the renku access token for the access token of the corresponding provider
+func (b *renkuBackend) GetToken(provider config.GitProvider) (TokenSet, error) {
+	renkuAccessToken, err := b.getValidAccessToken()
+	if err != nil {
+		return TokenSet{}, err
+	}
+	token, err := oauth.ExchangeRenkuToken(context.Background(), nil, provider.AccessTokenUrl, renkuAccessToken)
+	if err != nil {
+		return TokenSet{}, err
+	}
+	// The gateway does not always report the expiry, the token is then exchanged again after a short time
+	if token.ExpiresAt.IsZero() {
+		token.ExpiresAt = time.Now().Add(b.expirationLeeway + renkuGitTokenDefaultLifetime)
+	}
+	return TokenSet{AccessToken: token.AccessToken, ExpiresAt: token.ExpiresAt.Unix()}, nil
+}
+
+// Returns a valid renku access token. If the token is expired, the token will be refreshed first.
+func (b *renkuBackend) getValidAccessToken() (string, error) {
+	if token := b.source.Current(); utils.IsNotExpired(token.ExpiresAt, b.expirationLeeway, true) {
+		return token.AccessToken, nil
+	}
+	if err := b.refreshAccessToken(); err != nil {
+		return "", err
+	}
+	return b.getAccessToken(), nil
+}
+
+func (b *renkuBackend) getAccessToken() string {
+	return b.source.Current().AccessToken
+}
+
+func (b *renkuBackend) getRefreshToken() string {
+	return b.source.Current().RefreshToken
+}
+
+// Refreshes the renku access token.
+func (b *renkuBackend) refreshAccessToken() error {
+	_, err := b.source.Refresh(context.Background())
+	result := newRefreshResult(err)
+	b.lock.Lock()
+	b.refreshResult = &result
+	b.lock.Unlock()
+	return err
+}
+
+func (b *renkuBackend) requestAccessToken(ctx context.Context) (oauth.Token, error) {
+	payload := url.Values{}
+	payload.Set("grant_type", "refresh_token")
+	payload.Set("refresh_token", b.getRefreshToken())
+	var response oauth.Response
+	var err error
+	if b.config.RenkuAuthenticationVersion == "v2" {
+		response, err = oauth.RequestForm(ctx, http.DefaultClient, b.config.RenkuTokenURL, payload, "", "")
+	} else {
+		tokenURL := b.config.RenkuURL.JoinPath(fmt.Sprintf("auth/realms/%s/protocol/openid-connect/token", b.config.RenkuRealm)).String()
+		response, err = oauth.RequestForm(ctx, http.DefaultClient, tokenURL, payload, b.config.RenkuClientID, b.config.RenkuClientSecret)
+	}
+	if err != nil {
+		return oauth.Token{}, err
+	}
+	return response.Token(), nil
+}
+
+// Periodically refreshes the renku access token. Used to make sure the refresh token does not expire.
+func (b *renkuBackend) periodicTokenRefresh() {
+	for {
+		<-b.refreshTicker.C
+		refreshTokenIsValid, err := utils.VerifyJWTExpiresAt(b.getRefreshToken(), b.expirationLeeway, false)
+		if err != nil {
+			log.Printf("Could not check if renku refresh token is expired: %s\n", err.Error())
+		}
+		if !refreshTokenIsValid {
+			log.Println("Getting a new renku refresh token from automatic checks")
+			err = b.refreshAccessToken()
+			if err != nil {
+				log.Printf("Could not refresh renku token: %s\n", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package tokenstore
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+)
+
+// staticBackend reads the token of a provider from a file, e.g. a mounted secret. The token does not
+// expire, it is read again when the file changes.
+type staticBackend struct {
+	watcher *fsnotify.Watcher
+}
+
+// newStaticBackend watches the directory of the token file and calls onChange when it changes. The
+// directory is watched rather than the file because Kubernetes updates the mounted secrets by swapping
+// symlinks, which replaces the file.
+func newStaticBackend(provider config.GitProvider, onChange func()) (*staticBackend, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(provider.TokenFile)); err != nil {
+		_ = watcher.Close()
+		return nil, fmt.Errorf("cannot watch the token file of the provider %s: %w", provider.Id, err)
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Has(fsnotify.Chmod) {
+					continue
+				}
+				log.Printf("The token file of the git provider %s changed, it will be read again", provider.Id)
+				onChange()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching the token file of the git provider %s: %s\n", provider.Id, err.Error())
+			}
+		}
+	}()
+	return &staticBackend{watcher: watcher}, nil
+}
+
+func (b *staticBackend) GetToken(provider config.GitProvider) (TokenSet, error) {
+	token, err := readTokenFile(provider.TokenFile)
+	if err != nil {
+		return TokenSet{}, err
+	}
+	return TokenSet{AccessToken: token}, nil
+}
+
+// readTokenFile returns the content of a file without the surrounding whitespace
+func readTokenFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("the token file %s is empty", path)
+	}
+	return token, nil
+}
@@ -0,0 +1,56 @@
+package tokenstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	configLib "github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticBackend(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("first-token\n"), 0o600))
+	config := configLib.GitProxyConfig{
+		Providers: []configLib.GitProvider{{Id: "static", Type: configLib.StaticTokenBackend, TokenFile: tokenFile}},
+	}
+
+	store, err := New(&config)
+	require.NoError(t, err)
+	assert.Nil(t, store.renku)
+	username, token, err := store.GetGitCredentials("static")
+	require.NoError(t, err)
+	assert.Equal(t, "oauth2", username)
+	assert.Equal(t, "first-token", token)
+	assert.True(t, store.Status().Healthy)
+
+	// Kubernetes replaces the mounted secrets by renaming files
+	newTokenFile := filepath.Join(dir, "token.new")
+	require.NoError(t, os.WriteFile(newTokenFile, []byte("second-token"), 0o600))
+	require.NoError(t, os.Rename(newTokenFile, tokenFile))
+	assert.Eventually(t, func() bool {
+		_, token, err := store.GetGitCredentials("static")
+		return err == nil && token == "second-token"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestStaticBackendErrors(t *testing.T) {
+	config := configLib.GitProxyConfig{
+		Providers: []configLib.GitProvider{{Id: "static", Type: configLib.StaticTokenBackend, TokenFile: "/does/not/exist/token"}},
+	}
+	_, err := New(&config)
+	assert.Error(t, err)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("  \n"), 0o600))
+	config.Providers[0].TokenFile = tokenFile
+	store, err := New(&config)
+	require.NoError(t, err)
+	_, err = store.GetGitAccessToken("static", false)
+	assert.ErrorContains(t, err, "is empty")
+	assert.NotEmpty(t, store.Status().Providers["static"].LastRefresh.Error)
+}
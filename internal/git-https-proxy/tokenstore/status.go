@@ -0,0 +1,94 @@
+package tokenstore
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/SwissDataScienceCenter/amalthea/internal/oauth"
+)
+
+// RefreshResult is the outcome of the last refresh of a token
+type RefreshResult struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+	// True when the refresh was refused because the credentials are not valid anymore
+	unrecoverable bool
+}
+
+func newRefreshResult(err error) RefreshResult {
+	result := RefreshResult{Time: time.Now().UTC()}
+	if err != nil {
+		result.Error = err.Error()
+		var statusError *oauth.StatusError
+		result.unrecoverable = errors.As(err, &statusError) &&
+			(statusError.StatusCode == http.StatusBadRequest || statusError.StatusCode == http.StatusUnauthorized)
+	}
+	return result
+}
+
+type ProviderStatus struct {
+	// The expiry of the current token, empty when no token has been exchanged yet
+	ExpiresAt   *time.Time     `json:"expires_at,omitempty"`
+	LastRefresh *RefreshResult `json:"last_refresh,omitempty"`
+}
+
+type RenkuStatus struct {
+	// The expiry of the refresh token, empty when the token does not expire or is not a JWT
+	RefreshTokenExpiresAt *time.Time     `json:"refresh_token_expires_at,omitempty"`
+	RefreshTokenValid     bool           `json:"refresh_token_valid"`
+	LastRefresh           *RefreshResult `json:"last_refresh,omitempty"`
+}
+
+type Status struct {
+	// False when the tokens cannot be refreshed anymore without a new renku refresh token
+	Healthy   bool                      `json:"healthy"`
+	Renku     *RenkuStatus              `json:"renku,omitempty"`
+	Providers map[string]ProviderStatus `json:"providers"`
+}
+
+func (b *renkuBackend) status() *RenkuStatus {
+	status := RenkuStatus{}
+	refreshToken := b.getRefreshToken()
+	b.lock.RLock()
+	if b.refreshResult != nil {
+		lastRefresh := *b.refreshResult
+		status.LastRefresh = &lastRefresh
+	}
+	b.lock.RUnlock()
+
+	status.RefreshTokenValid = refreshToken != ""
+	if expiresAt, ok := oauth.JWTExpiry(refreshToken); ok {
+		expiresAt = expiresAt.UTC()
+		status.RefreshTokenExpiresAt = &expiresAt
+		status.RefreshTokenValid = status.RefreshTokenValid && time.Now().Before(expiresAt)
+	}
+	return &status
+}
+
+// Status reports the state of the tokens, it does not refresh any of them
+func (s *TokenStore) Status() Status {
+	status := Status{Healthy: true, Providers: make(map[string]ProviderStatus, len(s.Providers))}
+
+	if s.renku != nil {
+		status.Renku = s.renku.status()
+		if !status.Renku.RefreshTokenValid || (status.Renku.LastRefresh != nil && status.Renku.LastRefresh.unrecoverable) {
+			status.Healthy = false
+		}
+	}
+
+	s.gitAccessTokensLock.RLock()
+	defer s.gitAccessTokensLock.RUnlock()
+	for provider := range s.Providers {
+		providerStatus := ProviderStatus{}
+		if tokenSet, exists := s.gitAccessTokens[provider]; exists && tokenSet.ExpiresAt > 0 {
+			expiresAt := time.Unix(tokenSet.ExpiresAt, 0).UTC()
+			providerStatus.ExpiresAt = &expiresAt
+		}
+		if result, exists := s.gitRefreshResults[provider]; exists {
+			providerStatus.LastRefresh = &result
+		}
+		status.Providers[provider] = providerStatus
+	}
+	return status
+}
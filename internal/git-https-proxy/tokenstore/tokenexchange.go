@@ -0,0 +1,72 @@
+package tokenstore
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+	"github.com/SwissDataScienceCenter/amalthea/internal/oauth"
+)
+
+const (
+	tokenExchangeGrantType  = "urn:ietf:params:oauth:grant-type:token-exchange"
+	defaultSubjectTokenType = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// tokenExchangeBackend exchanges a token read from a file, e.g. a projected service account token,
+// for a git token at an OAuth2 token endpoint, see https://www.rfc-editor.org/rfc/rfc8693
+type tokenExchangeBackend struct {
+	client *http.Client
+}
+
+func newTokenExchangeBackend() *tokenExchangeBackend {
+	return &tokenExchangeBackend{client: &http.Client{Timeout: oauth.DefaultTimeout}}
+}
+
+func (b *tokenExchangeBackend) GetToken(provider config.GitProvider) (TokenSet, error) {
+	exchange := provider.TokenExchange
+	subjectToken, err := readTokenFile(exchange.SubjectTokenFile)
+	if err != nil {
+		return TokenSet{}, err
+	}
+	subjectTokenType := exchange.SubjectTokenType
+	if subjectTokenType == "" {
+		subjectTokenType = defaultSubjectTokenType
+	}
+	payload := url.Values{}
+	payload.Set("grant_type", tokenExchangeGrantType)
+	payload.Set("subject_token", subjectToken)
+	payload.Set("subject_token_type", subjectTokenType)
+	optional := map[string]string{
+		"requested_token_type": exchange.RequestedTokenType,
+		"audience":             exchange.Audience,
+		"resource":             exchange.Resource,
+		"scope":                exchange.Scope,
+	}
+	for key, value := range optional {
+		if value != "" {
+			payload.Set(key, value)
+		}
+	}
+	clientID, clientSecret := "", ""
+	if exchange.ClientID != "" {
+		if exchange.ClientSecretFile != "" {
+			if clientSecret, err = readTokenFile(exchange.ClientSecretFile); err != nil {
+				return TokenSet{}, err
+			}
+		}
+		// The client credentials are form encoded, see https://www.rfc-editor.org/rfc/rfc6749#section-2.3.1
+		clientID, clientSecret = url.QueryEscape(exchange.ClientID), url.QueryEscape(clientSecret)
+	}
+	response, err := oauth.RequestForm(context.Background(), b.client, exchange.TokenURL, payload, clientID, clientSecret)
+	if err != nil {
+		return TokenSet{}, err
+	}
+	tokenSet := TokenSet{AccessToken: response.AccessToken, Username: exchange.Username}
+	if response.ExpiresIn > 0 {
+		tokenSet.ExpiresAt = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second).Unix()
+	}
+	return tokenSet, nil
+}
@@ -0,0 +1,83 @@
+package tokenstore
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	configLib "github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+	"github.com/SwissDataScienceCenter/amalthea/internal/oauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenExchangeBackend(t *testing.T) {
+	dir := t.TempDir()
+	subjectTokenFile := filepath.Join(dir, "subject")
+	require.NoError(t, os.WriteFile(subjectTokenFile, []byte("subject-token"), 0o600))
+	clientSecretFile := filepath.Join(dir, "secret")
+	require.NoError(t, os.WriteFile(clientSecretFile, []byte("client-secret"), 0o600))
+
+	var exchanges atomic.Int32
+	handler := http.NewServeMux()
+	handler.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		exchanges.Add(1)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, tokenExchangeGrantType, r.PostForm.Get("grant_type"))
+		assert.Equal(t, "subject-token", r.PostForm.Get("subject_token"))
+		assert.Equal(t, defaultSubjectTokenType, r.PostForm.Get("subject_token_type"))
+		assert.False(t, r.PostForm.Has("scope"))
+		clientID, clientSecret, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "git-proxy", clientID)
+		assert.Equal(t, "client-secret", clientSecret)
+		if r.PostForm.Get("audience") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		assert.Equal(t, "https://gitlab.example.org", r.PostForm.Get("audience"))
+		_ = json.NewEncoder(w).Encode(oauth.Response{AccessToken: "exchanged-token", ExpiresIn: 3600})
+	})
+	serverURL, serverClose := setUpTestServer(handler)
+	defer serverClose()
+
+	config := configLib.GitProxyConfig{
+		Providers: []configLib.GitProvider{{
+			Id:   "exchange",
+			Type: configLib.TokenExchangeBackend,
+			TokenExchange: &configLib.TokenExchangeConfig{
+				TokenURL:         serverURL.JoinPath("/token").String(),
+				SubjectTokenFile: subjectTokenFile,
+				Audience:         "https://gitlab.example.org",
+				ClientID:         "git-proxy",
+				ClientSecretFile: clientSecretFile,
+				Username:         "git",
+			},
+		}},
+	}
+	store, err := New(&config)
+	require.NoError(t, err)
+	username, token, err := store.GetGitCredentials("exchange")
+	require.NoError(t, err)
+	assert.Equal(t, "git", username)
+	assert.Equal(t, "exchanged-token", token)
+	expiresAt := store.Status().Providers["exchange"].ExpiresAt
+	require.NotNil(t, expiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *expiresAt, time.Minute)
+
+	// The token is cached until it expires
+	_, _, err = store.GetGitCredentials("exchange")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), exchanges.Load())
+
+	// A refused exchange is reported
+	config.Providers[0].TokenExchange.Audience = ""
+	store, err = New(&config)
+	require.NoError(t, err)
+	_, err = store.GetGitAccessToken("exchange", false)
+	assert.ErrorContains(t, err, "400")
+}
@@ -2,22 +2,27 @@ package tokenstore
 
 import (
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
-	"net/url"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
 	"github.com/SwissDataScienceCenter/amalthea/internal/utils"
+	"golang.org/x/sync/singleflight"
 )
 
 type TokenSet struct {
 	AccessToken string
-	ExpiresAt   int64
+	// The expiry of the token as a unix timestamp, the token does not expire when it is 0
+	ExpiresAt int64
+	// The username used with the token, oauth2 when it is not set
+	Username string
+}
+
+// Backend gets the git tokens of a provider
+type Backend interface {
+	GetToken(provider config.GitProvider) (TokenSet, error)
 }
 
 type TokenStore struct {
@@ -31,239 +36,149 @@ type TokenStore struct {
 	// 30 seconds then the token is considered expired if it expires in the next 30 seconds.
 	ExpirationLeeway time.Duration
 
-	// The current renku access token
-	renkuAccessToken string
-	// The current renku refresh token
-	renkuRefreshToken string
-	// Ensures that the renku token is not refereshed
-	// twice at the same time. It also ensures that all other threads that need to simply
-	// read the token will wait until the refresh (write) is complete.
-	renkuAccessTokenLock *sync.RWMutex
-	// Channel that is populated by the timer that triggers the automated renku access token refresh
-	refreshTicker *time.Ticker
+	// The backend of each provider
+	backends map[string]Backend
+	// The renku backend, nil when no provider uses the renku tokens
+	renku *renkuBackend
 	// The current git access tokens for each provider
 	gitAccessTokens map[string]TokenSet
-	// Ensures that the git access token are not refreshed twice at the same time.
-	// Note: We use one lock for all tokens for simplicity.
+	// Protects gitAccessTokens, gitRefreshResults and gitTokenGenerations, it is not held while a backend
+	// is called so that a slow provider does not block the tokens of the other providers.
 	gitAccessTokensLock *sync.RWMutex
+	// The result of the last refresh of the token for each provider
+	gitRefreshResults map[string]RefreshResult
+	// Incremented when the token of a provider is invalidated, so that a refresh that started
+	// before does not store a token that is already stale
+	gitTokenGenerations map[string]uint64
+	// Ensures that the token of a provider is not refreshed twice at the same time
+	gitRefreshes singleflight.Group
 }
 
-func New(c *config.GitProxyConfig) *TokenStore {
-	providers := make(map[string]config.GitProvider, len(c.Providers))
-	for _, p := range c.Providers {
-		providers[p.Id] = p
-	}
-
+func New(c *config.GitProxyConfig) (*TokenStore, error) {
 	store := TokenStore{
-		Config:               c,
-		Providers:            providers,
-		RefreshTickerPeriod:  c.GetRefreshCheckPeriod(),
-		ExpirationLeeway:     c.GetExpirationLeeway(),
-		renkuAccessToken:     c.RenkuAccessToken,
-		renkuRefreshToken:    c.RenkuRefreshToken,
-		renkuAccessTokenLock: &sync.RWMutex{},
-		refreshTicker:        time.NewTicker(c.GetRefreshCheckPeriod()),
-		gitAccessTokens:      make(map[string]TokenSet, len(c.Providers)),
-		gitAccessTokensLock:  &sync.RWMutex{},
+		Config:              c,
+		Providers:           make(map[string]config.GitProvider, len(c.Providers)),
+		RefreshTickerPeriod: c.GetRefreshCheckPeriod(),
+		ExpirationLeeway:    c.GetExpirationLeeway(),
+		backends:            make(map[string]Backend, len(c.Providers)),
+		gitAccessTokens:     make(map[string]TokenSet, len(c.Providers)),
+		gitAccessTokensLock: &sync.RWMutex{},
+		gitRefreshResults:   make(map[string]RefreshResult, len(c.Providers)),
+		gitTokenGenerations: make(map[string]uint64, len(c.Providers)),
+	}
+	if c.UsesRenkuTokens() {
+		store.renku = newRenkuBackend(c)
+	}
+	for _, p := range c.Providers {
+		store.Providers[p.Id] = p
+		switch p.TokenBackend() {
+		case config.RenkuTokenBackend:
+			store.backends[p.Id] = store.renku
+		case config.StaticTokenBackend:
+			backend, err := newStaticBackend(p, func() { store.invalidate(p.Id) })
+			if err != nil {
+				return nil, err
+			}
+			store.backends[p.Id] = backend
+		case config.TokenExchangeBackend:
+			store.backends[p.Id] = newTokenExchangeBackend()
+		case config.GitHubAppBackend:
+			store.backends[p.Id] = newGitHubAppBackend()
+		default:
+			return nil, fmt.Errorf("the token backend %s of the provider %s is not supported", p.Type, p.Id)
+		}
 	}
-	// Start a go routine to keep the refresh token valid
-	go store.periodicTokenRefresh()
-	return &store
+	return &store, nil
 }
 
 // Returns a valid access token for the corresponding git provider.
-// If the token is expired, a new one will be retrieved using the renku access token.
+// If the token is expired, a new one will be retrieved from the backend of the provider.
 func (s *TokenStore) GetGitAccessToken(provider string, encode bool) (string, error) {
-	s.gitAccessTokensLock.RLock()
-	tokenSet, accessTokenExists := s.gitAccessTokens[provider]
-	accessTokenExpiresAt := time.Unix(tokenSet.ExpiresAt, 0).UTC()
-	s.gitAccessTokensLock.RUnlock()
-
-	if !accessTokenExists || !utils.IsNotExpired(accessTokenExpiresAt, s.ExpirationLeeway, false) {
-		log.Printf("Getting a fresh token for git provider: %s", provider)
-		if err := s.refreshGitAccessToken(provider); err != nil {
-			return "", err
-		}
+	username, token, err := s.GetGitCredentials(provider)
+	if err != nil {
+		return "", err
 	}
-
-	s.gitAccessTokensLock.RLock()
-	defer s.gitAccessTokensLock.RUnlock()
 	if encode {
-		return encodeGitCredentials(s.gitAccessTokens[provider].AccessToken), nil
+		return encodeGitCredentials(username, token), nil
 	}
-	return s.gitAccessTokens[provider].AccessToken, nil
-}
-
-type gitTokenRefreshResponse struct {
-	AccessToken string `json:"access_token"`
-	ExpiresAt   int64  `json:"expires_at"`
+	return token, nil
 }
 
-// Exchange the renku access token for the access token of the corresponding provider
-func (s *TokenStore) refreshGitAccessToken(provider string) error {
-	s.gitAccessTokensLock.Lock()
-	defer s.gitAccessTokensLock.Unlock()
-
-	providerURL := s.Providers[provider].AccessTokenUrl
+// Returns the username and a valid access token for the corresponding git provider.
+func (s *TokenStore) GetGitCredentials(provider string) (string, string, error) {
+	s.gitAccessTokensLock.RLock()
+	tokenSet, accessTokenExists := s.gitAccessTokens[provider]
+	s.gitAccessTokensLock.RUnlock()
 
-	req, err := http.NewRequest(http.MethodGet, providerURL, nil)
-	if err != nil {
-		return err
-	}
-	renkuAccessToken, err := s.getValidRenkuAccessToken()
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", renkuAccessToken))
-	// NOTE: Without the function below the authorization header is taken out before the request
-	// even hits the gateway proxy and therefore the token never reaches the gateway-auth module
-	// that swaps this authorization token for a gitlab token.
-	preserveAuthzHeader := func(req *http.Request, via []*http.Request) error {
-		if len(via) == 0 {
-			return nil
-		}
-		authz := via[0].Header.Get("Authorization")
-		if authz == "" {
-			return nil
+	if !accessTokenExists || !s.isValid(tokenSet) {
+		log.Printf("Getting a fresh token for git provider: %s", provider)
+		var err error
+		if tokenSet, err = s.refreshGitAccessToken(provider); err != nil {
+			return "", "", err
 		}
-		req.Header.Set("Authorization", authz)
-		return nil
-	}
-	c := http.Client{Timeout: time.Second * 30, CheckRedirect: preserveAuthzHeader}
-	res, err := c.Do(req)
-	if err != nil {
-		return err
-	}
-	if res.StatusCode != 200 {
-		return fmt.Errorf("cannot exchange renku token for git token, failed with staus code: %d", res.StatusCode)
-	}
-	var resParsed gitTokenRefreshResponse
-	err = json.NewDecoder(res.Body).Decode(&resParsed)
-	if err != nil {
-		return err
-	}
-	s.gitAccessTokens[provider] = TokenSet(resParsed)
-	return nil
-}
-
-// Returns a valid renku access token. If the token is expired, the token will be refreshed first.
-func (s *TokenStore) getValidRenkuAccessToken() (string, error) {
-	isValid, err := utils.VerifyJWTExpiresAt(s.getRenkuAccessToken(), s.ExpirationLeeway, false)
-
-	if err != nil {
-		return "", err
 	}
-	if !isValid {
-		if err = s.refreshRenkuAccessToken(); err != nil {
-			return "", err
-		}
+	username := tokenSet.Username
+	if username == "" {
+		username = defaultGitUsername
 	}
-	return s.getRenkuAccessToken(), nil
+	return username, tokenSet.AccessToken, nil
 }
 
-func (s *TokenStore) getRenkuAccessToken() string {
-	s.renkuAccessTokenLock.RLock()
-	defer s.renkuAccessTokenLock.RUnlock()
-	return s.renkuAccessToken
-}
+// The username used with the git tokens when the backend does not set one
+const defaultGitUsername = "oauth2"
 
-type renkuTokenRefreshResponse struct {
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
-}
-
-// Refreshes the renku access token.
-func (s *TokenStore) refreshRenkuAccessToken() error {
-	if s.Config.RenkuAuthenticationVersion == "v2" {
-		return s.refreshRenkuAccessTokenV2()
-	}
-	s.renkuAccessTokenLock.Lock()
-	defer s.renkuAccessTokenLock.Unlock()
-	payload := url.Values{}
-	payload.Add("grant_type", "refresh_token")
-	payload.Add("refresh_token", s.renkuRefreshToken)
-	body := strings.NewReader(payload.Encode())
-	req, err := http.NewRequest(http.MethodPost, s.Config.RenkuURL.JoinPath(fmt.Sprintf("auth/realms/%s/protocol/openid-connect/token", s.Config.RenkuRealm)).String(), body)
-	if err != nil {
-		return err
-	}
-	req.SetBasicAuth(s.Config.RenkuClientID, s.Config.RenkuClientSecret)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	if res.StatusCode != 200 {
-		err = fmt.Errorf("cannot refresh renku access token, failed with status code: %d", res.StatusCode)
-		return err
-	}
-	var resParsed renkuTokenRefreshResponse
-	err = json.NewDecoder(res.Body).Decode(&resParsed)
-	if err != nil {
-		return err
-	}
-	s.renkuAccessToken = resParsed.AccessToken
-	if resParsed.RefreshToken != "" {
-		s.renkuRefreshToken = resParsed.RefreshToken
+func (s *TokenStore) isValid(tokenSet TokenSet) bool {
+	if tokenSet.ExpiresAt == 0 {
+		return true
 	}
-	return nil
+	return utils.IsNotExpired(time.Unix(tokenSet.ExpiresAt, 0).UTC(), s.ExpirationLeeway, false)
 }
 
-func (s *TokenStore) refreshRenkuAccessTokenV2() error {
-	s.renkuAccessTokenLock.Lock()
-	defer s.renkuAccessTokenLock.Unlock()
+// Gets a new token for the corresponding provider from its backend
+func (s *TokenStore) refreshGitAccessToken(provider string) (TokenSet, error) {
+	tokenSet, err, _ := s.gitRefreshes.Do(provider, func() (any, error) {
+		s.gitAccessTokensLock.RLock()
+		tokenSet, exists := s.gitAccessTokens[provider]
+		generation := s.gitTokenGenerations[provider]
+		s.gitAccessTokensLock.RUnlock()
+		// Another request may have refreshed the token in the meantime
+		if exists && s.isValid(tokenSet) {
+			return tokenSet, nil
+		}
 
-	renkuTokenURL, err := url.Parse(s.Config.RenkuTokenURL)
-	if err != nil {
-		return err
-	}
-	payload := url.Values{}
-	payload.Set("grant_type", "refresh_token")
-	payload.Set("refresh_token", s.renkuRefreshToken)
-	req, err := http.NewRequest(http.MethodPost, renkuTokenURL.String(), strings.NewReader(payload.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	if err != nil {
-		return err
-	}
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	if res.StatusCode != 200 {
-		err = fmt.Errorf("cannot refresh renku access token, failed with status code: %d", res.StatusCode)
-		return err
-	}
-	var resParsed renkuTokenRefreshResponse
-	err = json.NewDecoder(res.Body).Decode(&resParsed)
-	if err != nil {
-		return err
-	}
-	s.renkuAccessToken = resParsed.AccessToken
-	s.renkuRefreshToken = resParsed.RefreshToken
-	return nil
-}
+		var err error
+		backend, exists := s.backends[provider]
+		if !exists {
+			err = fmt.Errorf("the provider %s is not configured", provider)
+		} else {
+			tokenSet, err = backend.GetToken(s.Providers[provider])
+		}
 
-// Periodically refreshes the renku access token. Used to make sure the refresh token does not expire.
-func (s *TokenStore) periodicTokenRefresh() {
-	for {
-		<-s.refreshTicker.C
-		s.renkuAccessTokenLock.RLock()
-		renkuRefreshToken := s.renkuRefreshToken
-		s.renkuAccessTokenLock.RUnlock()
-		refreshTokenIsValid, err := utils.VerifyJWTExpiresAt(renkuRefreshToken, s.ExpirationLeeway, false)
+		s.gitAccessTokensLock.Lock()
+		defer s.gitAccessTokensLock.Unlock()
+		s.gitRefreshResults[provider] = newRefreshResult(err)
 		if err != nil {
-			log.Printf("Could not check if renku refresh token is expired: %s\n", err.Error())
+			return TokenSet{}, err
 		}
-		if !refreshTokenIsValid {
-			log.Println("Getting a new renku refresh token from automatic checks")
-			err = s.refreshRenkuAccessToken()
-			if err != nil {
-				log.Printf("Could not refresh renku token: %s\n", err.Error())
-			}
+		if s.gitTokenGenerations[provider] == generation {
+			s.gitAccessTokens[provider] = tokenSet
 		}
+		return tokenSet, nil
+	})
+	if err != nil {
+		return TokenSet{}, err
 	}
+	return tokenSet.(TokenSet), nil
+}
+
+// Drops the cached token of a provider so that it is read again from its backend
+func (s *TokenStore) invalidate(provider string) {
+	s.gitAccessTokensLock.Lock()
+	defer s.gitAccessTokensLock.Unlock()
+	delete(s.gitAccessTokens, provider)
+	s.gitTokenGenerations[provider]++
 }
 
-func encodeGitCredentials(token string) string {
-	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("oauth2:%s", token)))
+func encodeGitCredentials(username string, token string) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, token)))
 }
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	configLib "github.com/SwissDataScienceCenter/amalthea/internal/git-https-proxy/config"
+	"github.com/SwissDataScienceCenter/amalthea/internal/oauth"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 )
@@ -46,7 +47,11 @@ func getTestConfig(renkuURL string, renkuAccessToken string, renkuRefreshToken s
 
 func getTestTokenStore(renkuURL string, renkuAccessToken string, renkuRefreshToken string) *TokenStore {
 	config := getTestConfig(renkuURL, renkuAccessToken, renkuRefreshToken)
-	return New(&config)
+	store, err := New(&config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return store
 }
 
 func setUpTestServer(handler http.Handler) (*url.URL, func()) {
@@ -58,7 +63,7 @@ func setUpTestServer(handler http.Handler) (*url.URL, func()) {
 	return tsURL, ts.Close
 }
 
-func setUpDummyRefreshEndpoints(gitRefreshResponse *gitTokenRefreshResponse, renkuRefreshResponse *renkuTokenRefreshResponse) (*url.URL, func()) {
+func setUpDummyRefreshEndpoints(gitRefreshResponse *oauth.Response, renkuRefreshResponse *oauth.Response) (*url.URL, func()) {
 	handler := http.NewServeMux()
 	gitHandlerFunc := func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Handling git token refresh request at %s", r.URL.String())
@@ -123,11 +128,11 @@ func TestSuccessfulRefresh(t *testing.T) {
 	assert.Nil(t, err)
 	oldRenkuRefreshToken, err := getDummyAccessToken(time.Now().Add(2 * time.Hour).Unix())
 	assert.Nil(t, err)
-	gitRefreshResponse := &gitTokenRefreshResponse{
+	gitRefreshResponse := &oauth.Response{
 		AccessToken: newGitToken,
 		ExpiresAt:   time.Now().Add(time.Hour).Unix(),
 	}
-	renkuRefreshResponse := &renkuTokenRefreshResponse{
+	renkuRefreshResponse := &oauth.Response{
 		AccessToken:  newRenkuToken,
 		RefreshToken: oldRenkuRefreshToken,
 	}
@@ -140,7 +145,7 @@ func TestSuccessfulRefresh(t *testing.T) {
 	gitToken, err := store.GetGitAccessToken("example", false)
 	assert.Nil(t, err)
 	assert.Equal(t, gitToken, newGitToken)
-	renkuAccessToken, err := store.getValidRenkuAccessToken()
+	renkuAccessToken, err := store.renku.getValidAccessToken()
 	assert.Nil(t, err)
 	assert.Equal(t, renkuAccessToken, newRenkuToken)
 
@@ -153,7 +158,7 @@ func TestSuccessfulRefresh(t *testing.T) {
 	gitToken, err = store.GetGitAccessToken("example", false)
 	assert.Nil(t, err)
 	assert.Equal(t, gitToken, newGitToken)
-	renkuAccessToken, err = store.getValidRenkuAccessToken()
+	renkuAccessToken, err = store.renku.getValidAccessToken()
 	assert.Nil(t, err)
 	assert.Equal(t, renkuAccessToken, newRenkuToken)
 }
@@ -164,7 +169,7 @@ func TestNoRefreshNeeded(t *testing.T) {
 	assert.Nil(t, err)
 	oldRenkuRefreshToken, err := getDummyAccessToken(time.Now().Add(2 * time.Hour).Unix())
 	assert.Nil(t, err)
-	gitRefreshResponse := &gitTokenRefreshResponse{
+	gitRefreshResponse := &oauth.Response{
 		AccessToken: newGitToken,
 		ExpiresAt:   time.Now().Add(time.Hour).Unix(),
 	}
@@ -176,7 +181,7 @@ func TestNoRefreshNeeded(t *testing.T) {
 	gitToken, err := store.GetGitAccessToken("example", false)
 	assert.Nil(t, err)
 	assert.Equal(t, newGitToken, gitToken)
-	renkuAccessToken, err := store.getValidRenkuAccessToken()
+	renkuAccessToken, err := store.renku.getValidAccessToken()
 	assert.Nil(t, err)
 	assert.Equal(t, renkuAccessToken, oldRenkuAccessToken)
 }
@@ -190,7 +195,7 @@ func TestAutomatedRefreshTokenRenewal(t *testing.T) {
 	assert.Nil(t, err)
 	oldRenkuRefreshToken, err := getDummyAccessToken(time.Now().Add(10 * time.Second).Unix())
 	assert.Nil(t, err)
-	renkuRefreshResponse := &renkuTokenRefreshResponse{
+	renkuRefreshResponse := &oauth.Response{
 		AccessToken:  newRenkuAccessToken,
 		RefreshToken: newRenkuRefreshToken,
 	}
@@ -200,11 +205,145 @@ func TestAutomatedRefreshTokenRenewal(t *testing.T) {
 
 	config := getTestConfig(authServerURL.String(), oldRenkuAccessToken, oldRenkuRefreshToken)
 	config.RefreshCheckPeriodSeconds = 2
-	store := New(&config)
-	assert.Equal(t, store.getRenkuAccessToken(), oldRenkuAccessToken)
-	assert.Equal(t, store.renkuRefreshToken, oldRenkuRefreshToken)
+	store, err := New(&config)
+	assert.Nil(t, err)
+	assert.Equal(t, store.renku.getAccessToken(), oldRenkuAccessToken)
+	assert.Equal(t, store.renku.getRefreshToken(), oldRenkuRefreshToken)
 	// Sleep to allow for automated token refresh to occur
 	time.Sleep(5 * time.Second)
-	assert.Equal(t, store.getRenkuAccessToken(), newRenkuAccessToken)
-	assert.Equal(t, store.renkuRefreshToken, newRenkuRefreshToken)
+	assert.Equal(t, store.renku.getAccessToken(), newRenkuAccessToken)
+	assert.Equal(t, store.renku.getRefreshToken(), newRenkuRefreshToken)
+}
+
+func TestStatus(t *testing.T) {
+	renkuAccessToken, err := getDummyAccessToken(time.Now().Add(-time.Hour).Unix())
+	assert.Nil(t, err)
+	renkuRefreshToken, err := getDummyAccessToken(time.Now().Add(2 * time.Hour).Unix())
+	assert.Nil(t, err)
+	gitRefreshResponse := &oauth.Response{AccessToken: "gitToken", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	// The renku token cannot be refreshed, so the git token cannot be exchanged
+	authServerURL, authServerClose := setUpDummyRefreshEndpoints(gitRefreshResponse, nil)
+	defer authServerClose()
+
+	store := getTestTokenStore(authServerURL.String(), renkuAccessToken, renkuRefreshToken)
+	status := store.Status()
+	assert.True(t, status.Healthy)
+	assert.True(t, status.Renku.RefreshTokenValid)
+	assert.NotNil(t, status.Renku.RefreshTokenExpiresAt)
+	assert.Nil(t, status.Renku.LastRefresh)
+	assert.Equal(t, ProviderStatus{}, status.Providers["example"])
+
+	_, err = store.GetGitAccessToken("example", false)
+	assert.NotNil(t, err)
+	status = store.Status()
+	assert.False(t, status.Healthy)
+	assert.NotEmpty(t, status.Renku.LastRefresh.Error)
+	assert.NotNil(t, status.Providers["example"].LastRefresh)
+	assert.NotEmpty(t, status.Providers["example"].LastRefresh.Error)
+
+	// The status recovers with a new renku access token
+	newRenkuAccessToken, err := getDummyAccessToken(time.Now().Add(time.Hour).Unix())
+	assert.Nil(t, err)
+	store.renku.source.Set(oauth.Token{AccessToken: newRenkuAccessToken, ExpiresAt: time.Now().Add(time.Hour), RefreshToken: renkuRefreshToken})
+	_, err = store.GetGitAccessToken("example", false)
+	assert.Nil(t, err)
+	status = store.Status()
+	assert.Empty(t, status.Providers["example"].LastRefresh.Error)
+	assert.NotNil(t, status.Providers["example"].ExpiresAt)
+
+	// An expired refresh token cannot be recovered
+	expiredRenkuRefreshToken, err := getDummyAccessToken(time.Now().Add(-time.Minute).Unix())
+	assert.Nil(t, err)
+	store.renku.source.Set(oauth.Token{AccessToken: newRenkuAccessToken, RefreshToken: expiredRenkuRefreshToken})
+	store.renku.refreshResult = nil
+	status = store.Status()
+	assert.False(t, status.Healthy)
+	assert.False(t, status.Renku.RefreshTokenValid)
+}
+
+func TestRenkuTokenWithoutExpiry(t *testing.T) {
+	renkuAccessToken, err := getDummyAccessToken(time.Now().Add(time.Hour).Unix())
+	assert.Nil(t, err)
+	renkuRefreshToken, err := getDummyAccessToken(time.Now().Add(2 * time.Hour).Unix())
+	assert.Nil(t, err)
+	gitRefreshResponse := &oauth.Response{AccessToken: "gitToken"}
+	authServerURL, authServerClose := setUpDummyRefreshEndpoints(gitRefreshResponse, nil)
+	defer authServerClose()
+
+	store := getTestTokenStore(authServerURL.String(), renkuAccessToken, renkuRefreshToken)
+	gitToken, err := store.GetGitAccessToken("example", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "gitToken", gitToken)
+	// The token is reused for a short time instead of being exchanged for every request
+	gitRefreshResponse.AccessToken = "otherGitToken"
+	gitToken, err = store.GetGitAccessToken("example", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "gitToken", gitToken)
+	expiresAt := time.Unix(store.gitAccessTokens["example"].ExpiresAt, 0)
+	assert.WithinDuration(t, time.Now().Add(store.ExpirationLeeway+renkuGitTokenDefaultLifetime), expiresAt, 5*time.Second)
+}
+
+type blockingBackend struct {
+	release chan struct{}
+	calls   chan struct{}
+}
+
+func (b blockingBackend) GetToken(provider configLib.GitProvider) (TokenSet, error) {
+	b.calls <- struct{}{}
+	<-b.release
+	return TokenSet{AccessToken: "slow-token"}, nil
+}
+
+type constantBackend string
+
+func (b constantBackend) GetToken(provider configLib.GitProvider) (TokenSet, error) {
+	return TokenSet{AccessToken: string(b)}, nil
+}
+
+func TestRefreshDoesNotBlockOtherProviders(t *testing.T) {
+	store := getTestTokenStore("https://renku.example.org", "", "")
+	slow := blockingBackend{release: make(chan struct{}), calls: make(chan struct{}, 2)}
+	store.Providers = map[string]configLib.GitProvider{"slow": {Id: "slow"}, "fast": {Id: "fast"}}
+	store.backends = map[string]Backend{"slow": slow, "fast": constantBackend("fast-token")}
+
+	results := make(chan string, 2)
+	for range 2 {
+		go func() {
+			token, _ := store.GetGitAccessToken("slow", false)
+			results <- token
+		}()
+	}
+	<-slow.calls
+
+	// The other providers and the status are served while the slow backend is called
+	token, err := store.GetGitAccessToken("fast", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "fast-token", token)
+	assert.Contains(t, store.Status().Providers, "slow")
+
+	close(slow.release)
+	assert.Equal(t, "slow-token", <-results)
+	assert.Equal(t, "slow-token", <-results)
+	// The concurrent requests for the same provider share a single call to the backend
+	assert.Len(t, slow.calls, 0)
+}
+
+func TestInvalidateDuringRefresh(t *testing.T) {
+	store := getTestTokenStore("https://renku.example.org", "", "")
+	slow := blockingBackend{release: make(chan struct{}), calls: make(chan struct{}, 1)}
+	store.Providers = map[string]configLib.GitProvider{"slow": {Id: "slow"}}
+	store.backends = map[string]Backend{"slow": slow}
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = store.GetGitAccessToken("slow", false)
+		close(done)
+	}()
+	<-slow.calls
+	store.invalidate("slow")
+	close(slow.release)
+	<-done
+	// The token read before the invalidation is not cached
+	_, exists := store.gitAccessTokens["slow"]
+	assert.False(t, exists)
 }
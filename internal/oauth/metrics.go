@@ -0,0 +1,51 @@
+package oauth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// refreshesTotal counts the token refreshes by source and result
+	refreshesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amalthea_oauth_token_refreshes_total",
+			Help: "Number of token refreshes by token source and result",
+		},
+		[]string{"source", "result"},
+	)
+
+	// refreshDuration tracks the latency of the token refreshes, including the retries
+	refreshDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "amalthea_oauth_token_refresh_duration_seconds",
+			Help:    "Duration in seconds of the token refreshes by token source",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"source"},
+	)
+)
+
+// The metrics of the token sources have their own registry, the processes that use them serve it
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(refreshesTotal, refreshDuration)
+}
+
+// MetricsHandler serves the metrics of the token sources in the Prometheus format
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+func observeRefresh(source string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	refreshesTotal.WithLabelValues(source, result).Inc()
+	refreshDuration.WithLabelValues(source).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,141 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The maximum size of a token response
+const maxResponseSize = 1024 * 1024
+
+// StatusError is returned when the server refuses a token request
+type StatusError struct {
+	Message    string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s, failed with status code: %d", e.Message, e.StatusCode)
+}
+
+// Response is the response of an OAuth 2.0 token endpoint, expires_at is not part of the
+// standard but is returned by the Renku token exchange.
+type Response struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	ExpiresAt    int64  `json:"expires_at"`
+}
+
+// Token returns the token of the response, see Expiry for how the expiry is determined
+func (r Response) Token() Token {
+	return Token{
+		AccessToken:  r.AccessToken,
+		ExpiresAt:    Expiry(r.AccessToken, r.ExpiresAt, r.ExpiresIn),
+		RefreshToken: r.RefreshToken,
+	}
+}
+
+// Expiry returns the expiry of a token from its "exp" claim when it is a JWT, otherwise from the expires_at
+// unix timestamp or the expires_in seconds of the response. The zero time is returned when none is known.
+func Expiry(accessToken string, expiresAt int64, expiresIn int64) time.Time {
+	if expiry, ok := JWTExpiry(accessToken); ok {
+		return expiry
+	}
+	if expiresAt > 0 {
+		return time.Unix(expiresAt, 0)
+	}
+	if expiresIn > 0 {
+		return time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
+	return time.Time{}
+}
+
+// JWTExpiry returns the "exp" claim of a JWT, it is not verified
+func JWTExpiry(token string) (time.Time, bool) {
+	claims := jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil || claims.ExpiresAt == nil {
+		return time.Time{}, false
+	}
+	return claims.ExpiresAt.Time, true
+}
+
+// Do sends a token request and decodes the JSON response into v, a StatusError is returned
+// when the response is not successful.
+func Do(client *http.Client, req *http.Request, v any) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return &StatusError{Message: fmt.Sprintf("the token request to %s was refused", req.URL.Redacted()), StatusCode: res.StatusCode}
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, maxResponseSize)).Decode(v)
+}
+
+// RequestForm posts a form to a token endpoint, the client is authenticated with basic authentication
+// when clientID is not empty.
+func RequestForm(ctx context.Context, client *http.Client, tokenURL string, form url.Values, clientID, clientSecret string) (Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Response{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientID != "" {
+		req.SetBasicAuth(clientID, clientSecret)
+	}
+	var response Response
+	if err := Do(client, req, &response); err != nil {
+		return Response{}, err
+	}
+	return response, nil
+}
+
+// ExchangeRenkuToken exchanges a renku access token for the token of a git provider or of a remote
+// service at the URL of its token endpoint in Renku.
+func ExchangeRenkuToken(ctx context.Context, client *http.Client, tokenURL, renkuAccessToken string) (Token, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL, nil)
+	if err != nil {
+		return Token{}, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", renkuAccessToken))
+	exchangeClient := http.Client{Timeout: DefaultTimeout}
+	if client != nil {
+		exchangeClient = *client
+	}
+	if exchangeClient.CheckRedirect == nil {
+		exchangeClient.CheckRedirect = PreserveAuthorization
+	}
+	var response Response
+	if err := Do(&exchangeClient, req, &response); err != nil {
+		return Token{}, err
+	}
+	return response.Token(), nil
+}
+
+// PreserveAuthorization keeps the authorization header on redirects.
+// NOTE: Without it the authorization header is taken out before the request even hits the gateway
+// proxy and therefore the token never reaches the gateway-auth module that swaps this authorization
+// token for a gitlab token.
+func PreserveAuthorization(req *http.Request, via []*http.Request) error {
+	if len(via) == 0 {
+		return nil
+	}
+	authz := via[0].Header.Get("Authorization")
+	if authz == "" {
+		return nil
+	}
+	req.Header.Set("Authorization", authz)
+	return nil
+}
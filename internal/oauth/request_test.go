@@ -0,0 +1,74 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiry(t *testing.T) {
+	jwtExpiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(jwtExpiry)}).SignedString([]byte("secret"))
+	require.NoError(t, err)
+	expiresAt := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+
+	assert.True(t, jwtExpiry.Equal(Expiry(token, expiresAt.Unix(), 60)))
+	assert.True(t, expiresAt.Equal(Expiry("opaque", expiresAt.Unix(), 60)))
+	assert.WithinDuration(t, time.Now().Add(time.Minute), Expiry("opaque", 0, 60), time.Second)
+	assert.True(t, Expiry("opaque", 0, 0).IsZero())
+}
+
+func TestExchangeRenkuToken(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	handler := http.NewServeMux()
+	handler.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/token", http.StatusFound)
+	})
+	handler.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer renku-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(Response{AccessToken: "git-token", ExpiresAt: expiresAt.Unix()})
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// The authorization header is kept on redirects
+	token, err := ExchangeRenkuToken(context.Background(), nil, server.URL+"/redirect", "renku-token")
+	require.NoError(t, err)
+	assert.Equal(t, "git-token", token.AccessToken)
+	assert.True(t, expiresAt.Equal(token.ExpiresAt))
+
+	_, err = ExchangeRenkuToken(context.Background(), nil, server.URL+"/token", "other-token")
+	var statusError *StatusError
+	require.ErrorAs(t, err, &statusError)
+	assert.Equal(t, http.StatusUnauthorized, statusError.StatusCode)
+}
+
+func TestRequestForm(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "refresh_token", r.PostForm.Get("grant_type"))
+		clientID, clientSecret, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "client", clientID)
+		assert.Equal(t, "secret", clientSecret)
+		_ = json.NewEncoder(w).Encode(Response{AccessToken: "access", RefreshToken: "refresh", ExpiresIn: 300})
+	}))
+	defer server.Close()
+
+	response, err := RequestForm(context.Background(), http.DefaultClient, server.URL, url.Values{"grant_type": {"refresh_token"}}, "client", "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "access", response.AccessToken)
+	assert.Equal(t, "refresh", response.RefreshToken)
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), response.Token().ExpiresAt, time.Second)
+}
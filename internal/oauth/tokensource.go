@@ -0,0 +1,203 @@
+// Package oauth provides the refreshing token sources shared by the git proxy, the cloner
+// and the remote session controller.
+package oauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/SwissDataScienceCenter/amalthea/internal/utils"
+)
+
+const (
+	// DefaultLeeway is the margin before the expiry at which a token is refreshed
+	DefaultLeeway = 10 * time.Second
+	// DefaultTimeout bounds a single token request
+	DefaultTimeout = 30 * time.Second
+)
+
+// Token is an access token with its expiry
+type Token struct {
+	AccessToken string
+	// The expiry of the token, the zero time when it is unknown
+	ExpiresAt time.Time
+	// The refresh token returned with the access token, if any
+	RefreshToken string
+}
+
+// FetchFunc gets a new token
+type FetchFunc func(ctx context.Context) (Token, error)
+
+// TokenSource caches the token returned by a FetchFunc and fetches a new one when it expires.
+// It is safe for concurrent use, concurrent callers share a single refresh.
+type TokenSource struct {
+	// The name of the source in the logs and metrics
+	name  string
+	fetch FetchFunc
+	// Safety margin for when to consider a token expired
+	leeway time.Duration
+	// True when a token without an expiry is considered expired
+	expiryRequired bool
+	// The number of attempts and the delay before the first retry, which doubles with every attempt
+	attempts     int
+	retryBackoff time.Duration
+	timeout      time.Duration
+
+	lock  sync.RWMutex
+	token Token
+	group singleflight.Group
+}
+
+// TokenSourceOption allows setting options
+type TokenSourceOption func(*TokenSource)
+
+// WithLeeway sets the margin before the expiry at which the token is refreshed
+func WithLeeway(leeway time.Duration) TokenSourceOption {
+	return func(s *TokenSource) {
+		s.leeway = leeway
+	}
+}
+
+// WithExpiryRequired fetches a new token on every call when the expiry of the token is unknown
+func WithExpiryRequired() TokenSourceOption {
+	return func(s *TokenSource) {
+		s.expiryRequired = true
+	}
+}
+
+// WithRetry retries the failed requests, the errors returned by the server for the invalid
+// requests (4xx except 429) are not retried.
+func WithRetry(attempts int, backoff time.Duration) TokenSourceOption {
+	return func(s *TokenSource) {
+		s.attempts = max(attempts, 1)
+		s.retryBackoff = backoff
+	}
+}
+
+// WithTimeout bounds each attempt to fetch a token
+func WithTimeout(timeout time.Duration) TokenSourceOption {
+	return func(s *TokenSource) {
+		s.timeout = timeout
+	}
+}
+
+// WithInitialToken sets the token used until it expires
+func WithInitialToken(token Token) TokenSourceOption {
+	return func(s *TokenSource) {
+		s.token = token
+	}
+}
+
+func NewTokenSource(name string, fetch FetchFunc, options ...TokenSourceOption) *TokenSource {
+	source := &TokenSource{
+		name:     name,
+		fetch:    fetch,
+		leeway:   DefaultLeeway,
+		attempts: 1,
+		timeout:  DefaultTimeout,
+	}
+	for _, opt := range options {
+		opt(source)
+	}
+	return source
+}
+
+// Token returns a valid token, a new token is fetched when the current one is expired
+func (s *TokenSource) Token(ctx context.Context) (Token, error) {
+	if token := s.Current(); s.valid(token) {
+		return token, nil
+	}
+	return s.Refresh(ctx)
+}
+
+// AccessToken returns a valid access token
+func (s *TokenSource) AccessToken(ctx context.Context) (string, error) {
+	token, err := s.Token(ctx)
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// Current returns the current token without refreshing it
+func (s *TokenSource) Current() Token {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.token
+}
+
+// Refresh fetches a new token, the callers that refresh at the same time share the result
+func (s *TokenSource) Refresh(ctx context.Context) (Token, error) {
+	// NOTE: the refresh is shared, so it is not cancelled by one of the callers
+	ctx = context.WithoutCancel(ctx)
+	result, err, _ := s.group.Do("refresh", func() (any, error) {
+		start := time.Now()
+		token, err := s.fetchWithRetry(ctx)
+		observeRefresh(s.name, start, err)
+		if err != nil {
+			return Token{}, err
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		// Keep the refresh token when the server does not rotate it
+		if token.RefreshToken == "" {
+			token.RefreshToken = s.token.RefreshToken
+		}
+		s.token = token
+		return token, nil
+	})
+	return result.(Token), err
+}
+
+// Set replaces the current token, e.g. with a token received from another component
+func (s *TokenSource) Set(token Token) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.token = token
+}
+
+// Invalidate drops the current access token, the next call fetches a new one
+func (s *TokenSource) Invalidate() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.token.AccessToken = ""
+}
+
+func (s *TokenSource) valid(token Token) bool {
+	return token.AccessToken != "" && utils.IsNotExpired(token.ExpiresAt, s.leeway, s.expiryRequired)
+}
+
+func (s *TokenSource) fetchWithRetry(ctx context.Context) (Token, error) {
+	backoff := s.retryBackoff
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeoutCause(ctx, s.timeout, fmt.Errorf("the %s token request timed out", s.name))
+		token, err := s.fetch(attemptCtx)
+		cancel()
+		if err == nil || attempt >= s.attempts || !retryable(err) {
+			return token, err
+		}
+		slog.Warn("cannot fetch token, retrying", "source", s.name, "attempt", attempt, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return Token{}, err
+		}
+		backoff *= 2
+	}
+}
+
+// retryable returns false for the errors that will not go away by trying again
+func retryable(err error) bool {
+	var statusError *StatusError
+	if errors.As(err, &statusError) {
+		return statusError.StatusCode >= http.StatusInternalServerError || statusError.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenSourceCachesUntilExpiry(t *testing.T) {
+	var fetches atomic.Int32
+	source := NewTokenSource("test", func(ctx context.Context) (Token, error) {
+		fetches.Add(1)
+		return Token{AccessToken: "token", ExpiresAt: time.Now().Add(time.Hour), RefreshToken: "refresh"}, nil
+	})
+	for range 3 {
+		token, err := source.AccessToken(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "token", token)
+	}
+	assert.Equal(t, int32(1), fetches.Load())
+
+	// Within the leeway the token is refreshed
+	source.Set(Token{AccessToken: "old", ExpiresAt: time.Now().Add(5 * time.Second)})
+	token, err := source.AccessToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token", token)
+	assert.Equal(t, int32(2), fetches.Load())
+
+	source.Invalidate()
+	_, err = source.AccessToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), fetches.Load())
+}
+
+func TestTokenSourceUnknownExpiry(t *testing.T) {
+	var fetches atomic.Int32
+	fetch := func(ctx context.Context) (Token, error) {
+		fetches.Add(1)
+		return Token{AccessToken: "token"}, nil
+	}
+	source := NewTokenSource("test", fetch)
+	_, _ = source.AccessToken(context.Background())
+	_, _ = source.AccessToken(context.Background())
+	assert.Equal(t, int32(1), fetches.Load())
+
+	fetches.Store(0)
+	source = NewTokenSource("test", fetch, WithExpiryRequired())
+	_, _ = source.AccessToken(context.Background())
+	_, _ = source.AccessToken(context.Background())
+	assert.Equal(t, int32(2), fetches.Load())
+}
+
+func TestTokenSourceSharesRefresh(t *testing.T) {
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	source := NewTokenSource("test", func(ctx context.Context) (Token, error) {
+		fetches.Add(1)
+		<-release
+		return Token{AccessToken: "token", ExpiresAt: time.Now().Add(time.Hour)}, nil
+	})
+	wg := sync.WaitGroup{}
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := source.AccessToken(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, "token", token)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), fetches.Load())
+}
+
+func TestTokenSourceKeepsRefreshToken(t *testing.T) {
+	source := NewTokenSource("test", func(ctx context.Context) (Token, error) {
+		return Token{AccessToken: "new"}, nil
+	}, WithInitialToken(Token{AccessToken: "old", RefreshToken: "refresh"}))
+	token, err := source.Refresh(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "new", token.AccessToken)
+	assert.Equal(t, "refresh", source.Current().RefreshToken)
+}
+
+func TestTokenSourceRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		fetches int32
+	}{
+		{name: "network error", err: errors.New("connection refused"), fetches: 3},
+		{name: "server error", err: &StatusError{Message: "unavailable", StatusCode: http.StatusServiceUnavailable}, fetches: 3},
+		{name: "rate limited", err: &StatusError{Message: "slow down", StatusCode: http.StatusTooManyRequests}, fetches: 3},
+		{name: "invalid grant", err: &StatusError{Message: "invalid", StatusCode: http.StatusBadRequest}, fetches: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			source := NewTokenSource("test", func(ctx context.Context) (Token, error) {
+				fetches.Add(1)
+				return Token{}, tt.err
+			}, WithRetry(3, time.Millisecond))
+			_, err := source.AccessToken(context.Background())
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.fetches, fetches.Load())
+		})
+	}
+
+	var fetches atomic.Int32
+	source := NewTokenSource("test", func(ctx context.Context) (Token, error) {
+		if fetches.Add(1) < 2 {
+			return Token{}, errors.New("connection reset")
+		}
+		return Token{AccessToken: "token"}, nil
+	}, WithRetry(3, time.Millisecond))
+	token, err := source.AccessToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token", token)
+}
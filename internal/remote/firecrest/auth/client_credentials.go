@@ -20,11 +20,9 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"sync"
-	"time"
 
+	"github.com/SwissDataScienceCenter/amalthea/internal/oauth"
 	sharedAuth "github.com/SwissDataScienceCenter/amalthea/internal/remote/auth/shared"
-	"github.com/SwissDataScienceCenter/amalthea/internal/utils"
 )
 
 // FirecrestClientCredentialsAuth implements the "Client Credentials Grant"
@@ -37,13 +35,8 @@ type FirecrestClientCredentialsAuth struct {
 	// clientSecret the client secret used for the "Client Credentials Grant" authentication flow
 	clientSecret string
 
-	// accessToken is the current access token
-	accessToken string
-	// accessTokenExpiresAt is when the access token expires
-	accessTokenExpiresAt time.Time
-	// accessTokenLock ensures that we do not try to refresh
-	// the accessToken twice at the same time.
-	accessTokenLock *sync.RWMutex
+	// source provides the access tokens and refreshes them when they expire
+	source *oauth.TokenSource
 
 	// httpClient is the HTTP client used to obtain access tokens
 	httpClient *http.Client
@@ -54,12 +47,9 @@ var _ FirecrestAuth = (*FirecrestClientCredentialsAuth)(nil)
 
 func newFirecrestClientCredentialsAuth(tokenURI, clientID, clientSecret string, options ...FirecrestClientCredentialsAuthOption) (auth *FirecrestClientCredentialsAuth, err error) {
 	auth = &FirecrestClientCredentialsAuth{
-		tokenURI:             tokenURI,
-		clientID:             clientID,
-		clientSecret:         clientSecret,
-		accessToken:          "",
-		accessTokenExpiresAt: time.Time{},
-		accessTokenLock:      &sync.RWMutex{},
+		tokenURI:     tokenURI,
+		clientID:     clientID,
+		clientSecret: clientSecret,
 	}
 	for _, opt := range options {
 		if err := opt(auth); err != nil {
@@ -80,6 +70,7 @@ func newFirecrestClientCredentialsAuth(tokenURI, clientID, clientSecret string,
 	if auth.httpClient == nil {
 		auth.httpClient = http.DefaultClient
 	}
+	auth.source = oauth.NewTokenSource("firecrest", auth.requestAccessToken, oauth.WithRetry(tokenRequestAttempts, tokenRequestBackoff))
 	return auth, nil
 }
 
@@ -93,39 +84,9 @@ func (a *FirecrestClientCredentialsAuth) RequestEditor() sharedAuth.RequestEdito
 }
 
 func (a *FirecrestClientCredentialsAuth) GetAccessToken(ctx context.Context) (token string, err error) {
-	a.accessTokenLock.RLock()
-	token = a.accessToken
-	expiresAt := a.accessTokenExpiresAt
-	a.accessTokenLock.RUnlock()
-
-	// Return the current token if it is still valid
-	if token != "" && (utils.IsNotExpired(expiresAt, 10*time.Second, false)) {
-		return token, nil
-	}
-
-	// Refresh the token
-	if err := a.refreshAccessToken(ctx); err != nil {
-		return token, err
-	}
-	a.accessTokenLock.RLock()
-	defer a.accessTokenLock.RUnlock()
-	return a.accessToken, nil
+	return a.source.AccessToken(ctx)
 }
 
-func (a *FirecrestClientCredentialsAuth) refreshAccessToken(ctx context.Context) error {
-	a.accessTokenLock.Lock()
-	defer a.accessTokenLock.Unlock()
-
-	// NOTE: we do not let the refresh request be cancelled by the caller
-	refreshCtx, cancel := context.WithTimeoutCause(context.WithoutCancel(ctx), 30*time.Second, fmt.Errorf("authentication request timed out"))
-	defer cancel()
-
-	result, err := requestNewAccessToken(refreshCtx, a.httpClient, a.tokenURI, "client_credentials", a.clientID, a.clientSecret, "")
-	if err != nil {
-		return err
-	}
-
-	a.accessToken = result.AccessToken
-	a.accessTokenExpiresAt = result.ExpiresAt
-	return nil
+func (a *FirecrestClientCredentialsAuth) requestAccessToken(ctx context.Context) (oauth.Token, error) {
+	return requestNewAccessToken(ctx, a.httpClient, a.tokenURI, "client_credentials", a.clientID, a.clientSecret, "")
 }
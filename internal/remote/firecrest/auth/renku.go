@@ -18,18 +18,15 @@ package auth
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
-	"strings"
-	"sync"
 	"time"
 
+	"github.com/SwissDataScienceCenter/amalthea/internal/oauth"
 	sharedAuth "github.com/SwissDataScienceCenter/amalthea/internal/remote/auth/shared"
 	"github.com/SwissDataScienceCenter/amalthea/internal/utils"
-	"github.com/golang-jwt/jwt/v5"
 )
 
 // RenkuAuth implements authentication as used in Renku:
@@ -43,28 +40,16 @@ type RenkuAuth struct {
 
 	// renkuAuthenticationVersion is equal to "v2" when using internal tokens
 	renkuAuthenticationVersion string
-	// renkuAccessToken the current renku access token
-	renkuAccessToken string
-	// renkuAccessTokenExpiresAt is when the renku access token expires
-	renkuAccessTokenExpiresAt time.Time
-	// renkuRefreshToken the current renku refresh token
-	renkuRefreshToken string
 	// renkuTokenURI the URI used for obtaining new renku tokens
 	renkuTokenURI string
 	// renkuClientID the client ID to which the access token and refresh tokens were issued to
 	renkuClientID string
 	// renkuClientSecret the client secret for the client ID
 	renkuClientSecret string
-	// renkuAccessTokenLock ensures that we do not try to refresh
-	// the renkuAccessToken twice at the same time.
-	renkuAccessTokenLock *sync.RWMutex
-	// accessToken is the current access token
-	accessToken string
-	// accessTokenExpiresAt is when the access token expires
-	accessTokenExpiresAt time.Time
-	// accessTokenLock ensures that we do not try to refresh
-	// the accessToken twice at the same time.
-	accessTokenLock *sync.RWMutex
+	// renkuSource provides the renku access and refresh tokens
+	renkuSource *oauth.TokenSource
+	// source provides the access tokens for the FirecREST API
+	source *oauth.TokenSource
 	// refreshTicker to automate renku access token refresh
 	refreshTicker *time.Ticker
 
@@ -79,16 +64,9 @@ func newRenkuAuth(firecrestTokenURI, renkuAuthenticationVersion, renkuAccessToke
 	auth = &RenkuAuth{
 		firecrestTokenURI:          firecrestTokenURI,
 		renkuAuthenticationVersion: renkuAuthenticationVersion,
-		renkuAccessToken:           renkuAccessToken,
-		renkuAccessTokenExpiresAt:  time.Time{},
-		renkuRefreshToken:          renkuRefreshToken,
 		renkuTokenURI:              renkuTokenURI,
 		renkuClientID:              renkuClientID,
 		renkuClientSecret:          renkuClientSecret,
-		renkuAccessTokenLock:       &sync.RWMutex{},
-		accessToken:                "",
-		accessTokenExpiresAt:       time.Time{},
-		accessTokenLock:            &sync.RWMutex{},
 	}
 	for _, opt := range options {
 		if err := opt(auth); err != nil {
@@ -111,19 +89,21 @@ func newRenkuAuth(firecrestTokenURI, renkuAuthenticationVersion, renkuAccessToke
 	if renkuAuthenticationVersion != "v2" && renkuClientSecret == "" {
 		return nil, fmt.Errorf("renkuClientSecret is not set")
 	}
-	if renkuAuthenticationVersion == "v2" {
-		parser := jwt.NewParser()
-		claims := jwt.RegisteredClaims{}
-		_, _, err := parser.ParseUnverified(auth.renkuAccessToken, &claims)
-		if err == nil {
-			auth.renkuAccessTokenExpiresAt = claims.ExpiresAt.Time
-		}
-	}
 	// Create httpClient, if not already present
 	if auth.httpClient == nil {
 		auth.httpClient = http.DefaultClient
 	}
 
+	initialToken := oauth.Token{AccessToken: renkuAccessToken, RefreshToken: renkuRefreshToken}
+	initialToken.ExpiresAt, _ = oauth.JWTExpiry(renkuAccessToken)
+	auth.renkuSource = oauth.NewTokenSource(
+		"renku",
+		auth.requestRenkuAccessToken,
+		oauth.WithInitialToken(initialToken),
+		oauth.WithRetry(tokenRequestAttempts, tokenRequestBackoff),
+	)
+	auth.source = oauth.NewTokenSource("firecrest", auth.requestAccessToken, oauth.WithRetry(tokenRequestAttempts, tokenRequestBackoff))
+
 	auth.refreshTicker = time.NewTicker(time.Duration(60) * time.Second)
 	// Start a go routine to keep the refresh token valid
 	go auth.periodicTokenRefresh()
@@ -141,174 +121,40 @@ func (a *RenkuAuth) RequestEditor() sharedAuth.RequestEditorFn {
 }
 
 func (a *RenkuAuth) GetAccessToken(ctx context.Context) (token string, err error) {
-	a.accessTokenLock.RLock()
-	token = a.accessToken
-	expiresAt := a.accessTokenExpiresAt
-	a.accessTokenLock.RUnlock()
-
-	// Return the current token if it is still valid
-	if token != "" && (utils.IsNotExpired(expiresAt, 10*time.Second, false)) {
-		return token, nil
-	}
-
-	// Refresh the token
-	if err := a.refreshAccessToken(ctx); err != nil {
-		return token, err
-	}
-	a.accessTokenLock.RLock()
-	defer a.accessTokenLock.RUnlock()
-	return a.accessToken, nil
-}
-
-func (a *RenkuAuth) refreshAccessToken(ctx context.Context) error {
-	renkuAccessToken, err := a.getRenkuAccessToken(ctx)
-	if err != nil {
-		return err
-	}
-
-	a.accessTokenLock.Lock()
-	defer a.accessTokenLock.Unlock()
-
-	childCtx, cancel := context.WithTimeoutCause(ctx, 30*time.Second, fmt.Errorf("authentication request timed out"))
-	defer cancel()
-
-	result, err := requestNewAccessTokenFromRenku(childCtx, a.httpClient, a.firecrestTokenURI, renkuAccessToken)
-	if err != nil {
-		return err
-	}
-
-	a.accessToken = result.AccessToken
-	a.accessTokenExpiresAt = result.ExpiresAt
-	return nil
-}
-
-func requestNewAccessTokenFromRenku(ctx context.Context, httpClient *http.Client, tokenURI, renkuAccessToken string) (result tokenResult, err error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURI, nil)
-	if err != nil {
-		return tokenResult{}, err
-	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", renkuAccessToken))
-	res, err := httpClient.Do(req)
-	if err != nil {
-		return tokenResult{}, err
-	}
-	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return tokenResult{}, fmt.Errorf("token request failed: %s", res.Status)
-	}
-	tokenResponse, err := parseTokenResponse(res)
-	if err != nil {
-		return tokenResult{}, err
-	}
-	expiresAt, err := getJWTExpiresAt(tokenResponse.AccessToken)
-	if err != nil {
-		expiresAt = time.Now().Add(time.Second * time.Duration(tokenResponse.ExpiresIn))
-	}
-	return tokenResult{
-		AccessToken:  tokenResponse.AccessToken,
-		ExpiresAt:    expiresAt,
-		RefreshToken: tokenResponse.RefreshToken,
-	}, nil
+	return a.source.AccessToken(ctx)
 }
 
-func (a *RenkuAuth) getRenkuAccessToken(ctx context.Context) (token string, err error) {
-	a.renkuAccessTokenLock.RLock()
-	token = a.renkuAccessToken
-	expiresAt := a.renkuAccessTokenExpiresAt
-	a.renkuAccessTokenLock.RUnlock()
-
-	// Return the current token if it is still valid
-	if token != "" && (utils.IsNotExpired(expiresAt, 10*time.Second, false)) {
-		return token, nil
-	}
-
-	// Refresh the token
-	if err := a.refreshRenkuAccessToken(ctx); err != nil {
-		return token, err
-	}
-	a.renkuAccessTokenLock.RLock()
-	defer a.renkuAccessTokenLock.RUnlock()
-	return a.renkuAccessToken, nil
-}
-
-func (a *RenkuAuth) refreshRenkuAccessToken(ctx context.Context) error {
-	if a.renkuAuthenticationVersion == "v2" {
-		return a.refreshRenkuAccessTokenV2(ctx)
-	}
-
-	a.renkuAccessTokenLock.Lock()
-	defer a.renkuAccessTokenLock.Unlock()
-
-	// NOTE: we do not let the refresh request be cancelled by the caller
-	refreshCtx, cancel := context.WithTimeoutCause(context.WithoutCancel(ctx), 30*time.Second, fmt.Errorf("authentication request timed out"))
-	defer cancel()
-
-	result, err := requestNewAccessToken(refreshCtx, a.httpClient, a.renkuTokenURI, "refresh_token", a.renkuClientID, a.renkuClientSecret, a.renkuRefreshToken)
+// requestAccessToken exchanges the renku access token for a FirecREST access token
+func (a *RenkuAuth) requestAccessToken(ctx context.Context) (oauth.Token, error) {
+	renkuAccessToken, err := a.renkuSource.AccessToken(ctx)
 	if err != nil {
-		return err
+		return oauth.Token{}, err
 	}
-
-	a.renkuAccessToken = result.AccessToken
-	a.renkuAccessTokenExpiresAt = result.ExpiresAt
-	return nil
+	return oauth.ExchangeRenkuToken(ctx, a.httpClient, a.firecrestTokenURI, renkuAccessToken)
 }
 
-func (a *RenkuAuth) refreshRenkuAccessTokenV2(ctx context.Context) error {
-	a.renkuAccessTokenLock.Lock()
-	defer a.renkuAccessTokenLock.Unlock()
-
-	renkuTokenURL, err := url.Parse(a.renkuTokenURI)
-	if err != nil {
-		return err
+func (a *RenkuAuth) requestRenkuAccessToken(ctx context.Context) (oauth.Token, error) {
+	refreshToken := a.renkuSource.Current().RefreshToken
+	if a.renkuAuthenticationVersion != "v2" {
+		return requestNewAccessToken(ctx, a.httpClient, a.renkuTokenURI, "refresh_token", a.renkuClientID, a.renkuClientSecret, refreshToken)
 	}
 	payload := url.Values{}
 	payload.Set("grant_type", "refresh_token")
-	payload.Set("refresh_token", a.renkuRefreshToken)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, renkuTokenURL.String(), strings.NewReader(payload.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	if err != nil {
-		return err
-	}
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	if res.StatusCode != 200 {
-		err = fmt.Errorf("cannot refresh renku access token, failed with status code: %d", res.StatusCode)
-		return err
-	}
-	var resParsed renkuTokenRefreshResponse
-	err = json.NewDecoder(res.Body).Decode(&resParsed)
+	payload.Set("refresh_token", refreshToken)
+	response, err := oauth.RequestForm(ctx, a.httpClient, a.renkuTokenURI, payload, "", "")
 	if err != nil {
-		return err
+		return oauth.Token{}, err
 	}
-	a.renkuAccessToken = resParsed.AccessToken
-	a.renkuRefreshToken = resParsed.RefreshToken
-
-	parser := jwt.NewParser()
-	claims := jwt.RegisteredClaims{}
-	if _, _, err := parser.ParseUnverified(a.renkuAccessToken, &claims); err != nil {
-		log.Printf("cannot parse token claims: %s\n", err.Error())
-		return err
-	}
-	a.renkuAccessTokenExpiresAt = claims.ExpiresAt.Time
-
-	log.Printf("refreshed renku access tokens, renkuAccessTokenExpiresAt = %s\n", a.renkuAccessTokenExpiresAt.String())
-
-	return nil
-}
-
-type renkuTokenRefreshResponse struct {
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
+	token := response.Token()
+	log.Printf("refreshed renku access tokens, renkuAccessTokenExpiresAt = %s\n", token.ExpiresAt.String())
+	return token, nil
 }
 
 // Periodically refreshes the renku access token. Used to make sure the refresh token does not expire.
 func (a *RenkuAuth) periodicTokenRefresh() {
 	for {
 		<-a.refreshTicker.C
-		a.renkuAccessTokenLock.RLock()
-		renkuRefreshToken := a.renkuRefreshToken
-		a.renkuAccessTokenLock.RUnlock()
+		renkuRefreshToken := a.renkuSource.Current().RefreshToken
 		refreshTokenIsValid, err := utils.VerifyJWTExpiresAt(renkuRefreshToken, 4*time.Minute, false)
 		if err != nil {
 			log.Printf("Could not check if renku refresh token is expired: %s\n", err.Error())
@@ -316,7 +162,7 @@ func (a *RenkuAuth) periodicTokenRefresh() {
 		if !refreshTokenIsValid {
 			log.Println("Getting a new renku refresh token from automatic checks")
 			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(60)*time.Second)
-			err = a.refreshRenkuAccessToken(ctx)
+			_, err = a.renkuSource.Refresh(ctx)
 			cancel()
 			if err != nil {
 				log.Printf("Could not refresh renku token: %s\n", err.Error())
@@ -254,11 +254,17 @@ if [ -n "${GIT_REPOSITORIES}" ]; then
     done
     if [ "${git_proxy_ready}" == "0" ]; then
         echo "Git proxy not ready, cannot setup git repositories"
+        # The status explains whether the git credentials cannot be refreshed anymore
+        git_proxy_status="$(curl -sSL "http://localhost:${GIT_PROXY_HEALTH_PORT}/status" 2>/dev/null || true)"
+        echo "Git proxy status: ${git_proxy_status}"
         for line in "${GIT_REPOSITORIES[@]}"; do
             repo="$(echo "${line}" | cut -d$'\t' -f1)"
             branch="$(echo "${line}" | cut -d$'\t' -f2)"
             echo "repo: ${repo}, branch: ${branch}"
             echo "Error: could not contact the git proxy" > "${RENKU_WORKING_DIR}/${repo}/ERROR"
+            if [ -n "${git_proxy_status}" ]; then
+                echo "Git proxy status: ${git_proxy_status}" >> "${RENKU_WORKING_DIR}/${repo}/ERROR"
+            fi
         done
     else
         echo "Setting up git repositories..."
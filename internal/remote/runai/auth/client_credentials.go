@@ -22,11 +22,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"sync"
 	"time"
 
+	"github.com/SwissDataScienceCenter/amalthea/internal/oauth"
 	sharedAuth "github.com/SwissDataScienceCenter/amalthea/internal/remote/auth/shared"
-	"github.com/SwissDataScienceCenter/amalthea/internal/utils"
 )
 
 // RunaiClientCredentialsAuth implements the "Client Credentials Grant"
@@ -39,13 +38,8 @@ type RunaiClientCredentialsAuth struct {
 	// clientSecret the client secret used for the "Client Credentials Grant" authentication flow
 	clientSecret string
 
-	// accessToken is the current access token
-	accessToken string
-	// accessTokenExpiresAt is when the access token expires
-	accessTokenExpiresAt time.Time
-	// accessTokenLock ensures that we do not try to refresh
-	// the accessToken twice at the same time.
-	accessTokenLock *sync.RWMutex
+	// source provides the access tokens and refreshes them when they expire
+	source *oauth.TokenSource
 
 	// httpClient is the HTTP client used to obtain access tokens
 	httpClient *http.Client
@@ -56,12 +50,9 @@ var _ RunaiAuth = (*RunaiClientCredentialsAuth)(nil)
 
 func newRunaiClientCredentialsAuth(tokenURI, clientID, clientSecret string, options ...RunaiClientCredentialsAuthOption) (auth *RunaiClientCredentialsAuth, err error) {
 	auth = &RunaiClientCredentialsAuth{
-		tokenURI:             tokenURI,
-		clientID:             clientID,
-		clientSecret:         clientSecret,
-		accessToken:          "",
-		accessTokenExpiresAt: time.Time{},
-		accessTokenLock:      &sync.RWMutex{},
+		tokenURI:     tokenURI,
+		clientID:     clientID,
+		clientSecret: clientSecret,
 	}
 	for _, opt := range options {
 		if err := opt(auth); err != nil {
@@ -82,6 +73,7 @@ func newRunaiClientCredentialsAuth(tokenURI, clientID, clientSecret string, opti
 	if auth.httpClient == nil {
 		auth.httpClient = http.DefaultClient
 	}
+	auth.source = oauth.NewTokenSource("runai", auth.requestAccessToken, oauth.WithRetry(3, time.Second))
 	return auth, nil
 }
 
@@ -95,49 +87,11 @@ func (a *RunaiClientCredentialsAuth) RequestEditor() sharedAuth.RequestEditorFn
 }
 
 func (a *RunaiClientCredentialsAuth) GetAccessToken(ctx context.Context) (token string, err error) {
-	a.accessTokenLock.RLock()
-	token = a.accessToken
-	expiresAt := a.accessTokenExpiresAt
-	a.accessTokenLock.RUnlock()
-
-	// Return the current token if it is still valid
-	if token != "" && (utils.IsNotExpired(expiresAt, 10*time.Second, false)) {
-		return token, nil
-	}
-
-	// Refresh the token
-	token, err = a.refreshAccessToken(ctx)
-	if err != nil {
-		return "", err
-	}
-	return token, nil
+	return a.source.AccessToken(ctx)
 }
 
-func (a *RunaiClientCredentialsAuth) refreshAccessToken(ctx context.Context) (token string, err error) {
-	a.accessTokenLock.Lock()
-	defer a.accessTokenLock.Unlock()
-
-	// Re-check if another goroutine has already refreshed the token
-	token = a.accessToken
-	expiresAt := a.accessTokenExpiresAt
-
-	// Return the current token if it is still valid
-	if token != "" && (utils.IsNotExpired(expiresAt, 10*time.Second, false)) {
-		return token, nil
-	}
-
-	// NOTE: we do not let the refresh request be cancelled by the caller
-	refreshCtx, cancel := context.WithTimeoutCause(context.WithoutCancel(ctx), 30*time.Second, fmt.Errorf("authentication request timed out"))
-	defer cancel()
-
-	result, err := requestNewAccessToken(refreshCtx, a.httpClient, a.tokenURI, "client_credentials", a.clientID, a.clientSecret)
-	if err != nil {
-		return "", err
-	}
-
-	a.accessToken = result.AccessToken
-	a.accessTokenExpiresAt = result.ExpiresAt
-	return a.accessToken, nil
+func (a *RunaiClientCredentialsAuth) requestAccessToken(ctx context.Context) (oauth.Token, error) {
+	return requestNewAccessToken(ctx, a.httpClient, a.tokenURI, "client_credentials", a.clientID, a.clientSecret)
 }
 
 type tokenRequest struct {
@@ -148,16 +102,11 @@ type tokenRequest struct {
 
 type tokenResponse struct {
 	AccessToken string `json:"accessToken"`
-	ExpiresIn   int    `json:"expiresIn"`
-}
-
-type tokenResult struct {
-	AccessToken string
-	ExpiresAt   time.Time
+	ExpiresIn   int64  `json:"expiresIn"`
 }
 
 // requestNewAccessToken implements requesting an access token from a Runai API token endpoint
-func requestNewAccessToken(ctx context.Context, httpClient *http.Client, tokenURI, grantType, clientID, clientSecret string) (result tokenResult, err error) {
+func requestNewAccessToken(ctx context.Context, httpClient *http.Client, tokenURI, grantType, clientID, clientSecret string) (result oauth.Token, err error) {
 	tokenReq := tokenRequest{
 		GrantType:    grantType,
 		ClientID:     clientID,
@@ -165,37 +114,21 @@ func requestNewAccessToken(ctx context.Context, httpClient *http.Client, tokenUR
 	}
 	jsonData, err := json.Marshal(tokenReq)
 	if err != nil {
-		return tokenResult{}, err
+		return oauth.Token{}, err
 	}
 
 	body := bytes.NewBuffer(jsonData)
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURI, body)
 	if err != nil {
-		return tokenResult{}, err
+		return oauth.Token{}, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	res, err := httpClient.Do(req)
-	if err != nil {
-		return tokenResult{}, err
-	}
-	defer func() { _ = res.Body.Close() }()
-	if res.StatusCode != http.StatusOK {
-		return tokenResult{}, fmt.Errorf("token request failed: %s", res.Status)
+	var response tokenResponse
+	if err := oauth.Do(httpClient, req, &response); err != nil {
+		return oauth.Token{}, err
 	}
-	tokenResponse, err := parseTokenResponse(res)
-	if err != nil {
-		return tokenResult{}, err
-	}
-	expiresAt := time.Now().Add(time.Second * time.Duration(tokenResponse.ExpiresIn))
-	return tokenResult{
-		AccessToken: tokenResponse.AccessToken,
-		ExpiresAt:   expiresAt,
+	return oauth.Token{
+		AccessToken: response.AccessToken,
+		ExpiresAt:   oauth.Expiry(response.AccessToken, 0, response.ExpiresIn),
 	}, nil
 }
-
-func parseTokenResponse(res *http.Response) (result tokenResponse, err error) {
-	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
-		return tokenResponse{}, err
-	}
-	return result, nil
-}
@@ -28,6 +28,7 @@ import (
 
 	amaltheadevv1alpha1 "github.com/SwissDataScienceCenter/amalthea/api/v1alpha1"
 	"github.com/SwissDataScienceCenter/amalthea/internal/common"
+	"github.com/SwissDataScienceCenter/amalthea/internal/oauth"
 	"github.com/SwissDataScienceCenter/amalthea/internal/remote/config"
 	"github.com/SwissDataScienceCenter/amalthea/internal/remote/controller"
 	"github.com/SwissDataScienceCenter/amalthea/internal/remote/models"
@@ -110,6 +111,8 @@ func newServer(rsController controller.RemoteSessionController, cfg config.Remot
 	})
 
 	// Liveness endpoint
+	e.GET("/metrics", echo.WrapHandler(oauth.MetricsHandler()))
+
 	e.GET("/live", func(c echo.Context) error {
 		return c.NoContent(http.StatusOK)
 	})
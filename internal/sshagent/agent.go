@@ -0,0 +1,183 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sshagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var errReadOnly = errors.New("the keys of the agent are managed by amalthea and cannot be changed")
+
+// readOnlyAgent lets the session list the keys and sign with them, but the keys cannot be
+// modified, removed or locked through the socket.
+type readOnlyAgent struct {
+	keyring agent.ExtendedAgent
+}
+
+func (a readOnlyAgent) List() ([]*agent.Key, error) {
+	return a.keyring.List()
+}
+
+func (a readOnlyAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.keyring.Sign(key, data)
+}
+
+func (a readOnlyAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return a.keyring.SignWithFlags(key, data, flags)
+}
+
+func (a readOnlyAgent) Signers() ([]ssh.Signer, error) {
+	return a.keyring.Signers()
+}
+
+func (a readOnlyAgent) Add(key agent.AddedKey) error {
+	return errReadOnly
+}
+
+func (a readOnlyAgent) Remove(key ssh.PublicKey) error {
+	return errReadOnly
+}
+
+func (a readOnlyAgent) RemoveAll() error {
+	return errReadOnly
+}
+
+func (a readOnlyAgent) Lock(passphrase []byte) error {
+	return errReadOnly
+}
+
+func (a readOnlyAgent) Unlock(passphrase []byte) error {
+	return errReadOnly
+}
+
+func (a readOnlyAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+// loadKeyFile adds the private key from a file to the keyring
+func loadKeyFile(keyring agent.Agent, path string) error {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read the key %s: %w", path, err)
+	}
+	key, err := ssh.ParseRawPrivateKey(pem)
+	if err != nil {
+		return fmt.Errorf("cannot parse the key %s: %w", path, err)
+	}
+	return keyring.Add(agent.AddedKey{PrivateKey: key, Comment: filepath.Base(path)})
+}
+
+// listen opens the unix socket of the agent, a socket left over from a previous run is removed
+func listen(socket string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socket), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: The session usually runs with another user than the sidecar, the socket is only
+	// reachable from the containers that mount its volume.
+	if err := os.Chmod(socket, 0o666); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Serve answers the agent requests on the listener until it is closed
+func Serve(listener net.Listener, sshAgent agent.Agent) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer func() { _ = conn.Close() }()
+			if err := agent.ServeAgent(sshAgent, conn); err != nil && !errors.Is(err, io.EOF) {
+				log.Printf("The SSH agent connection failed: %v", err)
+			}
+		}()
+	}
+}
+
+func serve(cmd *cobra.Command, args []string) error {
+	socket := viper.GetString(sshAgentPrefix + "." + socketFlag)
+	keyFiles := viper.GetStringSlice(sshAgentPrefix + "." + keyFilesFlag)
+	certificateURL := viper.GetString(sshAgentPrefix + "." + certificateURLFlag)
+	if len(keyFiles) == 0 && certificateURL == "" {
+		return fmt.Errorf("no keys to serve, use --%s or --%s", keyFilesFlag, certificateURLFlag)
+	}
+
+	keyring := agent.NewKeyring().(agent.ExtendedAgent)
+	for _, path := range keyFiles {
+		if err := loadKeyFile(keyring, path); err != nil {
+			return err
+		}
+		cmd.Printf("Loaded the SSH key %s\n", path)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	if certificateURL != "" {
+		certificates := &certificateRenewer{
+			keyring:     keyring,
+			url:         certificateURL,
+			tokenFile:   viper.GetString(sshAgentPrefix + "." + certificateTokenFileFlag),
+			principals:  viper.GetStringSlice(sshAgentPrefix + "." + certificatePrincipalsFlag),
+			refresh:     viper.GetFloat64(sshAgentPrefix + "." + certificateRefreshFlag),
+			retryPeriod: viper.GetDuration(sshAgentPrefix + "." + certificateRetryPeriodFlag),
+		}
+		if certificates.refresh <= 0 || certificates.refresh >= 1 {
+			return fmt.Errorf("the certificate refresh has to be between 0 and 1, got %v", certificates.refresh)
+		}
+		go certificates.run(ctx)
+	}
+
+	listener, err := listen(socket)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %w", socket, err)
+	}
+	go func() {
+		<-ctx.Done()
+		cmd.Println("SIGTERM received. Shutting down the SSH agent.")
+		_ = listener.Close()
+	}()
+	cmd.Printf("SSH agent listening on %s\n", socket)
+	return Serve(listener, readOnlyAgent{keyring: keyring})
+}
@@ -0,0 +1,178 @@
+package sshagent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func writeKeyFile(t *testing.T) (string, ssh.PublicKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(privateKey, "")
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0o600))
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	require.NoError(t, err)
+	return path, sshPublicKey
+}
+
+// serveAgent serves the agent on a unix socket and returns a client connected to it
+func serveAgent(t *testing.T, sshAgent agent.Agent) agent.ExtendedAgent {
+	// NOTE: The path of a unix socket is limited to about 100 characters
+	dir, err := os.MkdirTemp("", "agent")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	listener, err := listen(filepath.Join(dir, "agent.sock"))
+	require.NoError(t, err)
+	go func() { _ = Serve(listener, sshAgent) }()
+	t.Cleanup(func() { _ = listener.Close() })
+	conn, err := net.Dial("unix", filepath.Join(dir, "agent.sock"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return agent.NewClient(conn)
+}
+
+func TestReadOnlyAgent(t *testing.T) {
+	path, publicKey := writeKeyFile(t)
+	keyring := agent.NewKeyring().(agent.ExtendedAgent)
+	require.NoError(t, loadKeyFile(keyring, path))
+	client := serveAgent(t, readOnlyAgent{keyring: keyring})
+
+	keys, err := client.List()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, publicKey.Marshal(), keys[0].Marshal())
+	assert.Equal(t, "id_ed25519", keys[0].Comment)
+
+	signature, err := client.Sign(publicKey, []byte("data"))
+	require.NoError(t, err)
+	assert.NoError(t, publicKey.Verify([]byte("data"), signature))
+
+	// The session cannot change the keys of the agent
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	assert.Error(t, client.Add(agent.AddedKey{PrivateKey: otherKey}))
+	assert.Error(t, client.Remove(publicKey))
+	assert.Error(t, client.RemoveAll())
+	assert.Error(t, client.Lock([]byte("passphrase")))
+	keys, err = client.List()
+	require.NoError(t, err)
+	assert.Len(t, keys, 1)
+}
+
+func TestLoadKeyFileErrors(t *testing.T) {
+	keyring := agent.NewKeyring()
+	assert.Error(t, loadKeyFile(keyring, filepath.Join(t.TempDir(), "missing")))
+	path := filepath.Join(t.TempDir(), "invalid")
+	require.NoError(t, os.WriteFile(path, []byte("not a key"), 0o600))
+	assert.Error(t, loadKeyFile(keyring, path))
+}
+
+// newSigningEndpoint returns an endpoint that signs certificates valid for the given duration
+func newSigningEndpoint(t *testing.T, validity time.Duration) (*httptest.Server, ssh.PublicKey) {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	caSigner, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer the-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		request := CertificateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(request.PublicKey))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		certificate := &ssh.Certificate{
+			Key:             publicKey,
+			CertType:        ssh.UserCert,
+			KeyId:           "session",
+			ValidPrincipals: request.Principals,
+			ValidAfter:      uint64(now.Unix()),
+			ValidBefore:     uint64(now.Add(validity).Unix()),
+		}
+		if err := certificate.SignCert(rand.Reader, caSigner); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(CertificateResponse{Certificate: string(ssh.MarshalAuthorizedKey(certificate))})
+	}))
+	t.Cleanup(server.Close)
+	return server, caSigner.PublicKey()
+}
+
+func TestCertificateRenewer(t *testing.T) {
+	server, caKey := newSigningEndpoint(t, time.Hour)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("the-token\n"), 0o600))
+	keyring := agent.NewKeyring()
+	renewer := &certificateRenewer{
+		keyring:     keyring,
+		url:         server.URL,
+		tokenFile:   tokenFile,
+		principals:  []string{"git"},
+		refresh:     0.5,
+		retryPeriod: time.Second,
+	}
+
+	certificate, err := renewer.renew(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"git"}, certificate.ValidPrincipals)
+	assert.Equal(t, caKey.Marshal(), certificate.SignatureKey.Marshal())
+	assert.InDelta(t, 30*time.Minute, renewer.renewAfter(certificate), float64(5*time.Second))
+
+	// The previous certificate is replaced when it is renewed
+	renewed, err := renewer.renew(context.Background())
+	require.NoError(t, err)
+	keys, err := keyring.List()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, renewed.Marshal(), keys[0].Marshal())
+
+	// The session can authenticate with the certificate through the agent
+	client := serveAgent(t, readOnlyAgent{keyring: keyring.(agent.ExtendedAgent)})
+	signers, err := client.Signers()
+	require.NoError(t, err)
+	require.Len(t, signers, 1)
+	assert.Equal(t, ssh.CertAlgoED25519v01, signers[0].PublicKey().Type())
+
+	renewer.tokenFile = ""
+	_, err = renewer.renew(context.Background())
+	assert.ErrorContains(t, err, "401")
+}
+
+func TestCertificateRenewAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	renewer := &certificateRenewer{refresh: 0.8, retryPeriod: time.Minute, now: func() time.Time { return now }}
+	certificate := func(validAfter time.Time, validBefore uint64) *ssh.Certificate {
+		return &ssh.Certificate{ValidAfter: uint64(validAfter.Unix()), ValidBefore: validBefore}
+	}
+	assert.Equal(t, 8*time.Hour, renewer.renewAfter(certificate(now, uint64(now.Add(10*time.Hour).Unix()))))
+	// The certificates that do not expire are renewed as if they were valid for a day
+	assert.Equal(t, time.Duration(0.8*float64(24*time.Hour)), renewer.renewAfter(certificate(now, ssh.CertTimeInfinity)))
+	// The renewal does not happen more often than the retries
+	assert.Equal(t, time.Minute, renewer.renewAfter(certificate(now, uint64(now.Add(10*time.Second).Unix()))))
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sshagent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// CertificateRequest is sent to the signing endpoint to get a certificate for the public key of the agent
+type CertificateRequest struct {
+	// The public key in the authorized_keys format
+	PublicKey  string   `json:"public_key"`
+	Principals []string `json:"principals,omitempty"`
+}
+
+// CertificateResponse is returned by the signing endpoint
+type CertificateResponse struct {
+	// The signed certificate in the authorized_keys format
+	Certificate string `json:"certificate"`
+}
+
+// certificateRenewer keeps a short-lived SSH certificate in the keyring. Every certificate is issued for a
+// new key that is generated in memory, so the private key never leaves the agent.
+type certificateRenewer struct {
+	keyring    agent.Agent
+	url        string
+	tokenFile  string
+	principals []string
+	// The fraction of the validity of a certificate after which it is renewed
+	refresh     float64
+	retryPeriod time.Duration
+	client      *http.Client
+	now         func() time.Time
+	current     ssh.PublicKey
+}
+
+func (r *certificateRenewer) run(ctx context.Context) {
+	for {
+		wait := r.retryPeriod
+		certificate, err := r.renew(ctx)
+		if err != nil {
+			log.Printf("Cannot get a new SSH certificate, retrying in %s: %v", r.retryPeriod, err)
+		} else {
+			wait = r.renewAfter(certificate)
+			log.Printf("Loaded a new SSH certificate, it will be renewed in %s", wait)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// The certificates that do not expire or that are valid for longer are renewed as if they were valid for a day
+const maxCertificateValidity = 24 * time.Hour
+
+func (r *certificateRenewer) currentTime() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// renewAfter returns how long to wait before the certificate is renewed
+func (r *certificateRenewer) renewAfter(certificate *ssh.Certificate) time.Duration {
+	now := uint64(r.currentTime().Unix())
+	validAfter := min(certificate.ValidAfter, now)
+	validBefore := min(certificate.ValidBefore, validAfter+uint64(maxCertificateValidity.Seconds()))
+	renewAt := validAfter + uint64(r.refresh*float64(validBefore-validAfter))
+	if renewAt <= now {
+		return r.retryPeriod
+	}
+	return max(time.Duration(renewAt-now)*time.Second, r.retryPeriod)
+}
+
+// renew requests a certificate for a new key and replaces the previous certificate in the keyring
+func (r *certificateRenewer) renew(ctx context.Context) (*ssh.Certificate, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := r.sign(ctx, sshPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	now := uint64(r.currentTime().Unix())
+	if certificate.ValidBefore <= now {
+		return nil, fmt.Errorf("the certificate has already expired")
+	}
+	added := agent.AddedKey{
+		PrivateKey:  privateKey,
+		Certificate: certificate,
+		Comment:     "amalthea-certificate",
+	}
+	if lifetime := certificate.ValidBefore - now; lifetime < math.MaxUint32 {
+		// NOTE: The keyring removes the certificate by itself once it has expired
+		added.LifetimeSecs = uint32(lifetime)
+	}
+	if err := r.keyring.Add(added); err != nil {
+		return nil, err
+	}
+	if r.current != nil {
+		// The previous certificate may have expired already, in which case it is not in the keyring anymore
+		_ = r.keyring.Remove(r.current)
+	}
+	r.current = certificate
+	return certificate, nil
+}
+
+func (r *certificateRenewer) sign(ctx context.Context, publicKey ssh.PublicKey) (*ssh.Certificate, error) {
+	body, err := json.Marshal(CertificateRequest{
+		PublicKey:  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))),
+		Principals: r.principals,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.tokenFile != "" {
+		token, err := os.ReadFile(r.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the token for the signing endpoint: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	client := r.client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("the signing endpoint returned %d: %s", res.StatusCode, strings.TrimSpace(string(message)))
+	}
+	response := CertificateResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("cannot decode the response of the signing endpoint: %w", err)
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(response.Certificate))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the certificate: %w", err)
+	}
+	certificate, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("the signing endpoint did not return a certificate")
+	}
+	if !bytes.Equal(certificate.Key.Marshal(), publicKey.Marshal()) {
+		return nil, fmt.Errorf("the certificate is not for the key of the agent")
+	}
+	return certificate, nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sshagent
+
+import (
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	socketFlag                  = "socket"
+	keyFilesFlag                = "key_files"
+	certificateURLFlag          = "certificate_url"
+	certificateTokenFileFlag    = "certificate_token_file"
+	certificatePrincipalsFlag   = "certificate_principals"
+	certificateRefreshFlag      = "certificate_refresh"
+	certificateRetryPeriodFlag  = "certificate_retry_period"
+	sshAgentPrefix              = "ssh_agent"
+	defaultSocket               = "/ssh-agent/agent.sock"
+	defaultCertificateRefresh   = 0.8
+	defaultCertificateRetryWait = 30 * time.Second
+)
+
+func Command() (*cobra.Command, error) {
+	var serveCmd = &cobra.Command{
+		Use:   "serve",
+		Short: "Runs the SSH agent",
+		Long: `serve runs an SSH agent on a unix socket that is shared with the session through SSH_AUTH_SOCK.
+The private keys are only kept in the memory of the agent, the session can use them to authenticate
+with git remotes over SSH but it cannot read them, add other keys or remove them.`,
+		RunE: serve,
+	}
+
+	serveCmd.PersistentFlags().String(socketFlag, defaultSocket, "path of the unix socket of the agent, it should be in a volume that is only shared with the session container")
+	err := viper.BindPFlag(sshAgentPrefix+"."+socketFlag, serveCmd.PersistentFlags().Lookup(socketFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(sshAgentPrefix+"."+socketFlag, strings.ToUpper(sshAgentPrefix+"_"+socketFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringSlice(keyFilesFlag, nil, "comma separated paths of unencrypted private keys to load, usually mounted from secrets into the agent container only")
+	err = viper.BindPFlag(sshAgentPrefix+"."+keyFilesFlag, serveCmd.PersistentFlags().Lookup(keyFilesFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(sshAgentPrefix+"."+keyFilesFlag, strings.ToUpper(sshAgentPrefix+"_"+keyFilesFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().String(certificateURLFlag, "", "URL of the endpoint that signs the SSH certificates for the key generated by the agent, no certificate is requested when empty")
+	err = viper.BindPFlag(sshAgentPrefix+"."+certificateURLFlag, serveCmd.PersistentFlags().Lookup(certificateURLFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(sshAgentPrefix+"."+certificateURLFlag, strings.ToUpper(sshAgentPrefix+"_"+certificateURLFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().String(certificateTokenFileFlag, "", "file with the bearer token sent to the signing endpoint, it is read again for every request so that the token can be rotated")
+	err = viper.BindPFlag(sshAgentPrefix+"."+certificateTokenFileFlag, serveCmd.PersistentFlags().Lookup(certificateTokenFileFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(sshAgentPrefix+"."+certificateTokenFileFlag, strings.ToUpper(sshAgentPrefix+"_"+certificateTokenFileFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().StringSlice(certificatePrincipalsFlag, nil, "comma separated principals requested for the SSH certificates")
+	err = viper.BindPFlag(sshAgentPrefix+"."+certificatePrincipalsFlag, serveCmd.PersistentFlags().Lookup(certificatePrincipalsFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(sshAgentPrefix+"."+certificatePrincipalsFlag, strings.ToUpper(sshAgentPrefix+"_"+certificatePrincipalsFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().Float64(certificateRefreshFlag, defaultCertificateRefresh, "fraction of the validity of a certificate after which a new certificate is requested")
+	err = viper.BindPFlag(sshAgentPrefix+"."+certificateRefreshFlag, serveCmd.PersistentFlags().Lookup(certificateRefreshFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(sshAgentPrefix+"."+certificateRefreshFlag, strings.ToUpper(sshAgentPrefix+"_"+certificateRefreshFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	serveCmd.PersistentFlags().Duration(certificateRetryPeriodFlag, defaultCertificateRetryWait, "how long to wait before requesting a certificate again after a failure")
+	err = viper.BindPFlag(sshAgentPrefix+"."+certificateRetryPeriodFlag, serveCmd.PersistentFlags().Lookup(certificateRetryPeriodFlag))
+	if err != nil {
+		return nil, err
+	}
+	err = viper.BindEnv(sshAgentPrefix+"."+certificateRetryPeriodFlag, strings.ToUpper(sshAgentPrefix+"_"+certificateRetryPeriodFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	return serveCmd, nil
+}